@@ -0,0 +1,464 @@
+package led
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/taoso/led/store"
+)
+
+//go:embed admin.html
+var adminHTML []byte
+
+// admin 管理后台，/+/admin 为页面，其余为 JSON 接口
+//
+//	GET /+/admin/wallets?q=x finds wallets by id, pubkey or username.
+//	GET /+/admin/logs?user_id=1&before=0 lists logs of wallet 1, or ?pay_no=x finds one log.
+//	POST /+/admin/adjust {"user_id":1,"tokens":-10,"reason":"x"} changes tokens of wallet 1.
+//	GET /+/admin/sessions?user_id=1 lists login sessions, DELETE with &id=2 revokes session 2.
+//	GET /+/admin/tickets?token=x&before=0 lists tickets, or ?id=1 fetches ticket 1.
+//	POST /+/admin/tickets {"id":1,"bytes":1,"total_bytes":1,"tier":"","expires":"t","reason":"x"} edits ticket 1.
+//	GET /+/admin/zones?name=x or ?email=x lists zones, including deleted ones.
+//	POST /+/admin/zones {"id":1,"status":2,"reason":"x"} suspends zone 1, and status 0 resumes it.
+//	GET /+/admin/applications lists pending zz.ac applications.
+//	POST /+/admin/applications {"domain":"x","approve":true} approves or rejects the application of x.
+//	GET /+/admin/audits?target=x&before=0 lists audit records, or ?verify checks the hash chain.
+//	GET /+/admin/reload shows the last config reload, POST reloads users, sites, BPEs and plans.
+//
+// POST and DELETE must be same-origin requests with Content-Type: application/json.
+func (p *Proxy) admin(w http.ResponseWriter, req *http.Request) {
+	if !p.isAdmin(w, req) || !sameOrigin(w, req) {
+		return
+	}
+
+	path := strings.TrimPrefix(req.URL.Path, "/+/admin")
+	if path == "" || path == "/" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(adminHTML)
+		return
+	}
+
+	var v any
+	var err error
+	switch path {
+	case "/wallets":
+		v, err = p.adminWallets(req)
+	case "/logs":
+		v, err = p.adminLogs(req)
+	case "/adjust":
+		v, err = p.adminAdjust(req)
+	case "/sessions":
+		v, err = p.adminSessions(req)
+	case "/tickets":
+		v, err = p.adminTickets(req)
+	case "/zones":
+		v, err = p.adminZones(req)
+	case "/applications":
+		v, err = p.adminApplications(req)
+	case "/audits":
+		v, err = p.adminAudits(req)
+	case "/reload":
+		v, err = p.adminReload(req)
+	default:
+		http.NotFound(w, req)
+		return
+	}
+
+	if err != nil {
+		var ae *appError
+		if errors.As(err, &ae) {
+			http.Error(w, string(ae.Body), ae.Code)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// adminError 返回给管理员的错误，code 为 HTTP 状态码
+func adminError(code int, msg string) error {
+	return &appError{Code: code, Body: []byte(msg)}
+}
+
+var adminCSRF = http.NewCrossOriginProtection()
+
+// sameOrigin 浏览器会自动带上 Basic Auth 凭证，所以修改数据的请求必须是同源的 JSON 请求。
+// 跨站表单无法设置 application/json，跨站 fetch 会被 Origin 和 Sec-Fetch-Site 拦截。
+func sameOrigin(w http.ResponseWriter, req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	if t, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); t != "application/json" {
+		http.Error(w, "content type must be application/json", http.StatusUnsupportedMediaType)
+		return false
+	}
+	if err := adminCSRF.Check(req); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func decodeJSON(req *http.Request, v any) error {
+	defer req.Body.Close()
+	if err := json.NewDecoder(req.Body).Decode(v); err != nil {
+		return adminError(http.StatusBadRequest, err.Error())
+	}
+	return nil
+}
+
+func queryInt(req *http.Request, key string) int {
+	i, _ := strconv.Atoi(req.URL.Query().Get(key))
+	return i
+}
+
+func (p *Proxy) adminWallets(req *http.Request) (any, error) {
+	if p.TokenRepo == nil {
+		return nil, adminError(http.StatusNotImplemented, "token repo is not enabled")
+	}
+
+	q := strings.TrimSpace(req.URL.Query().Get("q"))
+	if q == "" {
+		return nil, adminError(http.StatusBadRequest, "q is required")
+	}
+
+	ws := []store.TokenWallet{}
+	seen := map[int]bool{}
+	find := func(w store.TokenWallet, err error) error {
+		if err != nil && !errors.Is(err, store.ClientErr) {
+			return err
+		}
+		if w.ID != 0 && !seen[w.ID] {
+			seen[w.ID] = true
+			ws = append(ws, w)
+		}
+		return nil
+	}
+
+	if id, err := strconv.Atoi(q); err == nil {
+		if err := find(p.TokenRepo.GetWallet(id)); err != nil {
+			return nil, err
+		}
+	}
+	if err := find(p.TokenRepo.FindWallet(q)); err != nil {
+		return nil, err
+	}
+	if err := find(p.TokenRepo.FindWalletByName(q)); err != nil {
+		return nil, err
+	}
+	return ws, nil
+}
+
+func (p *Proxy) adminLogs(req *http.Request) (any, error) {
+	if p.TokenRepo == nil {
+		return nil, adminError(http.StatusNotImplemented, "token repo is not enabled")
+	}
+
+	if payNo := req.URL.Query().Get("pay_no"); payNo != "" {
+		l, err := p.TokenRepo.FindLog(payNo)
+		if err != nil {
+			return nil, err
+		}
+		if l.ID == 0 {
+			return []store.TokenLog{}, nil
+		}
+		return []store.TokenLog{l}, nil
+	}
+
+	before := queryInt(req, "before")
+	if before <= 0 {
+		before = math.MaxInt
+	}
+	return p.TokenRepo.ScanLogs(queryInt(req, "user_id"), before, 50)
+}
+
+func (p *Proxy) adminAdjust(req *http.Request) (any, error) {
+	if p.TokenRepo == nil {
+		return nil, adminError(http.StatusNotImplemented, "token repo is not enabled")
+	}
+	if req.Method != http.MethodPost {
+		return nil, adminError(http.StatusMethodNotAllowed, "POST is required")
+	}
+
+	args := struct {
+		UserID int    `json:"user_id"`
+		Tokens int    `json:"tokens"`
+		Reason string `json:"reason"`
+	}{}
+	if err := decodeJSON(req, &args); err != nil {
+		return nil, err
+	}
+	if args.UserID <= 0 || args.Tokens == 0 || args.Reason == "" {
+		return nil, adminError(http.StatusBadRequest, "user_id, tokens and reason are required")
+	}
+
+	if w, err := p.TokenRepo.GetWallet(args.UserID); err != nil {
+		return nil, err
+	} else if w.ID == 0 {
+		return nil, adminError(http.StatusNotFound, "wallet not found")
+	}
+
+	admin, _, _ := req.BasicAuth()
+	l := store.TokenLog{
+		UserID:   args.UserID,
+		Type:     store.LogTypeAdjust,
+		TokenNum: args.Tokens,
+		Extra:    store.KV{"admin": admin, "reason": args.Reason},
+		Created:  time.Now(),
+	}
+	w, err := p.TokenRepo.UpdateWallet(&l)
+	if errors.Is(err, store.ClientErr) {
+		return nil, adminError(http.StatusBadRequest, err.Error())
+	} else if err != nil {
+		return nil, err
+	}
+
+	p.audit(req, adminActor(req), "wallet.adjust", "wallet:"+strconv.Itoa(w.ID), nil, args)
+	return w, nil
+}
+
+func (p *Proxy) adminSessions(req *http.Request) (any, error) {
+	if p.TokenRepo == nil {
+		return nil, adminError(http.StatusNotImplemented, "token repo is not enabled")
+	}
+
+	uid := queryInt(req, "user_id")
+	switch req.Method {
+	case http.MethodGet:
+		return p.TokenRepo.ListSession(uid)
+	case http.MethodDelete:
+		id := queryInt(req, "id")
+		if err := p.TokenRepo.DelSession(id, uid); err != nil {
+			return nil, err
+		}
+		p.audit(req, adminActor(req), "session.revoke", "wallet:"+strconv.Itoa(uid), nil, map[string]int{"id": id})
+		return map[string]int{"id": id}, nil
+	default:
+		return nil, adminError(http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (p *Proxy) adminTickets(req *http.Request) (any, error) {
+	if p.TicketRepo == nil {
+		return nil, adminError(http.StatusNotImplemented, "ticket repo is not enabled")
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		if id := queryInt(req, "id"); id > 0 {
+			t, err := p.TicketRepo.Get(id)
+			if err != nil {
+				return nil, err
+			}
+			if t.ID == 0 {
+				return []store.Ticket{}, nil
+			}
+			return []store.Ticket{t}, nil
+		}
+		token := req.URL.Query().Get("token")
+		if token == "" {
+			return nil, adminError(http.StatusBadRequest, "token or id is required")
+		}
+		return p.TicketRepo.History(token, queryInt(req, "before"), 20)
+	case http.MethodPost:
+		// 只修改请求中出现的字段
+		args := struct {
+			ID         int        `json:"id"`
+			Bytes      *int       `json:"bytes"`
+			TotalBytes *int       `json:"total_bytes"`
+			Tier       *string    `json:"tier"`
+			Expires    *time.Time `json:"expires"`
+			Reason     string     `json:"reason"`
+		}{}
+		if err := decodeJSON(req, &args); err != nil {
+			return nil, err
+		}
+		if args.Reason == "" {
+			return nil, adminError(http.StatusBadRequest, "reason is required")
+		}
+		if args.Tier != nil && *args.Tier != "" {
+			if _, ok := p.ticketCfg().Tiers[*args.Tier]; !ok {
+				return nil, adminError(http.StatusBadRequest, "unknown tier "+*args.Tier)
+			}
+		}
+
+		t, err := p.TicketRepo.Get(args.ID)
+		if err != nil {
+			return nil, err
+		}
+		if t.ID == 0 {
+			return nil, adminError(http.StatusNotFound, "ticket not found")
+		}
+
+		before := t
+		if args.Bytes != nil {
+			t.Bytes = *args.Bytes
+		}
+		if args.TotalBytes != nil {
+			t.TotalBytes = *args.TotalBytes
+		}
+		if args.Tier != nil {
+			t.Tier = *args.Tier
+		}
+		if args.Expires != nil {
+			t.Expires = *args.Expires
+		}
+		if t.Bytes < 0 || t.Bytes > t.TotalBytes {
+			return nil, adminError(http.StatusBadRequest, "bytes must be in [0, total_bytes]")
+		}
+		if err := p.TicketRepo.Update(&t); err != nil {
+			return nil, err
+		}
+
+		p.audit(req, adminActor(req), "ticket.edit", "ticket:"+strconv.Itoa(t.ID), nil, map[string]any{
+			"reason": args.Reason,
+			"before": map[string]any{"bytes": before.Bytes, "total_bytes": before.TotalBytes, "tier": before.Tier, "expires": before.Expires},
+			"after":  map[string]any{"bytes": t.Bytes, "total_bytes": t.TotalBytes, "tier": t.Tier, "expires": t.Expires},
+		})
+		return t, nil
+	default:
+		return nil, adminError(http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (p *Proxy) adminZones(req *http.Request) (any, error) {
+	if p.ZoneRepo == nil {
+		return nil, adminError(http.StatusNotImplemented, "zone repo is not enabled")
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		q := req.URL.Query()
+		if name := q.Get("name"); name != "" {
+			return p.ZoneRepo.GetAll(name)
+		}
+		if email := q.Get("email"); email != "" {
+			return p.ZoneRepo.ListByEmail(email)
+		}
+		return nil, adminError(http.StatusBadRequest, "name or email is required")
+	case http.MethodPost:
+		args := struct {
+			Name   string       `json:"name"`
+			ID     int          `json:"id"`
+			Status store.Status `json:"status"`
+			Reason string       `json:"reason"`
+		}{}
+		if err := decodeJSON(req, &args); err != nil {
+			return nil, err
+		}
+		if args.Reason == "" || (args.Status != store.StatusOK && args.Status != store.StatusSuspended) {
+			return nil, adminError(http.StatusBadRequest, "reason is required and status must be 0 or 2")
+		}
+
+		zs, err := p.ZoneRepo.GetAll(args.Name)
+		if err != nil {
+			return nil, err
+		}
+		var z store.Zone
+		for _, i := range zs {
+			if i.ID == args.ID {
+				z = i
+			}
+		}
+		if z.ID == 0 || z.Status == store.StatusDeleted {
+			return nil, adminError(http.StatusNotFound, "zone not found")
+		}
+
+		from := z.Status
+		z.Status = args.Status
+		if err := p.ZoneRepo.Update(&z); err != nil {
+			return nil, err
+		}
+
+		action := "zone.resume"
+		if z.Status == store.StatusSuspended {
+			action = "zone.suspend"
+		}
+		p.audit(req, adminActor(req), action, "zone:"+z.Name, nil, map[string]any{"id": z.ID, "from": from, "reason": args.Reason})
+		return z, nil
+	default:
+		return nil, adminError(http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (p *Proxy) adminApplications(req *http.Request) (any, error) {
+	if p.ZoneRepo == nil {
+		return nil, adminError(http.StatusNotImplemented, "zone repo is not enabled")
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		return p.zoneApplications()
+	case http.MethodPost:
+		args := struct {
+			Domain  string `json:"domain"`
+			Approve bool   `json:"approve"`
+		}{}
+		if err := decodeJSON(req, &args); err != nil {
+			return nil, err
+		}
+
+		if !args.Approve {
+			if args.Domain == "" || strings.ContainsAny(args.Domain, `/\`) {
+				return nil, adminError(http.StatusBadRequest, "invalid domain")
+			}
+			if err := removeApplication(p.zPath, args.Domain); errors.Is(err, fs.ErrNotExist) {
+				return nil, adminError(http.StatusNotFound, "application not found")
+			} else if err != nil {
+				return nil, err
+			}
+			p.audit(req, adminActor(req), "zone.reject", "zone:"+args.Domain, nil, nil)
+			return map[string]string{"domain": args.Domain}, nil
+		}
+
+		z, err := p.ApproveZone(req.Context(), args.Domain)
+		if errors.Is(err, errZoneApply) {
+			return nil, adminError(http.StatusBadRequest, err.Error())
+		} else if errors.Is(err, fs.ErrNotExist) {
+			return nil, adminError(http.StatusNotFound, "application not found")
+		} else if err != nil {
+			return nil, err
+		}
+		p.audit(req, adminActor(req), "zone.approve", "zone:"+z.Name, nil, map[string]int{"id": z.ID})
+		return z, nil
+	default:
+		return nil, adminError(http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (p *Proxy) adminAudits(req *http.Request) (any, error) {
+	if p.AuditRepo == nil {
+		return nil, adminError(http.StatusNotImplemented, "audit repo is not enabled")
+	}
+	if req.URL.Query().Has("verify") {
+		n, broken, err := p.AuditRepo.VerifyAudits()
+		if err != nil {
+			return nil, err
+		}
+		return map[string]int{"checked": n, "broken": broken}, nil
+	}
+	return p.AuditRepo.ListAudits(req.URL.Query().Get("target"), queryInt(req, "before"), 50)
+}
+
+func (p *Proxy) adminReload(req *http.Request) (any, error) {
+	if req.Method != http.MethodPost {
+		return p.LastReload(), nil
+	}
+	r, err := p.Reload()
+	p.audit(req, adminActor(req), "config.reload", "config", err, nil)
+	if err != nil {
+		return nil, adminError(http.StatusUnprocessableEntity, err.Error())
+	}
+	return r, nil
+}
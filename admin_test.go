@@ -0,0 +1,194 @@
+package led
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/taoso/led/store"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAdmin(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("pass"), bcrypt.MinCost)
+	assert.Nil(t, err)
+
+	f, err := os.CreateTemp("", "led-*.db")
+	assert.Nil(t, err)
+	f.Close()
+	defer os.Remove(f.Name())
+
+	dir := t.TempDir()
+	assert.Nil(t, os.Mkdir(dir+"/tmp", 0755))
+
+	p := &Proxy{
+		TokenRepo:  store.NewTokenRepo(f.Name()),
+		TicketRepo: store.NewTicketRepo(":memory:"),
+		ZoneRepo:   store.NewZoneRepo(":memory:"),
+		AuditRepo:  store.NewAuditRepo(":memory:"),
+		zPath:      dir,
+	}
+	p.SetUsers(map[string]string{"admin": string(hash)})
+
+	call := func(method, path string, args any) *httptest.ResponseRecorder {
+		var b []byte
+		if args != nil {
+			b, _ = json.Marshal(args)
+		}
+		req := httptest.NewRequest(method, path, bytes.NewReader(b))
+		req.SetBasicAuth("admin", "pass")
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		p.admin(w, req)
+		return w
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/+/admin", nil)
+	w := httptest.NewRecorder()
+	p.admin(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = call(http.MethodGet, "/+/admin", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "LED Admin")
+
+	// 钱包调账
+	l := store.TokenLog{Type: store.LogTypeBuy, TokenNum: 100, PayNo: "pay-1",
+		Extra: store.KV{"_pubkey": "pk1"}, Created: time.Now()}
+	_, err = p.TokenRepo.UpdateWallet(&l)
+	assert.Nil(t, err)
+
+	w = call(http.MethodGet, "/+/admin/wallets?q=pk1", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var ws []store.TokenWallet
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &ws))
+	assert.Len(t, ws, 1)
+	assert.Equal(t, l.UserID, ws[0].ID)
+
+	w = call(http.MethodPost, "/+/admin/adjust", map[string]any{"user_id": l.UserID, "tokens": -30})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = call(http.MethodPost, "/+/admin/adjust", map[string]any{"user_id": 999, "tokens": 1, "reason": "x"})
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = call(http.MethodPost, "/+/admin/adjust", map[string]any{"user_id": l.UserID, "tokens": -30, "reason": "abuse"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	var wallet store.TokenWallet
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &wallet))
+	assert.Equal(t, 70, wallet.Tokens)
+
+	w = call(http.MethodGet, "/+/admin/logs?user_id="+strconv.Itoa(l.UserID), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var logs []store.TokenLog
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &logs))
+	assert.Len(t, logs, 2)
+	assert.Equal(t, store.LogTypeAdjust, logs[0].Type)
+	assert.Equal(t, "abuse", logs[0].Extra["reason"])
+	assert.Equal(t, 70, logs[0].AfterNum)
+
+	// 跨站请求和非 JSON 请求不能修改数据
+	csrf, _ := json.Marshal(map[string]any{"user_id": l.UserID, "tokens": 1, "reason": "csrf"})
+	for _, h := range []map[string]string{
+		{"Content-Type": "text/plain"},
+		{"Content-Type": "application/json", "Sec-Fetch-Site": "cross-site"},
+		{"Content-Type": "application/json", "Origin": "https://evil.com"},
+	} {
+		req = httptest.NewRequest(http.MethodPost, "/+/admin/adjust", bytes.NewReader(csrf))
+		req.SetBasicAuth("admin", "pass")
+		for k, v := range h {
+			req.Header.Set(k, v)
+		}
+		w = httptest.NewRecorder()
+		p.admin(w, req)
+		assert.NotEqual(t, http.StatusOK, w.Code, h)
+	}
+	w = call(http.MethodGet, "/+/admin/wallets?q=pk1", nil)
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &ws))
+	assert.Equal(t, 70, ws[0].Tokens)
+
+	// 修改流量包
+	assert.Nil(t, p.TicketRepo.New("tk", store.TicketPlan{Bytes: 100, Days: 30}, "buy-1", "trade-1"))
+	w = call(http.MethodGet, "/+/admin/tickets?token=tk", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var ts []store.Ticket
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &ts))
+	assert.Len(t, ts, 1)
+
+	w = call(http.MethodPost, "/+/admin/tickets", map[string]any{"id": ts[0].ID, "bytes": 200, "total_bytes": 100, "reason": "x"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = call(http.MethodPost, "/+/admin/tickets", map[string]any{"id": ts[0].ID, "bytes": 50, "total_bytes": 200, "reason": "gift"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	tk, err := p.TicketRepo.Get(ts[0].ID)
+	assert.Nil(t, err)
+	assert.Equal(t, 50, tk.Bytes)
+	assert.Equal(t, 200, tk.TotalBytes)
+
+	// 限速等级必须存在，没有传的字段保持不变
+	w = call(http.MethodPost, "/+/admin/tickets", map[string]any{"id": ts[0].ID, "tier": "xl", "reason": "x"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = call(http.MethodPost, "/+/admin/tickets", map[string]any{"id": ts[0].ID, "tier": "m", "reason": "upgrade"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = call(http.MethodPost, "/+/admin/tickets", map[string]any{"id": ts[0].ID, "bytes": 80, "reason": "gift"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	tk, err = p.TicketRepo.Get(ts[0].ID)
+	assert.Nil(t, err)
+	assert.Equal(t, 80, tk.Bytes)
+	assert.Equal(t, 200, tk.TotalBytes)
+	assert.Equal(t, "m", tk.Tier)
+	assert.Equal(t, ts[0].Expires.Unix(), tk.Expires.Unix())
+
+	// 暂停和恢复域名
+	z := store.Zone{Name: "foo", Email: "a@b.c", Time: time.Now()}
+	assert.Nil(t, p.ZoneRepo.New(&z))
+
+	w = call(http.MethodPost, "/+/admin/zones", map[string]any{"name": "foo", "id": z.ID, "status": store.StatusSuspended, "reason": "spam"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	z2, err := p.ZoneRepo.Get("foo")
+	assert.Nil(t, err)
+	assert.Zero(t, z2.ID)
+
+	w = call(http.MethodPost, "/+/admin/zones", map[string]any{"name": "foo", "id": z.ID, "status": store.StatusOK, "reason": "ok"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	z2, err = p.ZoneRepo.Get("foo")
+	assert.Nil(t, err)
+	assert.Equal(t, z.ID, z2.ID)
+
+	// 驳回域名申请
+	b, _ := json.Marshal(zoneApplication{Domain: "bar", Email: "a@b.c"})
+	assert.Nil(t, os.WriteFile(dir+"/tmp/bar.json_", b, 0644))
+
+	w = call(http.MethodGet, "/+/admin/applications", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var as []zoneApplication
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &as))
+	assert.Len(t, as, 1)
+
+	w = call(http.MethodPost, "/+/admin/applications", map[string]any{"domain": "../bar", "approve": false})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = call(http.MethodPost, "/+/admin/applications", map[string]any{"domain": "bar", "approve": false})
+	assert.Equal(t, http.StatusOK, w.Code)
+	_, err = os.Stat(dir + "/tmp/bar.json_")
+	assert.True(t, os.IsNotExist(err))
+
+	// 操作记录
+	w = call(http.MethodGet, "/+/admin/audits", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var audits []store.Audit
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &audits))
+	assert.Len(t, audits, 7)
+	assert.Equal(t, "zone.reject", audits[0].Action)
+	assert.Equal(t, "admin", audits[0].Actor)
+
+	w = call(http.MethodGet, "/+/admin/audits?target=wallet:"+strconv.Itoa(l.UserID), nil)
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &audits))
+	assert.Len(t, audits, 1)
+	assert.Equal(t, "wallet.adjust", audits[0].Action)
+	assert.Contains(t, audits[0].Detail, "abuse")
+}
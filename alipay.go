@@ -1,18 +1,15 @@
 package led
 
 import (
-	"bytes"
-	"crypto/ed25519"
-	"encoding/base64"
+	"context"
 	"encoding/json"
-	"io"
+	"fmt"
 	"net/http"
 	"net/url"
-	"os"
-	"strconv"
 	"time"
 
 	"github.com/taoso/led/pay"
+	"github.com/taoso/led/store"
 )
 
 type alipayOrderArgs struct {
@@ -23,69 +20,69 @@ type alipayOrderArgs struct {
 	Created time.Time `json:"created"`  // 请求时间
 
 	NotifyURL string `json:"notify_url,omitempty"` // 异步通知地址
+	Event     string `json:"event,omitempty"`      // 通知事件类型
 }
 
 func (p *Proxy) AlipayOrderCreate(w http.ResponseWriter, req *http.Request, f *FileHandler) {
-	defer req.Body.Close()
-	body, err := io.ReadAll(req.Body)
+	app, body, err := p.verifyApp(req)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(err.Error()))
 		return
 	}
 
-	app := req.Header.Get("zz-app")
-	sign, err := base64.RawURLEncoding.DecodeString(req.Header.Get("zz-sign"))
-	if err != nil {
+	args := alipayOrderArgs{}
+	if err := json.Unmarshal(body, &args); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(err.Error()))
 		return
 	}
 
-	key, err := base64.RawURLEncoding.DecodeString(os.Getenv("APP_PUBKEY_" + app))
-	if err != nil {
+	if args.Created.Sub(time.Now()).Abs() > 5*time.Minute {
 		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(err.Error()))
+		w.Write([]byte("client time is inaccurate"))
 		return
 	}
 
-	if !ed25519.Verify(key, body, sign) {
+	if args.CentNum < 1 {
 		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("invalid sign"))
+		w.Write([]byte("cent_num must > 0"))
 		return
 	}
 
-	args := alipayOrderArgs{}
-	if err := json.Unmarshal(body, &args); err != nil {
+	if !app.AllowCents(args.CentNum) {
 		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(err.Error()))
+		w.Write([]byte("cent_num exceeds the limits of app"))
 		return
 	}
 
-	if args.Created.Sub(time.Now()).Abs() > 5*time.Minute {
+	// 环境变量配置的应用不限制通知地址
+	if p.AppRepo != nil && !app.AllowNotify(args.NotifyURL) {
 		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("client time is inaccurate"))
+		w.Write([]byte("notify_url is not allowed"))
 		return
 	}
 
-	if args.CentNum < 1 {
+	pp, err := p.payment(req)
+	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("cent_num must > 0"))
+		w.Write([]byte(err.Error()))
 		return
 	}
 
 	extras := url.Values{}
+	extras.Set("app", app.Name)
 	extras.Set("url", args.NotifyURL)
 	extras.Set("extra", args.Extra)
 
 	order := pay.Order{
 		TradeNo:   args.OrderID,
-		Amount:    strconv.FormatFloat(float64(args.CentNum)/100, 'f', 2, 64),
+		Cents:     args.CentNum,
 		Subject:   args.Subject,
 		Extra:     extras.Encode(),
-		NotifyURL: "https://" + f.Name + "/+/alipay-order-notify",
+		NotifyURL: notifyURL(f.Name, "/+/alipay-order-notify", pp),
 	}
-	qr, err := p.Alipay.CreateQR(order)
+	qr, err := p.createOrder(req.Context(), pp, orderApp, order)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
@@ -99,81 +96,117 @@ func (p *Proxy) AlipayOrderCreate(w http.ResponseWriter, req *http.Request, f *F
 }
 
 func (p *Proxy) AlipayOrderNotify(w http.ResponseWriter, req *http.Request, f *FileHandler) {
-	trade, err := p.Alipay.GetNotification(req)
+	pp, err := p.payment(req)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(err.Error()))
 		return
 	}
 
-	extras, err := url.ParseQuery(trade.PassbackParams)
+	trade, err := pp.Notify(req)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		p.recordNotify(req, pp, nil, err)
+		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
 		return
 	}
 
-	notifyUrl := extras.Get("url")
-	extras.Del("url")
-	extras.Set("trade_no", trade.TradeNo)
-	extras.Set("trade_status", string(trade.TradeStatus))
-
-	cent, err := strconv.ParseFloat(trade.TotalAmount, 64)
+	// 除了无需处理的通知都转发给应用，支付成功时还要更新订单状态
+	switch {
+	case trade.Noop:
+	case trade.Status == pay.StatusPaid && !trade.IsRefund():
+		err = p.applyPayment(req.Context(), orderApp, trade)
+	default:
+		err = p.notifyApp(req.Context(), trade)
+	}
+	p.recordNotify(req, pp, trade, err)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(err.Error()))
+		notifyError(w, err)
 		return
 	}
 
+	pp.Ack(w)
+}
+
+// notifyApp 生成应用通知并写入发件箱，由 DeliverWebhooks 异步投递。
+// 没有启用订单库时同步投递一次，失败时由支付渠道重试。
+func (p *Proxy) notifyApp(ctx context.Context, trade *pay.Notification) error {
+	// 回传参数超长时只保存在订单中
+	if trade.Extra == "" && p.OrderRepo != nil {
+		o, err := p.OrderRepo.FindOrder(trade.TradeNo)
+		if err != nil {
+			return err
+		}
+		trade.Extra = o.Extra
+	}
+
+	extras, err := url.ParseQuery(trade.Extra)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errInvalidNotify, err)
+	}
+
+	notifyUrl := extras.Get("url")
+	if notifyUrl == "" {
+		return fmt.Errorf("%w: notify url not found", errInvalidNotify)
+	}
+	// 老订单没有记录应用
+	app := extras.Get("app")
+	if app == "" {
+		app = "zz"
+	}
+	extras.Del("url")
+	extras.Del("app")
+	extras.Set("trade_no", trade.PayNo)
+	extras.Set("trade_status", alipayTradeStatus(trade))
+	extras.Set("provider", trade.Provider)
+
 	now := time.Now()
 
 	args := alipayOrderArgs{
-		CentNum: int(cent * 100),
-		OrderID: trade.OutTradeNo,
+		CentNum: trade.Cents,
+		OrderID: trade.TradeNo,
 		Subject: trade.Subject,
 		Extra:   extras.Encode(),
 		Created: now,
+		Event:   appEvent(trade),
 	}
 
 	body, err := json.Marshal(args)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
-		return
+		return err
 	}
 
-	app := "zz"
-
-	seed, err := base64.RawURLEncoding.DecodeString(os.Getenv("APP_PRVKEY_" + app))
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
-		return
+	h := store.Webhook{
+		App:     app,
+		Event:   args.Event,
+		TradeNo: args.OrderID,
+		URL:     notifyUrl,
+		Body:    string(body),
 	}
 
-	key := ed25519.NewKeyFromSeed(seed)
-
-	sign := base64.RawURLEncoding.EncodeToString(ed25519.Sign(key, body))
-
-	r, err := http.NewRequest("POST", notifyUrl, bytes.NewReader(body))
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
-		return
+	if p.OrderRepo == nil {
+		_, err := p.sendWebhook(ctx, &h)
+		return err
 	}
 
-	r.Header.Set("zz-app", app)
-	r.Header.Set("zz-sign", sign)
-	r.Header.Set("Content-Type", "application/json")
-
-	resp, err := http.DefaultClient.Do(r)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
-		return
+	// 先尝试立即投递，失败后由 DeliverWebhooks 按退避时间重试
+	h.NextAt = now.Add(webhookBackoff(0))
+	if err := p.OrderRepo.AddWebhook(&h); err != nil {
+		return err
 	}
+	// 请求结束后继续投递，不能随请求取消
+	go p.deliverWebhook(context.WithoutCancel(ctx), h)
+	return nil
+}
 
-	defer resp.Body.Close()
-	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+// alipayTradeStatus 第三方应用按支付宝的交易状态处理通知，其他渠道的状态也转换成支付宝格式
+func alipayTradeStatus(n *pay.Notification) string {
+	switch n.Status {
+	case pay.StatusPaid:
+		return "TRADE_SUCCESS"
+	case pay.StatusClosed:
+		return "TRADE_CLOSED"
+	default:
+		return "WAIT_BUYER_PAY"
+	}
 }
@@ -0,0 +1,183 @@
+package led
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/taoso/led/store"
+)
+
+var errAppNotFound = errors.New("app not found")
+
+// findApp 查找应用。
+// 没有启用应用库时使用环境变量 APP_PUBKEY_<app> 和 APP_PRVKEY_<app>，
+// 签名私钥缺省使用 APP_PRVKEY_zz，不限制通知地址和金额。
+func (p *Proxy) findApp(name string) (store.App, error) {
+	if p.AppRepo != nil {
+		a, err := p.AppRepo.GetApp(name)
+		if err == nil && a.ID == 0 {
+			err = fmt.Errorf("%w: %q", errAppNotFound, name)
+		}
+		return a, err
+	}
+
+	a := store.App{
+		Name:      name,
+		VerifyKey: os.Getenv("APP_PUBKEY_" + name),
+		SignKey:   os.Getenv("APP_PRVKEY_" + name),
+	}
+	if a.SignKey == "" {
+		a.SignKey = os.Getenv("APP_PRVKEY_zz")
+	}
+	a.Active = a.VerifyKey != "" || a.SignKey != ""
+	if !a.Active {
+		return a, fmt.Errorf("%w: %q", errAppNotFound, name)
+	}
+	return a, nil
+}
+
+// verifyApp 读取请求体并验证应用签名，已停用的应用不能调用接口
+func (p *Proxy) verifyApp(req *http.Request) (a store.App, body []byte, err error) {
+	defer req.Body.Close()
+	body, err = io.ReadAll(req.Body)
+	if err != nil {
+		return
+	}
+
+	sign, err := base64.RawURLEncoding.DecodeString(req.Header.Get("zz-sign"))
+	if err != nil {
+		return
+	}
+
+	if a, err = p.findApp(req.Header.Get("zz-app")); err != nil {
+		return
+	}
+	if !a.Active {
+		err = errors.New("app is disabled")
+		return
+	}
+
+	key, err := base64.RawURLEncoding.DecodeString(a.VerifyKey)
+	if err != nil {
+		return
+	}
+
+	if len(key) != ed25519.PublicKeySize || !ed25519.Verify(key, body, sign) {
+		err = errors.New("invalid sign")
+	}
+	return
+}
+
+// appSignKey 返回签名通知的私钥，停用的应用仍然接收已创建订单的通知
+func (p *Proxy) appSignKey(name string) (ed25519.PrivateKey, error) {
+	a, err := p.findApp(name)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := base64.RawURLEncoding.DecodeString(a.SignKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("invalid sign key of app %q", name)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+type appInfo struct {
+	store.App
+	SignPubkey string `json:"sign_pubkey"` // 应用用来验证通知的公钥
+}
+
+// apps 管理接入的应用
+//
+//	GET lists all apps.
+//	POST {"name":"x",...} creates or updates app x, the sign key is generated
+//	for new apps or if rotate_sign_key is true.
+func (p *Proxy) apps(w http.ResponseWriter, req *http.Request) {
+	if !p.isAdmin(w, req) {
+		return
+	}
+
+	if p.AppRepo == nil {
+		http.Error(w, "app registry is not enabled", http.StatusNotImplemented)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		as, err := p.AppRepo.ListApps()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		infos := make([]appInfo, 0, len(as))
+		for _, a := range as {
+			infos = append(infos, appInfo{App: a, SignPubkey: a.SignPubkey()})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(infos)
+	case http.MethodPost:
+		defer req.Body.Close()
+		args := struct {
+			Name           string `json:"name"`
+			VerifyKey      string `json:"verify_key"`
+			NotifyPrefixes string `json:"notify_prefixes"`
+			MinCents       int    `json:"min_cents"`
+			MaxCents       int    `json:"max_cents"`
+			Active         bool   `json:"active"`
+			RotateSignKey  bool   `json:"rotate_sign_key"`
+		}{}
+		if err := json.NewDecoder(req.Body).Decode(&args); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if args.Name == "" {
+			http.Error(w, "name is required", http.StatusBadRequest)
+			return
+		}
+		if k, err := base64.RawURLEncoding.DecodeString(args.VerifyKey); err != nil || len(k) != ed25519.PublicKeySize {
+			http.Error(w, "invalid verify_key", http.StatusBadRequest)
+			return
+		}
+		if args.MinCents < 0 || args.MaxCents < 0 || (args.MaxCents > 0 && args.MinCents > args.MaxCents) {
+			http.Error(w, "invalid amount limits", http.StatusBadRequest)
+			return
+		}
+
+		a, err := p.AppRepo.GetApp(args.Name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		a.Name = args.Name
+		a.VerifyKey = args.VerifyKey
+		a.NotifyPrefixes = args.NotifyPrefixes
+		a.MinCents = args.MinCents
+		a.MaxCents = args.MaxCents
+		a.Active = args.Active
+		if a.SignKey == "" || args.RotateSignKey {
+			seed := make([]byte, ed25519.SeedSize)
+			rand.Read(seed)
+			a.SignKey = base64.RawURLEncoding.EncodeToString(seed)
+		}
+
+		if err := p.AppRepo.SaveApp(&a); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(appInfo{App: a, SignPubkey: a.SignPubkey()})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,131 @@
+package led
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/taoso/led/pay"
+	"github.com/taoso/led/store"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAppRegistry(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("pass"), bcrypt.MinCost)
+	assert.Nil(t, err)
+
+	// 环境变量中的密钥不再生效
+	zzPub, zzKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	t.Setenv("APP_PRVKEY_zz", base64.RawURLEncoding.EncodeToString(zzKey.Seed()))
+
+	p := &Proxy{
+		OrderRepo: store.NewOrderRepo(":memory:"),
+		AppRepo:   store.NewAppRepo(":memory:"),
+	}
+	p.SetUsers(map[string]string{"admin": string(hash)})
+	p.AddPayment(&pay.Fake{})
+
+	appPub, appKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+
+	admin := func(method string, args map[string]any) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(args)
+		req := httptest.NewRequest(method, "/+/apps", bytes.NewReader(b))
+		req.SetBasicAuth("admin", "pass")
+		w := httptest.NewRecorder()
+		p.apps(w, req)
+		return w
+	}
+
+	notify := make(chan *http.Request, 1)
+	var body []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+		notify <- r
+		w.Write([]byte("success"))
+	}))
+	defer ts.Close()
+
+	w := admin(http.MethodPost, map[string]any{
+		"name":            "app1",
+		"verify_key":      base64.RawURLEncoding.EncodeToString(appPub),
+		"notify_prefixes": ts.URL + "/pay/",
+		"min_cents":       10,
+		"max_cents":       1000,
+		"active":          true,
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	var info appInfo
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &info))
+	signPub, err := base64.RawURLEncoding.DecodeString(info.SignPubkey)
+	assert.Nil(t, err)
+	assert.NotContains(t, w.Body.String(), "sign_key")
+
+	w = admin(http.MethodPost, map[string]any{"name": "app2", "verify_key": "x"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	create := func(app string, key ed25519.PrivateKey, cents int, notifyURL string) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(alipayOrderArgs{
+			CentNum:   cents,
+			OrderID:   pay.NewTradeNo(),
+			Subject:   "test",
+			Created:   time.Now(),
+			NotifyURL: notifyURL,
+		})
+		req := httptest.NewRequest(http.MethodPost, "/+/alipay-order-create?provider=fake", bytes.NewReader(b))
+		req.Header.Set("zz-app", app)
+		req.Header.Set("zz-sign", base64.RawURLEncoding.EncodeToString(ed25519.Sign(key, b)))
+		w := httptest.NewRecorder()
+		p.AlipayOrderCreate(w, req, &FileHandler{Name: "lehu.in"})
+		return w
+	}
+
+	assert.Equal(t, http.StatusBadRequest, create("zz", zzKey, 100, ts.URL+"/pay/").Code)
+	assert.Equal(t, http.StatusBadRequest, create("app1", appKey, 1001, ts.URL+"/pay/").Code)
+	assert.Equal(t, http.StatusBadRequest, create("app1", appKey, 100, ts.URL+"/other").Code)
+	assert.Equal(t, http.StatusOK, create("app1", appKey, 100, ts.URL+"/pay/1").Code)
+
+	// 通知使用创建订单的应用的密钥签名
+	extras := url.Values{}
+	extras.Set("app", "app1")
+	extras.Set("url", ts.URL+"/pay/1")
+	assert.Nil(t, p.notifyApp(context.Background(), &pay.Notification{
+		Provider: "fake",
+		TradeNo:  "o1",
+		Cents:    100,
+		Status:   pay.StatusPaid,
+		Extra:    extras.Encode(),
+	}))
+	r := <-notify
+	assert.Equal(t, "app1", r.Header.Get("zz-app"))
+	sign, _ := base64.RawURLEncoding.DecodeString(r.Header.Get("zz-sign"))
+	assert.True(t, ed25519.Verify(signPub, body, sign))
+	assert.False(t, ed25519.Verify(zzPub, body, sign))
+
+	// 停用后不能再创建订单
+	w = admin(http.MethodPost, map[string]any{
+		"name":       "app1",
+		"verify_key": base64.RawURLEncoding.EncodeToString(appPub),
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, http.StatusBadRequest, create("app1", appKey, 100, ts.URL+"/pay/1").Code)
+
+	w = admin(http.MethodGet, map[string]any{})
+	var infos []appInfo
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &infos))
+	if assert.Equal(t, 1, len(infos)) {
+		assert.False(t, infos[0].Active)
+		assert.Equal(t, info.SignPubkey, infos[0].SignPubkey)
+	}
+}
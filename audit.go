@@ -0,0 +1,83 @@
+package led
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+
+	"github.com/taoso/led/pay"
+	"github.com/taoso/led/store"
+)
+
+// audit 记录特权及安全相关操作，err 为 nil 表示操作成功。
+// 没有启用审计库时只打印日志，写入失败不影响操作本身。
+func (p *Proxy) audit(req *http.Request, actor, action, target string, err error, detail any) {
+	p.Audit(req.Context(), store.Audit{
+		Actor:  actor,
+		Action: action,
+		Target: target,
+		IP:     clientIP(req),
+		Agent:  req.UserAgent(),
+	}, err, detail)
+}
+
+// Audit records the operation a from sources other than HTTP requests, such
+// as the command line. Result and Detail of a are set by err and detail.
+func (p *Proxy) Audit(ctx context.Context, a store.Audit, err error, detail any) {
+	a.Result = store.AuditOK
+	if err != nil {
+		a.Result = err.Error()
+	}
+	if detail != nil {
+		b, _ := json.Marshal(detail)
+		a.Detail = string(b)
+	}
+
+	if p.AuditRepo == nil {
+		slog.InfoContext(ctx, "audit", "actor", a.Actor, "action", a.Action, "target", a.Target,
+			"ip", a.IP, "result", a.Result, "detail", a.Detail)
+		return
+	}
+	if err := p.AuditRepo.AddAudit(&a); err != nil {
+		slog.ErrorContext(ctx, "add audit error", "action", a.Action, "target", a.Target, "err", err)
+	}
+}
+
+// adminActor 管理员为 basic auth 用户名
+func adminActor(req *http.Request) string {
+	name, _, _ := req.BasicAuth()
+	return name
+}
+
+// clientIP 取连接的来源地址，经过代理时 ServeHTTP 已改写为真实地址
+func clientIP(req *http.Request) string {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return ip
+}
+
+// recordNotify 审计并统计支付渠道的异步通知，trade 为 nil 表示通知验证失败
+func (p *Proxy) recordNotify(req *http.Request, pp pay.Provider, trade *pay.Notification, err error) {
+	action, target, kind := "pay.notify", "", "invalid"
+	var detail map[string]any
+	if trade != nil {
+		kind = trade.Status.String()
+		if trade.IsRefund() {
+			action, kind = "pay.refund", "refund"
+		}
+		target = "order:" + trade.TradeNo
+		detail = map[string]any{
+			"pay_no":       trade.PayNo,
+			"status":       trade.Status.String(),
+			"cents":        trade.Cents,
+			"refund_no":    trade.RefundNo,
+			"refund_cents": trade.RefundCents,
+		}
+	}
+	p.audit(req, "pay:"+pp.Name(), action, target, err, detail)
+	payNotifications.Inc(pp.Name(), kind, result(err))
+}
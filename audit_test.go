@@ -0,0 +1,78 @@
+package led
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/taoso/led/pay"
+	"github.com/taoso/led/store"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAudit(t *testing.T) {
+	f, err := os.CreateTemp("", "led-*.db")
+	assert.Nil(t, err)
+	f.Close()
+	defer os.Remove(f.Name())
+
+	p := &Proxy{
+		TokenRepo: store.NewTokenRepo(f.Name()),
+		AuditRepo: store.NewAuditRepo(":memory:"),
+	}
+	p.AddPayment(&pay.Fake{})
+
+	l := store.TokenLog{Type: store.LogTypeBuy, TokenNum: 100, PayNo: "pay-1",
+		Extra: store.KV{"_pubkey": "pk1"}, Created: time.Now()}
+	u, err := p.TokenRepo.UpdateWallet(&l)
+	assert.Nil(t, err)
+	u.Username = "foo"
+	u.Password, err = bcrypt.GenerateFromPassword([]byte("bar"), bcrypt.MinCost)
+	assert.Nil(t, err)
+	assert.Nil(t, p.TokenRepo.SaveWallet(u))
+
+	login := func(password string) int {
+		b, _ := json.Marshal(map[string]string{"username": "foo", "password": password})
+		req := httptest.NewRequest(http.MethodPost, "/+/v2/login", bytes.NewReader(b))
+		req.Header.Set("User-Agent", "test")
+		w := httptest.NewRecorder()
+		p.login(w, req, nil)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusUnauthorized, login("baz"))
+	assert.Equal(t, http.StatusOK, login("bar"))
+
+	// 伪造的支付通知
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/+/buy-tokens-notify?provider=fake", nil)
+	p.buyTokensNotify(w, req, nil)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+	as, err := p.AuditRepo.ListAudits("", 0, 10)
+	assert.Nil(t, err)
+	assert.Len(t, as, 3)
+
+	assert.Equal(t, "pay.notify", as[0].Action)
+	assert.Equal(t, "pay:fake", as[0].Actor)
+	assert.Equal(t, pay.ErrInvalidAmount.Error(), as[0].Result)
+
+	assert.Equal(t, "login", as[1].Action)
+	assert.Equal(t, "user:foo", as[1].Actor)
+	assert.Equal(t, "wallet:"+strconv.Itoa(u.ID), as[1].Target)
+	assert.Equal(t, store.AuditOK, as[1].Result)
+	assert.Equal(t, "192.0.2.1", as[1].IP)
+	assert.Equal(t, "test", as[1].Agent)
+
+	assert.Equal(t, errLoginFailed.Error(), as[2].Result)
+
+	n, broken, err := p.AuditRepo.VerifyAudits()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, n)
+	assert.Zero(t, broken)
+}
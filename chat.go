@@ -3,6 +3,7 @@ package led
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
@@ -10,7 +11,7 @@ import (
 	"fmt"
 	"image"
 	"io"
-	"log"
+	"log/slog"
 	"math"
 	"net/http"
 	"net/url"
@@ -19,7 +20,6 @@ import (
 	"strconv"
 	"strings"
 	"time"
-	"unsafe"
 
 	_ "image/jpeg"
 	_ "image/png"
@@ -35,7 +35,9 @@ import (
 const utcTime = "2006-01-02T15:04:05.000Z"
 
 func (p *Proxy) getWallet(wid int, req *http.Request) (w store.TokenWallet, err error) {
+	end := traceRepo(req.Context(), "TokenRepo.GetWallet")
 	w, err = p.TokenRepo.GetWallet(wid)
+	end(err)
 	if err != nil || w.ID == 0 {
 		return
 	}
@@ -49,7 +51,9 @@ func (p *Proxy) getWallet(wid int, req *http.Request) (w store.TokenWallet, err
 		err = nil
 		return
 	}
+	end = traceRepo(req.Context(), "TokenRepo.GetSession")
 	s, err := p.TokenRepo.GetSession(i)
+	end(err)
 	if err != nil {
 		return
 	}
@@ -110,7 +114,7 @@ type chatmsg struct {
 	MaxTokens int       `json:"max_completion_tokens"`
 }
 
-func (m *chatmsg) CountToken(bpe *tiktoken.BPE) (int, error) {
+func (m *chatmsg) CountToken(ctx context.Context, bpe *tiktoken.BPE) (int, error) {
 	var n int
 	for _, m := range m.Messages {
 		switch v := m.Content.(type) {
@@ -132,7 +136,7 @@ func (m *chatmsg) CountToken(bpe *tiktoken.BPE) (int, error) {
 						},
 					})
 				case "image_url":
-					c, err := openImageConfig(m.Image.URL)
+					c, err := openImageConfig(ctx, m.Image.URL)
 					if err != nil {
 						return 0, err
 					}
@@ -149,13 +153,18 @@ func (m *chatmsg) CountToken(bpe *tiktoken.BPE) (int, error) {
 	return n, nil
 }
 
-func openImageConfig(url string) (image.Config, error) {
+func openImageConfig(ctx context.Context, url string) (image.Config, error) {
 	var img io.Reader
 	if strings.HasPrefix(url, "http") {
-		r, err := http.Get(url)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 		if err != nil {
 			return image.Config{}, err
 		}
+		r, err := httpClient.Do(req)
+		if err != nil {
+			return image.Config{}, err
+		}
+		defer r.Body.Close()
 		if r.StatusCode != http.StatusOK {
 			return image.Config{}, errors.New("download error")
 		}
@@ -247,7 +256,9 @@ func (p *Proxy) chat(w http.ResponseWriter, req *http.Request, f *FileHandler) {
 
 	if auth := req.Header.Get("Authorization"); auth != "" {
 		key := auth[len("Bearer "):]
+		end := traceRepo(req.Context(), "TokenRepo.FindWallet")
 		wallet, err = p.TokenRepo.FindWallet(key)
+		end(err)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte(err.Error()))
@@ -390,9 +401,15 @@ func (p *Proxy) chat(w http.ResponseWriter, req *http.Request, f *FileHandler) {
 				Created: msg.Created,
 				Sign:    msg.Sign,
 			}
+			chatTokens.Add(float64(u.Usage.PromptTokens), msg.Model, "prompt")
+			chatTokens.Add(float64(u.Usage.ReplyTokens), msg.Model, "completion")
+
+			end := traceRepo(req.Context(), "TokenRepo.UpdateWallet")
 			uw, err := p.TokenRepo.UpdateWallet(&tl)
+			end(err)
+			debited("chat", tl.TokenNum, err)
 			if err != nil {
-				log.Printf("save token log %+v err %v", tl, err)
+				slog.ErrorContext(req.Context(), "save token log error", "user_id", tl.UserID, "tokens", tl.TokenNum, "err", err)
 			} else {
 				u.Usage.RemainTokens = uw.Tokens
 			}
@@ -403,7 +420,7 @@ func (p *Proxy) chat(w http.ResponseWriter, req *http.Request, f *FileHandler) {
 		}
 	}()
 
-	u.Usage.PromptTokens, err = msg.CountToken(p.bpe(msg.Model))
+	u.Usage.PromptTokens, err = msg.CountToken(req.Context(), p.bpe(msg.Model))
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(err.Error()))
@@ -428,22 +445,25 @@ func (p *Proxy) chat(w http.ResponseWriter, req *http.Request, f *FileHandler) {
 	}
 
 	url := "https://api.openai.com" + req.URL.Path[len("/+/chat"):]
-	r, err := http.NewRequest("POST", url, bytes.NewReader(b))
+	r, err := http.NewRequestWithContext(req.Context(), "POST", url, bytes.NewReader(b))
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
 		return
 	}
+	setRequestID(req.Context(), r, "X-Client-Request-Id")
 	r.Header.Set("Authorization", "Bearer "+os.Getenv("CHAT_TOKEN"))
 	r.Header.Set("Content-Type", req.Header.Get("Content-Type"))
 
-	resp, err := http.DefaultClient.Do(r)
+	resp, err := httpClient.Do(r)
 	if err != nil {
+		upstreamDone("openai", err, 0)
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
 		return
 	}
 	defer resp.Body.Close()
+	upstreamDone("openai", nil, resp.StatusCode)
 
 	chatID = resp.Header.Get("X-Request-Id")
 
@@ -458,8 +478,10 @@ func (p *Proxy) chat(w http.ResponseWriter, req *http.Request, f *FileHandler) {
 		b, _ := io.ReadAll(resp.Body)
 		if resp.StatusCode == http.StatusOK {
 			if err := json.Unmarshal(b, &u); err != nil {
-				log.Println("unmarshal data error: ", err)
+				slog.WarnContext(req.Context(), "unmarshal data error", "err", err)
 			}
+			chatTokens.Add(float64(u.Usage.PromptTokens), msg.Model, "prompt")
+			chatTokens.Add(float64(u.Usage.ReplyTokens), msg.Model, "completion")
 		}
 		w.Write(b)
 		return
@@ -483,7 +505,7 @@ func (p *Proxy) chat(w http.ResponseWriter, req *http.Request, f *FileHandler) {
 		}
 		err := json.Unmarshal([]byte(l[len("data: "):]), &data)
 		if err != nil {
-			log.Println("unmarshal data error: ", err)
+			slog.WarnContext(req.Context(), "unmarshal data error", "err", err)
 			return
 		}
 
@@ -493,7 +515,7 @@ func (p *Proxy) chat(w http.ResponseWriter, req *http.Request, f *FileHandler) {
 
 		b, err := json.Marshal(data)
 		if err != nil {
-			log.Println("marshal data error: ", err)
+			slog.WarnContext(req.Context(), "marshal data error", "err", err)
 			return
 		}
 
@@ -503,14 +525,14 @@ func (p *Proxy) chat(w http.ResponseWriter, req *http.Request, f *FileHandler) {
 		copy(buf[len(b)+len("data: "):], []byte("\n\n"))
 
 		if _, err := w.Write(buf); err != nil {
-			log.Println("write data error: ", err)
+			slog.DebugContext(req.Context(), "write data error", "err", err)
 			return
 		}
 		w.(http.Flusher).Flush()
 	}
 
 	if err := s.Err(); err != nil {
-		log.Println("scan err", err)
+		slog.WarnContext(req.Context(), "scan error", "err", err)
 	}
 }
 
@@ -576,22 +598,25 @@ func (p *Proxy) image(w http.ResponseWriter, req *http.Request, f *FileHandler,
 		return
 	}
 	url := "https://api.openai.com/v1/images/generations"
-	r, err := http.NewRequest("POST", url, bytes.NewReader(b))
+	r, err := http.NewRequestWithContext(req.Context(), "POST", url, bytes.NewReader(b))
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
 		return
 	}
+	setRequestID(req.Context(), r, "X-Client-Request-Id")
 	r.Header.Set("Authorization", "Bearer "+os.Getenv("CHAT_TOKEN"))
 	r.Header.Set("Content-Type", req.Header.Get("Content-Type"))
 
-	resp, err := http.DefaultClient.Do(r)
+	resp, err := httpClient.Do(r)
 	if err != nil {
+		upstreamDone("openai", err, 0)
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
 		return
 	}
 	defer resp.Body.Close()
+	upstreamDone("openai", nil, resp.StatusCode)
 
 	chatID := resp.Header.Get("X-Request-Id")
 
@@ -645,9 +670,14 @@ func (p *Proxy) image(w http.ResponseWriter, req *http.Request, f *FileHandler,
 		Created: msg.Created,
 		Sign:    msg.Sign,
 	}
+	chatTokens.Add(float64(token), model, "image")
+
+	end := traceRepo(req.Context(), "TokenRepo.UpdateWallet")
 	uw, err := p.TokenRepo.UpdateWallet(&tl)
+	end(err)
+	debited("image", tl.TokenNum, err)
 	if err != nil {
-		log.Printf("save token log %+v err %v", tl, err)
+		slog.ErrorContext(req.Context(), "save token log error", "user_id", tl.UserID, "tokens", tl.TokenNum, "err", err)
 	} else {
 		u.Usage.RemainTokens = uw.Tokens
 	}
@@ -741,6 +771,11 @@ func (p *Proxy) checkName(w http.ResponseWriter, req *http.Request, f *FileHandl
 
 var usernameRE = regexp.MustCompile(`^[a-z][a-z0-9]*$`)
 
+var (
+	errUsernameTaken = errors.New("username is taken")
+	errLoginFailed   = errors.New("invalid username or password")
+)
+
 func (p *Proxy) setAuth(w http.ResponseWriter, req *http.Request, f *FileHandler) {
 	var args struct {
 		Username string `json:"username"`
@@ -777,11 +812,15 @@ func (p *Proxy) setAuth(w http.ResponseWriter, req *http.Request, f *FileHandler
 		return
 	}
 
+	actor := "wallet:" + strconv.Itoa(uid)
+	detail := map[string]string{"username": args.Username}
+
 	if u, err := p.TokenRepo.FindWalletByName(args.Username); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
 		return
 	} else if u.ID != 0 {
+		p.audit(req, actor, "wallet.set_auth", actor, errUsernameTaken, detail)
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte("用户名已存在"))
 		return
@@ -790,9 +829,12 @@ func (p *Proxy) setAuth(w http.ResponseWriter, req *http.Request, f *FileHandler
 	wallet.Username = args.Username
 	wallet.SetPassword(args.Password)
 
-	if err = p.TokenRepo.SaveWallet(wallet); err != nil {
+	err = p.TokenRepo.SaveWallet(wallet)
+	p.audit(req, actor, "wallet.set_auth", actor, err, detail)
+	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
+		return
 	}
 	w.Write([]byte("ok"))
 }
@@ -816,8 +858,12 @@ func (p *Proxy) login(w http.ResponseWriter, req *http.Request, f *FileHandler)
 		return
 	}
 
+	actor := "user:" + args.Username
+	target := "wallet:" + strconv.Itoa(u.ID)
+
 	// 同时检查用户不存在的情形
 	if !u.CheckPassword(args.Password) {
+		p.audit(req, actor, "login", target, errLoginFailed, nil)
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
@@ -830,7 +876,9 @@ func (p *Proxy) login(w http.ResponseWriter, req *http.Request, f *FileHandler)
 		Created: time.Now(),
 	}
 
-	if err = p.TokenRepo.AddSession(&s); err != nil {
+	err = p.TokenRepo.AddSession(&s)
+	p.audit(req, actor, "login", target, err, map[string]any{"sid": s.ID, "pubkey": s.Pubkey})
+	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
 		return
@@ -870,7 +918,9 @@ func (p *Proxy) delSession(w http.ResponseWriter, req *http.Request, f *FileHand
 	}
 	uid, _ := strconv.Atoi(req.Header.Get("cg-uid"))
 
-	if err := p.TokenRepo.DelSession(args.ID, uid); err != nil {
+	err := p.TokenRepo.DelSession(args.ID, uid)
+	p.audit(req, "wallet:"+strconv.Itoa(uid), "session.delete", "session:"+strconv.Itoa(args.ID), err, nil)
+	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
 		return
@@ -965,15 +1015,22 @@ func (p *Proxy) buyTokens(w http.ResponseWriter, req *http.Request, f *FileHandl
 		args.FromID = f.Value
 	}
 
+	pp, err := p.payment(req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
 	body, _ := json.Marshal(args)
 	order := pay.Order{
-		TradeNo:   genTradeNo(pk),
-		Amount:    strconv.Itoa(args.CentNum / 100),
+		TradeNo:   pay.NewTradeNo(),
+		Cents:     args.CentNum,
 		Subject:   strconv.Itoa(args.TokenNum) + " tokens",
 		Extra:     url.QueryEscape(string(body)),
-		NotifyURL: "https://" + f.Name + "/+/buy-tokens-notify",
+		NotifyURL: notifyURL(f.Name, "/+/buy-tokens-notify", pp),
 	}
-	qr, err := p.Alipay.CreateQR(order)
+	qr, err := p.createOrder(req.Context(), pp, orderTokens, order)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
@@ -983,56 +1040,67 @@ func (p *Proxy) buyTokens(w http.ResponseWriter, req *http.Request, f *FileHandl
 	w.Write([]byte(`{"qr":"` + qr + `","trade_no":"` + order.TradeNo + `","ttl":900}`))
 }
 
-// genTradeNo 为当前用户生成订单号
-//
-// 当前毫秒时间戳再追加一部分用户公钥信息，几乎不可能冲突。
-func genTradeNo(pubkey ecdsa.PublicKey) string {
-	ts := time.Now().UTC().Format("20060102150405.000")
-	ts = strings.Replace(ts, ".", "", 1)
-
-	var i uint32
-	p := unsafe.Pointer(&i)
-	copy((*[4]byte)(p)[:], pubkey.X.Bytes()[:4])
-
-	return ts + strconv.Itoa(int(i))
-}
-
 func (p *Proxy) buyTokensNotify(w http.ResponseWriter, req *http.Request, f *FileHandler) {
-	trade, err := p.Alipay.GetNotification(req)
+	pp, err := p.payment(req)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(err.Error()))
 		return
 	}
 
-	args := alipayArgs{}
-	params, err := url.QueryUnescape(trade.PassbackParams)
+	trade, err := pp.Notify(req)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		p.recordNotify(req, pp, nil, err)
+		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
 		return
 	}
-	err = json.Unmarshal([]byte(params), &args)
+
+	// 退款通知发到原订单的通知地址
+	if trade.IsRefund() {
+		err = p.refundNotify(w, pp, trade)
+		p.recordNotify(req, pp, trade, err)
+		return
+	}
+
+	// 只有支付成功才充值
+	if trade.Status == pay.StatusPaid {
+		err = p.applyPayment(req.Context(), orderTokens, trade)
+	}
+	p.recordNotify(req, pp, trade, err)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
+		notifyError(w, err)
 		return
 	}
 
+	pp.Ack(w)
+}
+
+// applyTokens 按回传参数充值，同一订单只充值一次
+func (p *Proxy) applyTokens(trade *pay.Notification) error {
+	args := alipayArgs{}
+	params, err := url.QueryUnescape(trade.Extra)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errInvalidNotify, err)
+	}
+	err = json.Unmarshal([]byte(params), &args)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errInvalidNotify, err)
+	}
+
+	if trade.Cents != args.CentNum {
+		return fmt.Errorf("%w: amount mismatch", errInvalidNotify)
+	}
+
 	pk, err := ecdsa.ParsePubkey(args.Pubkey)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(err.Error()))
-		return
+		return fmt.Errorf("%w: %w", errInvalidNotify, err)
 	}
 
-	if l, err := p.TokenRepo.FindLog(trade.OutTradeNo); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
-		return
+	if l, err := p.TokenRepo.FindLog(trade.TradeNo); err != nil {
+		return err
 	} else if l.ID != 0 {
-		w.Write([]byte("success"))
-		return
+		return nil
 	}
 
 	log := store.TokenLog{
@@ -1040,10 +1108,11 @@ func (p *Proxy) buyTokensNotify(w http.ResponseWriter, req *http.Request, f *Fil
 		Type:     store.LogTypeBuy,
 		TokenNum: args.TokenNum,
 		ExtraNum: args.CentNum,
-		PayNo:    trade.OutTradeNo,
+		PayNo:    trade.TradeNo,
 		Extra: map[string]string{
-			"trade_no":  trade.TradeNo,
-			"_buyer_id": trade.BuyerId,
+			"trade_no":  trade.PayNo,
+			"provider":  trade.Provider,
+			"_buyer_id": trade.BuyerID,
 			"_pubkey":   ecdsa.Compress(pk),
 			"_from_id":  args.FromID,
 		},
@@ -1051,13 +1120,8 @@ func (p *Proxy) buyTokensNotify(w http.ResponseWriter, req *http.Request, f *Fil
 		Created: args.Created,
 	}
 
-	if _, err := p.TokenRepo.UpdateWallet(&log); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
-		return
-	}
-
-	w.Write([]byte("success"))
+	_, err = p.TokenRepo.UpdateWallet(&log)
+	return err
 }
 
 func (p *Proxy) buyTokensLog(w http.ResponseWriter, req *http.Request, f *FileHandler) {
@@ -2,16 +2,15 @@ package led
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
-	"strings"
 	"testing"
 	"time"
 
 	"github.com/go-kiss/monkey"
-	"github.com/smartwalle/alipay/v3"
 	"github.com/stretchr/testify/assert"
 	"github.com/taoso/led/pay"
 	"github.com/taoso/led/store"
@@ -29,27 +28,34 @@ func TestBuyTokens(t *testing.T) {
 	assert.Nil(t, err)
 
 	w := httptest.NewRecorder()
-	req := httptest.NewRequest("POST", "/+/buy-tokens", bytes.NewReader(b))
+	req := httptest.NewRequest("POST", "/+/buy-tokens?provider=fake", bytes.NewReader(b))
+	fake := &pay.Fake{}
 	p := &Proxy{}
+	p.AddPayment(fake)
 
 	g1 := monkey.Patch(time.Now, func() time.Time {
 		return args.Created.Add(2 * time.Minute)
 	})
 	defer g1.Unpatch()
 
-	g2 := monkey.Patch((*pay.Alipay).CreateQR, func(_ *pay.Alipay, o pay.Order) (string, error) {
-		assert.Equal(t, "1", o.Amount)
-		assert.Equal(t, "4000 tokens", o.Subject)
-		assert.Equal(t, url.QueryEscape(string(b)), o.Extra)
-		assert.Equal(t, "https://lehu.in/+/buy-tokens-notify", o.NotifyURL)
-		return "https://example.qr", nil
-	})
-	defer g2.Unpatch()
-
 	p.buyTokens(w, req, &FileHandler{Name: "lehu.in"})
 
 	assert.Equal(t, http.StatusOK, w.Code)
-	assert.Equal(t, `{"qr":"https://example.qr","ttl":900}`, w.Body.String())
+	var r struct {
+		QR      string `json:"qr"`
+		TradeNo string `json:"trade_no"`
+		TTL     int    `json:"ttl"`
+	}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &r))
+	assert.Equal(t, "fake://pay/"+r.TradeNo, r.QR)
+	assert.Equal(t, 900, r.TTL)
+
+	o, err := fake.Query(context.Background(), r.TradeNo)
+	if assert.Nil(t, err) {
+		assert.Equal(t, 100, o.Cents)
+		assert.Equal(t, "4000 tokens", o.Subject)
+		assert.Equal(t, url.QueryEscape(string(b)), o.Extra)
+	}
 }
 
 func TestBuyTokensErr(t *testing.T) {
@@ -126,30 +132,26 @@ func TestBuyTokensNotify(t *testing.T) {
 	b, err := json.Marshal(args)
 	assert.Nil(t, err)
 
-	params := url.Values{}
-	params.Set("passback_params", url.QueryEscape(string(b)))
-	params.Set("buyer_id", "1024")
-	params.Set("trade_no", "tn1")
-	params.Set("out_trade_no", "otn1")
+	n := &pay.Notification{
+		TradeNo: "otn1",
+		PayNo:   "tn1",
+		BuyerID: "1024",
+		Cents:   100,
+		Status:  pay.StatusPaid,
+		Extra:   url.QueryEscape(string(b)),
+	}
 
 	w := httptest.NewRecorder()
-
-	req := httptest.NewRequest("POST", "/+/buy-tokens-notify", strings.NewReader(params.Encode()))
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	req.ParseForm()
+	req := pay.NotifyRequest("/+/buy-tokens-notify?provider=fake", n)
 
 	p := &Proxy{}
+	p.AddPayment(&pay.Fake{})
 
-	g1 := monkey.Patch((*pay.Alipay).GetNotification, func(_ *pay.Alipay, req *http.Request) (n alipay.TradeNotification, err error) {
-		n.PassbackParams = req.FormValue("passback_params")
-		n.BuyerId = req.FormValue("buyer_id")
-		n.TradeNo = req.FormValue("trade_no")
-		n.OutTradeNo = req.FormValue("out_trade_no")
-		return
-	})
-	defer g1.Unpatch()
+	repo := &fakeTokenRepo{}
+	p.TokenRepo = repo
 
-	g2 := monkey.Patch((*store.TokenRepo).UpdateWallet, func(_ *store.TokenRepo, log *store.TokenLog) (w store.TokenWallet, err error) {
+	called := false
+	repo.updateWallet = func(log *store.TokenLog) (w store.TokenWallet, err error) {
 		assert.Equal(t, 0, log.UserID)
 		assert.Equal(t, store.LogTypeBuy, log.Type)
 		assert.Equal(t, args.TokenNum, log.TokenNum)
@@ -157,20 +159,39 @@ func TestBuyTokensNotify(t *testing.T) {
 		assert.Equal(t, args.Sign, log.Sign)
 		assert.Equal(t, args.Created, log.Created)
 		assert.Equal(t, "A6jQmlNjXfWLeprdKDpmdHNFQZz4mdQktEfXo0FsSj+r", log.Extra["_pubkey"])
-		assert.Equal(t, params.Get("out_trade_no"), log.PayNo)
-		assert.Equal(t, params.Get("trade_no"), log.Extra["trade_no"])
-		assert.Equal(t, params.Get("buyer_id"), log.Extra["_buyer_id"])
-		return
-	})
-	defer g2.Unpatch()
-
-	g3 := monkey.Patch((*store.TokenRepo).FindLog, func(_ *store.TokenRepo, payNo string) (l store.TokenLog, err error) {
+		assert.Equal(t, n.TradeNo, log.PayNo)
+		assert.Equal(t, n.PayNo, log.Extra["trade_no"])
+		assert.Equal(t, n.BuyerID, log.Extra["_buyer_id"])
+		assert.Equal(t, "fake", log.Extra["provider"])
+		called = true
 		return
-	})
-	defer g3.Unpatch()
+	}
 
 	p.buyTokensNotify(w, req, &FileHandler{Name: "lehu.in"})
 
 	assert.Equal(t, http.StatusOK, w.Code)
 	assert.Equal(t, `success`, w.Body.String())
+	assert.True(t, called)
+
+	// 金额不符不能充值
+	called = false
+	n.Cents = 1
+	w = httptest.NewRecorder()
+	p.buyTokensNotify(w, pay.NotifyRequest("/+/buy-tokens-notify?provider=fake", n), &FileHandler{Name: "lehu.in"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.False(t, called)
+}
+
+type fakeTokenRepo struct {
+	store.TokenRepo
+
+	updateWallet func(log *store.TokenLog) (store.TokenWallet, error)
+}
+
+func (r *fakeTokenRepo) UpdateWallet(log *store.TokenLog) (store.TokenWallet, error) {
+	return r.updateWallet(log)
+}
+
+func (r *fakeTokenRepo) FindLog(payNo string) (l store.TokenLog, err error) {
+	return
 }
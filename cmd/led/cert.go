@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// certCacheDir autocert 证书缓存目录
+func certCacheDir() autocert.DirCache {
+	return autocert.DirCache(os.Getenv("HOME") + "/.autocert")
+}
+
+// certInfo autocert 缓存中的一张证书
+type certInfo struct {
+	Key      string    `json:"key"` // 缓存的文件名，RSA 证书以 +rsa 结尾
+	Names    []string  `json:"names"`
+	Issuer   string    `json:"issuer"`
+	NotAfter time.Time `json:"not_after"`
+}
+
+// certCmd 列出 autocert 缓存中的证书，按到期时间排序
+//
+//	led cert list [-json]
+func certCmd(args []string) error {
+	if len(args) == 0 || args[0] != "list" {
+		return errors.New("usage: led cert list [-json]")
+	}
+
+	fs := flag.NewFlagSet("cert list", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print certificates as json")
+	fs.Parse(args[1:])
+
+	cs, err := listCerts(string(certCacheDir()))
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		printJSON(cs)
+		return nil
+	}
+	for _, c := range cs {
+		days := int(time.Until(c.NotAfter).Hours() / 24)
+		fmt.Printf("%s\t%s\t%dd\t%s\t%s\n", c.Key, c.NotAfter.Format(time.DateOnly), days, c.Issuer, strings.Join(c.Names, ","))
+	}
+	return nil
+}
+
+func listCerts(dir string) ([]certInfo, error) {
+	es, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	cs := []certInfo{}
+	for _, e := range es {
+		key := e.Name()
+		// 跳过账号密钥、验证令牌和健康检查文件
+		if e.IsDir() || key == "acme_account+key" || strings.HasSuffix(key, "+token") || key == "led-healthz" {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(dir, key))
+		if err != nil {
+			return nil, err
+		}
+		for {
+			var p *pem.Block
+			if p, b = pem.Decode(b); p == nil {
+				break
+			}
+			if p.Type != "CERTIFICATE" {
+				continue
+			}
+			c, err := x509.ParseCertificate(p.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("parse %s: %w", key, err)
+			}
+			cs = append(cs, certInfo{Key: key, Names: c.DNSNames, Issuer: c.Issuer.CommonName, NotAfter: c.NotAfter})
+			// 只需要第一张，之后是中间证书
+			break
+		}
+	}
+	slices.SortFunc(cs, func(a, b certInfo) int { return a.NotAfter.Compare(b.NotAfter) })
+	return cs, nil
+}
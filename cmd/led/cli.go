@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+
+	"github.com/taoso/led"
+	"github.com/taoso/led/store"
+)
+
+// command 子命令，run 的参数为子命令之后的参数
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+var commands = []command{
+	{"serve", "start the servers, which is the default", serve},
+	{"db", "db init|migrate [-repo token] [-dry-run]", dbCmd},
+	{"migrate", "same as db migrate", migrate},
+	{"ledger", "ledger verify [-alipay bill.csv] [-json]", ledger},
+	{"user", "user add [-cost 10] name < password", userCmd},
+	{"ticket", "ticket grant -token x -plan 2g -reason x", ticketCmd},
+	{"wallet", "wallet credit -id 1 -tokens 100 -reason x", walletCmd},
+	{"zone", "zone approve -domain x | zone suspend|resume -name x [-id 1] -reason x", zoneCmd},
+	{"cert", "cert list [-json]", certCmd},
+	{"config", "config check", configCmd},
+}
+
+func findCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+func usage() {
+	w := flag.CommandLine.Output()
+	fmt.Fprintf(w, "Usage: %s [flags] [command] [args]\n\nCommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-8s %s\n", c.name, c.usage)
+	}
+	fmt.Fprintf(w, "\nOther settings are read from environment variables.\n\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+// newProxy 按环境变量和配置文件创建 Proxy，服务和运维命令共用
+func newProxy() (*led.Proxy, error) {
+	proxy := &led.Proxy{
+		DavEvs: make(chan string, 1024),
+		Root:   root,
+	}
+	if err := setup(proxy); err != nil {
+		return nil, err
+	}
+	proxy.Loader = loadConfig
+	if _, err := proxy.Reload(); err != nil {
+		return nil, err
+	}
+	return proxy, nil
+}
+
+// cliActor 命令行的操作人为当前系统用户
+func cliActor() string {
+	if u, err := user.Current(); err == nil {
+		return "cli:" + u.Username
+	}
+	return "cli"
+}
+
+// audit 记录命令行执行的操作
+func audit(proxy *led.Proxy, action, target string, err error, detail any) {
+	proxy.Audit(context.Background(), store.Audit{
+		Actor:  cliActor(),
+		Action: action,
+		Target: target,
+		Agent:  "led-cli",
+	}, err, detail)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"os"
+
+	"github.com/taoso/led"
+	"github.com/taoso/led/store"
+)
+
+// ledger 核对 Token 账本，存在问题时返回错误
+//
+//	led ledger verify [-alipay bill.csv] [-json]
+func ledger(args []string) error {
+	if len(args) == 0 || args[0] != "verify" {
+		return errors.New("usage: led ledger verify [-alipay bill.csv] [-json]")
+	}
+
+	fs := flag.NewFlagSet("ledger verify", flag.ExitOnError)
+	bill := fs.String("alipay", "", "alipay bill csv to reconcile")
+	asJSON := fs.Bool("json", false, "print report as json")
+	fs.Parse(args[1:])
+
+	db := os.Getenv("TOKEN_REPO_DB")
+	if db == "" {
+		return errors.New("TOKEN_REPO_DB is not set")
+	}
+	repo := store.NewTokenRepo(db)
+
+	var in io.Reader
+	if *bill != "" {
+		f, err := os.Open(*bill)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	r, err := led.VerifyLedger(repo, in)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		e := json.NewEncoder(os.Stdout)
+		e.SetIndent("", "  ")
+		e.Encode(r)
+	} else {
+		r.WriteText(os.Stdout)
+	}
+
+	if len(r.Issues) > 0 {
+		return errors.New("ledger has issues")
+	}
+	return nil
+}
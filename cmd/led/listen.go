@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// listeners 监听的套接字，为空表示没有开启
+type listeners struct {
+	h1, h2 net.Listener
+	h3     net.PacketConn
+	sock   net.Listener // SOCK_PATH 监听的 unix socket
+}
+
+// 继承的套接字名称，与 systemd socket 中的 FileDescriptorName 一致
+const (
+	fdHTTP1 = "http1"
+	fdHTTP2 = "http2"
+	fdHTTP3 = "http3"
+	fdSock  = "sock"
+)
+
+// listenFdsStart systemd 传递的第一个 fd
+const listenFdsStart = 3
+
+// inheritFiles 读取 systemd socket activation 或者父进程传递的套接字。
+//
+// LISTEN_FDS 为套接字数量，从 fd 3 开始；LISTEN_FDNAMES 为冒号分隔的名称。
+// LISTEN_PID 不为空时必须是当前进程。读取后清除这些环境变量，避免传给子进程。
+func inheritFiles() (map[string]*os.File, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	v := os.Getenv("LISTEN_FDS")
+	if v == "" {
+		return nil, nil
+	}
+	if pid := os.Getenv("LISTEN_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q: %w", v, err)
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	files := map[string]*os.File{}
+	for i := range n {
+		fd := listenFdsStart + i
+		syscall.CloseOnExec(fd)
+
+		var name string
+		if i < len(names) {
+			name = names[i]
+		}
+		switch name {
+		case fdHTTP1, fdHTTP2, fdHTTP3, fdSock:
+			files[name] = os.NewFile(uintptr(fd), name)
+		default:
+			slog.Warn("unknown inherited socket", "fd", fd, "name", name)
+		}
+	}
+	return files, nil
+}
+
+// listen 优先使用继承的套接字，没有时按命令行参数监听
+func listen() (ls listeners, err error) {
+	files, err := inheritFiles()
+	if err != nil {
+		return
+	}
+
+	if ls.h1, err = listenTCP(files[fdHTTP1], flags.http1); err != nil {
+		return
+	}
+	if ls.h2, err = listenTCP(files[fdHTTP2], flags.http2); err != nil {
+		return
+	}
+
+	if f := files[fdHTTP3]; f != nil {
+		ls.h3, err = net.FilePacketConn(f)
+		f.Close()
+	} else if flags.http3 != "" {
+		ls.h3, err = net.ListenPacket("udp", flags.http3)
+	}
+	if err != nil {
+		return
+	}
+
+	if f := files[fdSock]; f != nil {
+		ls.sock, err = net.FileListener(f)
+		f.Close()
+	} else if sk := os.Getenv("SOCK_PATH"); sk != "" {
+		ls.sock, err = listenUnix(sk)
+	}
+	return
+}
+
+func listenTCP(f *os.File, addr string) (net.Listener, error) {
+	if f != nil {
+		defer f.Close()
+		return net.FileListener(f)
+	}
+	if addr == "" {
+		return nil, nil
+	}
+	return net.Listen("tcp", addr)
+}
+
+func listenUnix(path string) (net.Listener, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("remove old socket %s: %w", path, err)
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("listen on unix socket %s: %w", path, err)
+	}
+
+	if err := os.Chmod(path, os.FileMode(0666)); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("chmod unix socket %s: %w", path, err)
+	}
+	return ln, nil
+}
+
+type filer interface {
+	File() (*os.File, error)
+}
+
+// upgrade 启动新的进程并传递所有监听的套接字，用于不中断连接的重启。
+// 新进程启动后，当前进程需要停止接受连接并等待已有请求结束。
+//
+// h3 的 UDP 套接字由新旧进程共享，新进程无法识别旧进程的 QUIC 连接，
+// 所以 h3 的已有连接可能会中断，客户端会自动重连。
+func upgrade(ls listeners) (*os.Process, error) {
+	var names []string
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	for _, l := range []struct {
+		name string
+		v    any
+	}{
+		{fdHTTP1, ls.h1},
+		{fdHTTP2, ls.h2},
+		{fdHTTP3, ls.h3},
+		{fdSock, ls.sock},
+	} {
+		if l.v == nil {
+			continue
+		}
+		// 旧进程关闭时不能删除 unix socket 文件
+		if ul, ok := l.v.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+		fl, ok := l.v.(filer)
+		if !ok {
+			return nil, errors.New("can not get file of " + l.name)
+		}
+		f, err := fl.File()
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, l.name)
+		files = append(files, f)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	// WATCHDOG_PID 是旧进程的 pid，新进程启动后才知道自己的 pid，所以不再传递，
+	// 否则新进程不会给 watchdog 发心跳
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "WATCHDOG_PID=") {
+			env = append(env, kv)
+		}
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(env,
+		"LISTEN_FDS="+strconv.Itoa(len(files)),
+		"LISTEN_FDNAMES="+strings.Join(names, ":"),
+	)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return cmd.Process, nil
+}
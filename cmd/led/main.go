@@ -8,23 +8,24 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/CAFxX/httpcompression"
-	"github.com/gorilla/handlers"
 	"github.com/pires/go-proxyproto"
 	"github.com/quic-go/quic-go/http3"
 	"github.com/taoso/led"
 	"github.com/taoso/led/pay"
 	"github.com/taoso/led/store"
-	"github.com/taoso/led/tiktoken"
+	"github.com/taoso/led/trace"
 	"golang.org/x/crypto/acme/autocert"
 	"golang.org/x/net/idna"
 )
@@ -33,6 +34,7 @@ var root, sites, users string
 
 var flags struct {
 	http1, http2, http3 string
+	metrics             string
 }
 
 func init() {
@@ -42,57 +44,129 @@ func init() {
 	flag.StringVar(&flags.http1, "http1", "", "listen address for http1")
 	flag.StringVar(&flags.http2, "http2", "", "listen address for http2")
 	flag.StringVar(&flags.http3, "http3", "", "listen address for http3")
+	flag.StringVar(&flags.metrics, "metrics", "", "listen address for prometheus metrics and health checks, such as 127.0.0.1:9100")
 
 	log.SetOutput(os.Stderr)
 }
 
-func listen() (h1, h2 net.Listener, h3 net.PacketConn, err error) {
-	if flags.http1 != "" {
-		h1, err = net.Listen("tcp", flags.http1)
-		if err != nil {
-			return
-		}
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	// LOG_FORMAT 为 json 或 text，LOG_LEVEL 为 debug、info、warn 或 error
+	lh, err := led.NewLogHandler(os.Stderr, os.Getenv("LOG_FORMAT"), os.Getenv("LOG_LEVEL"))
+	if err != nil {
+		log.Fatal(err)
 	}
-	if flags.http2 != "" {
-		h2, err = net.Listen("tcp", flags.http2)
-		if err != nil {
-			return
-		}
+	slog.SetDefault(slog.New(lh))
+
+	// 多实例共享数据库时可关闭自动迁移，改为手工执行 led migrate
+	store.AutoMigrate = os.Getenv("DB_AUTO_MIGRATE") != "0"
+
+	// 没有子命令时启动服务，兼容原有的启动参数
+	name, args := "serve", flag.Args()
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
 	}
-	if flags.http3 != "" {
-		h3, err = net.ListenPacket("udp", flags.http3)
+	cmd := findCommand(name)
+	if cmd == nil {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := cmd.run(args); err != nil {
+		log.Fatal(err)
 	}
-	return
 }
 
-func main() {
-	flag.Parse()
+// serve 启动服务，启动参数也可以放在 serve 之后
+//
+//	led serve [-http1 :80] [-http2 :443] [-http3 :443] [-metrics 127.0.0.1:9100]
+func serve(args []string) error {
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return err
+	}
+
+	var err error
+	var tracer *trace.Tracer
+	// OTEL_EXPORTER_OTLP_ENDPOINT 为 OTLP/HTTP 地址，如 http://127.0.0.1:4318
+	if ep := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); ep != "" {
+		ratio := 1.0
+		if v := os.Getenv("OTEL_TRACES_SAMPLER_ARG"); v != "" {
+			if ratio, err = strconv.ParseFloat(v, 64); err != nil {
+				log.Fatal("invalid OTEL_TRACES_SAMPLER_ARG: ", err)
+			}
+		}
+		service := os.Getenv("OTEL_SERVICE_NAME")
+		if service == "" {
+			service = "led"
+		}
+		tracer = trace.Setup(&trace.OTLP{
+			Endpoint: ep,
+			Service:  service,
+			Headers:  trace.ParseHeaders(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS")),
+		}, ratio)
+	}
 
-	lnH1, lnH2, lnH3, err := listen()
+	ls, err := listen()
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	proxy := &led.Proxy{
-		DavEvs: make(chan string, 1024),
-		Root:   root,
+	proxy, err := newProxy()
+	if err != nil {
+		return err
+	}
+	if err := proxy.InitZzAuth(); err != nil {
+		return err
+	}
+
+	if proxy.TicketRepo != nil {
+		go proxy.WatchTickets(1 * time.Hour)
 	}
 
-	if err := load(proxy); err != nil {
-		panic(err)
+	if host := os.Getenv("STATEMENT_HOST"); host != "" && proxy.TokenRepo != nil {
+		go proxy.SendStatements(host, 1*time.Hour)
+	}
+
+	if proxy.OrderRepo != nil {
+		go proxy.ReconcileOrders(1 * time.Minute)
+		go proxy.DeliverWebhooks(10 * time.Second)
 	}
 
 	sg := make(chan os.Signal, 3)
 	signal.Notify(sg, syscall.SIGHUP)
 	go func() {
 		for range sg {
-			if err := load(proxy); err != nil {
-				log.Println("load err:", err)
-			}
+			reload(proxy, "signal")
 		}
 	}()
 
-	h := handlers.VhostCombinedLoggingHandler(os.Stdout, proxy)
+	// RELOAD_WATCH 为检查配置文件修改的间隔，如 5s，为空时只在 SIGHUP 时重新加载
+	if v := os.Getenv("RELOAD_WATCH"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatal("invalid RELOAD_WATCH: ", err)
+		}
+		go watchConfig(proxy, d)
+	}
+
+	certDir := certCacheDir()
+
+	health := &led.Health{
+		Checks:   healthChecks(proxy, ls.h2 != nil || ls.h3 != nil || ls.sock != nil),
+		Interval: 10 * time.Second,
+	}
+	go health.Run(context.Background())
+
+	if d := sdWatchdog(); d > 0 {
+		go watchdog(d, health.Alive)
+	}
+
+	if flags.metrics != "" {
+		go serveAdmin(flags.metrics, proxy, health)
+	}
+
+	h := proxy.Trace(led.LogRequests(proxy.Instrument(proxy)))
 
 	ch, err := httpcompression.DefaultAdapter(
 		httpcompression.MinSize(1024),
@@ -112,21 +186,32 @@ func main() {
 		}, false),
 	)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	h = ch(h)
 
 	wg := sync.WaitGroup{}
+	serve := func(name string, f func() error) {
+		wg.Go(func() {
+			if err := f(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("serve error", "server", name, "err", err)
+			}
+		})
+	}
+
+	var servers []*http.Server
 
-	if lnH1 != nil {
-		wg.Go(func() { http.Serve(lnH1, h) })
+	if ls.h1 != nil {
+		s1 := &http.Server{Handler: h}
+		servers = append(servers, s1)
+		serve(fdHTTP1, func() error { return s1.Serve(ls.h1) })
 	}
 
 	// http2 or http3
 	acm := autocert.Manager{
 		Prompt: autocert.AcceptTOS,
-		Cache:  autocert.DirCache(os.Getenv("HOME") + "/.autocert"),
+		Cache:  certCache{certDir},
 		HostPolicy: func(ctx context.Context, host string) error {
 			host, err := idna.ToUnicode(host)
 			if err != nil {
@@ -140,99 +225,151 @@ func main() {
 	}
 
 	tlsCfg := acm.TLSConfig()
+	countCertErrors(tlsCfg)
 
-	if lnH3 != nil {
-		p := lnH3.LocalAddr().(*net.UDPAddr).Port
+	var h3 *http3.Server
+	if ls.h3 != nil {
+		p := ls.h3.LocalAddr().(*net.UDPAddr).Port
 		proxy.AltSvc = fmt.Sprintf(`h3=":%d"`, p)
 
-		h3 := http3.Server{
+		h3 = &http3.Server{
 			Handler:         h,
 			TLSConfig:       tlsCfg,
 			EnableDatagrams: true,
 		}
-		wg.Go(func() { h3.Serve(lnH3) })
+		serve(fdHTTP3, func() error { return h3.Serve(ls.h3) })
 	}
 
-	s := http.Server{
+	s := &http.Server{
 		Handler:     h,
 		IdleTimeout: 30 * time.Second,
 	}
 
-	if sk := os.Getenv("SOCK_PATH"); sk != "" {
-		if err := os.Remove(sk); err != nil && !os.IsNotExist(err) {
-			log.Fatal("Error removing old socket", sk, err)
-		}
+	if ls.sock != nil {
+		pln := &proxyproto.Listener{Listener: ls.sock}
+		servers = append(servers, s)
+		serve(fdSock, func() error { return s.Serve(tls.NewListener(pln, tlsCfg)) })
+	} else if ls.h2 != nil {
+		servers = append(servers, s)
+		serve(fdHTTP2, func() error { return s.Serve(tls.NewListener(ls.h2, tlsCfg)) })
+	}
 
-		ln, err := net.Listen("unix", sk)
-		if err != nil {
-			log.Fatal("Error listening on Unix socket", sk, err)
-		}
+	health.SetReady(true)
+	sdNotify("READY=1")
 
-		if err := os.Chmod(sk, os.FileMode(0666)); err != nil {
-			log.Fatal("Error changing mode on Unix socket", sk, err)
+	// SIGTERM 和 SIGINT 停止服务，SIGUSR2 启动新进程接管监听的套接字后停止服务
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR2)
+	handoff := false
+	for sig := range stop {
+		if sig == syscall.SIGUSR2 {
+			p, err := upgrade(ls)
+			if err != nil {
+				slog.Error("upgrade error", "err", err)
+				continue
+			}
+			slog.Info("new process started", "pid", p.Pid)
+			// 由新进程通知 systemd 就绪，需要设置 NotifyAccess=all
+			sdNotify("MAINPID=" + strconv.Itoa(p.Pid))
+			handoff = true
 		}
+		slog.Info("shutting down", "signal", sig.String())
+		break
+	}
+	signal.Stop(stop)
 
-		pln := &proxyproto.Listener{Listener: ln}
-		defer pln.Close()
-		wg.Go(func() { s.Serve(tls.NewListener(pln, tlsCfg)) })
-	} else if lnH2 != nil {
-		wg.Go(func() { s.Serve(tls.NewListener(lnH2, tlsCfg)) })
+	health.SetReady(false)
+	// 已经交给新进程时不能通知 STOPPING，否则 systemd 会停止新的主进程
+	if !handoff {
+		sdNotify("STOPPING=1")
 	}
-	wg.Wait()
-}
 
-func load(proxy *led.Proxy) error {
-	if tk := os.Getenv("TIKTOKEN_FILE"); tk != "" {
-		bpes := map[string]*tiktoken.BPE{}
-		for _, kv := range strings.Split(tk, ",") {
-			name := "cl100k_base"
-			path := kv
-			if ps := strings.Split(kv, "="); len(ps) == 2 {
-				name = ps[0]
-				path = ps[1]
-			}
-			f, err := os.Open(path)
-			if err != nil {
-				return err
-			}
-			defer f.Close()
-			bpe, err := tiktoken.NewCL100K(f)
-			if err != nil {
-				return err
-			}
-			bpes[name] = bpe
-		}
+	shutdown(shutdownTimeout(), proxy, h3, servers...)
+	wg.Wait()
 
-		proxy.BPEs = bpes
+	if tracer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		tracer.Shutdown(ctx)
 	}
+	return nil
+}
 
+// setup 根据环境变量启用支付渠道和数据库等，只在启动时执行一次。
+// 环境变量在运行期间不会变化，热加载时继续使用这些资源。
+func setup(proxy *led.Proxy) error {
 	if id := os.Getenv("ALIPAY_APP_ID"); id != "" {
-		proxy.Alipay = pay.New(
+		proxy.AddPayment(pay.New(
 			id,
 			os.Getenv("ALIPAY_PRIVATE_KEY"),
 			os.Getenv("ALIPAY_PUBLIC_KEY"),
+		))
+	}
+
+	if id := os.Getenv("WECHAT_MCH_ID"); id != "" {
+		// 微信回传参数最长 128 字节，放不下 Token 和流量订单的参数，需要保存在订单库中
+		if os.Getenv("ORDER_REPO_DB") == "" {
+			return errors.New("WECHAT_MCH_ID requires ORDER_REPO_DB")
+		}
+		wx, err := pay.NewWechatPay(
+			os.Getenv("WECHAT_APP_ID"),
+			id,
+			os.Getenv("WECHAT_MCH_SERIAL"),
+			os.Getenv("WECHAT_PRIVATE_KEY"),
+			os.Getenv("WECHAT_API_KEY"),
+			os.Getenv("WECHAT_PLATFORM_KEY"),
 		)
+		if err != nil {
+			return err
+		}
+		proxy.AddPayment(wx)
+	}
+
+	if key := os.Getenv("STRIPE_SECRET_KEY"); key != "" {
+		proxy.AddPayment(&pay.Stripe{
+			SecretKey:     key,
+			WebhookSecret: os.Getenv("STRIPE_WEBHOOK_SECRET"),
+			Currency:      os.Getenv("STRIPE_CURRENCY"),
+			SuccessURL:    os.Getenv("STRIPE_SUCCESS_URL"),
+		})
 	}
 
 	if db := os.Getenv("TOKEN_REPO_DB"); db != "" {
-		proxy.TokenRepo = store.NewTokenRepo(db)
+		repo := store.NewTokenRepo(db)
+		policy, err := referralPolicy()
+		if err != nil {
+			return err
+		}
+		repo.SetReferralPolicy(policy)
+		proxy.TokenRepo = repo
 	}
 
 	if db := os.Getenv("TICKET_REPO_DB"); db != "" {
 		proxy.TicketRepo = store.NewTicketRepo(db)
 	}
 
-	d, err := loadfile(users)
-	if err != nil {
-		return err
+	if db := os.Getenv("ORDER_REPO_DB"); db != "" {
+		proxy.OrderRepo = store.NewOrderRepo(db)
 	}
-	proxy.SetUsers(d)
 
-	d, err = loadfile(sites)
-	if err != nil {
-		return err
+	if db := os.Getenv("APP_REPO_DB"); db != "" {
+		proxy.AppRepo = store.NewAppRepo(db)
+	}
+
+	if db := os.Getenv("AUDIT_REPO_DB"); db != "" {
+		proxy.AuditRepo = store.NewAuditRepo(db)
+	}
+
+	if db := os.Getenv("USAGE_REPO_DB"); db != "" {
+		proxy.UsageRepo = store.NewUsageRepo(db)
+	}
+
+	// 收据链接单独签名，与启用了哪些数据库无关
+	if key := os.Getenv("RECEIPT_SIGN_KEY"); key != "" {
+		if err := proxy.SetReceiptKey(key); err != nil {
+			return fmt.Errorf("invalid RECEIPT_SIGN_KEY: %w", err)
+		}
 	}
-	proxy.SetSites(d)
 
 	if db := os.Getenv("ZONE_REPO_DB"); db != "" {
 		proxy.ZoneRepo = store.NewZoneRepo(db)
@@ -244,10 +381,6 @@ func load(proxy *led.Proxy) error {
 		proxy.ZnsUpstream = up
 	}
 
-	if err := proxy.InitZzAuth(); err != nil {
-		return err
-	}
-
 	return nil
 }
 
@@ -275,3 +408,33 @@ func loadfile(path string) (map[string]string, error) {
 	}
 	return kv, nil
 }
+
+// referralPolicy 读取邀请奖励规则，没有配置的使用默认值
+func referralPolicy() (p store.ReferralPolicy, err error) {
+	p = store.DefaultReferralPolicy
+	if v := os.Getenv("REFERRAL_PERCENT"); v != "" {
+		if p.Percent, err = strconv.Atoi(v); err != nil {
+			return
+		}
+		if p.Percent < 0 || p.Percent > 100 {
+			return p, fmt.Errorf("REFERRAL_PERCENT must be in [0, 100], got %d", p.Percent)
+		}
+	}
+	if v := os.Getenv("REFERRAL_CAP"); v != "" {
+		if p.Cap, err = strconv.Atoi(v); err != nil {
+			return
+		}
+		if p.Cap < 0 {
+			return p, fmt.Errorf("REFERRAL_CAP must not be negative, got %d", p.Cap)
+		}
+	}
+	if v := os.Getenv("REFERRAL_WINDOW"); v != "" {
+		if p.Window, err = time.ParseDuration(v); err != nil {
+			return
+		}
+		if p.Window < 0 {
+			return p, fmt.Errorf("REFERRAL_WINDOW must not be negative, got %s", p.Window)
+		}
+	}
+	return
+}
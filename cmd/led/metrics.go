@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/taoso/led"
+	"github.com/taoso/led/metrics"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/sys/unix"
+)
+
+var certEvents = metrics.NewCounter("led_autocert_events_total",
+	"Autocert events, issued for new or renewed certificates and error for failed handshakes.", "event")
+
+// certCache 统计 autocert 签发的证书，账号密钥和验证令牌不计入
+type certCache struct {
+	autocert.Cache
+}
+
+func (c certCache) Put(ctx context.Context, key string, data []byte) error {
+	err := c.Cache.Put(ctx, key, data)
+	if err == nil && (!strings.Contains(key, "+") || strings.HasSuffix(key, "+rsa")) {
+		certEvents.Inc("issued")
+	}
+	return err
+}
+
+// countCertErrors 统计获取证书失败的次数
+func countCertErrors(cfg *tls.Config) {
+	get := cfg.GetCertificate
+	cfg.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		c, err := get(hello)
+		if err != nil {
+			certEvents.Inc("error")
+		}
+		return c, err
+	}
+}
+
+// checkCertCache 检查证书缓存可以读写
+func checkCertCache(c autocert.Cache) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		const key = "led-healthz"
+		if err := c.Put(ctx, key, []byte("ok")); err != nil {
+			return err
+		}
+		if _, err := c.Get(ctx, key); err != nil {
+			return err
+		}
+		return c.Delete(ctx, key)
+	}
+}
+
+// checkCertDir 只检查证书缓存目录的读写权限，不写入文件。
+// 目录不存在时 autocert 会在第一次写入时创建，改为检查上级目录。
+func checkCertDir(dir string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		if _, err := os.Stat(dir); errors.Is(err, fs.ErrNotExist) {
+			dir = filepath.Dir(dir)
+		}
+		return unix.Access(dir, unix.R_OK|unix.W_OK)
+	}
+}
+
+// healthChecks 返回 proxy 的检查项，开启 TLS 时检查证书缓存
+func healthChecks(proxy *led.Proxy, useTLS bool) []led.HealthCheck {
+	var names []string
+	for name := range tiktokenFiles() {
+		names = append(names, name)
+	}
+	cs := proxy.HealthChecks(names)
+	if useTLS {
+		cs = append(cs, led.HealthCheck{Name: "autocert", Run: checkCertCache(certCacheDir())})
+	}
+	return cs
+}
+
+// serveAdmin 在单独的管理端口提供 /metrics、/healthz 和 /readyz，不要暴露到公网
+func serveAdmin(addr string, proxy *led.Proxy, health *led.Health) {
+	metrics.NewGaugeFunc("led_dav_events_queued", "DAV events waiting in DavEvs.", func() float64 {
+		return float64(len(proxy.DavEvs))
+	})
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/healthz", health.Healthz)
+	mux.HandleFunc("/readyz", health.Readyz)
+	slog.Info("admin listen", "addr", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		slog.Error("admin server error", "err", err)
+	}
+}
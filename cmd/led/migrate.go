@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/taoso/led/store"
+)
+
+// repoDBs 各仓库对应的数据库环境变量
+var repoDBs = []struct{ repo, env string }{
+	{"token", "TOKEN_REPO_DB"},
+	{"ticket", "TICKET_REPO_DB"},
+	{"usage", "USAGE_REPO_DB"},
+	{"zone", "ZONE_REPO_DB"},
+	{"order", "ORDER_REPO_DB"},
+	{"app", "APP_REPO_DB"},
+	{"audit", "AUDIT_REPO_DB"},
+}
+
+// dbCmd 管理数据库，init 和 migrate 都会执行所有未执行的迁移，
+// init 要求至少配置了一个数据库，用于新部署时建表
+//
+//	led db init [-repo token]
+//	led db migrate [-repo token] [-dry-run]
+func dbCmd(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: led db init|migrate [-repo token] [-dry-run]")
+	}
+	switch args[0] {
+	case "init":
+		n := 0
+		for _, r := range repoDBs {
+			if os.Getenv(r.env) != "" {
+				n++
+			}
+		}
+		if n == 0 {
+			return errors.New("no database is configured, set TOKEN_REPO_DB and the like")
+		}
+		return migrate(args[1:])
+	case "migrate":
+		return migrate(args[1:])
+	default:
+		return fmt.Errorf("unknown db command %q", args[0])
+	}
+}
+
+// migrate 执行所有已配置仓库的数据库迁移
+//
+//	led migrate [-repo token] [-dry-run]
+func migrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "only print pending migrations")
+	repo := fs.String("repo", "", "only migrate the repo, such as token or ticket")
+	fs.Parse(args)
+
+	found := *repo == ""
+	for _, r := range repoDBs {
+		if *repo != "" && r.repo != *repo {
+			continue
+		}
+		found = true
+		dsn := os.Getenv(r.env)
+		if dsn == "" {
+			if *repo != "" {
+				return fmt.Errorf("%s is not set", r.env)
+			}
+			continue
+		}
+		db, err := store.Open(dsn)
+		if err != nil {
+			return err
+		}
+		v, err := db.Version(r.repo)
+		if err != nil {
+			db.Close()
+			return err
+		}
+		ms, err := db.Migrate(r.repo, *dryRun)
+		db.Close()
+		if err != nil {
+			return err
+		}
+
+		state := "applied"
+		if *dryRun {
+			state = "pending"
+		}
+		fmt.Printf("%s: version %d, %d %s\n", r.repo, v, len(ms), state)
+		for _, m := range ms {
+			fmt.Printf("  %d %s\n", m.Version, m.Name)
+		}
+	}
+	if !found {
+		return fmt.Errorf("unknown repo %q", *repo)
+	}
+	return nil
+}
+
+// pendingMigrations 打印各仓库待执行的迁移并返回总数，不修改数据库。
+// SQLite 文件不存在时不打开，避免创建空库，此时所有迁移都待执行。
+func pendingMigrations() (n int, err error) {
+	for _, r := range repoDBs {
+		dsn := os.Getenv(r.env)
+		if dsn == "" {
+			continue
+		}
+		if path, ok := sqlitePath(dsn); ok {
+			if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+				fmt.Printf("%s: %s does not exist\n", r.repo, path)
+				n += len(store.Migrations[r.repo])
+				continue
+			}
+		}
+
+		db, err := store.Open(dsn)
+		if err != nil {
+			return n, err
+		}
+		ms, err := db.Migrate(r.repo, true)
+		db.Close()
+		if err != nil {
+			return n, err
+		}
+		fmt.Printf("%s: %d pending migrations\n", r.repo, len(ms))
+		for _, m := range ms {
+			fmt.Printf("  %d %s\n", m.Version, m.Name)
+		}
+		n += len(ms)
+	}
+	return
+}
+
+// sqlitePath 返回 SQLite dsn 对应的文件路径，内存库和 PostgreSQL 返回 false
+func sqlitePath(dsn string) (string, bool) {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		return "", false
+	}
+	path, _, _ := strings.Cut(strings.TrimPrefix(dsn, "file:"), "?")
+	if path == "" || path == ":memory:" {
+		return "", false
+	}
+	return path, true
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/taoso/led/store"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func printJSON(v any) {
+	e := json.NewEncoder(os.Stdout)
+	e.SetIndent("", "  ")
+	e.Encode(v)
+}
+
+// userCmd 管理 users.txt 中的代理用户，密码从标准输入的第一行读取。
+// 正在运行的服务收到 SIGHUP 或者开启 RELOAD_WATCH 后生效。
+//
+//	echo pass | led -users users.txt user add [-cost 10] name
+func userCmd(args []string) error {
+	if len(args) == 0 || args[0] != "add" {
+		return errors.New("usage: led -users users.txt user add [-cost 10] name < password")
+	}
+
+	fs := flag.NewFlagSet("user add", flag.ExitOnError)
+	cost := fs.Int("cost", bcrypt.DefaultCost, "bcrypt cost")
+	fs.Parse(args[1:])
+
+	name := fs.Arg(0)
+	if users == "" {
+		return errors.New("-users is required")
+	}
+	if name == "" || strings.ContainsAny(name, ":\r\n") || strings.HasPrefix(name, "#") {
+		return fmt.Errorf("invalid user name %q", name)
+	}
+
+	pass, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	pass = strings.TrimRight(pass, "\r\n")
+	if pass == "" {
+		return errors.New("password is required on stdin")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(pass), *cost)
+	if err != nil {
+		return err
+	}
+	added, err := setUser(users, name, string(hash))
+	if err != nil {
+		return err
+	}
+	if added {
+		fmt.Printf("user %s added\n", name)
+	} else {
+		fmt.Printf("user %s updated\n", name)
+	}
+	return nil
+}
+
+// setUser 添加或替换 path 中 name 的密码哈希，通过临时文件原子替换
+func setUser(path, name, hash string) (added bool, err error) {
+	b, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+	mode := os.FileMode(0600)
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode().Perm()
+	}
+
+	var lines []string
+	if len(b) > 0 {
+		lines = strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	}
+	added = true
+	for i, l := range lines {
+		if strings.HasPrefix(l, "#") {
+			continue
+		}
+		if n, _, _ := strings.Cut(l, ":"); n == name {
+			lines[i] = name + ":" + hash
+			added = false
+		}
+	}
+	if added {
+		lines = append(lines, name+":"+hash)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), ".users-*")
+	if err != nil {
+		return
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.WriteString(strings.Join(lines, "\n") + "\n"); err != nil {
+		f.Close()
+		return
+	}
+	if err = f.Chmod(mode); err != nil {
+		f.Close()
+		return
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+	err = os.Rename(f.Name(), path)
+	return
+}
+
+// ticketCmd 赠送流量套餐，套餐来自 TICKET_PLANS，可以赠送已下架的套餐
+//
+//	led ticket grant -token x -plan 2g -reason x
+func ticketCmd(args []string) error {
+	if len(args) == 0 || args[0] != "grant" {
+		return errors.New("usage: led ticket grant -token x -plan 2g -reason x")
+	}
+
+	fs := flag.NewFlagSet("ticket grant", flag.ExitOnError)
+	token := fs.String("token", "", "proxy token")
+	plan := fs.String("plan", "", "plan id")
+	reason := fs.String("reason", "", "reason of the grant")
+	fs.Parse(args[1:])
+
+	if *token == "" || *plan == "" || *reason == "" {
+		return errors.New("token, plan and reason are required")
+	}
+
+	proxy, err := newProxy()
+	if err != nil {
+		return err
+	}
+
+	trade := "grant-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	t, err := proxy.GrantTicket(*token, *plan, trade)
+	if err != nil {
+		return err
+	}
+	audit(proxy, "ticket.grant", "ticket:"+strconv.Itoa(t.ID), nil, map[string]string{
+		"plan":   *plan,
+		"reason": *reason,
+	})
+	printJSON(t)
+	return nil
+}
+
+// walletCmd 调整钱包的 Token 数量，tokens 为负数时扣减
+//
+//	led wallet credit -id 1 -tokens 100 -reason x
+func walletCmd(args []string) error {
+	if len(args) == 0 || args[0] != "credit" {
+		return errors.New("usage: led wallet credit -id 1 -tokens 100 -reason x")
+	}
+
+	fs := flag.NewFlagSet("wallet credit", flag.ExitOnError)
+	id := fs.Int("id", 0, "wallet id")
+	tokens := fs.Int("tokens", 0, "tokens to add, negative to deduct")
+	reason := fs.String("reason", "", "reason of the adjustment")
+	fs.Parse(args[1:])
+
+	if *id <= 0 || *tokens == 0 || *reason == "" {
+		return errors.New("id, tokens and reason are required")
+	}
+
+	proxy, err := newProxy()
+	if err != nil {
+		return err
+	}
+	if proxy.TokenRepo == nil {
+		return errors.New("TOKEN_REPO_DB is not set")
+	}
+
+	w, err := proxy.TokenRepo.GetWallet(*id)
+	if err != nil {
+		return err
+	}
+	if w.ID == 0 {
+		return errors.New("wallet not found")
+	}
+
+	l := store.TokenLog{
+		UserID:   *id,
+		Type:     store.LogTypeAdjust,
+		TokenNum: *tokens,
+		Extra:    store.KV{"admin": cliActor(), "reason": *reason},
+		Created:  time.Now(),
+	}
+	if w, err = proxy.TokenRepo.UpdateWallet(&l); err != nil {
+		return err
+	}
+	audit(proxy, "wallet.adjust", "wallet:"+strconv.Itoa(w.ID), nil, map[string]any{
+		"user_id": *id,
+		"tokens":  *tokens,
+		"reason":  *reason,
+	})
+	printJSON(w)
+	return nil
+}
+
+// zoneCmd 审核 zz.ac 域名申请，暂停或者恢复域名解析
+//
+//	led zone approve -domain x
+//	led zone suspend -name x [-id 1] -reason x
+//	led zone resume -name x [-id 1] -reason x
+func zoneCmd(args []string) error {
+	usage := errors.New("usage: led zone approve -domain x | led zone suspend|resume -name x [-id 1] -reason x")
+	if len(args) == 0 {
+		return usage
+	}
+
+	fs := flag.NewFlagSet("zone "+args[0], flag.ExitOnError)
+	domain := fs.String("domain", "", "domain of the application")
+	name := fs.String("name", "", "zone name")
+	id := fs.Int("id", 0, "zone id, required if there are many zones of name")
+	reason := fs.String("reason", "", "reason of the change")
+	fs.Parse(args[1:])
+
+	var status store.Status
+	switch args[0] {
+	case "approve":
+		if *domain == "" {
+			return errors.New("domain is required")
+		}
+	case "suspend":
+		status = store.StatusSuspended
+	case "resume":
+		status = store.StatusOK
+	default:
+		return usage
+	}
+
+	proxy, err := newProxy()
+	if err != nil {
+		return err
+	}
+	if proxy.ZoneRepo == nil {
+		return errors.New("ZONE_REPO_DB is not set")
+	}
+
+	if args[0] == "approve" {
+		// 创建域名需要 ZZ_APP_KEY
+		if err := proxy.InitZzAuth(); err != nil {
+			return err
+		}
+		z, err := proxy.ApproveZone(context.Background(), *domain)
+		if err != nil {
+			return err
+		}
+		audit(proxy, "zone.approve", "zone:"+z.Name, nil, map[string]int{"id": z.ID})
+		printJSON(z)
+		return nil
+	}
+
+	if *name == "" || *reason == "" {
+		return errors.New("name and reason are required")
+	}
+
+	zs, err := proxy.ZoneRepo.GetAll(*name)
+	if err != nil {
+		return err
+	}
+	var found []store.Zone
+	for _, z := range zs {
+		if z.Status != store.StatusDeleted && (*id == 0 || z.ID == *id) {
+			found = append(found, z)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return errors.New("zone not found")
+	case 1:
+	default:
+		return fmt.Errorf("%d zones of %s found, use -id to choose one", len(found), *name)
+	}
+
+	z := found[0]
+	from := z.Status
+	z.Status = status
+	if err := proxy.ZoneRepo.Update(&z); err != nil {
+		return err
+	}
+	audit(proxy, "zone."+args[0], "zone:"+z.Name, nil, map[string]any{
+		"id":     z.ID,
+		"from":   from,
+		"reason": *reason,
+	})
+	printJSON(z)
+	return nil
+}
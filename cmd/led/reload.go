@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/taoso/led"
+	"github.com/taoso/led/store"
+	"github.com/taoso/led/tiktoken"
+)
+
+// tiktokenFiles 解析 TIKTOKEN_FILE，格式为 name=path,...，省略名称时为 cl100k_base
+func tiktokenFiles() map[string]string {
+	files := map[string]string{}
+	tk := os.Getenv("TIKTOKEN_FILE")
+	if tk == "" {
+		return files
+	}
+	for _, kv := range strings.Split(tk, ",") {
+		name := "cl100k_base"
+		path := kv
+		if ps := strings.Split(kv, "="); len(ps) == 2 {
+			name = ps[0]
+			path = ps[1]
+		}
+		files[name] = path
+	}
+	return files
+}
+
+// loadConfig 读取可以热加载的配置文件
+func loadConfig() (c led.Config, err error) {
+	c.BPEs = map[string]*tiktoken.BPE{}
+	for name, path := range tiktokenFiles() {
+		f, err := os.Open(path)
+		if err != nil {
+			return c, err
+		}
+		bpe, err := tiktoken.NewCL100K(f)
+		f.Close()
+		if err != nil {
+			return c, err
+		}
+		c.BPEs[name] = bpe
+	}
+
+	if path := os.Getenv("TICKET_PLANS"); path != "" {
+		if c.Plans, err = os.ReadFile(path); err != nil {
+			return
+		}
+	}
+
+	if c.Users, err = loadfile(users); err != nil {
+		return
+	}
+	c.Sites, err = loadfile(sites)
+	return
+}
+
+// reload 重新加载配置并记录结果，from 为触发的来源
+func reload(proxy *led.Proxy, from string) {
+	sdReloading()
+	defer sdNotify("READY=1")
+
+	r, err := proxy.Reload()
+	if err != nil {
+		slog.Error("reload config error", "from", from, "err", err)
+		return
+	}
+	slog.Info("config reloaded", "from", from,
+		"users", r.Users, "sites", r.Sites, "bpes", r.BPEs, "plans", r.Plans)
+}
+
+// configFiles 返回需要监控的配置文件
+func configFiles() []string {
+	fs := []string{users, sites}
+	if path := os.Getenv("TICKET_PLANS"); path != "" {
+		fs = append(fs, path)
+	}
+	for _, path := range tiktokenFiles() {
+		fs = append(fs, path)
+	}
+	return fs
+}
+
+// modTimes 返回文件的修改时间，文件不存在时为零值
+func modTimes(files []string) map[string]time.Time {
+	ts := make(map[string]time.Time, len(files))
+	for _, f := range files {
+		if fi, err := os.Stat(f); err == nil {
+			ts[f] = fi.ModTime()
+		}
+	}
+	return ts
+}
+
+// watchConfig 每隔 d 检查一次配置文件，有修改时重新加载。
+// 编辑器保存文件时可能先清空再写入，所以等待一个间隔没有变化后再加载。
+func watchConfig(proxy *led.Proxy, d time.Duration) {
+	files := configFiles()
+	last := modTimes(files)
+	var pending map[string]time.Time
+	for range time.Tick(d) {
+		ts := modTimes(files)
+		if pending != nil && maps.EqualFunc(ts, pending, time.Time.Equal) {
+			pending = nil
+			last = ts
+			reload(proxy, "watch")
+			continue
+		}
+		if maps.EqualFunc(ts, last, time.Time.Equal) {
+			pending = nil
+		} else {
+			pending = ts
+		}
+	}
+}
+
+// configCmd 检查环境变量和配置文件，并执行一次健康检查。
+// 检查时不修改任何数据：不执行迁移，不创建数据库文件，不写证书缓存。
+//
+//	led -users users.txt -sites sites.txt config check
+func configCmd(args []string) error {
+	if len(args) == 0 || args[0] != "check" {
+		return errors.New("usage: led config check")
+	}
+
+	for _, env := range []string{"SHUTDOWN_TIMEOUT", "RELOAD_WATCH"} {
+		if v := os.Getenv(env); v != "" {
+			if _, err := time.ParseDuration(v); err != nil {
+				return fmt.Errorf("invalid %s: %w", env, err)
+			}
+		}
+	}
+
+	store.AutoMigrate = false
+	n, err := pendingMigrations()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return fmt.Errorf("%d pending migrations, run led migrate before checking the rest", n)
+	}
+
+	proxy, err := newProxy()
+	if err != nil {
+		return err
+	}
+	if err := proxy.InitZzAuth(); err != nil {
+		return fmt.Errorf("oidc discovery: %w", err)
+	}
+
+	if r := proxy.LastReload(); r != nil {
+		fmt.Printf("users: %d, sites: %d, bpes: %d\n", len(r.Users.Added), len(r.Sites.Added), len(r.BPEs.Added))
+	}
+
+	checks := healthChecks(proxy, false)
+	if flags.http2 != "" || flags.http3 != "" || os.Getenv("SOCK_PATH") != "" {
+		checks = append(checks, led.HealthCheck{Name: "autocert", Run: checkCertDir(string(certCacheDir()))})
+	}
+	var failed int
+	for _, c := range checks {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := c.Run(ctx)
+		cancel()
+		if err != nil {
+			failed++
+			fmt.Printf("%s: %v\n", c.Name, err)
+		} else {
+			fmt.Printf("%s: ok\n", c.Name)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d checks failed", failed)
+	}
+	return nil
+}
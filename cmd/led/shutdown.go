@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/taoso/led"
+)
+
+// shutdownTimeout 等待已有请求结束的时间，可通过 SHUTDOWN_TIMEOUT 修改
+func shutdownTimeout() time.Duration {
+	if v := os.Getenv("SHUTDOWN_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err == nil {
+			return d
+		}
+		slog.Warn("invalid SHUTDOWN_TIMEOUT", "value", v, "err", err)
+	}
+	return 30 * time.Second
+}
+
+// shutdown 停止接受新连接，等待已有请求和代理隧道结束。
+// 超时后强制关闭剩余连接，然后等待处理函数退出，保证流量和 Token 完成结算。
+func shutdown(timeout time.Duration, proxy *led.Proxy, h3 *http3.Server, servers ...*http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		wg.Go(func() {
+			if err := s.Shutdown(ctx); err != nil {
+				slog.Warn("shutdown http server", "err", err)
+			}
+		})
+	}
+	if h3 != nil {
+		wg.Go(func() {
+			if err := h3.Shutdown(ctx); err != nil {
+				slog.Warn("shutdown http3 server", "err", err)
+			}
+		})
+	}
+	wg.Wait()
+
+	// Shutdown 不会等待被 Hijack 的 CONNECT 隧道
+	if err := proxy.Wait(ctx); err != nil {
+		slog.Warn("shutdown timeout, close remaining connections", "sessions", proxy.KillSessions())
+	}
+
+	for _, s := range servers {
+		s.Close()
+	}
+	if h3 != nil {
+		h3.Close()
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := proxy.Wait(ctx); err != nil {
+		slog.Error("requests are still running after shutdown", "err", err)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// sdNotify 向 systemd 发送状态，没有设置 NOTIFY_SOCKET 时忽略。
+// 常用的状态有 READY=1、RELOADING=1、STOPPING=1 和 WATCHDOG=1。
+func sdNotify(state string) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return
+	}
+	// 以 @ 开头的是 Linux 抽象套接字
+	if path[0] == '@' {
+		path = "\x00" + path[1:]
+	}
+
+	c, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		slog.Warn("sd_notify error", "state", state, "err", err)
+		return
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte(state)); err != nil {
+		slog.Warn("sd_notify error", "state", state, "err", err)
+	}
+}
+
+// sdReloading 开始重新加载配置，systemd 要求同时发送 CLOCK_MONOTONIC 时间
+func sdReloading() {
+	var ts unix.Timespec
+	unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts)
+	usec := ts.Nano() / int64(time.Microsecond)
+	sdNotify(fmt.Sprintf("RELOADING=1\nMONOTONIC_USEC=%d", usec))
+}
+
+// sdWatchdog 返回 systemd 要求的看门狗间隔，没有开启时为 0
+func sdWatchdog() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// watchdog 每隔半个看门狗间隔通知 systemd，健康检查卡住时停止通知，由 systemd 重启
+func watchdog(d time.Duration, alive func() bool) {
+	for range time.Tick(d / 2) {
+		if alive() {
+			sdNotify("WATCHDOG=1")
+		} else {
+			slog.Error("health checks are stuck, stop pinging watchdog")
+		}
+	}
+}
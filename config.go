@@ -0,0 +1,176 @@
+package led
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"time"
+
+	"github.com/taoso/led/tiktoken"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// config 可以热加载的配置，创建后只读，通过 Proxy.config 整体替换
+type config struct {
+	users   map[string]string
+	sites   map[string]*FileHandler
+	bpes    map[string]*tiktoken.BPE
+	tickets *ticketConfig
+}
+
+var emptyConfig config
+
+// conf 返回当前配置，请求处理过程中应该只读取一次
+func (p *Proxy) conf() *config {
+	if c := p.config.Load(); c != nil {
+		return c
+	}
+	return &emptyConfig
+}
+
+// update 修改当前配置的副本并替换
+func (p *Proxy) update(f func(c *config)) {
+	p.reloadMu.Lock()
+	defer p.reloadMu.Unlock()
+	c := *p.conf()
+	f(&c)
+	p.config.Store(&c)
+}
+
+// Config 热加载的配置内容，由 Proxy.Loader 读取
+type Config struct {
+	Users map[string]string        // users.txt，用户名到 bcrypt 哈希
+	Sites map[string]string        // sites.txt
+	BPEs  map[string]*tiktoken.BPE // TIKTOKEN_FILE
+	Plans []byte                   // TICKET_PLANS 的内容，为空时使用默认套餐
+}
+
+// ConfigDiff 配置的变化，只记录名称，不记录密码哈希等内容
+type ConfigDiff struct {
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+	Changed []string `json:"changed,omitempty"`
+}
+
+func diffMap[V any](old, new map[string]V, equal func(a, b V) bool) (d ConfigDiff) {
+	for _, k := range slices.Sorted(maps.Keys(new)) {
+		v, ok := old[k]
+		if !ok {
+			d.Added = append(d.Added, k)
+		} else if equal != nil && !equal(v, new[k]) {
+			d.Changed = append(d.Changed, k)
+		}
+	}
+	for _, k := range slices.Sorted(maps.Keys(old)) {
+		if _, ok := new[k]; !ok {
+			d.Removed = append(d.Removed, k)
+		}
+	}
+	return
+}
+
+// ReloadResult 一次热加载的结果
+type ReloadResult struct {
+	Time  time.Time  `json:"time"`
+	Error string     `json:"error,omitempty"`
+	Users ConfigDiff `json:"users"`
+	Sites ConfigDiff `json:"sites"`
+	BPEs  ConfigDiff `json:"bpes"`
+	Plans ConfigDiff `json:"plans"`
+}
+
+// Reload reads the config by p.Loader and validates it. The current config is
+// replaced only if everything is valid, otherwise it is kept unchanged.
+// Handlers of unchanged sites are reused to keep their WebDAV locks.
+func (p *Proxy) Reload() (r ReloadResult, err error) {
+	p.reloadMu.Lock()
+	defer p.reloadMu.Unlock()
+
+	r.Time = time.Now()
+	defer func() {
+		if err != nil {
+			r.Error = err.Error()
+		}
+		p.lastReload = &r
+		configReloads.Inc(result(err))
+	}()
+
+	if p.Loader == nil {
+		err = errors.New("config loader is not set")
+		return
+	}
+	nc, err := p.Loader()
+	if err != nil {
+		return
+	}
+
+	old := p.conf()
+	c, err := p.newConfig(old, nc)
+	if err != nil {
+		return
+	}
+
+	r.Users = diffMap(old.users, c.users, func(a, b string) bool { return a == b })
+	r.Sites = diffMap(old.sites, c.sites, nil)
+	r.BPEs = diffMap(old.bpes, c.bpes, nil)
+	r.Plans = diffMap(planMap(old.tickets), planMap(c.tickets), func(a, b ticketPlan) bool {
+		return reflect.DeepEqual(a, b)
+	})
+
+	p.config.Store(c)
+	return
+}
+
+// LastReload 返回最近一次热加载的结果，没有时为 nil
+func (p *Proxy) LastReload() *ReloadResult {
+	p.reloadMu.Lock()
+	defer p.reloadMu.Unlock()
+	return p.lastReload
+}
+
+func (p *Proxy) newConfig(old *config, nc Config) (*config, error) {
+	c := &config{users: nc.Users, bpes: nc.BPEs}
+
+	for name, hash := range nc.Users {
+		if hash == "" {
+			continue
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("invalid password hash of user %s: %w", name, err)
+		}
+	}
+
+	c.sites = make(map[string]*FileHandler, len(nc.Sites))
+	for name := range nc.Sites {
+		if name == "" {
+			return nil, errors.New("empty site name")
+		}
+		if h := old.sites[name]; h != nil {
+			c.sites[name] = h
+		} else {
+			c.sites[name] = NewHandler(p.Root, name)
+		}
+	}
+
+	if len(nc.Plans) > 0 {
+		tc, err := parseTicketConfig(nc.Plans)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ticket plans: %w", err)
+		}
+		c.tickets = &tc
+	}
+	return c, nil
+}
+
+func planMap(c *ticketConfig) map[string]ticketPlan {
+	if c == nil {
+		c = &defaultTicketConfig
+	}
+	m := make(map[string]ticketPlan, len(c.Plans))
+	for _, p := range c.Plans {
+		m[p.ID] = p
+	}
+	return m
+}
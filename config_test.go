@@ -0,0 +1,113 @@
+package led
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestReload(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("pass"), bcrypt.MinCost)
+	assert.Nil(t, err)
+
+	c := Config{
+		Users: map[string]string{"admin": string(hash), "foo": string(hash)},
+		Sites: map[string]string{"a.com": "", "b.com": ""},
+	}
+	var loadErr error
+	p := &Proxy{Loader: func() (Config, error) { return c, loadErr }}
+
+	r, err := p.Reload()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"admin", "foo"}, r.Users.Added)
+	assert.Equal(t, []string{"a.com", "b.com"}, r.Sites.Added)
+	assert.True(t, p.MySite("a.com"))
+	assert.Equal(t, defaultTicketConfig.Plans, p.activePlans(r.Time))
+	site := p.conf().sites["a.com"]
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Go(func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				p.MySite("a.com")
+				p.auth("admin", "pass")
+			}
+		}
+	})
+
+	c = Config{
+		Users: map[string]string{"admin": string(hash), "bar": string(hash), "foo": "x"},
+		Sites: map[string]string{"a.com": "", "c.com": ""},
+		Plans: []byte(`{"plans": [{"id": "2g", "cents": 100, "bytes": 1, "days": 1, "tier": "s"}]}`),
+	}
+	_, err = p.Reload()
+	assert.ErrorContains(t, err, "invalid password hash of user foo")
+	assert.True(t, p.MySite("b.com"))
+
+	c.Users["foo"] = string(hash)
+	c.Users["admin"] = ""
+	r, err = p.Reload()
+	assert.Nil(t, err)
+	assert.Equal(t, ConfigDiff{Added: []string{"bar"}, Changed: []string{"admin"}}, r.Users)
+	assert.Equal(t, ConfigDiff{Added: []string{"c.com"}, Removed: []string{"b.com"}}, r.Sites)
+	assert.Equal(t, ConfigDiff{Changed: []string{"2g"}, Removed: []string{"32g", "8g"}}, r.Plans)
+	assert.Same(t, site, p.conf().sites["a.com"])
+	assert.False(t, p.MySite("b.com"))
+	assert.Equal(t, 100, p.activePlans(r.Time)[0].Cents)
+
+	c.Plans = []byte(`{"plans": []}`)
+	_, err = p.Reload()
+	assert.ErrorContains(t, err, "invalid ticket plans")
+	assert.Equal(t, 100, p.activePlans(r.Time)[0].Cents)
+
+	loadErr = errors.New("no such file")
+	_, err = p.Reload()
+	assert.EqualError(t, err, "no such file")
+	assert.Equal(t, "no such file", p.LastReload().Error)
+	assert.True(t, p.MySite("c.com"))
+
+	close(done)
+	wg.Wait()
+}
+
+func TestAdminReload(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("pass"), bcrypt.MinCost)
+	assert.Nil(t, err)
+
+	users := map[string]string{"admin": string(hash)}
+	p := &Proxy{Loader: func() (Config, error) { return Config{Users: users}, nil }}
+	p.SetUsers(users)
+
+	call := func(method string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/+/admin/reload", nil)
+		req.SetBasicAuth("admin", "pass")
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		p.admin(w, req)
+		return w
+	}
+
+	w := call(http.MethodGet)
+	assert.Equal(t, "null\n", w.Body.String())
+
+	w = call(http.MethodPost)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, strings.Contains(w.Body.String(), `"users":{}`), w.Body.String())
+
+	users = map[string]string{"admin": string(hash), "foo": "x"}
+	w = call(http.MethodPost)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	w = call(http.MethodGet)
+	assert.Contains(t, w.Body.String(), "invalid password hash of user foo")
+}
@@ -1,25 +1,27 @@
 package led
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"net/http"
 	"strings"
 )
 
-func deSecZone(name, token string) (zone string, err error) {
+func deSecZone(ctx context.Context, name, token string) (zone string, err error) {
 	zone = "; desec-token: " + token + "\n" +
 		"@ NS ns1.desec.io.\n" +
 		"@ NS ns2.desec.org.\n"
 
 	api := "https://desec.io/api/v1/domains/" + name + "/"
-	req, err := http.NewRequest("GET", api, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", api, nil)
 	if err != nil {
 		return
 	}
 	req.Header.Set("Authorization", "Token "+token)
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := httpClient.Do(req)
 	if err != nil {
+		return
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
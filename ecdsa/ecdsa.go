@@ -5,6 +5,7 @@ import (
 	"crypto/elliptic"
 	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"math/big"
 
 	lru "github.com/hashicorp/golang-lru/v2"
@@ -68,17 +69,25 @@ func Compress(k ecdsa.PublicKey) string {
 // VerifyES256 校验 ES256 签名
 func VerifyES256(data, sign string, pubkey ecdsa.PublicKey) (ok bool, hash [32]byte, err error) {
 	hash = sha256.Sum256([]byte(data))
+	ok, err = VerifyHash(hash[:], sign, pubkey)
+	return
+}
 
+// VerifyHash 校验 ES256 签名，hash 为签名数据的 SHA-256 摘要
+func VerifyHash(hash []byte, sign string, pubkey ecdsa.PublicKey) (ok bool, err error) {
 	sig, err := base64.StdEncoding.DecodeString(sign)
 	if err != nil {
 		return
 	}
+	if len(sig) != 64 {
+		return false, errors.New("invalid signature length")
+	}
 
 	r := big.Int{}
 	s := big.Int{}
 	r.SetBytes(sig[:32])
 	s.SetBytes(sig[32:])
 
-	ok = ecdsa.Verify(&pubkey, hash[:], &r, &s)
+	ok = ecdsa.Verify(&pubkey, hash, &r, &s)
 	return
 }
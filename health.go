@@ -0,0 +1,170 @@
+package led
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/taoso/led/store"
+)
+
+// HealthCheck 一项依赖检查，Run 返回 nil 表示正常
+type HealthCheck struct {
+	Name string
+	Run  func(ctx context.Context) error
+}
+
+// HealthChecks returns checks of enabled repositories, tiktoken and OIDC
+// discovery. bpes are names of tiktoken encodings which must be loaded.
+func (p *Proxy) HealthChecks(bpes []string) []HealthCheck {
+	var cs []HealthCheck
+	for _, r := range []struct {
+		name string
+		repo any
+	}{
+		{"token_repo", p.TokenRepo},
+		{"ticket_repo", p.TicketRepo},
+		{"zone_repo", p.ZoneRepo},
+		{"usage_repo", p.UsageRepo},
+		{"order_repo", p.OrderRepo},
+		{"app_repo", p.AppRepo},
+		{"audit_repo", p.AuditRepo},
+	} {
+		if r.repo == nil {
+			continue
+		}
+		cs = append(cs, HealthCheck{r.name, func(ctx context.Context) error {
+			return store.Ping(ctx, r.repo)
+		}})
+	}
+
+	if len(bpes) > 0 {
+		cs = append(cs, HealthCheck{"tiktoken", func(ctx context.Context) error {
+			loaded := p.conf().bpes
+			for _, name := range bpes {
+				if loaded[name] == nil {
+					return fmt.Errorf("tiktoken %s is not loaded", name)
+				}
+			}
+			return nil
+		}})
+	}
+
+	if p.ZzOIDC != nil {
+		issuer := p.ZzOIDC.Issuer
+		cs = append(cs, HealthCheck{"oidc", func(ctx context.Context) error {
+			_, err := discoverOIDC(ctx, issuer)
+			return err
+		}})
+	}
+	return cs
+}
+
+// Health 在后台定期执行检查，探测请求只读取最近一次的结果，
+// 避免负载均衡器的频繁探测压垮数据库和 OIDC 服务。
+type Health struct {
+	Checks   []HealthCheck
+	Interval time.Duration // 检查间隔，每项检查的超时时间也是 Interval
+
+	ready  atomic.Bool
+	status atomic.Pointer[healthStatus]
+}
+
+type healthStatus struct {
+	Time   time.Time         `json:"time"`
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"` // 正常为 ok，否则为错误信息
+
+	ok bool
+}
+
+// SetReady 启动完成后设为 true，开始停止服务时设为 false
+func (h *Health) SetReady(ready bool) {
+	h.ready.Store(ready)
+}
+
+// Run 立即执行一次检查，之后每隔 Interval 检查一次，直到 ctx 结束
+func (h *Health) Run(ctx context.Context) {
+	tk := time.NewTicker(h.Interval)
+	defer tk.Stop()
+	for {
+		h.check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-tk.C:
+		}
+	}
+}
+
+func (h *Health) check(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, h.Interval)
+	defer cancel()
+
+	s := &healthStatus{Checks: make(map[string]string, len(h.Checks)), ok: true}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range h.Checks {
+		wg.Go(func() {
+			err := c.Run(ctx)
+			healthChecks.Set(boolGauge(err == nil), c.Name)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				s.Checks[c.Name] = err.Error()
+				s.ok = false
+			} else {
+				s.Checks[c.Name] = "ok"
+			}
+		})
+	}
+	wg.Wait()
+
+	s.Time = time.Now()
+	h.status.Store(s)
+}
+
+// Alive reports whether the checks are still running. It is false if the
+// last check is older than three intervals, which means something is stuck.
+func (h *Health) Alive() bool {
+	s := h.status.Load()
+	return s != nil && time.Since(s.Time) < 3*h.Interval
+}
+
+// Healthz 存活探测，检查循环卡住时返回 503
+func (h *Health) Healthz(w http.ResponseWriter, req *http.Request) {
+	if !h.Alive() {
+		http.Error(w, "health checks are stuck", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// Readyz 就绪探测，启动完成且所有检查通过时返回 200，否则返回 503
+func (h *Health) Readyz(w http.ResponseWriter, req *http.Request) {
+	s := healthStatus{Ready: h.ready.Load(), Checks: map[string]string{}}
+	if last := h.status.Load(); last != nil {
+		s.Time = last.Time
+		s.Checks = last.Checks
+		s.ok = last.ok
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !s.Ready || !s.ok || !h.Alive() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(s)
+}
+
+func boolGauge(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,91 @@
+package led
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/taoso/led/store"
+)
+
+func TestHealthChecks(t *testing.T) {
+	oidc := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/.well-known/openid-configuration" {
+			http.NotFound(w, req)
+			return
+		}
+		w.Write([]byte(`{"authorization_endpoint":"https://a/auth"}`))
+	}))
+	defer oidc.Close()
+
+	p := &Proxy{UsageRepo: store.NewUsageRepo(":memory:")}
+	assert.Nil(t, p.InitZzAuth())
+	t.Setenv("ZZ_OIDC_ISSUER", oidc.URL)
+	assert.Nil(t, p.InitZzAuth())
+	assert.Equal(t, "https://a/auth", p.ZzOIDC.AuthEndpoint)
+
+	cs := p.HealthChecks([]string{"cl100k_base"})
+	var names []string
+	errs := map[string]error{}
+	for _, c := range cs {
+		names = append(names, c.Name)
+		errs[c.Name] = c.Run(context.Background())
+	}
+	assert.Equal(t, []string{"usage_repo", "tiktoken", "oidc"}, names)
+	assert.Nil(t, errs["usage_repo"])
+	assert.Nil(t, errs["oidc"])
+	assert.EqualError(t, errs["tiktoken"], "tiktoken cl100k_base is not loaded")
+
+	p.ZzOIDC.Issuer = oidc.URL + "/x"
+	cs = p.HealthChecks(nil)
+	assert.Equal(t, "oidc", cs[1].Name)
+	assert.EqualError(t, cs[1].Run(context.Background()), "oidc discovery: 404 Not Found")
+}
+
+func TestHealth(t *testing.T) {
+	var err error
+	h := &Health{
+		Checks:   []HealthCheck{{"db", func(ctx context.Context) error { return err }}},
+		Interval: time.Hour,
+	}
+
+	probe := func(f http.HandlerFunc) (int, healthStatus) {
+		w := httptest.NewRecorder()
+		f(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		var s healthStatus
+		json.Unmarshal(w.Body.Bytes(), &s)
+		return w.Code, s
+	}
+
+	code, _ := probe(h.Healthz)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+
+	h.check(context.Background())
+	code, _ = probe(h.Healthz)
+	assert.Equal(t, http.StatusOK, code)
+
+	code, s := probe(h.Readyz)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.False(t, s.Ready)
+	assert.Equal(t, map[string]string{"db": "ok"}, s.Checks)
+
+	h.SetReady(true)
+	code, _ = probe(h.Readyz)
+	assert.Equal(t, http.StatusOK, code)
+
+	err = errors.New("database is locked")
+	h.check(context.Background())
+	code, s = probe(h.Readyz)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "database is locked", s.Checks["db"])
+
+	// 检查卡住时存活探测失败
+	h.status.Load().Time = time.Now().Add(-3 * time.Hour)
+	code, _ = probe(h.Healthz)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+}
@@ -4,15 +4,17 @@ import (
 	"bytes"
 	"context"
 	"encoding/base64"
-	"fmt"
+	"errors"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
+	"net/textproto"
 	"net/url"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/felixge/httpsnoop"
@@ -24,14 +26,20 @@ import (
 	"github.com/taoso/led/store"
 	"github.com/taoso/led/tiktoken"
 	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/net/http/httpguts"
 	"golang.org/x/net/idna"
 	"golang.org/x/net/webdav"
 )
 
 // Proxy http proxy handler
 type Proxy struct {
-	sites map[string]*FileHandler
-	users map[string]string
+	// config 可以热加载的配置，见 Reload
+	config     atomic.Pointer[config]
+	reloadMu   sync.Mutex
+	lastReload *ReloadResult
+
+	// Loader 读取可以热加载的配置
+	Loader func() (Config, error)
 
 	davs *xsync.Map[string, webdav.Handler]
 
@@ -39,18 +47,31 @@ type Proxy struct {
 
 	signKey []byte
 
-	BPEs map[string]*tiktoken.BPE
+	// receiptKey 收据链接的签名密钥，为空时不提供收据
+	receiptKey []byte
 
-	Alipay *pay.Alipay
+	// Payments 已启用的支付渠道，键为渠道名称
+	Payments map[string]pay.Provider
 
-	TokenRepo  *store.TokenRepo
+	TokenRepo  store.TokenRepo
 	TicketRepo store.TicketRepo
 	ZoneRepo   store.ZoneRepo
+	UsageRepo  store.UsageRepo
+	OrderRepo  store.OrderRepo
+	AppRepo    store.AppRepo
+	AuditRepo  store.AuditRepo
 
 	AltSvc string
 
 	chatLinks sync.Map
 
+	limiter limiter
+
+	sessions  sync.Map
+	sessionID atomic.Int64
+
+	running sync.WaitGroup // 正在处理的请求，停止服务时等待计费完成
+
 	DavEvs chan string
 	Root   string
 
@@ -72,28 +93,36 @@ func (p *Proxy) bpe(model string) *tiktoken.BPE {
 		name = "cl100k_base"
 	}
 
-	return p.BPEs[name]
+	return p.conf().bpes[name]
 }
 
 func (p *Proxy) auth(username, password string) bool {
-	hash, ok := p.users[username]
+	hash, ok := p.conf().users[username]
 	if !ok {
-		ts, err := p.TicketRepo.List(username, 1)
+		b, err := p.TicketRepo.Balance(username)
 		if err != nil {
-			log.Println("ticket list error: ", username, err)
+			slog.Error("ticket balance error", "token", username, "err", err)
 			return false
 		}
-		if len(ts) == 0 || ts[0].Bytes <= 0 || ts[0].Expires.Before(time.Now()) {
-			return false
-		}
-		return true
+		return b.Bytes > 0
 	}
 	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
 	return err == nil
 }
 
+// isAdmin checks the basic auth of admin, who must be in users.txt.
+func (p *Proxy) isAdmin(w http.ResponseWriter, req *http.Request) bool {
+	username, password, ok := req.BasicAuth()
+	if _, admin := p.conf().users[username]; !ok || username != "admin" || !admin || !p.auth(username, password) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="Admin"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
 func (p *Proxy) SetUsers(users map[string]string) {
-	p.users = users
+	p.update(func(c *config) { c.users = users })
 }
 
 func (p *Proxy) SetSites(sites map[string]string) {
@@ -102,7 +131,7 @@ func (p *Proxy) SetSites(sites map[string]string) {
 		hs[name] = NewHandler(p.Root, name)
 	}
 
-	p.sites = hs
+	p.update(func(c *config) { c.sites = hs })
 }
 
 func (p *Proxy) SetZonePath(path string) {
@@ -118,6 +147,19 @@ func (p *Proxy) SetKey(key string) {
 	p.signKey = k
 }
 
+// SetReceiptKey 设置 base64 编码的收据签名密钥，至少 32 字节
+func (p *Proxy) SetReceiptKey(key string) error {
+	k, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return err
+	}
+	if len(k) < 32 {
+		return errors.New("receipt key must be at least 32 bytes")
+	}
+	p.receiptKey = k
+	return nil
+}
+
 func (p *Proxy) MySite(name string) bool {
 	if strings.HasSuffix(name, "zz.ac") {
 		name := strings.TrimSuffix(name, ".zz.ac")
@@ -126,7 +168,7 @@ func (p *Proxy) MySite(name string) bool {
 			return true
 		}
 	}
-	_, ok := p.sites[name]
+	_, ok := p.conf().sites[name]
 	return ok
 }
 
@@ -136,7 +178,7 @@ func (p *Proxy) host(host string) string {
 	}
 	host, err := idna.ToUnicode(host)
 	if err != nil {
-		log.Println("host idna.ToUnicode error", host, err)
+		slog.Warn("host idna.ToUnicode error", "host", host, "err", err)
 	}
 	return host
 }
@@ -150,6 +192,9 @@ func localRedirect(w http.ResponseWriter, r *http.Request, newPath string) {
 }
 
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	p.running.Add(1)
+	defer p.running.Done()
+
 	auth := req.Header.Get("Proxy-Authorization")
 	if auth != "" {
 		username, password, ok := parseBasicAuth(auth)
@@ -169,7 +214,7 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			}
 			return
 		} else {
-			proxyHTTP(w, req)
+			p.proxyHTTP(w, req)
 			return
 		}
 	} else if req.Method == http.MethodConnect {
@@ -231,7 +276,7 @@ func (p *Proxy) serveLocal(w http.ResponseWriter, req *http.Request) {
 			}
 		resp:
 			for _, e := range evs {
-				fmt.Println("my", e)
+				slog.DebugContext(req.Context(), "dav event", "event", e)
 				w.Write([]byte(e + "\n"))
 			}
 		case <-t.C:
@@ -240,7 +285,7 @@ func (p *Proxy) serveLocal(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if f := p.sites[host]; f != nil {
+	if f := p.conf().sites[host]; f != nil {
 		if strings.HasSuffix(req.RequestURI, "/index.htm") {
 			localRedirect(w, req, "./")
 			return
@@ -251,31 +296,76 @@ func (p *Proxy) serveLocal(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 
-		if req.RequestURI == "/+/alipay-order-create" && req.Method == http.MethodPost {
+		if req.URL.Path == "/+/alipay-order-create" && req.Method == http.MethodPost {
 			p.AlipayOrderCreate(w, req, f)
 			return
 		}
 
-		if req.RequestURI == "/+/alipay-order-notify" {
+		if req.URL.Path == "/+/alipay-order-notify" {
 			p.AlipayOrderNotify(w, req, f)
 			return
 		}
 
-		if req.URL.Path == "/+/ticket" && req.Method == http.MethodPost {
+		if req.URL.Path == "/+/app-webhooks" && req.Method == http.MethodPost {
+			p.appWebhooks(w, req)
+			return
+		}
+
+		if req.URL.Path == "/+/admin" || strings.HasPrefix(req.URL.Path, "/+/admin/") {
+			p.admin(w, req)
+			return
+		}
+
+		if req.URL.Path == "/+/apps" {
+			p.apps(w, req)
+			return
+		}
+
+		if req.URL.Path == "/+/proxy-sessions" {
+			p.proxySessions(w, req)
+			return
+		}
+
+		if req.URL.Path == "/+/ledger" {
+			p.ledger(w, req)
+			return
+		}
+
+		if req.URL.Path == "/+/referrals" && req.Method == http.MethodPost {
+			p.referrals(w, req)
+			return
+		}
+
+		if req.URL.Path == "/+/receipt" {
+			p.serveReceipt(w, req)
+			return
+		}
+
+		if req.URL.Path == "/+/refunds" {
+			p.refunds(w, req)
+			return
+		}
+
+		if req.URL.Path == "/+/ticket" {
 			p.ServeTicket(w, req)
 			return
 		}
 
-		if req.RequestURI == "/+/buy-tokens" && req.Method == http.MethodPost {
+		if req.URL.Path == "/+/buy-tokens" && req.Method == http.MethodPost {
 			p.buyTokens(w, req, f)
 			return
 		}
 
-		if req.RequestURI == "/+/buy-tokens-notify" {
+		if req.URL.Path == "/+/buy-tokens-notify" {
 			p.buyTokensNotify(w, req, f)
 			return
 		}
 
+		if req.RequestURI == "/+/buy-tokens-refund" && req.Method == http.MethodPost {
+			p.buyTokensRefund(w, req, f)
+			return
+		}
+
 		if req.RequestURI == "/+/buy-tokens-log" {
 			p.buyTokensLog(w, req, f)
 			return
@@ -334,8 +424,7 @@ func (p *Proxy) serveLocal(w http.ResponseWriter, req *http.Request) {
 				http.Error(w, "Unauthorized", http.StatusUnauthorized)
 				return
 			}
-			f.dav.ServeHTTP(w, req)
-			p.SendDavEvent(req, host)
+			p.serveDav(f.dav, w, req, username, host)
 			return
 		}
 
@@ -396,10 +485,34 @@ func (p *Proxy) serveLocal(w http.ResponseWriter, req *http.Request) {
 			}, false
 		})
 
-		fs.ServeHTTP(w, req)
+		p.serveDav(&fs, w, req, req.URL.User.Username(), host)
+		return
+	}
+}
+
+// serveDav 处理 WebDAV 请求，记录写操作并通知文件变更
+func (p *Proxy) serveDav(h http.Handler, w http.ResponseWriter, req *http.Request, user, host string) {
+	switch req.Method {
+	case "PUT", "DELETE", "MOVE", "COPY", "MKCOL", "PROPPATCH":
+	default:
+		h.ServeHTTP(w, req)
 		p.SendDavEvent(req, host)
 		return
 	}
+
+	m := httpsnoop.CaptureMetrics(h, w, req)
+
+	var err error
+	if m.Code >= http.StatusBadRequest {
+		err = errors.New(strconv.Itoa(m.Code) + " " + http.StatusText(m.Code))
+	}
+	var detail map[string]string
+	if d := req.Header.Get("Destination"); d != "" {
+		detail = map[string]string{"destination": d}
+	}
+	p.audit(req, user, "dav."+strings.ToLower(req.Method), host+req.URL.Path, err, detail)
+
+	p.SendDavEvent(req, host)
 }
 
 func (p *Proxy) SendDavEvent(req *http.Request, host string) {
@@ -526,6 +639,28 @@ func (p *Proxy) api2(w http.ResponseWriter, req *http.Request, f *FileHandler) {
 	}
 }
 
+// cost returns the billing function of user's proxy traffic.
+//
+// Users in users.txt are free. All the closers will be closed if the tickets
+// of user are used up.
+func (p *Proxy) cost(user, proto string, closers ...io.Closer) func(up, down int) {
+	_, free := p.conf().users[user]
+	return func(up, down int) {
+		proxyBytes.Add(float64(up), proto, "up")
+		proxyBytes.Add(float64(down), proto, "down")
+		if free {
+			return
+		}
+		err := p.TicketRepo.Cost(user, up, down)
+		if err != nil {
+			slog.Error("ticket cost error", "token", user, "up", up, "down", down, "err", err)
+			for _, c := range closers {
+				c.Close()
+			}
+		}
+	}
+}
+
 func (p *Proxy) proxyUDP(w http.ResponseWriter, req *http.Request) {
 	if req.ProtoMajor < 3 {
 		w.WriteHeader(http.StatusNotImplemented)
@@ -537,17 +672,28 @@ func (p *Proxy) proxyUDP(w http.ResponseWriter, req *http.Request) {
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte("invalid target"))
-		log.Println("invalid target", req.URL)
+		slog.InfoContext(req.Context(), "invalid masque target", "path", req.URL.Path, "err", err)
 		return
 	}
 
-	log.Println("target:", req.URL)
+	slog.DebugContext(req.Context(), "masque target", "addr", addr)
+
+	user := req.URL.User.Username()
+
+	lim, release, err := p.limit(user, true)
+	if err != nil {
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	defer release()
 
 	up, err := net.Dial("udp", addr)
+	upstreamDone("connect-udp", err, 0)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte("dial udp err: " + err.Error()))
-		log.Println("dial udp err", err)
+		slog.WarnContext(req.Context(), "dial udp error", "addr", addr, "err", err)
 		return
 	}
 	defer up.Close()
@@ -556,29 +702,25 @@ func (p *Proxy) proxyUDP(w http.ResponseWriter, req *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.(http.Flusher).Flush()
 
-	w = w.(httpsnoop.Unwrapper).Unwrap()
+	// 日志和指标等中间件会包装多层
+	for {
+		if _, ok := w.(http3.HTTPStreamer); ok {
+			break
+		}
+		w = w.(httpsnoop.Unwrapper).Unwrap()
+	}
 	str := w.(http3.HTTPStreamer).HTTPStream()
 	defer str.Close()
 
 	var wg sync.WaitGroup
 	wg.Add(2)
 
-	user := req.URL.User.Username()
-
-	cost := func(n int) {}
+	defer lim.lifetime(str, up)()
 
-	if _, ok := p.users[user]; !ok {
-		cost = func(n int) {
-			err := p.TicketRepo.Cost(user, n)
-			if err != nil {
-				log.Println("ticket cost error: ", user, n, err)
-				str.Close()
-				up.Close()
-			}
-		}
-	}
+	ps := p.openSession(user, addr, "connect-udp", str, up)
+	defer p.closeSession(ps)
 
-	u := &bytesCounter{w: up, d: 1 * time.Second, f: cost}
+	u := &bytesCounter{w: ps.wrap(lim.wrap(up), true), d: 1 * time.Second, f: p.cost(user, "connect-udp", str, up)}
 
 	go u.Start()
 	defer u.Done()
@@ -589,12 +731,12 @@ func (p *Proxy) proxyUDP(w http.ResponseWriter, req *http.Request) {
 		for {
 			n, err := u.Read(b[1:])
 			if err != nil {
-				log.Println("up.Read err:", err)
+				slog.DebugContext(req.Context(), "udp read error", "err", err)
 				return
 			}
 			err = str.SendDatagram(b[:n+1])
 			if err != nil {
-				log.Println("SendDatagram err:", err)
+				slog.DebugContext(req.Context(), "send datagram error", "err", err)
 				return
 			}
 		}
@@ -606,17 +748,17 @@ func (p *Proxy) proxyUDP(w http.ResponseWriter, req *http.Request) {
 		for {
 			b, err := str.ReceiveDatagram(ctx)
 			if err != nil {
-				log.Println("ReceiveDatagram err:", err)
+				slog.DebugContext(req.Context(), "receive datagram error", "err", err)
 				return
 			}
 			_, n, err := quicvarint.Parse(b)
 			if err != nil {
-				log.Println("parse cid err:", err)
+				slog.DebugContext(req.Context(), "parse context id error", "err", err)
 				return
 			}
 			_, err = u.Write(b[n:])
 			if err != nil {
-				log.Println("up.Write err:", err)
+				slog.DebugContext(req.Context(), "udp write error", "err", err)
 				return
 			}
 		}
@@ -626,8 +768,19 @@ func (p *Proxy) proxyUDP(w http.ResponseWriter, req *http.Request) {
 }
 
 func (p *Proxy) proxyHTTPS(w http.ResponseWriter, req *http.Request) {
+	user := req.URL.User.Username()
+
+	lim, release, err := p.limit(user, true)
+	if err != nil {
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	defer release()
+
 	address := req.RequestURI
 	upConn, err := net.DialTimeout("tcp", address, 5*time.Second)
+	upstreamDone("connect", err, 0)
 	if err != nil {
 		w.WriteHeader(http.StatusBadGateway)
 		return
@@ -653,22 +806,12 @@ func (p *Proxy) proxyHTTPS(w http.ResponseWriter, req *http.Request) {
 	var wg sync.WaitGroup
 	wg.Add(2)
 
-	user := req.URL.User.Username()
+	defer lim.lifetime(downConn, upConn)()
 
-	cost := func(n int) {}
+	ps := p.openSession(user, address, "connect", downConn, upConn)
+	defer p.closeSession(ps)
 
-	if _, ok := p.users[user]; !ok {
-		cost = func(n int) {
-			err := p.TicketRepo.Cost(user, n)
-			if err != nil {
-				log.Println("ticket cost error: ", user, n, err)
-				downConn.Close()
-				upConn.Close()
-			}
-		}
-	}
-
-	u := &bytesCounter{w: upConn, d: 1 * time.Second, f: cost}
+	u := &bytesCounter{w: ps.wrap(lim.wrap(upConn), true), d: 1 * time.Second, f: p.cost(user, "connect", downConn, upConn)}
 
 	go u.Start()
 	defer u.Done()
@@ -685,51 +828,144 @@ func (p *Proxy) proxyHTTPS(w http.ResponseWriter, req *http.Request) {
 	wg.Wait()
 }
 
-func proxyHTTP(w http.ResponseWriter, req *http.Request) {
-	var url string
-	if strings.HasPrefix(req.RequestURI, "http") {
-		url = req.RequestURI
+// proxyTransport is shared by all plain http proxy requests so that
+// connections to origin servers can be reused.
+var proxyTransport = &http.Transport{
+	DialContext: (&net.Dialer{
+		Timeout:   5 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext,
+	MaxIdleConns:          1024,
+	MaxIdleConnsPerHost:   16,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ResponseHeaderTimeout: 30 * time.Second,
+	ExpectContinueTimeout: 1 * time.Second,
+}
+
+// hopHeaders are connection specific fields which must not be forwarded.
+//
+// See https://www.rfc-editor.org/rfc/rfc9110.html#section-7.6.1
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders deletes hop-by-hop fields and all fields listed in the
+// Connection header.
+func removeHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, f := range strings.Split(v, ",") {
+			if f = textproto.TrimString(f); f != "" {
+				h.Del(f)
+			}
+		}
+	}
+	for _, f := range hopHeaders {
+		h.Del(f)
+	}
+}
+
+// addVia appends this proxy to the Via header.
+//
+// See https://www.rfc-editor.org/rfc/rfc9110.html#section-7.6.3
+func addVia(h http.Header, major, minor int) {
+	v := strconv.Itoa(major)
+	if major < 2 {
+		v += "." + strconv.Itoa(minor)
+	}
+	h.Add("Via", v+" led")
+}
+
+func (p *Proxy) proxyHTTP(w http.ResponseWriter, req *http.Request) {
+	var u string
+	if req.URL.IsAbs() {
+		// ServeHTTP saves the proxy user in URL, which must not be sent.
+		ou := *req.URL
+		ou.User = nil
+		u = ou.String()
 	} else {
-		url = "http://" + req.Host + req.RequestURI
+		u = "http://" + req.Host + req.URL.RequestURI()
 	}
-	r, err := http.NewRequest(req.Method, url, req.Body)
+
+	user := req.URL.User.Username()
+
+	lim, release, err := p.limit(user, false)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(http.StatusTooManyRequests)
 		w.Write([]byte(err.Error()))
 		return
 	}
+	defer release()
+
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+
+	ps := p.openSession(user, req.Host, "http", closeFunc(cancel), req.Body)
+	defer p.closeSession(ps)
 
-	h := req.Header.Clone()
-	h.Del("Proxy-Authorization")
-	h.Del("Te")
-	h.Del("TransferEncoding")
-	h.Del("Host")
-	h.Set("Connection", "close")
-	req.Header = h
+	down := ps.wrap(lim.wrap(flushWriter{w: w, r: req.Body}), false)
+	bc := &bytesCounter{w: down, d: 1 * time.Second, f: p.cost(user, "http", closeFunc(cancel), req.Body), client: true}
 
-	c := &http.Client{
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			// do not follow redirect response
-			return http.ErrUseLastResponse
-		},
+	go bc.Start()
+	defer bc.Done()
+
+	var body io.Reader
+	if req.Body != nil && req.Body != http.NoBody {
+		body = struct{ io.Reader }{bc}
 	}
 
-	resp, err := c.Do(r)
+	r, err := http.NewRequestWithContext(ctx, req.Method, u, body)
 	if err != nil {
-		w.WriteHeader(http.StatusBadGateway)
+		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(err.Error()))
 		return
 	}
+	r.ContentLength = req.ContentLength
 
-	for k, vs := range resp.Header {
-		for _, v := range vs {
-			w.Header().Add(k, v)
+	r.Header = req.Header.Clone()
+	removeHopHeaders(r.Header)
+	if httpguts.HeaderValuesContainsToken(req.Header["Te"], "trailers") {
+		r.Header.Set("Te", "trailers")
+	}
+	addVia(r.Header, req.ProtoMajor, req.ProtoMinor)
+	// Go adds its own User-Agent if absent
+	if _, ok := r.Header["User-Agent"]; !ok {
+		r.Header.Set("User-Agent", "")
+	}
+
+	resp, err := proxyTransport.RoundTrip(r)
+	// 源站的 5xx 不算代理错误
+	upstreamDone("http", err, 0)
+	if err != nil {
+		code := http.StatusBadGateway
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			code = http.StatusGatewayTimeout
 		}
+		w.WriteHeader(code)
+		w.Write([]byte(err.Error()))
+		return
 	}
+	defer resp.Body.Close()
+
+	h := w.Header()
+	for k, vs := range resp.Header {
+		h[k] = vs
+	}
+	removeHopHeaders(h)
+	addVia(h, resp.ProtoMajor, resp.ProtoMinor)
 
 	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
-	return
+	if _, err := io.Copy(bc, resp.Body); err != nil {
+		slog.DebugContext(req.Context(), "proxy http copy error", "url", redactURI(u), "err", err)
+	}
 }
 
 type flushWriter struct {
@@ -0,0 +1,79 @@
+package led
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/taoso/led/store"
+)
+
+func TestRemoveHopHeaders(t *testing.T) {
+	h := http.Header{}
+	h.Set("Connection", "keep-alive, X-Foo")
+	h.Set("Keep-Alive", "timeout=5")
+	h.Set("X-Foo", "foo")
+	h.Set("X-Bar", "bar")
+	h.Set("Proxy-Authorization", "Basic Zm9vOmJhcg==")
+	h.Set("Upgrade", "websocket")
+
+	removeHopHeaders(h)
+
+	assert.Equal(t, http.Header{"X-Bar": {"bar"}}, h)
+}
+
+func TestProxyHTTP(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "", r.Header.Get("Proxy-Authorization"))
+		assert.Equal(t, "", r.Header.Get("X-Hop"))
+		assert.Equal(t, "bar", r.Header.Get("X-Foo"))
+		assert.Equal(t, "1.1 led", r.Header.Get("Via"))
+		assert.Nil(t, r.URL.User)
+		b, _ := io.ReadAll(r.Body)
+		w.Header().Set("Connection", "X-Secret")
+		w.Header().Set("X-Secret", "1")
+		w.Write(append(b, " world"...))
+	}))
+	defer up.Close()
+
+	var upN, downN atomic.Int64
+	p := &Proxy{TicketRepo: costTicketRepo{f: func(token string, u, d int) error {
+		assert.Equal(t, "foo", token)
+		upN.Add(int64(u))
+		downN.Add(int64(d))
+		return nil
+	}}}
+
+	req := httptest.NewRequest("POST", up.URL+"/echo", strings.NewReader("hello"))
+	req.Header.Set("Proxy-Authorization", "Basic Zm9vOmJhcg==")
+	req.Header.Set("Connection", "X-Hop")
+	req.Header.Set("X-Hop", "1")
+	req.Header.Set("X-Foo", "bar")
+	req.URL.User = url.User("foo")
+
+	w := httptest.NewRecorder()
+	p.proxyHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "hello world", w.Body.String())
+	assert.Equal(t, "", w.Header().Get("X-Secret"))
+	assert.Equal(t, "1.1 led", w.Header().Get("Via"))
+	assert.Eventually(t, func() bool {
+		return upN.Load() == int64(len("hello")) && downN.Load() == int64(len("hello world"))
+	}, time.Second, 10*time.Millisecond)
+}
+
+type costTicketRepo struct {
+	store.FreeTicketRepo
+	f func(token string, up, down int) error
+}
+
+func (r costTicketRepo) Cost(token string, up, down int) error {
+	return r.f(token, up, down)
+}
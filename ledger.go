@@ -0,0 +1,442 @@
+package led
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/taoso/led/ecdsa"
+	"github.com/taoso/led/store"
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+const (
+	issueBalance = "balance"       // 流水合计与钱包余额不符
+	issueGap     = "gap"           // AfterNum 不连续，流水缺失或被篡改
+	issueSign    = "sign"          // 签名校验失败
+	issueDupPay  = "duplicate_pay" // 多条流水使用同一个 pay_no
+	issueNoLog   = "missing_log"   // 支付宝有交易但没有充值流水
+	issueNoTrade = "missing_trade" // 有充值流水但支付宝没有交易
+	issueAmount  = "amount"        // 充值金额与支付宝交易金额不符
+)
+
+// LedgerIssue 账本核对发现的问题
+type LedgerIssue struct {
+	Kind   string `json:"kind"`
+	UserID int    `json:"user_id,omitempty"`
+	LogID  int    `json:"log_id,omitempty"`
+	PayNo  string `json:"pay_no,omitempty"`
+	Detail string `json:"detail"`
+}
+
+// LedgerReport 账本核对报告
+type LedgerReport struct {
+	Wallets int           `json:"wallets"`
+	Logs    int           `json:"logs"`
+	Trades  int           `json:"trades"`
+	Issues  []LedgerIssue `json:"issues"`
+}
+
+func (r *LedgerReport) add(i LedgerIssue) {
+	r.Issues = append(r.Issues, i)
+}
+
+// WriteText 输出文本格式的报告
+func (r *LedgerReport) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "wallets: %d, logs: %d, trades: %d, issues: %d\n",
+		r.Wallets, r.Logs, r.Trades, len(r.Issues))
+	for _, i := range r.Issues {
+		fmt.Fprintf(w, "%s\tuser=%d\tlog=%d\tpay_no=%s\t%s\n",
+			i.Kind, i.UserID, i.LogID, i.PayNo, i.Detail)
+	}
+}
+
+// VerifyLedger 核对 Token 账本。
+//
+// 逐个钱包按顺序重放流水，检查 AfterNum 是否连续、合计是否等于余额，
+// 并重新校验用户签名。alipay 不为空时再与支付宝账单核对充值流水。
+func VerifyLedger(repo store.TokenRepo, alipay io.Reader) (*LedgerReport, error) {
+	r := &LedgerReport{Issues: []LedgerIssue{}}
+
+	after := 0
+	for {
+		ws, err := repo.ListWallets(after, 100)
+		if err != nil {
+			return nil, err
+		}
+		for _, w := range ws {
+			if err := r.verifyWallet(repo, w); err != nil {
+				return nil, err
+			}
+		}
+		if len(ws) < 100 {
+			break
+		}
+		after = ws[len(ws)-1].ID
+	}
+
+	nos, err := repo.DupPayNos()
+	if err != nil {
+		return nil, err
+	}
+	for _, no := range nos {
+		r.add(LedgerIssue{Kind: issueDupPay, PayNo: no, Detail: "pay_no is used by multiple logs"})
+	}
+
+	if alipay != nil {
+		if err := r.reconcile(repo, alipay); err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+func (r *LedgerReport) verifyWallet(repo store.TokenRepo, w store.TokenWallet) error {
+	r.Wallets++
+
+	keys, err := walletKeys(repo, w)
+	if err != nil {
+		return err
+	}
+
+	var sum, prev, after int
+	for {
+		logs, err := repo.ReplayLogs(w.ID, after, 100)
+		if err != nil {
+			return err
+		}
+		for _, l := range logs {
+			r.Logs++
+
+			n := -l.TokenNum
+			if l.Type == store.LogTypeBuy || l.Type == store.LogTypeInvite || l.Type == store.LogTypeAdjust {
+				n = l.TokenNum
+			}
+			sum += n
+
+			if l.AfterNum != prev+n {
+				r.add(LedgerIssue{
+					Kind:   issueGap,
+					UserID: w.ID,
+					LogID:  l.ID,
+					PayNo:  l.PayNo,
+					Detail: fmt.Sprintf("after_num %d, expected %d", l.AfterNum, prev+n),
+				})
+			}
+			prev = l.AfterNum
+
+			if !verifyLogSign(l, keys) {
+				r.add(LedgerIssue{
+					Kind:   issueSign,
+					UserID: w.ID,
+					LogID:  l.ID,
+					PayNo:  l.PayNo,
+					Detail: "no wallet or session key verifies the signature",
+				})
+			}
+		}
+		if len(logs) < 100 {
+			break
+		}
+		after = logs[len(logs)-1].ID
+	}
+
+	if sum != w.Tokens {
+		r.add(LedgerIssue{
+			Kind:   issueBalance,
+			UserID: w.ID,
+			Detail: fmt.Sprintf("tokens %d, logs sum to %d", w.Tokens, sum),
+		})
+	}
+	return nil
+}
+
+// walletKeys 返回钱包及其所有会话的公钥，已删除会话的公钥无法找回
+func walletKeys(repo store.TokenRepo, w store.TokenWallet) (keys []ecdsa.PublicKey, err error) {
+	pubkeys := []string{w.Pubkey}
+	ss, err := repo.ListSession(w.ID)
+	if err != nil {
+		return
+	}
+	for _, s := range ss {
+		pubkeys = append(pubkeys, s.Pubkey)
+	}
+	for _, k := range pubkeys {
+		if k == "" {
+			continue
+		}
+		pk, err := ecdsa.GetPubkey(k)
+		if err != nil || pk.X == nil {
+			continue
+		}
+		keys = append(keys, pk)
+	}
+	return
+}
+
+// ownsWallet 公钥是否属于钱包或者钱包的登录会话
+func ownsWallet(repo store.TokenRepo, w store.TokenWallet, pk ecdsa.PublicKey) (bool, error) {
+	keys, err := walletKeys(repo, w)
+	if err != nil {
+		return false, err
+	}
+	for _, k := range keys {
+		if k.Equal(&pk) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// verifyLogSign 校验流水签名，没有签名的流水直接通过
+func verifyLogSign(l store.TokenLog, keys []ecdsa.PublicKey) bool {
+	if l.Sign == "" {
+		return true
+	}
+
+	var hash []byte
+	switch l.Type {
+	case store.LogTypeBuy, store.LogTypeRefund:
+		h := sha256.Sum256([]byte(l.SignData()))
+		hash = h[:]
+	case store.LogTypeCost:
+		// 消费流水的签名对象是聊天请求，只保存了其摘要
+		h, err := hex.DecodeString(l.Extra["sha256"])
+		if err != nil || len(h) == 0 {
+			return false
+		}
+		hash = h
+	default:
+		return true
+	}
+
+	for _, k := range keys {
+		if ok, _ := ecdsa.VerifyHash(hash, l.Sign, k); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// alipayTrade 支付宝账单中的一笔交易
+type alipayTrade struct {
+	OutTradeNo string
+	Subject    string
+	Cents      int
+	Time       time.Time
+}
+
+// 支付宝不同账单导出的列名不同
+var alipayColumns = map[string][]string{
+	"out_trade_no": {"商户订单号", "out_trade_no"},
+	"subject":      {"商品名称", "subject"},
+	"amount":       {"订单金额（元）", "订单金额(元)", "收入金额（+元）", "收入金额(+元)", "total_amount", "amount"},
+	"time":         {"完成时间", "付款时间", "交易创建时间", "gmt_payment", "gmt_create"},
+}
+
+// parseAlipayCSV 解析支付宝账单，支持 UTF-8 和 GBK 编码
+func parseAlipayCSV(in io.Reader) ([]alipayTrade, error) {
+	b, err := io.ReadAll(in)
+	if err != nil {
+		return nil, err
+	}
+	if !utf8.Valid(b) {
+		if b, err = simplifiedchinese.GBK.NewDecoder().Bytes(b); err != nil {
+			return nil, err
+		}
+	}
+	b = bytes.TrimPrefix(b, []byte("\xef\xbb\xbf"))
+
+	cr := csv.NewReader(bytes.NewReader(b))
+	cr.Comment = '#'
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+
+	var idx map[string]int
+	var ts []alipayTrade
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		for i := range rec {
+			rec[i] = strings.TrimSpace(rec[i])
+		}
+
+		if idx == nil {
+			idx = alipayHeader(rec)
+			continue
+		}
+
+		get := func(col string) string {
+			if i, ok := idx[col]; ok && i < len(rec) {
+				return rec[i]
+			}
+			return ""
+		}
+
+		// 账单末尾是汇总信息
+		t := alipayTrade{OutTradeNo: get("out_trade_no"), Subject: get("subject")}
+		if t.OutTradeNo == "" {
+			continue
+		}
+		f, err := strconv.ParseFloat(get("amount"), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid amount of %s: %w", t.OutTradeNo, err)
+		}
+		t.Cents = int(math.Round(f * 100))
+		if s := get("time"); s != "" {
+			t.Time, _ = time.ParseInLocation(time.DateTime, s, time.Local)
+		}
+		ts = append(ts, t)
+	}
+
+	if idx == nil {
+		return nil, fmt.Errorf("out_trade_no column not found")
+	}
+	return ts, nil
+}
+
+// alipayHeader 识别表头，不是表头时返回 nil
+func alipayHeader(rec []string) map[string]int {
+	idx := map[string]int{}
+	for col, names := range alipayColumns {
+	find:
+		for _, n := range names {
+			for i, v := range rec {
+				if v == n {
+					idx[col] = i
+					break find
+				}
+			}
+		}
+	}
+	if _, ok := idx["out_trade_no"]; !ok {
+		return nil
+	}
+	if _, ok := idx["amount"]; !ok {
+		return nil
+	}
+	return idx
+}
+
+func (r *LedgerReport) reconcile(repo store.TokenRepo, in io.Reader) error {
+	trades, err := parseAlipayCSV(in)
+	if err != nil {
+		return err
+	}
+
+	var begin, end time.Time
+	paid := make(map[string]bool, len(trades))
+	for _, t := range trades {
+		paid[t.OutTradeNo] = true
+
+		if !t.Time.IsZero() {
+			if begin.IsZero() || t.Time.Before(begin) {
+				begin = t.Time
+			}
+			if t.Time.After(end) {
+				end = t.Time
+			}
+		}
+
+		l, err := repo.FindLog(t.OutTradeNo)
+		if err != nil {
+			return err
+		}
+		if l.ID == 0 {
+			// 账单中还有流量和第三方应用订单，只有 Token 订单需要流水
+			if strings.HasSuffix(t.Subject, " tokens") {
+				r.add(LedgerIssue{
+					Kind:   issueNoLog,
+					PayNo:  t.OutTradeNo,
+					Detail: fmt.Sprintf("paid %d cents without log", t.Cents),
+				})
+			}
+			continue
+		}
+
+		r.Trades++
+		if l.ExtraNum != t.Cents {
+			r.add(LedgerIssue{
+				Kind:   issueAmount,
+				UserID: l.UserID,
+				LogID:  l.ID,
+				PayNo:  l.PayNo,
+				Detail: fmt.Sprintf("log %d cents, paid %d cents", l.ExtraNum, t.Cents),
+			})
+		}
+	}
+
+	if begin.IsZero() {
+		return nil
+	}
+
+	// 订单 15 分钟内有效，此区间内创建的流水一定在账单时间范围内付款
+	end = end.Add(-15 * time.Minute)
+	if !end.After(begin) {
+		return nil
+	}
+	logs, err := repo.ListPaidLogs(begin, end)
+	if err != nil {
+		return err
+	}
+	for _, l := range logs {
+		if l.Type != store.LogTypeBuy || paid[l.PayNo] {
+			continue
+		}
+		r.add(LedgerIssue{
+			Kind:   issueNoTrade,
+			UserID: l.UserID,
+			LogID:  l.ID,
+			PayNo:  l.PayNo,
+			Detail: "log is not in the alipay bill",
+		})
+	}
+	return nil
+}
+
+// ledger 核对 Token 账本，POST 时请求体为支付宝账单 CSV
+func (p *Proxy) ledger(w http.ResponseWriter, req *http.Request) {
+	if !p.isAdmin(w, req) {
+		return
+	}
+
+	if p.TokenRepo == nil {
+		http.Error(w, "token repo is not enabled", http.StatusNotImplemented)
+		return
+	}
+
+	var bill io.Reader
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		defer req.Body.Close()
+		bill = http.MaxBytesReader(w, req.Body, 64<<20)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	r, err := VerifyLedger(p.TokenRepo, bill)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r)
+}
@@ -0,0 +1,181 @@
+package led
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	ecdsa2 "github.com/taoso/led/ecdsa"
+	"github.com/taoso/led/store"
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+func signHash(t *testing.T, k *ecdsa.PrivateKey, hash []byte) string {
+	r, s, err := ecdsa.Sign(rand.Reader, k, hash)
+	assert.Nil(t, err)
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return base64.StdEncoding.EncodeToString(sig)
+}
+
+func TestVerifyLedger(t *testing.T) {
+	f, err := os.CreateTemp("", "led-*.db")
+	assert.Nil(t, err)
+	f.Close()
+	defer os.Remove(f.Name())
+
+	repo := store.NewTokenRepo(f.Name())
+
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+
+	buy := store.TokenLog{
+		Type:     store.LogTypeBuy,
+		TokenNum: 1000,
+		ExtraNum: 100,
+		PayNo:    "pay-1",
+		Extra:    store.KV{"_pubkey": ecdsa2.Compress(k.PublicKey)},
+		Created:  now,
+	}
+	h := sha256.Sum256([]byte(buy.SignData()))
+	buy.Sign = signHash(t, k, h[:])
+	w, err := repo.UpdateWallet(&buy)
+	assert.Nil(t, err)
+
+	h = sha256.Sum256([]byte("chat"))
+	cost := store.TokenLog{
+		UserID:   w.ID,
+		Type:     store.LogTypeCost,
+		TokenNum: 100,
+		Extra:    store.KV{"sha256": hex.EncodeToString(h[:])},
+		Sign:     signHash(t, k, h[:]),
+		Created:  now,
+	}
+	_, err = repo.UpdateWallet(&cost)
+	assert.Nil(t, err)
+
+	r, err := VerifyLedger(repo, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, r.Wallets)
+	assert.Equal(t, 2, r.Logs)
+	assert.Empty(t, r.Issues)
+
+	// 伪造签名、重复支付单号、余额被改
+	bad := store.TokenLog{
+		UserID:   w.ID,
+		Type:     store.LogTypeBuy,
+		TokenNum: 500,
+		ExtraNum: 50,
+		PayNo:    "pay-1",
+		Sign:     buy.Sign,
+		Created:  now,
+	}
+	w, err = repo.UpdateWallet(&bad)
+	assert.Nil(t, err)
+	w.Tokens += 1
+	assert.Nil(t, repo.SaveWallet(w))
+
+	r, err = VerifyLedger(repo, nil)
+	assert.Nil(t, err)
+	kinds := map[string]int{}
+	for _, i := range r.Issues {
+		kinds[i.Kind]++
+	}
+	assert.Equal(t, map[string]int{issueSign: 1, issueDupPay: 1, issueBalance: 1}, kinds)
+
+	// 篡改流水
+	db, err := store.Open(f.Name())
+	assert.Nil(t, err)
+	_, err = db.Exec("update token_logs set after_num = 800 where id = ?", cost.ID)
+	assert.Nil(t, err)
+	db.Close()
+
+	r, err = VerifyLedger(repo, nil)
+	assert.Nil(t, err)
+	var gaps []LedgerIssue
+	for _, i := range r.Issues {
+		if i.Kind == issueGap {
+			gaps = append(gaps, i)
+		}
+	}
+	assert.Equal(t, 2, len(gaps))
+	assert.Equal(t, cost.ID, gaps[0].LogID)
+	assert.Equal(t, bad.ID, gaps[1].LogID)
+
+	bill := strings.Join([]string{
+		"#支付宝业务明细查询",
+		"支付宝交易号,商户订单号,商品名称,完成时间,订单金额（元）",
+		"2023001\t,pay-1\t,1000 tokens,2023-04-12 23:23:23,1.00",
+		"2023002\t,pay-2\t,2000 tokens,2023-04-12 23:24:23,2.00",
+		"2023003\t,foo@2023\t,Traffic: 2G,2023-04-12 23:25:23,2.00",
+		"#结束",
+	}, "\n")
+	r, err = VerifyLedger(repo, strings.NewReader(bill))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, r.Trades)
+	var bi []LedgerIssue
+	for _, i := range r.Issues {
+		if i.Kind == issueNoLog || i.Kind == issueAmount {
+			bi = append(bi, i)
+		}
+	}
+	assert.Equal(t, []LedgerIssue{
+		{Kind: issueNoLog, PayNo: "pay-2", Detail: "paid 200 cents without log"},
+	}, bi)
+}
+
+func TestParseAlipayCSV(t *testing.T) {
+	bill := "#账务明细\n商户订单号,商品名称,收入金额（+元）,订单金额（元）\n" +
+		"t1,10 tokens,1.00,2.50\n" +
+		",,3.50,\n"
+	b, err := simplifiedchinese.GBK.NewEncoder().String(bill)
+	assert.Nil(t, err)
+
+	ts, err := parseAlipayCSV(strings.NewReader(b))
+	assert.Nil(t, err)
+	assert.Equal(t, []alipayTrade{{OutTradeNo: "t1", Subject: "10 tokens", Cents: 250}}, ts)
+
+	_, err = parseAlipayCSV(strings.NewReader("a,b\n1,2\n"))
+	assert.NotNil(t, err)
+}
+
+func TestReconcileMissingTrade(t *testing.T) {
+	f, err := os.CreateTemp("", "led-*.db")
+	assert.Nil(t, err)
+	f.Close()
+	defer os.Remove(f.Name())
+
+	repo := store.NewTokenRepo(f.Name())
+
+	created, err := time.ParseInLocation(time.DateTime, "2023-04-12 23:30:00", time.Local)
+	assert.Nil(t, err)
+	for _, no := range []string{"pay-1", "pay-2"} {
+		l := store.TokenLog{Type: store.LogTypeBuy, TokenNum: 1000, ExtraNum: 100, PayNo: no,
+			Extra: store.KV{"_pubkey": "pk-" + no}, Created: created}
+		_, err = repo.UpdateWallet(&l)
+		assert.Nil(t, err)
+	}
+
+	bill := strings.Join([]string{
+		"商户订单号,商品名称,完成时间,订单金额（元）",
+		"pay-1,1000 tokens,2023-04-12 23:00:00,1.00",
+		"pay-3,Traffic: 2G,2023-04-13 01:00:00,2.00",
+	}, "\n")
+	r := &LedgerReport{}
+	assert.Nil(t, r.reconcile(repo, strings.NewReader(bill)))
+	assert.Equal(t, 1, r.Trades)
+	assert.Len(t, r.Issues, 1)
+	assert.Equal(t, issueNoTrade, r.Issues[0].Kind)
+	assert.Equal(t, "pay-2", r.Issues[0].PayNo)
+}
@@ -2,6 +2,7 @@ package led
 
 import (
 	"bytes"
+	"context"
 	"net/http"
 	"os"
 
@@ -9,6 +10,7 @@ import (
 	"github.com/emersion/go-smtp"
 	"github.com/jhillyerd/enmime"
 	"github.com/joho/godotenv"
+	"github.com/taoso/led/trace"
 )
 
 func (p *Proxy) Comment(host string, w http.ResponseWriter, req *http.Request) {
@@ -36,11 +38,7 @@ func (p *Proxy) Comment(host string, w http.ResponseWriter, req *http.Request) {
 		Subject(f.Get("subject")).
 		Text([]byte(content))
 
-	s := TLSSender{
-		Username: os.Getenv("SMTP_USER"),
-		Password: os.Getenv("SMTP_PASS"),
-		Hostaddr: os.Getenv("SMTP_HOST"),
-	}
+	s := smtpSender(req.Context())
 
 	if err = m.Send(s); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -52,9 +50,44 @@ type TLSSender struct {
 	Username string
 	Password string
 	Hostaddr string
+
+	ctx context.Context // 关联到当前链路，可以为空
+}
+
+// smtpSender returns the SMTP account from env.
+func smtpSender(ctx context.Context) TLSSender {
+	return TLSSender{
+		Username: os.Getenv("SMTP_USER"),
+		Password: os.Getenv("SMTP_PASS"),
+		Hostaddr: os.Getenv("SMTP_HOST"),
+		ctx:      ctx,
+	}
 }
 
 func (s TLSSender) Send(reversePath string, recipients []string, msg []byte) error {
+	ctx := s.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	_, sp := trace.Start(ctx, "smtp.send")
+	sp.Set("server.address", s.Hostaddr)
+	sp.Set("smtp.recipients", len(recipients))
+
 	auth := sasl.NewPlainClient("", s.Username, s.Password)
-	return smtp.SendMailTLS(s.Hostaddr, auth, reversePath, recipients, bytes.NewReader(msg))
+	err := smtp.SendMailTLS(s.Hostaddr, auth, reversePath, recipients, bytes.NewReader(msg))
+	sp.End(err)
+	return err
+}
+
+// sendMail sends a plain text mail with the SMTP account from env.
+func sendMail(ctx context.Context, name, email, subject, content string) error {
+	m := enmime.Builder().
+		From("", os.Getenv("SMTP_USER")).
+		To(name, email).
+		Subject(subject).
+		Text([]byte(content))
+
+	s := smtpSender(ctx)
+
+	return m.Send(s)
 }
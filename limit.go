@@ -0,0 +1,204 @@
+package led
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// ticketTier 流量套餐对应的限速等级
+type ticketTier struct {
+	Rate     int `json:"rate"`     // 每秒最大字节数，0 表示不限速
+	Conns    int `json:"conns"`    // 最大并发 CONNECT/connect-udp 连接数
+	Lifetime int `json:"lifetime"` // 单条连接的最长存活时间，单位秒
+}
+
+// 老 Ticket 没有限速等级，使用该默认等级
+const defaultTier = "s"
+
+var errTooManyConns = errors.New("too many connections")
+
+// tokenBucket limits the throughput to rate bytes per second.
+//
+// Callers may take more tokens than available and will sleep until the
+// debt is paid off. A nil tokenBucket does not limit anything.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenBucket{
+		rate:   float64(rate),
+		burst:  float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// reserve takes n tokens and returns how long to wait before using them.
+func (b *tokenBucket) reserve(n int) time.Duration {
+	if b == nil || n <= 0 {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) wait(n int) {
+	if d := b.reserve(n); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// limitRW throttles both Read and Write of rw with one token bucket.
+type limitRW struct {
+	rw io.ReadWriter
+	b  *tokenBucket
+}
+
+func (l limitRW) Read(p []byte) (n int, err error) {
+	n, err = l.rw.Read(p)
+	l.b.wait(n)
+	return
+}
+
+func (l limitRW) Write(p []byte) (n int, err error) {
+	l.b.wait(len(p))
+	return l.rw.Write(p)
+}
+
+// userLimit is shared by all flows of one proxy user.
+type userLimit struct {
+	tier   ticketTier
+	bucket *tokenBucket
+	conns  int // 当前并发连接数
+	refs   int // 当前引用数，包括普通 http 请求
+}
+
+// limiter tracks the limits of online proxy users.
+type limiter struct {
+	mu    sync.Mutex
+	users map[string]*userLimit
+}
+
+// acquire returns the limit of user. tier is only called when the user has
+// no active flows. If conn is true, one concurrent connection is taken.
+func (l *limiter) acquire(user string, conn bool, tier func() ticketTier) (*userLimit, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.users == nil {
+		l.users = map[string]*userLimit{}
+	}
+
+	u := l.users[user]
+	if u == nil {
+		t := tier()
+		u = &userLimit{tier: t, bucket: newTokenBucket(t.Rate)}
+		l.users[user] = u
+	}
+
+	if conn {
+		if u.tier.Conns > 0 && u.conns >= u.tier.Conns {
+			if u.refs == 0 {
+				delete(l.users, user)
+			}
+			return nil, errTooManyConns
+		}
+		u.conns++
+	}
+	u.refs++
+	return u, nil
+}
+
+// release returns what acquire has taken.
+func (l *limiter) release(user string, conn bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	u := l.users[user]
+	if u == nil {
+		return
+	}
+	if conn {
+		u.conns--
+	}
+	u.refs--
+	if u.refs <= 0 {
+		delete(l.users, user)
+	}
+}
+
+// limit acquires the limit of one proxy user flow. Users in users.txt are
+// not limited and get a nil *userLimit. The release func must be called
+// when the flow is done.
+func (p *Proxy) limit(user string, conn bool) (u *userLimit, release func(), err error) {
+	if _, ok := p.conf().users[user]; ok {
+		return nil, func() {}, nil
+	}
+	u, err = p.limiter.acquire(user, conn, func() ticketTier { return p.userTier(user) })
+	if err != nil {
+		return
+	}
+	release = func() { p.limiter.release(user, conn) }
+	return
+}
+
+// userTier returns the tier of the newest available ticket of user. Old
+// tickets without tier are not limited.
+func (p *Proxy) userTier(user string) ticketTier {
+	ts, err := p.TicketRepo.List(user, 10)
+	if err != nil {
+		return p.getTier(defaultTier)
+	}
+	now := time.Now()
+	for _, t := range ts {
+		if t.Bytes > 0 && t.Expires.After(now) {
+			return p.ticketTierOf(t)
+		}
+	}
+	return p.getTier(defaultTier)
+}
+
+// wrap throttles rw with the limit of u.
+func (u *userLimit) wrap(rw io.ReadWriter) io.ReadWriter {
+	if u == nil || u.bucket == nil {
+		return rw
+	}
+	return limitRW{rw: rw, b: u.bucket}
+}
+
+// lifetime closes all closers after the tier lifetime. The returned func
+// stops the timer.
+func (u *userLimit) lifetime(closers ...io.Closer) func() {
+	if u == nil || u.tier.Lifetime <= 0 {
+		return func() {}
+	}
+	t := time.AfterFunc(time.Duration(u.tier.Lifetime)*time.Second, func() {
+		for _, c := range closers {
+			c.Close()
+		}
+	})
+	return func() { t.Stop() }
+}
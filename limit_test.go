@@ -0,0 +1,106 @@
+package led
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/taoso/led/store"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(1000)
+
+	assert.Equal(t, time.Duration(0), b.reserve(1000))
+
+	d := b.reserve(500)
+	assert.InDelta(t, 500*time.Millisecond, d, float64(10*time.Millisecond))
+
+	assert.Nil(t, newTokenBucket(0))
+	assert.Equal(t, time.Duration(0), (*tokenBucket)(nil).reserve(1000))
+}
+
+func TestLimitRW(t *testing.T) {
+	b := bytes.NewBuffer(nil)
+	rw := limitRW{rw: b, b: newTokenBucket(100)}
+
+	begin := time.Now()
+	rw.Write(make([]byte, 100))
+	rw.Write(make([]byte, 20))
+	assert.GreaterOrEqual(t, time.Since(begin), 190*time.Millisecond)
+}
+
+func TestLimiter(t *testing.T) {
+	var l limiter
+	n := 0
+	tier := func() ticketTier {
+		n++
+		return ticketTier{Conns: 2}
+	}
+
+	u1, err := l.acquire("foo", true, tier)
+	assert.Nil(t, err)
+	u2, err := l.acquire("foo", true, tier)
+	assert.Nil(t, err)
+	assert.Same(t, u1, u2)
+	assert.Equal(t, 1, n)
+
+	_, err = l.acquire("foo", true, tier)
+	assert.Equal(t, errTooManyConns, err)
+
+	// plain http requests are not limited by conns
+	_, err = l.acquire("foo", false, tier)
+	assert.Nil(t, err)
+	l.release("foo", false)
+
+	l.release("foo", true)
+	_, err = l.acquire("foo", true, tier)
+	assert.Nil(t, err)
+
+	l.release("foo", true)
+	l.release("foo", true)
+	assert.Empty(t, l.users)
+}
+
+func TestUserTier(t *testing.T) {
+	p := &Proxy{TicketRepo: store.NewTicketRepo(":memory:")}
+
+	assert.Equal(t, defaultTicketConfig.Tiers[defaultTier], p.userTier("foo"))
+
+	// 老 Ticket 没有等级，不限速
+	assert.Nil(t, p.TicketRepo.New("foo", store.TicketPlan{Bytes: 100, Days: 30}, "t1", "o1"))
+	assert.Equal(t, ticketTier{}, p.userTier("foo"))
+
+	assert.Nil(t, p.TicketRepo.New("foo", store.TicketPlan{Bytes: 100, Days: 30, Tier: "m"}, "t2", "o2"))
+	assert.Equal(t, defaultTicketConfig.Tiers["m"], p.userTier("foo"))
+}
+
+func TestTicketQueryLimits(t *testing.T) {
+	p := &Proxy{TicketRepo: store.NewTicketRepo(":memory:")}
+
+	assert.Nil(t, p.TicketRepo.New("foo", store.TicketPlan{Bytes: 100, Days: 30, Tier: "m"}, "t1", "o1"))
+	assert.Nil(t, p.TicketRepo.New("foo", store.TicketPlan{Bytes: 100, Days: 30}, "t2", "o2"))
+
+	req := httptest.NewRequest(http.MethodPost, "/+/ticket?query=1", strings.NewReader(`{"token":"foo"}`))
+	w := httptest.NewRecorder()
+	p.ServeTicket(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var ts []struct {
+		Tier   string     `json:"tier"`
+		Limits ticketTier `json:"limits"`
+	}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &ts))
+	if assert.Len(t, ts, 2) {
+		// 没有等级的 Ticket 不限速，与实际限速保持一致
+		assert.Equal(t, "", ts[0].Tier)
+		assert.Equal(t, ticketTier{}, ts[0].Limits)
+		assert.Equal(t, "m", ts[1].Tier)
+		assert.Equal(t, defaultTicketConfig.Tiers["m"], ts[1].Limits)
+	}
+}
@@ -0,0 +1,179 @@
+package led
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/felixge/httpsnoop"
+	"github.com/taoso/led/trace"
+)
+
+// RequestIDHeader 请求 ID 的请求头。客户端或者前置代理传入时沿用，否则自动生成。
+// 响应和发往上游的请求都会带上。
+// 注意 chat 接口响应的 X-Request-Id 是 OpenAI 的 ID，与此无关。
+const RequestIDHeader = "X-Led-Request-Id"
+
+type requestIDKey struct{}
+
+// RequestID 返回 ctx 中的请求 ID，不在请求中时为空
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// WithRequestID 将请求 ID 保存到 ctx 中
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// setRequestID 为上游请求 r 带上 ctx 中的请求 ID，headers 为上游自己约定的请求头
+func setRequestID(ctx context.Context, r *http.Request, headers ...string) {
+	id := RequestID(ctx)
+	if id == "" {
+		return
+	}
+	r.Header.Set(RequestIDHeader, id)
+	for _, h := range headers {
+		r.Header.Set(h, id)
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+var requestIDRE = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// LogRequests 为每个请求分配请求 ID，并输出结构化的访问日志
+func LogRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(RequestIDHeader)
+		if !requestIDRE.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		req = req.WithContext(WithRequestID(req.Context(), id))
+
+		m := httpsnoop.CaptureMetrics(h, w, req)
+
+		slog.InfoContext(req.Context(), "request",
+			"method", req.Method,
+			"host", req.Host,
+			"uri", redactURI(req.RequestURI),
+			"proto", req.Proto,
+			"status", m.Code,
+			"bytes", m.Written,
+			"duration", m.Duration,
+			"remote", clientIP(req),
+			"ua", req.UserAgent(),
+			"referer", redactURI(req.Referer()),
+		)
+	})
+}
+
+// NewLogHandler 创建结构化日志，format 为 json 或 text，level 为 debug、info、warn 或 error。
+// 日志会带上 context 中的请求 ID，并隐藏密码、令牌等敏感字段。
+func NewLogHandler(w io.Writer, format, level string) (slog.Handler, error) {
+	var l slog.Level
+	if level != "" {
+		if err := l.UnmarshalText([]byte(level)); err != nil {
+			return nil, err
+		}
+	}
+
+	opts := &slog.HandlerOptions{Level: l, ReplaceAttr: redactAttr}
+
+	var h slog.Handler
+	switch format {
+	case "", "json":
+		h = slog.NewJSONHandler(w, opts)
+	case "text":
+		h = slog.NewTextHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("invalid log format %q", format)
+	}
+	return ctxHandler{h}, nil
+}
+
+// ctxHandler 为日志加上 context 中的请求 ID 和链路 ID
+type ctxHandler struct {
+	slog.Handler
+}
+
+func (h ctxHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		r.AddAttrs(slog.String("req_id", id))
+	}
+	if sc := trace.SpanContextFrom(ctx); sc.IsValid() {
+		r.AddAttrs(slog.String("trace_id", sc.TraceID.String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h ctxHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return ctxHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h ctxHandler) WithGroup(name string) slog.Handler {
+	return ctxHandler{h.Handler.WithGroup(name)}
+}
+
+const redacted = "[redacted]"
+
+// sensitive 判断字段是否包含密码、令牌等敏感信息
+func sensitive(key string) bool {
+	k := strings.ToLower(key)
+	switch k {
+	case "authorization", "proxy-authorization", "cookie", "set-cookie",
+		"password", "passwd", "token", "secret", "sign", "signature", "key":
+		return true
+	}
+	// 如 web_key、access_token，但 prompt_tokens 之类的计数不算
+	for _, s := range []string{"password", "_token", "-token", "secret", "_key", "-key"} {
+		if strings.HasSuffix(k, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	if a.Value.Kind() != slog.KindGroup && sensitive(a.Key) {
+		return slog.String(a.Key, redacted)
+	}
+	return a
+}
+
+// redactURI 隐藏 URI 参数中的签名和令牌
+func redactURI(uri string) string {
+	path, query, ok := strings.Cut(uri, "?")
+	if !ok {
+		return uri
+	}
+	q, err := url.ParseQuery(query)
+	if err != nil {
+		return path + "?" + redacted
+	}
+	changed := false
+	for k := range q {
+		// s 为临时链接的签名
+		if k == "s" || sensitive(k) {
+			q[k] = []string{redacted}
+			changed = true
+		}
+	}
+	if !changed {
+		return uri
+	}
+	return path + "?" + q.Encode()
+}
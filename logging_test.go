@@ -0,0 +1,86 @@
+package led
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogRequests(t *testing.T) {
+	var buf bytes.Buffer
+	lh, err := NewLogHandler(&buf, "json", "debug")
+	assert.Nil(t, err)
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(lh))
+
+	var upstream *http.Request
+	h := LogRequests(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		upstream, _ = http.NewRequestWithContext(req.Context(), http.MethodGet, "https://api.example.com", nil)
+		setRequestID(req.Context(), upstream, "X-Client-Request-Id")
+		slog.InfoContext(req.Context(), "login", "user", "foo", "password", "bar")
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/+/file?s=sig&n=a.md&access_token=x", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	id := w.Header().Get(RequestIDHeader)
+	assert.Len(t, id, 16)
+	assert.Equal(t, id, upstream.Header.Get(RequestIDHeader))
+	assert.Equal(t, id, upstream.Header.Get("X-Client-Request-Id"))
+
+	var lines []map[string]any
+	for _, l := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+		var m map[string]any
+		assert.Nil(t, json.Unmarshal(l, &m))
+		lines = append(lines, m)
+	}
+	assert.Len(t, lines, 2)
+
+	assert.Equal(t, "login", lines[0]["msg"])
+	assert.Equal(t, id, lines[0]["req_id"])
+	assert.Equal(t, "foo", lines[0]["user"])
+	assert.Equal(t, redacted, lines[0]["password"])
+
+	assert.Equal(t, "request", lines[1]["msg"])
+	assert.Equal(t, id, lines[1]["req_id"])
+	assert.Equal(t, float64(http.StatusTeapot), lines[1]["status"])
+	assert.Equal(t, "/+/file?access_token=%5Bredacted%5D&n=a.md&s=%5Bredacted%5D", lines[1]["uri"])
+
+	// 沿用前置代理传入的请求 ID，不合法的重新生成
+	req = httptest.NewRequest(http.MethodGet, "https://lehu.in/", nil)
+	req.Header.Set(RequestIDHeader, "abc-123")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, "abc-123", w.Header().Get(RequestIDHeader))
+
+	req.Header.Set(RequestIDHeader, "a b\n")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Len(t, w.Header().Get(RequestIDHeader), 16)
+}
+
+func TestNewLogHandler(t *testing.T) {
+	var buf bytes.Buffer
+	lh, err := NewLogHandler(&buf, "text", "warn")
+	assert.Nil(t, err)
+
+	l := slog.New(lh)
+	l.Info("hidden")
+	l.Warn("shown", "token", "t1", "web_key", "k1", "prompt_tokens", 10,
+		slog.Group("header", "Proxy-Authorization", "Basic eDp5"))
+	_, out, _ := strings.Cut(buf.String(), " ")
+	assert.Equal(t, "level=WARN msg=shown token=[redacted] web_key=[redacted] prompt_tokens=10 header.Proxy-Authorization=[redacted]\n", out)
+
+	_, err = NewLogHandler(&buf, "xml", "")
+	assert.NotNil(t, err)
+	_, err = NewLogHandler(&buf, "", "verbose")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,119 @@
+package led
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/felixge/httpsnoop"
+	"github.com/taoso/led/metrics"
+)
+
+var (
+	httpRequests = metrics.NewCounter("led_http_requests_total",
+		"HTTP requests by vhost, route and status code.", "vhost", "route", "code")
+	httpDuration = metrics.NewHistogram("led_http_request_duration_seconds",
+		"HTTP request latency by vhost and route.", metrics.DefBuckets, "vhost", "route")
+
+	proxySessions = metrics.NewGauge("led_proxy_sessions",
+		"Active proxy sessions by protocol, including CONNECT and connect-udp tunnels.", "proto")
+	proxyBytes = metrics.NewCounter("led_proxy_bytes_total",
+		"Bytes proxied by protocol and direction.", "proto", "direction")
+
+	upstreamRequests = metrics.NewCounter("led_upstream_requests_total",
+		"Requests to upstreams by result, error means transport errors or 5xx responses.", "upstream", "result")
+
+	chatTokens = metrics.NewCounter("led_chat_tokens_total",
+		"Chat tokens by model and kind.", "model", "kind")
+	walletDebits = metrics.NewCounter("led_wallet_debits_total",
+		"Wallet debits by source and result.", "source", "result")
+	walletDebitTokens = metrics.NewCounter("led_wallet_debit_tokens_total",
+		"Tokens debited from wallets by source.", "source")
+
+	payNotifications = metrics.NewCounter("led_pay_notifications_total",
+		"Payment notifications by provider, kind and result.", "provider", "kind", "result")
+
+	zoneUpdates = metrics.NewCounter("led_zone_updates_total",
+		"DNS zone file updates by mode and result.", "mode", "result")
+
+	configReloads = metrics.NewCounter("led_config_reloads_total",
+		"Config reloads by result.", "result")
+	healthChecks = metrics.NewGauge("led_health_check_up",
+		"Result of the last health check by name, 1 for ok and 0 for error.", "check")
+)
+
+// result 将 err 转换为指标的 result 标签
+func result(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+// upstreamDone 记录一次上游请求，code 为上游的响应状态码，连接失败时为 0
+func upstreamDone(upstream string, err error, code int) {
+	if err == nil && code >= http.StatusInternalServerError {
+		upstreamRequests.Inc(upstream, "error")
+		return
+	}
+	upstreamRequests.Inc(upstream, result(err))
+}
+
+// debited 记录一次钱包扣费
+func debited(source string, tokens int, err error) {
+	walletDebits.Inc(source, result(err))
+	if err == nil {
+		walletDebitTokens.Add(float64(tokens), source)
+	}
+}
+
+// Instrument 统计请求数量和耗时，需要直接包装 Proxy 以便识别站点。
+// 代理请求的 vhost 为 proxy，其他未知站点为 other，避免标签过多。
+func (p *Proxy) Instrument(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		vhost, route := p.metricLabels(req)
+		m := httpsnoop.CaptureMetrics(h, w, req)
+		if m.Code == http.StatusNotFound {
+			route = "unknown"
+		}
+		httpRequests.Inc(vhost, route, strconv.Itoa(m.Code))
+		httpDuration.Observe(m.Duration.Seconds(), vhost, route)
+	})
+}
+
+func (p *Proxy) metricLabels(req *http.Request) (vhost, route string) {
+	if req.Method == http.MethodConnect {
+		if req.Proto == "connect-udp" {
+			return "proxy", "connect-udp"
+		}
+		return "proxy", "connect"
+	}
+	if req.Header.Get("Proxy-Authorization") != "" {
+		return "proxy", "http"
+	}
+
+	host := p.host(req.Host)
+	switch {
+	case p.conf().sites[host] != nil:
+		vhost = host
+	case strings.HasSuffix(host, ".zz.ac"):
+		vhost = "*.zz.ac"
+	default:
+		vhost = "other"
+	}
+
+	path := req.URL.Path
+	switch {
+	case strings.HasPrefix(path, "/+/"):
+		// 只保留第一级，如 /+/dav/a.md 为 /+/dav
+		seg, _, _ := strings.Cut(path[len("/+/"):], "/")
+		route = "/+/" + seg
+	case strings.HasPrefix(path, "/api/"):
+		route = "/api"
+	case req.Method == http.MethodGet || req.Method == http.MethodHead:
+		route = "static"
+	default:
+		route = "dav"
+	}
+	return
+}
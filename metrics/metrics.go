@@ -0,0 +1,278 @@
+// Package metrics 实现 Prometheus 文本格式的计数器、仪表盘和直方图，
+// 只覆盖 led 用到的功能，避免引入完整的客户端库。
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefBuckets 默认的请求耗时分桶，单位是秒
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry 保存已注册的指标，按注册顺序输出
+type Registry struct {
+	mu sync.Mutex
+	ms []metric
+}
+
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// Default 默认的注册表，包级别的 New 函数都注册到这里
+var Default = &Registry{}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ms = append(r.ms, m)
+}
+
+// Expose 按 Prometheus 文本格式输出所有指标
+func (r *Registry) Expose(w io.Writer) error {
+	r.mu.Lock()
+	ms := append([]metric(nil), r.ms...)
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range ms {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+// ServeHTTP 实现 /metrics 接口
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.Expose(w)
+}
+
+// Handler 返回 Default 的 /metrics 接口
+func Handler() http.Handler { return Default }
+
+// series 一组标签值对应的时间序列
+type series struct {
+	values []string
+	value  float64
+	counts []uint64 // 直方图各分桶的计数，不累加
+	sum    float64
+}
+
+// vec 按标签值分组的指标
+type vec struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+func newVec(name, help, typ string, labels []string) vec {
+	return vec{name: name, help: help, typ: typ, labels: labels, series: map[string]*series{}}
+}
+
+// with 返回 values 对应的序列，调用方需要持有 v.mu
+func (v *vec) with(values []string) *series {
+	if len(values) != len(v.labels) {
+		panic("metrics: " + v.name + " expects " + strconv.Itoa(len(v.labels)) + " label values")
+	}
+	k := strings.Join(values, "\xff")
+	s := v.series[k]
+	if s == nil {
+		s = &series{values: append([]string(nil), values...)}
+		v.series[k] = s
+	}
+	return s
+}
+
+func (v *vec) update(values []string, f func(s *series)) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	f(v.with(values))
+}
+
+// sorted 返回按标签值排序的序列副本
+func (v *vec) sorted() []series {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	ss := make([]series, 0, len(keys))
+	for _, k := range keys {
+		s := *v.series[k]
+		s.counts = append([]uint64(nil), s.counts...)
+		ss = append(ss, s)
+	}
+	return ss
+}
+
+func (v *vec) header(w *bufio.Writer) {
+	w.WriteString("# HELP " + v.name + " " + escape(v.help, false) + "\n")
+	w.WriteString("# TYPE " + v.name + " " + v.typ + "\n")
+}
+
+func (v *vec) write(w *bufio.Writer) {
+	v.header(w)
+	for _, s := range v.sorted() {
+		sample(w, v.name, v.labels, s.values, "", "", s.value)
+	}
+}
+
+// Counter 只增不减的计数器
+type Counter struct{ vec }
+
+// NewCounter 创建计数器并注册到 Default
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{newVec(name, help, "counter", labels)}
+	Default.register(c)
+	return c
+}
+
+func (c *Counter) Inc(values ...string) { c.Add(1, values...) }
+
+// Add 增加 d，d 不能为负数
+func (c *Counter) Add(d float64, values ...string) {
+	if d < 0 {
+		panic("metrics: counter " + c.name + " cannot decrease")
+	}
+	c.update(values, func(s *series) { s.value += d })
+}
+
+// Gauge 可增可减的仪表盘
+type Gauge struct{ vec }
+
+// NewGauge 创建仪表盘并注册到 Default
+func NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{newVec(name, help, "gauge", labels)}
+	Default.register(g)
+	return g
+}
+
+func (g *Gauge) Set(v float64, values ...string) {
+	g.update(values, func(s *series) { s.value = v })
+}
+
+func (g *Gauge) Add(d float64, values ...string) {
+	g.update(values, func(s *series) { s.value += d })
+}
+
+func (g *Gauge) Inc(values ...string) { g.Add(1, values...) }
+func (g *Gauge) Dec(values ...string) { g.Add(-1, values...) }
+
+// gaugeFunc 输出时调用 f 取值的仪表盘
+type gaugeFunc struct {
+	vec
+	f func() float64
+}
+
+// NewGaugeFunc 创建输出时才取值的仪表盘，如队列长度
+func NewGaugeFunc(name, help string, f func() float64) {
+	Default.register(&gaugeFunc{vec: newVec(name, help, "gauge", nil), f: f})
+}
+
+func (g *gaugeFunc) write(w *bufio.Writer) {
+	g.header(w)
+	sample(w, g.name, nil, nil, "", "", g.f())
+}
+
+// Histogram 按分桶统计观测值的分布
+type Histogram struct {
+	vec
+	buckets []float64
+}
+
+// NewHistogram 创建直方图并注册到 Default，buckets 必须递增
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{vec: newVec(name, help, "histogram", labels), buckets: buckets}
+	Default.register(h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64, values ...string) {
+	h.update(values, func(s *series) {
+		if s.counts == nil {
+			s.counts = make([]uint64, len(h.buckets))
+		}
+		if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+			s.counts[i]++
+		}
+		s.value++
+		s.sum += v
+	})
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.header(w)
+	for _, s := range h.sorted() {
+		var n uint64
+		for i, b := range h.buckets {
+			if s.counts != nil {
+				n += s.counts[i]
+			}
+			sample(w, h.name+"_bucket", h.labels, s.values, "le", format(b), float64(n))
+		}
+		sample(w, h.name+"_bucket", h.labels, s.values, "le", "+Inf", s.value)
+		sample(w, h.name+"_sum", h.labels, s.values, "", "", s.sum)
+		sample(w, h.name+"_count", h.labels, s.values, "", "", s.value)
+	}
+}
+
+// sample 输出一行样本，extra 为直方图的 le 标签
+func sample(w *bufio.Writer, name string, labels, values []string, extra, extraValue string, v float64) {
+	w.WriteString(name)
+	if len(labels) > 0 || extra != "" {
+		w.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(l + `="` + escape(values[i], true) + `"`)
+		}
+		if extra != "" {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(extra + `="` + extraValue + `"`)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(format(v))
+	w.WriteByte('\n')
+}
+
+func format(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escape(s string, label bool) string {
+	if label {
+		return labelEscaper.Replace(s)
+	}
+	return helpEscaper.Replace(s)
+}
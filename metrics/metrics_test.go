@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	c := NewCounter("test_requests_total", "Requests.", "route", "code")
+	c.Inc("/a", "200")
+	c.Add(2, "/a", "200")
+	c.Inc("/b\"\n", "500")
+	assert.Panics(t, func() { c.Inc("/a") })
+	assert.Panics(t, func() { c.Add(-1, "/a", "200") })
+
+	g := NewGauge("test_sessions", "Sessions.", "proto")
+	g.Inc("connect")
+	g.Inc("connect")
+	g.Dec("connect")
+
+	n := 3
+	NewGaugeFunc("test_queue", "Queue depth.", func() float64 { return float64(n) })
+
+	h := NewHistogram("test_seconds", "Latency.", []float64{0.1, 1}, "route")
+	h.Observe(0.05, "/a")
+	h.Observe(0.1, "/a")
+	h.Observe(5, "/a")
+
+	var buf bytes.Buffer
+	assert.Nil(t, Default.Expose(&buf))
+	assert.Equal(t, `# HELP test_requests_total Requests.
+# TYPE test_requests_total counter
+test_requests_total{route="/a",code="200"} 3
+test_requests_total{route="/b\"\n",code="500"} 1
+# HELP test_sessions Sessions.
+# TYPE test_sessions gauge
+test_sessions{proto="connect"} 1
+# HELP test_queue Queue depth.
+# TYPE test_queue gauge
+test_queue 3
+# HELP test_seconds Latency.
+# TYPE test_seconds histogram
+test_seconds_bucket{route="/a",le="0.1"} 2
+test_seconds_bucket{route="/a",le="1"} 2
+test_seconds_bucket{route="/a",le="+Inf"} 3
+test_seconds_sum{route="/a"} 5.15
+test_seconds_count{route="/a"} 3
+`, buf.String())
+
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Contains(t, w.Header().Get("Content-Type"), "version=0.0.4")
+	assert.Contains(t, w.Body.String(), "test_queue 3")
+}
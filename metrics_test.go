@@ -0,0 +1,59 @@
+package led
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/taoso/led/metrics"
+)
+
+func TestInstrument(t *testing.T) {
+	p := &Proxy{}
+	p.SetSites(map[string]string{"lehu.in": ""})
+
+	h := p.Instrument(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/+/missing" {
+			http.NotFound(w, req)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+
+	for _, c := range []struct {
+		method, url string
+		header      string
+	}{
+		{http.MethodGet, "https://lehu.in/+/ledger?x=1", ""},
+		{http.MethodPost, "https://lehu.in/+/dav/a.md", ""},
+		{http.MethodGet, "https://lehu.in/+/missing", ""},
+		{http.MethodGet, "https://foo.zz.ac/index.html", ""},
+		{http.MethodPut, "https://foo.zz.ac/a.md", ""},
+		{http.MethodGet, "https://evil.com/", ""},
+		{http.MethodGet, "http://example.com/", "Basic eDp5"},
+	} {
+		req := httptest.NewRequest(c.method, c.url, nil)
+		if c.header != "" {
+			req.Header.Set("Proxy-Authorization", c.header)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	var buf bytes.Buffer
+	assert.Nil(t, metrics.Default.Expose(&buf))
+	s := buf.String()
+	for _, l := range []string{
+		`led_http_requests_total{vhost="lehu.in",route="/+/ledger",code="200"} 1`,
+		`led_http_requests_total{vhost="lehu.in",route="/+/dav",code="200"} 1`,
+		`led_http_requests_total{vhost="lehu.in",route="unknown",code="404"} 1`,
+		`led_http_requests_total{vhost="*.zz.ac",route="static",code="200"} 1`,
+		`led_http_requests_total{vhost="*.zz.ac",route="dav",code="200"} 1`,
+		`led_http_requests_total{vhost="other",route="static",code="200"} 1`,
+		`led_http_requests_total{vhost="proxy",route="http",code="200"} 1`,
+		`led_http_request_duration_seconds_count{vhost="lehu.in",route="/+/ledger"} 1`,
+	} {
+		assert.Contains(t, s, l)
+	}
+}
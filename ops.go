@@ -0,0 +1,45 @@
+package led
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+
+	"github.com/taoso/led/store"
+)
+
+// GrantTicket grants the ticket plan of id to token without payment. Plans
+// out of their sale window can also be granted. trade is saved as the buy
+// order of the ticket and must be unique.
+func (p *Proxy) GrantTicket(token, id, trade string) (t store.Ticket, err error) {
+	if p.TicketRepo == nil {
+		return t, errors.New("ticket repo is not enabled")
+	}
+	if token == "" {
+		return t, errors.New("token is required")
+	}
+
+	for _, plan := range p.ticketCfg().Plans {
+		if plan.ID != id {
+			continue
+		}
+		if err = p.TicketRepo.New(token, plan.TicketPlan, trade, ""); err != nil {
+			return
+		}
+		return p.TicketRepo.Find(trade)
+	}
+	return t, errors.New("plan not found")
+}
+
+// ApproveZone approves the pending zz.ac application of domain and mails the
+// login link to the applicant. Mail errors are only logged.
+func (p *Proxy) ApproveZone(ctx context.Context, domain string) (store.Zone, error) {
+	z, link, err := p.approveZone(ctx, domain)
+	if err != nil {
+		return z, err
+	}
+	if err := zoneCreatedMail(ctx, z, link); err != nil {
+		slog.ErrorContext(ctx, "zone created mail error", "zone", z.Name, "err", err)
+	}
+	return z, nil
+}
@@ -0,0 +1,37 @@
+package led
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/taoso/led/store"
+)
+
+func TestGrantTicket(t *testing.T) {
+	p := &Proxy{}
+	_, err := p.GrantTicket("tk", "2g", "grant-1")
+	assert.EqualError(t, err, "ticket repo is not enabled")
+
+	// 已下架的套餐也可以赠送
+	end := time.Now().Add(-time.Hour)
+	p.TicketRepo = store.NewTicketRepo(":memory:")
+	p.config.Store(&config{tickets: &ticketConfig{
+		Plans: []ticketPlan{{ID: "old", TicketPlan: store.TicketPlan{Bytes: 100, Days: 30, Tier: "s"}, End: &end}},
+		Tiers: defaultTicketConfig.Tiers,
+	}})
+
+	_, err = p.GrantTicket("tk", "2g", "grant-1")
+	assert.EqualError(t, err, "plan not found")
+
+	tk, err := p.GrantTicket("tk", "old", "grant-1")
+	assert.Nil(t, err)
+	assert.NotZero(t, tk.ID)
+	assert.Equal(t, "tk", tk.Token)
+	assert.Equal(t, 100, tk.Bytes)
+	assert.Equal(t, "grant-1", tk.BuyOrder)
+
+	b, err := p.TicketRepo.Balance("tk")
+	assert.Nil(t, err)
+	assert.Equal(t, 100, b.Bytes)
+}
@@ -0,0 +1,208 @@
+package led
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/taoso/led/pay"
+	"github.com/taoso/led/store"
+	"github.com/taoso/led/trace"
+)
+
+// 订单业务类型
+const (
+	orderTokens = "tokens"
+	orderTicket = "ticket"
+	orderApp    = "app"
+)
+
+// orderTimeout 订单有效期，超时后由 ReconcileOrders 查询并处理
+const orderTimeout = 15 * time.Minute
+
+// errInvalidNotify 通知内容有误，重试也无法处理
+var errInvalidNotify = errors.New("invalid notification")
+
+// appError 第三方应用处理通知失败
+type appError struct {
+	Code int
+	Body []byte
+}
+
+func (e *appError) Error() string {
+	return fmt.Sprintf("app notify status %d: %s", e.Code, e.Body)
+}
+
+// notifyError 按错误类型响应支付渠道，渠道会重试非 2xx 的响应
+func notifyError(w http.ResponseWriter, err error) {
+	var ae *appError
+	switch {
+	case errors.As(err, &ae):
+		w.WriteHeader(ae.Code)
+		w.Write(ae.Body)
+		return
+	case errors.Is(err, errInvalidNotify):
+		w.WriteHeader(http.StatusBadRequest)
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	w.Write([]byte(err.Error()))
+}
+
+// payContext 把 ctx 中的请求 ID 带给支付渠道
+func payContext(ctx context.Context) context.Context {
+	return pay.WithRequestID(ctx, RequestID(ctx))
+}
+
+// createOrder 创建支付订单并记录待支付订单。
+// 回传参数超出渠道限制时只保存在本地，通知时再从订单中补全。
+func (p *Proxy) createOrder(ctx context.Context, pp pay.Provider, kind string, o pay.Order) (string, error) {
+	o.RequestID = RequestID(ctx)
+	qr, err := pp.Create(ctx, o)
+	if errors.Is(err, pay.ErrExtraTooLong) && p.OrderRepo != nil {
+		short := o
+		short.Extra = ""
+		qr, err = pp.Create(ctx, short)
+	}
+	if errors.Is(err, pay.ErrExtraTooLong) {
+		return "", fmt.Errorf("%s: %w, order repo is required", pp.Name(), err)
+	} else if err != nil {
+		return "", err
+	}
+
+	if p.OrderRepo == nil {
+		return qr, nil
+	}
+
+	po := store.PayOrder{
+		Provider: pp.Name(),
+		Kind:     kind,
+		TradeNo:  o.TradeNo,
+		Cents:    o.Cents,
+		Subject:  o.Subject,
+		Extra:    o.Extra,
+	}
+	if err := p.OrderRepo.NewOrder(&po); err != nil {
+		return "", err
+	}
+	return qr, nil
+}
+
+// applyPayment 处理支付成功的订单，支付通知和对账共用，重复调用只处理一次
+func (p *Proxy) applyPayment(ctx context.Context, kind string, n *pay.Notification) (err error) {
+	var o store.PayOrder
+	if p.OrderRepo != nil {
+		if o, err = p.OrderRepo.FindOrder(n.TradeNo); err != nil {
+			return
+		}
+	}
+	if o.ID != 0 {
+		if n.Extra == "" {
+			n.Extra = o.Extra
+		}
+		if n.Cents != o.Cents {
+			return fmt.Errorf("%w: amount mismatch", errInvalidNotify)
+		}
+	}
+
+	switch kind {
+	case orderTokens:
+		err = p.applyTokens(n)
+	case orderTicket:
+		err = p.applyTicket(n)
+	case orderApp:
+		err = p.notifyApp(ctx, n)
+	default:
+		err = fmt.Errorf("unknown order kind %s", kind)
+	}
+	if err != nil || o.ID == 0 || o.Status == store.OrderPaid {
+		return
+	}
+
+	o.Status = store.OrderPaid
+	o.PayNo = n.PayNo
+	return p.OrderRepo.UpdateOrder(&o)
+}
+
+// ReconcileOrders 定期查询超时仍未到账的订单。
+// 已支付的订单补充到账，丢失的支付通知不再需要人工处理；未支付的订单关闭。
+func (p *Proxy) ReconcileOrders(d time.Duration) {
+	t := time.NewTicker(d)
+	defer t.Stop()
+	for {
+		p.reconcileOrders(time.Now())
+		<-t.C
+	}
+}
+
+func (p *Proxy) reconcileOrders(now time.Time) {
+	after := 0
+	for {
+		os, err := p.OrderRepo.ListPending(now.Add(-orderTimeout), after, 100)
+		if err != nil {
+			slog.Error("list pending orders error", "err", err)
+			return
+		}
+		for _, o := range os {
+			// 每个订单单独分配请求 ID，便于在日志和链路中查找
+			ctx, sp := trace.Start(WithRequestID(context.Background(), newRequestID()), "order.reconcile")
+			err := p.reconcileOrder(ctx, o)
+			sp.End(err)
+			if err != nil {
+				slog.Error("reconcile order error", "provider", o.Provider, "trade_no", o.TradeNo, "err", err)
+			}
+		}
+		if len(os) < 100 {
+			return
+		}
+		after = os[len(os)-1].ID
+	}
+}
+
+func (p *Proxy) reconcileOrder(ctx context.Context, o store.PayOrder) error {
+	pp, ok := p.Payments[o.Provider]
+	if !ok {
+		return fmt.Errorf("payment %s is not enabled", o.Provider)
+	}
+
+	ctx = payContext(ctx)
+	n, err := pp.Query(ctx, o.TradeNo)
+	if errors.Is(err, pay.ErrNotFound) {
+		// 用户没有扫码，渠道还没有创建交易
+		n = &pay.Notification{Status: pay.StatusPending}
+	} else if err != nil {
+		return err
+	}
+
+	switch n.Status {
+	case pay.StatusPaid:
+		slog.Info("apply missed payment", "provider", o.Provider, "kind", o.Kind, "trade_no", o.TradeNo, "pay_no", n.PayNo)
+		return p.applyPayment(ctx, o.Kind, n)
+	case pay.StatusPending:
+		// 关闭失败时保持待支付，下次重试
+		if err := pp.Close(ctx, o.TradeNo); err != nil && !errors.Is(err, pay.ErrNotFound) {
+			return err
+		}
+	}
+
+	o.Status = store.OrderClosed
+	if err := p.OrderRepo.UpdateOrder(&o); err != nil {
+		return err
+	}
+
+	// 通知应用订单已关闭
+	if o.Kind == orderApp {
+		return p.notifyApp(ctx, &pay.Notification{
+			Provider: o.Provider,
+			TradeNo:  o.TradeNo,
+			Cents:    o.Cents,
+			Status:   pay.StatusClosed,
+			Subject:  o.Subject,
+			Extra:    o.Extra,
+		})
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package led
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/taoso/led/pay"
+	"github.com/taoso/led/store"
+)
+
+func TestReconcileOrders(t *testing.T) {
+	f, err := os.CreateTemp("", "led-*.db")
+	assert.Nil(t, err)
+	f.Close()
+	defer os.Remove(f.Name())
+
+	// 回传参数超过渠道限制时只保存在订单中
+	fake := &pay.Fake{ExtraLimit: 128}
+	p := &Proxy{
+		TokenRepo: store.NewTokenRepo(f.Name()),
+		OrderRepo: store.NewOrderRepo(":memory:"),
+	}
+	p.AddPayment(fake)
+
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	b, err := json.Marshal(alipayArgs{
+		TokenNum: 1000,
+		CentNum:  100,
+		Pubkey:   base64.StdEncoding.EncodeToString(elliptic.Marshal(k.Curve, k.X, k.Y)),
+		Created:  time.Now(),
+	})
+	assert.Nil(t, err)
+
+	for _, no := range []string{"t1", "t2"} {
+		_, err = p.createOrder(context.Background(), fake, orderTokens, pay.Order{
+			TradeNo: no,
+			Cents:   100,
+			Subject: "1000 tokens",
+			Extra:   url.QueryEscape(string(b)),
+		})
+		assert.Nil(t, err)
+	}
+	o, err := fake.Query(context.Background(), "t1")
+	assert.Nil(t, err)
+	assert.Equal(t, "", o.Extra)
+
+	// 没有订单库时无法保存回传参数
+	np := &Proxy{}
+	_, err = np.createOrder(context.Background(), fake, orderTokens, pay.Order{
+		TradeNo: "t0",
+		Cents:   100,
+		Subject: "1000 tokens",
+		Extra:   url.QueryEscape(string(b)),
+	})
+	assert.ErrorIs(t, err, pay.ErrExtraTooLong)
+
+	// 渠道没有这个订单
+	assert.Nil(t, p.OrderRepo.NewOrder(&store.PayOrder{Provider: "fake", Kind: orderTokens, TradeNo: "t3", Cents: 100}))
+
+	// t1 已支付但通知丢失
+	fake.Pay("t1")
+
+	// 未超时的订单不处理
+	p.reconcileOrders(time.Now())
+	l, err := p.TokenRepo.FindLog("t1")
+	assert.Nil(t, err)
+	assert.Zero(t, l.ID)
+
+	later := time.Now().Add(orderTimeout + time.Minute)
+	p.reconcileOrders(later)
+
+	l, err = p.TokenRepo.FindLog("t1")
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, l.TokenNum)
+	assert.Equal(t, "fake", l.Extra["provider"])
+
+	for no, status := range map[string]store.OrderStatus{
+		"t1": store.OrderPaid,
+		"t2": store.OrderClosed,
+		"t3": store.OrderClosed,
+	} {
+		po, err := p.OrderRepo.FindOrder(no)
+		assert.Nil(t, err)
+		assert.Equal(t, status, po.Status, no)
+	}
+	o, err = fake.Query(context.Background(), "t2")
+	assert.Nil(t, err)
+	assert.Equal(t, pay.StatusClosed, o.Status)
+
+	// 迟到的支付通知不会重复充值
+	n := fake.Pay("t1")
+	w := httptest.NewRecorder()
+	p.buyTokensNotify(w, pay.NotifyRequest("/+/buy-tokens-notify?provider=fake", n), nil)
+	assert.Equal(t, "success", w.Body.String())
+
+	u, err := p.TokenRepo.GetWallet(l.UserID)
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, u.Tokens)
+
+	p.reconcileOrders(later)
+	u, err = p.TokenRepo.GetWallet(l.UserID)
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, u.Tokens)
+}
@@ -8,13 +8,15 @@ import (
 	"github.com/smartwalle/alipay/v3"
 )
 
+// Alipay 支付宝当面付
 type Alipay struct {
 	client *alipay.Client
 }
 
 // New 创建支付宝实例
 func New(appID, privateKey, publicKey string) *Alipay {
-	client, err := alipay.New(appID, privateKey, true)
+	client, err := alipay.New(appID, privateKey, true,
+		alipay.WithHTTPClient(&http.Client{Transport: requestIDTransport{}}))
 	if err != nil {
 		panic(err)
 	}
@@ -24,23 +26,16 @@ func New(appID, privateKey, publicKey string) *Alipay {
 	return &Alipay{client: client}
 }
 
-type Order struct {
-	Subject string
-	TradeNo string
-	Amount  string
-	Extra   string
+func (ali *Alipay) Name() string { return "alipay" }
 
-	NotifyURL string
-}
-
-// CreateQR 创建二维码支付订单
-func (ali *Alipay) CreateQR(o Order) (string, error) {
-	r, err := ali.client.TradePreCreate(context.TODO(), alipay.TradePreCreate{
+// Create 创建二维码支付订单，15 分钟内有效
+func (ali *Alipay) Create(ctx context.Context, o Order) (string, error) {
+	r, err := ali.client.TradePreCreate(WithRequestID(ctx, o.RequestID), alipay.TradePreCreate{
 		Trade: alipay.Trade{
 			NotifyURL:      o.NotifyURL,
 			Subject:        o.Subject,
 			OutTradeNo:     o.TradeNo,
-			TotalAmount:    o.Amount,
+			TotalAmount:    Yuan(o.Cents),
 			PassbackParams: o.Extra,
 			TimeoutExpress: "15m",
 		},
@@ -50,13 +45,107 @@ func (ali *Alipay) CreateQR(o Order) (string, error) {
 	}
 
 	if r.Code != alipay.CodeSuccess {
-		return "", fmt.Errorf("TradePreCreate error: %w", err)
+		return "", fmt.Errorf("TradePreCreate error: %w", r.Error)
 	}
 
 	return r.QRCode, nil
 }
 
-func (ali *Alipay) GetNotification(req *http.Request) (n *alipay.Notification, err error) {
-	n, err = ali.client.GetTradeNotification(req)
-	return
+func (ali *Alipay) Notify(req *http.Request) (*Notification, error) {
+	t, err := ali.client.GetTradeNotification(req)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &Notification{
+		Provider: ali.Name(),
+		TradeNo:  t.OutTradeNo,
+		PayNo:    t.TradeNo,
+		Status:   alipayStatus(t.TradeStatus),
+		BuyerID:  t.BuyerId,
+		Subject:  t.Subject,
+		Extra:    t.PassbackParams,
+		RefundNo: t.OutBizNo,
+	}
+	if n.Cents, err = Cents(t.TotalAmount); err != nil {
+		return nil, err
+	}
+	if t.RefundFee != "" {
+		if n.RefundCents, err = Cents(t.RefundFee); err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+func (ali *Alipay) Ack(w http.ResponseWriter) {
+	w.Write([]byte("success"))
+}
+
+func (ali *Alipay) Query(ctx context.Context, tradeNo string) (*Notification, error) {
+	r, err := ali.client.TradeQuery(ctx, alipay.TradeQuery{OutTradeNo: tradeNo})
+	if err != nil {
+		return nil, err
+	}
+	if r.SubCode == "ACQ.TRADE_NOT_EXIST" {
+		return nil, ErrNotFound
+	}
+	if !r.IsSuccess() {
+		return nil, fmt.Errorf("TradeQuery error: %w", r.Error)
+	}
+
+	n := &Notification{
+		Provider: ali.Name(),
+		TradeNo:  r.OutTradeNo,
+		PayNo:    r.TradeNo,
+		Status:   alipayStatus(r.TradeStatus),
+		BuyerID:  r.BuyerUserId,
+	}
+	if n.Cents, err = Cents(r.TotalAmount); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+func (ali *Alipay) Refund(ctx context.Context, f Refund) error {
+	r, err := ali.client.TradeRefund(WithRequestID(ctx, f.RequestID), alipay.TradeRefund{
+		OutTradeNo:   f.TradeNo,
+		OutRequestNo: f.RefundNo,
+		RefundAmount: Yuan(f.Cents),
+		RefundReason: f.Reason,
+	})
+	if err != nil {
+		return err
+	}
+
+	if !r.IsSuccess() {
+		return fmt.Errorf("TradeRefund error: %w", r.Error)
+	}
+
+	return nil
+}
+
+func (ali *Alipay) Close(ctx context.Context, tradeNo string) error {
+	r, err := ali.client.TradeClose(ctx, alipay.TradeClose{OutTradeNo: tradeNo})
+	if err != nil {
+		return err
+	}
+
+	// 用户没有扫码时支付宝还没有创建交易
+	if !r.IsSuccess() && r.SubCode != "ACQ.TRADE_NOT_EXIST" {
+		return fmt.Errorf("TradeClose error: %w", r.Error)
+	}
+
+	return nil
+}
+
+func alipayStatus(s alipay.TradeStatus) Status {
+	switch s {
+	case alipay.TradeStatusSuccess, alipay.TradeStatusFinished:
+		return StatusPaid
+	case alipay.TradeStatusClosed:
+		return StatusClosed
+	default:
+		return StatusPending
+	}
 }
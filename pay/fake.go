@@ -0,0 +1,165 @@
+package pay
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Fake 内存中的支付渠道，用于测试和本地开发。
+// 通知请求使用表单格式，可以用 NotifyRequest 构造。
+type Fake struct {
+	// ExtraLimit 回传参数最大长度，用于模拟微信等渠道的限制，0 表示不限制
+	ExtraLimit int
+
+	mu      sync.Mutex
+	orders  map[string]*Notification
+	refunds []Refund
+}
+
+func (f *Fake) Name() string { return "fake" }
+
+func (f *Fake) Create(ctx context.Context, o Order) (string, error) {
+	if f.ExtraLimit > 0 && len(o.Extra) > f.ExtraLimit {
+		return "", ErrExtraTooLong
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.orders == nil {
+		f.orders = map[string]*Notification{}
+	}
+	f.orders[o.TradeNo] = &Notification{
+		Provider: f.Name(),
+		TradeNo:  o.TradeNo,
+		Cents:    o.Cents,
+		Subject:  o.Subject,
+		Extra:    o.Extra,
+	}
+	return "fake://pay/" + o.TradeNo, nil
+}
+
+// Pay 模拟用户付款，返回对应的支付通知
+func (f *Fake) Pay(tradeNo string) *Notification {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	o, ok := f.orders[tradeNo]
+	if !ok {
+		return nil
+	}
+	o.Status = StatusPaid
+	o.PayNo = "fake-" + tradeNo
+	n := *o
+	return &n
+}
+
+func (f *Fake) Notify(req *http.Request) (*Notification, error) {
+	if err := req.ParseForm(); err != nil {
+		return nil, err
+	}
+	v := req.PostForm
+
+	n := &Notification{
+		Provider: f.Name(),
+		TradeNo:  v.Get("trade_no"),
+		PayNo:    v.Get("pay_no"),
+		BuyerID:  v.Get("buyer_id"),
+		Subject:  v.Get("subject"),
+		Extra:    v.Get("extra"),
+		RefundNo: v.Get("refund_no"),
+	}
+	var err error
+	if n.Cents, err = strconv.Atoi(v.Get("cents")); err != nil {
+		return nil, ErrInvalidAmount
+	}
+	if s := v.Get("refund_cents"); s != "" {
+		if n.RefundCents, err = strconv.Atoi(s); err != nil {
+			return nil, ErrInvalidAmount
+		}
+	}
+	switch v.Get("status") {
+	case "paid":
+		n.Status = StatusPaid
+	case "closed":
+		n.Status = StatusClosed
+	}
+	return n, nil
+}
+
+// NotifyRequest 构造 n 对应的通知请求
+func NotifyRequest(target string, n *Notification) *http.Request {
+	v := url.Values{}
+	v.Set("trade_no", n.TradeNo)
+	v.Set("pay_no", n.PayNo)
+	v.Set("buyer_id", n.BuyerID)
+	v.Set("subject", n.Subject)
+	v.Set("extra", n.Extra)
+	v.Set("cents", strconv.Itoa(n.Cents))
+	v.Set("status", n.Status.String())
+	if n.RefundNo != "" {
+		v.Set("refund_no", n.RefundNo)
+		v.Set("refund_cents", strconv.Itoa(n.RefundCents))
+	}
+
+	req, err := http.NewRequest(http.MethodPost, target, strings.NewReader(v.Encode()))
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req
+}
+
+func (f *Fake) Ack(w http.ResponseWriter) {
+	w.Write([]byte("success"))
+}
+
+func (f *Fake) Query(ctx context.Context, tradeNo string) (*Notification, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	o, ok := f.orders[tradeNo]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	n := *o
+	return &n, nil
+}
+
+func (f *Fake) Refund(ctx context.Context, r Refund) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, x := range f.refunds {
+		if x.RefundNo == r.RefundNo {
+			return nil
+		}
+	}
+	f.refunds = append(f.refunds, r)
+	return nil
+}
+
+// Refunds 返回已经执行的退款
+func (f *Fake) Refunds() []Refund {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Refund(nil), f.refunds...)
+}
+
+func (f *Fake) Close(ctx context.Context, tradeNo string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	o, ok := f.orders[tradeNo]
+	if !ok {
+		return ErrNotFound
+	}
+	if o.Status == StatusPending {
+		o.Status = StatusClosed
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package pay
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/taoso/led/trace"
+)
+
+// Provider 支付渠道
+type Provider interface {
+	// Name 渠道名称，如 alipay、wechat、stripe
+	Name() string
+	// Create 创建订单，返回二维码内容或者支付链接
+	Create(ctx context.Context, o Order) (string, error)
+	// Notify 解析并验证异步通知，包括支付通知和退款通知
+	Notify(req *http.Request) (*Notification, error)
+	// Ack 通知处理成功后响应支付渠道，否则渠道会重复通知
+	Ack(w http.ResponseWriter)
+	// Query 按商户订单号查询订单，订单不存在时返回 ErrNotFound
+	Query(ctx context.Context, tradeNo string) (*Notification, error)
+	// Refund 退款，RefundNo 相同的请求只会退款一次
+	Refund(ctx context.Context, r Refund) error
+	// Close 关闭未支付的订单
+	Close(ctx context.Context, tradeNo string) error
+}
+
+// Order 支付订单
+type Order struct {
+	Subject string
+	TradeNo string // 商户订单号，参见 NewTradeNo
+	Cents   int    // 支付金额，单位是分
+	Extra   string // 回传参数，通知时原样返回
+
+	NotifyURL string
+	RequestID string // 请求 ID，放在发往渠道的请求头中，便于排查
+}
+
+// Status 订单状态
+type Status int
+
+const (
+	StatusPending Status = iota // 等待支付
+	StatusPaid                  // 支付成功
+	StatusClosed                // 已关闭或者已全额退款
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusPaid:
+		return "paid"
+	case StatusClosed:
+		return "closed"
+	default:
+		return "pending"
+	}
+}
+
+// Notification 各渠道统一的订单通知，也用作订单查询结果
+type Notification struct {
+	Provider string
+	TradeNo  string // 商户订单号
+	PayNo    string // 渠道交易号
+	Cents    int    // 订单金额，单位是分
+	Status   Status
+	BuyerID  string
+	Subject  string
+	Extra    string
+
+	// 退款通知才有以下字段
+	RefundNo    string
+	RefundCents int
+
+	// Noop 无需处理的通知，如尚未成功的退款，应答渠道即可
+	Noop bool
+}
+
+// IsRefund 是否为退款通知
+func (n *Notification) IsRefund() bool {
+	return n.RefundNo != "" || n.RefundCents > 0
+}
+
+// Refund 退款请求
+type Refund struct {
+	TradeNo  string
+	RefundNo string
+	Cents    int // 退款金额
+	Total    int // 订单金额，微信支付需要
+	Reason   string
+
+	RequestID string // 同 Order.RequestID
+}
+
+var (
+	ErrNotFound      = errors.New("order not found")
+	ErrExtraTooLong  = errors.New("extra is too long")
+	ErrInvalidAmount = errors.New("invalid amount")
+)
+
+// Yuan 将分转换成元，保留两位小数
+func Yuan(cents int) string {
+	return strconv.FormatFloat(float64(cents)/100, 'f', 2, 64)
+}
+
+// Cents 将元转换成分
+func Cents(yuan string) (int, error) {
+	i, f, _ := strings.Cut(strings.TrimSpace(yuan), ".")
+	if i == "" || len(f) > 2 {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidAmount, yuan)
+	}
+	f += strings.Repeat("0", 2-len(f))
+	n, err := strconv.Atoi(i + f)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidAmount, yuan)
+	}
+	return n, nil
+}
+
+// NewTradeNo 生成商户订单号
+//
+// 毫秒时间戳加 8 位随机数，共 25 位数字，满足各渠道对订单号的限制。
+func NewTradeNo() string {
+	ts := time.Now().UTC().Format("20060102150405.000")
+	ts = strings.Replace(ts, ".", "", 1)
+
+	n, err := rand.Int(rand.Reader, big.NewInt(1e8))
+	if err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%s%08d", ts, n)
+}
+
+// RequestIDHeader 携带请求 ID 的请求头，与 led 的访问日志一致
+const RequestIDHeader = "X-Led-Request-Id"
+
+type requestIDKey struct{}
+
+// WithRequestID 将请求 ID 保存到 ctx 中，调用渠道接口时带上
+func WithRequestID(ctx context.Context, id string) context.Context {
+	if id == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// setRequestID 为 req 设置 ctx 中的请求 ID
+func setRequestID(req *http.Request) {
+	if id, _ := req.Context().Value(requestIDKey{}).(string); id != "" {
+		req.Header.Set(RequestIDHeader, id)
+	}
+}
+
+// requestIDTransport 为 SDK 发出的请求设置请求 ID
+type requestIDTransport struct{}
+
+func (requestIDTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTripper 不能修改原请求
+	req = req.Clone(req.Context())
+	setRequestID(req)
+	return defaultClient.Transport.RoundTrip(req)
+}
+
+// defaultClient 调用渠道接口，请求需要带上 ctx 才能关联到当前链路
+var defaultClient = &http.Client{Transport: &trace.Transport{}}
@@ -0,0 +1,56 @@
+package pay
+
+import (
+	"context"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCents(t *testing.T) {
+	for yuan, cents := range map[string]int{
+		"1":     100,
+		"1.5":   150,
+		"0.01":  1,
+		"12.34": 1234,
+	} {
+		n, err := Cents(yuan)
+		assert.Nil(t, err)
+		assert.Equal(t, cents, n)
+		assert.Equal(t, yuan, Yuan(n)[:len(yuan)])
+	}
+
+	for _, yuan := range []string{"", "1.234", "-1", "a"} {
+		_, err := Cents(yuan)
+		assert.ErrorIs(t, err, ErrInvalidAmount)
+	}
+}
+
+func TestNewTradeNo(t *testing.T) {
+	a, b := NewTradeNo(), NewTradeNo()
+	assert.Regexp(t, regexp.MustCompile(`^[0-9]{25}$`), a)
+	assert.NotEqual(t, a, b)
+}
+
+func TestFake(t *testing.T) {
+	f := &Fake{}
+	qr, err := f.Create(context.Background(), Order{TradeNo: "t1", Cents: 100, Extra: "x"})
+	assert.Nil(t, err)
+	assert.Equal(t, "fake://pay/t1", qr)
+
+	n := f.Pay("t1")
+	assert.Equal(t, StatusPaid, n.Status)
+
+	got, err := f.Notify(NotifyRequest("/notify", n))
+	assert.Nil(t, err)
+	assert.Equal(t, n, got)
+
+	assert.Nil(t, f.Close(context.Background(), "t1"))
+	n, err = f.Query(context.Background(), "t1")
+	assert.Nil(t, err)
+	assert.Equal(t, StatusPaid, n.Status)
+
+	_, err = f.Query(context.Background(), "t2")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
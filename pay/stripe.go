@@ -0,0 +1,352 @@
+package pay
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Stripe 使用 Checkout Session 收款，返回的是支付页面链接
+type Stripe struct {
+	SecretKey     string
+	WebhookSecret string
+	Currency      string // 默认为 cny
+	SuccessURL    string // 支付完成后跳转的页面
+
+	// 接口地址，默认为 https://api.stripe.com
+	BaseURL string
+	Client  *http.Client
+}
+
+func (s *Stripe) Name() string { return "stripe" }
+
+// metadata 每个值最长 500 字符
+const stripeMetadataMax = 500
+
+// Create 创建 Checkout Session，订单号和回传参数同时写到 PaymentIntent，
+// 用于查询和退款。Stripe 要求 Session 至少 30 分钟后过期。
+func (s *Stripe) Create(ctx context.Context, o Order) (string, error) {
+	if len(o.Extra) > stripeMetadataMax {
+		return "", ErrExtraTooLong
+	}
+
+	currency := s.Currency
+	if currency == "" {
+		currency = "cny"
+	}
+
+	v := url.Values{}
+	v.Set("mode", "payment")
+	v.Set("client_reference_id", o.TradeNo)
+	v.Set("success_url", s.SuccessURL)
+	v.Set("expires_at", strconv.FormatInt(time.Now().Add(30*time.Minute).Unix(), 10))
+	v.Set("line_items[0][quantity]", "1")
+	v.Set("line_items[0][price_data][currency]", currency)
+	v.Set("line_items[0][price_data][unit_amount]", strconv.Itoa(o.Cents))
+	v.Set("line_items[0][price_data][product_data][name]", o.Subject)
+	for _, p := range []string{"metadata", "payment_intent_data[metadata]"} {
+		v.Set(p+"[trade_no]", o.TradeNo)
+		v.Set(p+"[subject]", o.Subject)
+		if o.Extra != "" {
+			v.Set(p+"[extra]", o.Extra)
+		}
+	}
+
+	var r struct {
+		URL string `json:"url"`
+	}
+	err := s.do(WithRequestID(ctx, o.RequestID), http.MethodPost, "/v1/checkout/sessions", v, "", &r)
+	return r.URL, err
+}
+
+type stripeObject struct {
+	ID                string            `json:"id"`
+	Object            string            `json:"object"`
+	Status            string            `json:"status"`
+	PaymentStatus     string            `json:"payment_status"`
+	PaymentIntent     string            `json:"payment_intent"`
+	Amount            int               `json:"amount"`
+	AmountTotal       int               `json:"amount_total"`
+	Customer          string            `json:"customer"`
+	Metadata          map[string]string `json:"metadata"`
+	ClientReferenceID string            `json:"client_reference_id"`
+}
+
+// Notify 验证 Stripe-Signature 并解析 Webhook 事件，只处理支付和退款事件
+func (s *Stripe) Notify(req *http.Request) (*Notification, error) {
+	defer req.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(req.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if err := s.verify(req.Header.Get("Stripe-Signature"), body); err != nil {
+		return nil, err
+	}
+
+	var e struct {
+		Type string `json:"type"`
+		Data struct {
+			Object stripeObject `json:"object"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &e); err != nil {
+		return nil, err
+	}
+
+	o := e.Data.Object
+	n := &Notification{
+		Provider: s.Name(),
+		TradeNo:  o.Metadata["trade_no"],
+		PayNo:    o.PaymentIntent,
+		Subject:  o.Metadata["subject"],
+		Extra:    o.Metadata["extra"],
+		BuyerID:  o.Customer,
+	}
+	switch e.Type {
+	case "checkout.session.completed", "checkout.session.async_payment_succeeded":
+		n.Cents = o.AmountTotal
+		if o.PaymentStatus == "paid" {
+			n.Status = StatusPaid
+		}
+	case "checkout.session.expired":
+		n.Cents = o.AmountTotal
+		n.Status = StatusClosed
+	case "refund.created", "refund.updated":
+		// 退款对象的 metadata 由 Refund 写入，退款成功前的事件只需要应答
+		if o.Status != "succeeded" {
+			n.Noop = true
+			break
+		}
+		n.Status = StatusPaid
+		n.RefundNo = o.Metadata["refund_no"]
+		n.RefundCents = o.Amount
+	default:
+		return nil, fmt.Errorf("unsupported stripe event %s", e.Type)
+	}
+	if n.TradeNo == "" {
+		n.TradeNo = o.ClientReferenceID
+	}
+	return n, nil
+}
+
+func (s *Stripe) Ack(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusOK)
+}
+
+// Query 按订单号搜索 PaymentIntent，用户没有打开支付页面时找不到
+func (s *Stripe) Query(ctx context.Context, tradeNo string) (*Notification, error) {
+	pi, err := s.findIntent(ctx, tradeNo)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &Notification{
+		Provider: s.Name(),
+		TradeNo:  tradeNo,
+		PayNo:    pi.ID,
+		Cents:    pi.Amount,
+		BuyerID:  pi.Customer,
+		Subject:  pi.Metadata["subject"],
+		Extra:    pi.Metadata["extra"],
+	}
+	switch pi.Status {
+	case "succeeded":
+		n.Status = StatusPaid
+	case "canceled":
+		n.Status = StatusClosed
+	}
+	return n, nil
+}
+
+func (s *Stripe) findIntent(ctx context.Context, tradeNo string) (*stripeObject, error) {
+	v := url.Values{}
+	v.Set("query", "metadata['trade_no']:'"+strings.ReplaceAll(tradeNo, "'", `\'`)+"'")
+	var r struct {
+		Data []stripeObject `json:"data"`
+	}
+	if err := s.do(ctx, http.MethodGet, "/v1/payment_intents/search", v, "", &r); err != nil {
+		return nil, err
+	}
+	if len(r.Data) == 0 {
+		return nil, ErrNotFound
+	}
+	return &r.Data[0], nil
+}
+
+// Refund 使用 RefundNo 作为幂等键
+func (s *Stripe) Refund(ctx context.Context, f Refund) error {
+	ctx = WithRequestID(ctx, f.RequestID)
+	pi, err := s.findIntent(ctx, f.TradeNo)
+	if err != nil {
+		return err
+	}
+
+	v := url.Values{}
+	v.Set("payment_intent", pi.ID)
+	v.Set("amount", strconv.Itoa(f.Cents))
+	v.Set("reason", "requested_by_customer")
+	v.Set("metadata[trade_no]", f.TradeNo)
+	v.Set("metadata[refund_no]", f.RefundNo)
+	if f.Reason != "" {
+		v.Set("metadata[reason]", f.Reason)
+	}
+	return s.do(ctx, http.MethodPost, "/v1/refunds", v, f.RefundNo, nil)
+}
+
+// Close 让未支付的 Checkout Session 立即过期，之后用户无法再支付。
+// 已经支付完成的 Session 返回错误，订单保持待支付，下次对账时再查询。
+func (s *Stripe) Close(ctx context.Context, tradeNo string) error {
+	cs, err := s.findSession(ctx, tradeNo)
+	if err != nil {
+		return err
+	}
+	switch cs.Status {
+	case "open":
+		return s.do(ctx, http.MethodPost, "/v1/checkout/sessions/"+cs.ID+"/expire", url.Values{}, "", nil)
+	case "complete":
+		return fmt.Errorf("checkout session %s is complete", cs.ID)
+	}
+	return nil
+}
+
+// findSession 按订单号查找 Checkout Session，用订单号中的时间缩小查询范围
+func (s *Stripe) findSession(ctx context.Context, tradeNo string) (*stripeObject, error) {
+	v := url.Values{}
+	v.Set("limit", "100")
+	if len(tradeNo) >= 14 {
+		if t, err := time.Parse("20060102150405", tradeNo[:14]); err == nil {
+			v.Set("created[gte]", strconv.FormatInt(t.Add(-time.Minute).Unix(), 10))
+			v.Set("created[lte]", strconv.FormatInt(t.Add(time.Minute).Unix(), 10))
+		}
+	}
+
+	for {
+		var r struct {
+			Data    []stripeObject `json:"data"`
+			HasMore bool           `json:"has_more"`
+		}
+		if err := s.do(ctx, http.MethodGet, "/v1/checkout/sessions", v, "", &r); err != nil {
+			return nil, err
+		}
+		for i, cs := range r.Data {
+			if cs.ClientReferenceID == tradeNo {
+				return &r.Data[i], nil
+			}
+		}
+		if !r.HasMore || len(r.Data) == 0 {
+			return nil, ErrNotFound
+		}
+		v.Set("starting_after", r.Data[len(r.Data)-1].ID)
+	}
+}
+
+type stripeError struct {
+	Status int
+	Err    struct {
+		Type    string `json:"type"`
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (e *stripeError) Error() string {
+	return fmt.Sprintf("stripe error %d %s: %s", e.Status, e.Err.Type, e.Err.Message)
+}
+
+func (s *Stripe) do(ctx context.Context, method, path string, v url.Values, idempotencyKey string, result any) error {
+	base := s.BaseURL
+	if base == "" {
+		base = "https://api.stripe.com"
+	}
+
+	var body io.Reader
+	u := base + path
+	if method == http.MethodGet {
+		u += "?" + v.Encode()
+	} else {
+		body = strings.NewReader(v.Encode())
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return err
+	}
+	setRequestID(req)
+	req.SetBasicAuth(s.SecretKey, "")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+
+	client := s.Client
+	if client == nil {
+		client = defaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		e := &stripeError{Status: resp.StatusCode}
+		json.Unmarshal(b, e)
+		return e
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(b, result)
+}
+
+// verify 校验 Webhook 签名，header 格式为 t=时间戳,v1=签名
+func (s *Stripe) verify(header string, body []byte) error {
+	var ts string
+	var sigs [][]byte
+	for _, kv := range strings.Split(header, ",") {
+		k, v, _ := strings.Cut(kv, "=")
+		switch k {
+		case "t":
+			ts = v
+		case "v1":
+			if b, err := hex.DecodeString(v); err == nil {
+				sigs = append(sigs, b)
+			}
+		}
+	}
+
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return errors.New("invalid stripe signature timestamp")
+	}
+	if time.Since(time.Unix(sec, 0)).Abs() > 5*time.Minute {
+		return errors.New("stripe signature expired")
+	}
+
+	m := hmac.New(sha256.New, []byte(s.WebhookSecret))
+	m.Write([]byte(ts + "."))
+	m.Write(body)
+	mac := m.Sum(nil)
+	for _, sig := range sigs {
+		if hmac.Equal(mac, sig) {
+			return nil
+		}
+	}
+	return errors.New("invalid stripe signature")
+}
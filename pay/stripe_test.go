@@ -0,0 +1,119 @@
+package pay
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func stripeRequest(secret, body string) *http.Request {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write([]byte(ts + "." + body))
+
+	req := httptest.NewRequest(http.MethodPost, "/notify", strings.NewReader(body))
+	req.Header.Set("Stripe-Signature", "t="+ts+",v1="+hex.EncodeToString(m.Sum(nil)))
+	return req
+}
+
+func TestStripe(t *testing.T) {
+	expired := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, _, _ := r.BasicAuth()
+		assert.Equal(t, "sk", key)
+
+		switch r.URL.Path {
+		case "/v1/checkout/sessions":
+			if r.Method == http.MethodGet {
+				w.Write([]byte(`{"data":[{"id":"cs_0","client_reference_id":"t0","status":"complete"},` +
+					`{"id":"cs_1","client_reference_id":"t1","status":"open"}],"has_more":false}`))
+				return
+			}
+			r.ParseForm()
+			assert.Equal(t, "t1", r.PostForm.Get("client_reference_id"))
+			assert.Equal(t, "100", r.PostForm.Get("line_items[0][price_data][unit_amount]"))
+			assert.Equal(t, "cny", r.PostForm.Get("line_items[0][price_data][currency]"))
+			assert.Equal(t, "x", r.PostForm.Get("payment_intent_data[metadata][extra]"))
+			assert.Equal(t, "req-1", r.Header.Get(RequestIDHeader))
+			w.Write([]byte(`{"id":"cs_1","url":"https://checkout.stripe.com/c/cs_1"}`))
+		case "/v1/payment_intents/search":
+			assert.Equal(t, "metadata['trade_no']:'t1'", r.URL.Query().Get("query"))
+			assert.Empty(t, r.Header.Get(RequestIDHeader))
+			w.Write([]byte(`{"data":[{"id":"pi_1","status":"succeeded","amount":100,"metadata":{"trade_no":"t1","extra":"x"}}]}`))
+		case "/v1/checkout/sessions/cs_1/expire":
+			expired++
+			w.Write([]byte(`{"id":"cs_1","status":"expired"}`))
+		case "/v1/refunds":
+			assert.Equal(t, "r1", r.Header.Get("Idempotency-Key"))
+			r.ParseForm()
+			assert.Equal(t, "pi_1", r.PostForm.Get("payment_intent"))
+			assert.Equal(t, "50", r.PostForm.Get("amount"))
+			w.Write([]byte(`{"id":"re_1"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":{"type":"invalid_request_error","message":"no"}}`))
+		}
+	}))
+	defer ts.Close()
+
+	s := &Stripe{SecretKey: "sk", WebhookSecret: "whsec", BaseURL: ts.URL}
+
+	u, err := s.Create(context.Background(), Order{TradeNo: "t1", Cents: 100, Subject: "test", Extra: "x", RequestID: "req-1"})
+	assert.Nil(t, err)
+	assert.Equal(t, "https://checkout.stripe.com/c/cs_1", u)
+
+	n, err := s.Query(context.Background(), "t1")
+	assert.Nil(t, err)
+	assert.Equal(t, StatusPaid, n.Status)
+	assert.Equal(t, "pi_1", n.PayNo)
+	assert.Equal(t, 100, n.Cents)
+
+	assert.Nil(t, s.Refund(context.Background(), Refund{TradeNo: "t1", RefundNo: "r1", Cents: 50}))
+
+	// 关闭订单时让 Session 过期，已完成的 Session 不能关闭
+	assert.Nil(t, s.Close(context.Background(), "t1"))
+	assert.Equal(t, 1, expired)
+	assert.NotNil(t, s.Close(context.Background(), "t0"))
+	assert.ErrorIs(t, s.Close(context.Background(), "t2"), ErrNotFound)
+
+	body := `{"type":"checkout.session.completed","data":{"object":{"id":"cs_1","payment_status":"paid",` +
+		`"payment_intent":"pi_1","amount_total":100,"client_reference_id":"t1","metadata":{"trade_no":"t1","extra":"x"}}}}`
+	n, err = s.Notify(stripeRequest("whsec", body))
+	assert.Nil(t, err)
+	assert.Equal(t, &Notification{
+		Provider: "stripe",
+		TradeNo:  "t1",
+		PayNo:    "pi_1",
+		Cents:    100,
+		Status:   StatusPaid,
+		Extra:    "x",
+	}, n)
+
+	body = `{"type":"refund.created","data":{"object":{"id":"re_1","status":"succeeded","amount":50,` +
+		`"payment_intent":"pi_1","metadata":{"trade_no":"t1","refund_no":"r1"}}}}`
+	n, err = s.Notify(stripeRequest("whsec", body))
+	assert.Nil(t, err)
+	assert.True(t, n.IsRefund())
+	assert.Equal(t, 50, n.RefundCents)
+
+	// 未完成的退款不需要处理
+	body = `{"type":"refund.created","data":{"object":{"id":"re_2","status":"pending","amount":50,` +
+		`"payment_intent":"pi_1","metadata":{"trade_no":"t1","refund_no":"r2"}}}}`
+	n, err = s.Notify(stripeRequest("whsec", body))
+	assert.Nil(t, err)
+	assert.True(t, n.Noop)
+	assert.False(t, n.IsRefund())
+	assert.Equal(t, StatusPending, n.Status)
+
+	_, err = s.Notify(stripeRequest("other", body))
+	assert.EqualError(t, err, "invalid stripe signature")
+}
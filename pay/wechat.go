@@ -0,0 +1,350 @@
+package pay
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// WechatPay 微信支付 Native 下单，使用 APIv3 接口
+type WechatPay struct {
+	AppID  string
+	MchID  string
+	Serial string // 商户证书序列号
+	Key    *rsa.PrivateKey
+	APIKey string // APIv3 密钥，用于解密通知
+
+	// 微信支付平台公钥，用于验证应答和通知签名
+	PlatformKey *rsa.PublicKey
+
+	// 接口地址，默认为 https://api.mch.weixin.qq.com
+	BaseURL string
+	Client  *http.Client
+}
+
+// NewWechatPay 创建微信支付实例，key 和 platformKey 为 PEM 格式
+func NewWechatPay(appID, mchID, serial, key, apiKey, platformKey string) (*WechatPay, error) {
+	b, _ := pem.Decode([]byte(key))
+	if b == nil {
+		return nil, errors.New("invalid wechat private key")
+	}
+	k, err := x509.ParsePKCS8PrivateKey(b.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	prv, ok := k.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("wechat private key is not rsa")
+	}
+
+	b, _ = pem.Decode([]byte(platformKey))
+	if b == nil {
+		return nil, errors.New("invalid wechat platform key")
+	}
+	k, err = x509.ParsePKIXPublicKey(b.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := k.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("wechat platform key is not rsa")
+	}
+
+	if len(apiKey) != 32 {
+		return nil, errors.New("wechat api key must be 32 bytes")
+	}
+
+	return &WechatPay{
+		AppID:       appID,
+		MchID:       mchID,
+		Serial:      serial,
+		Key:         prv,
+		APIKey:      apiKey,
+		PlatformKey: pub,
+	}, nil
+}
+
+func (wx *WechatPay) Name() string { return "wechat" }
+
+// 附加数据最长 128 字符
+const wechatAttachMax = 128
+
+type wechatAmount struct {
+	Total    int    `json:"total"`
+	Refund   int    `json:"refund,omitempty"`
+	Currency string `json:"currency,omitempty"`
+}
+
+type wechatTrade struct {
+	OutTradeNo    string       `json:"out_trade_no"`
+	TransactionID string       `json:"transaction_id"`
+	TradeState    string       `json:"trade_state"`
+	Attach        string       `json:"attach"`
+	Amount        wechatAmount `json:"amount"`
+	Payer         struct {
+		OpenID string `json:"openid"`
+	} `json:"payer"`
+
+	// 退款通知
+	OutRefundNo  string `json:"out_refund_no"`
+	RefundStatus string `json:"refund_status"`
+}
+
+func (t *wechatTrade) notification() *Notification {
+	n := &Notification{
+		Provider: "wechat",
+		TradeNo:  t.OutTradeNo,
+		PayNo:    t.TransactionID,
+		Cents:    t.Amount.Total,
+		BuyerID:  t.Payer.OpenID,
+		Extra:    t.Attach,
+	}
+	switch t.TradeState {
+	case "SUCCESS", "REFUND":
+		n.Status = StatusPaid
+	case "CLOSED", "REVOKED", "PAYERROR":
+		n.Status = StatusClosed
+	}
+	if t.OutRefundNo != "" {
+		n.Status = StatusPaid
+		n.RefundNo = t.OutRefundNo
+		n.RefundCents = t.Amount.Refund
+	}
+	return n
+}
+
+// Create 创建 Native 支付订单，返回二维码链接，15 分钟内有效
+func (wx *WechatPay) Create(ctx context.Context, o Order) (string, error) {
+	if len(o.Extra) > wechatAttachMax {
+		return "", ErrExtraTooLong
+	}
+
+	var r struct {
+		CodeURL string `json:"code_url"`
+	}
+	err := wx.do(WithRequestID(ctx, o.RequestID), http.MethodPost, "/v3/pay/transactions/native", map[string]any{
+		"appid":        wx.AppID,
+		"mchid":        wx.MchID,
+		"description":  o.Subject,
+		"out_trade_no": o.TradeNo,
+		"time_expire":  time.Now().Add(15 * time.Minute).Format(time.RFC3339),
+		"attach":       o.Extra,
+		"notify_url":   o.NotifyURL,
+		"amount":       wechatAmount{Total: o.Cents, Currency: "CNY"},
+	}, &r)
+	return r.CodeURL, err
+}
+
+// Notify 验证签名并解密通知
+func (wx *WechatPay) Notify(req *http.Request) (*Notification, error) {
+	defer req.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(req.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if err := wx.verify(req.Header, body); err != nil {
+		return nil, err
+	}
+
+	var e struct {
+		EventType string `json:"event_type"`
+		Resource  struct {
+			Ciphertext     string `json:"ciphertext"`
+			AssociatedData string `json:"associated_data"`
+			Nonce          string `json:"nonce"`
+		} `json:"resource"`
+	}
+	if err := json.Unmarshal(body, &e); err != nil {
+		return nil, err
+	}
+
+	data, err := base64.StdEncoding.DecodeString(e.Resource.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher([]byte(wx.APIKey))
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := gcm.Open(nil, []byte(e.Resource.Nonce), data, []byte(e.Resource.AssociatedData))
+	if err != nil {
+		return nil, err
+	}
+
+	var t wechatTrade
+	if err := json.Unmarshal(plain, &t); err != nil {
+		return nil, err
+	}
+	// 退款失败或关闭的通知无需处理，当作普通订单通知
+	if t.OutRefundNo != "" && t.RefundStatus != "SUCCESS" {
+		t.OutRefundNo = ""
+		t.Amount.Refund = 0
+	}
+	return t.notification(), nil
+}
+
+func (wx *WechatPay) Ack(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (wx *WechatPay) Query(ctx context.Context, tradeNo string) (*Notification, error) {
+	var t wechatTrade
+	err := wx.do(ctx, http.MethodGet, "/v3/pay/transactions/out-trade-no/"+
+		url.PathEscape(tradeNo)+"?mchid="+url.QueryEscape(wx.MchID), nil, &t)
+	if err != nil {
+		return nil, err
+	}
+	return t.notification(), nil
+}
+
+func (wx *WechatPay) Refund(ctx context.Context, f Refund) error {
+	return wx.do(WithRequestID(ctx, f.RequestID), http.MethodPost, "/v3/refund/domestic/refunds", map[string]any{
+		"out_trade_no":  f.TradeNo,
+		"out_refund_no": f.RefundNo,
+		"reason":        f.Reason,
+		"amount":        wechatAmount{Refund: f.Cents, Total: f.Total, Currency: "CNY"},
+	}, nil)
+}
+
+func (wx *WechatPay) Close(ctx context.Context, tradeNo string) error {
+	return wx.do(ctx, http.MethodPost, "/v3/pay/transactions/out-trade-no/"+
+		url.PathEscape(tradeNo)+"/close", map[string]any{"mchid": wx.MchID}, nil)
+}
+
+type wechatError struct {
+	Status  int
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *wechatError) Error() string {
+	return fmt.Sprintf("wechat pay error %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+// do 调用接口，请求和应答都要签名
+func (wx *WechatPay) do(ctx context.Context, method, path string, args, result any) error {
+	var body []byte
+	if args != nil {
+		var err error
+		if body, err = json.Marshal(args); err != nil {
+			return err
+		}
+	}
+
+	base := wx.BaseURL
+	if base == "" {
+		base = "https://api.mch.weixin.qq.com"
+	}
+	req, err := http.NewRequestWithContext(ctx, method, base+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	setRequestID(req)
+
+	auth, err := wx.sign(method, path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", auth)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	client := wx.Client
+	if client == nil {
+		client = defaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= 300 {
+		e := &wechatError{Status: resp.StatusCode}
+		json.Unmarshal(b, e)
+		if e.Code == "ORDER_NOT_EXIST" || e.Code == "RESOURCE_NOT_EXISTS" {
+			return ErrNotFound
+		}
+		return e
+	}
+
+	if err := wx.verify(resp.Header, b); err != nil {
+		return err
+	}
+	if result == nil || len(b) == 0 {
+		return nil
+	}
+	return json.Unmarshal(b, result)
+}
+
+// sign 生成请求的 Authorization 头
+func (wx *WechatPay) sign(method, path string, body []byte) (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	n := hex.EncodeToString(nonce)
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+
+	msg := method + "\n" + path + "\n" + ts + "\n" + n + "\n" + string(body) + "\n"
+	h := sha256.Sum256([]byte(msg))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, wx.Key, crypto.SHA256, h[:])
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf(`WECHATPAY2-SHA256-RSA2048 mchid="%s",nonce_str="%s",signature="%s",timestamp="%s",serial_no="%s"`,
+		wx.MchID, n, base64.StdEncoding.EncodeToString(sig), ts, wx.Serial), nil
+}
+
+// verify 使用平台公钥验证应答或通知签名
+func (wx *WechatPay) verify(h http.Header, body []byte) error {
+	ts := h.Get("Wechatpay-Timestamp")
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return errors.New("invalid wechatpay timestamp")
+	}
+	if time.Since(time.Unix(sec, 0)).Abs() > 5*time.Minute {
+		return errors.New("wechatpay timestamp expired")
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(h.Get("Wechatpay-Signature"))
+	if err != nil {
+		return err
+	}
+
+	msg := ts + "\n" + h.Get("Wechatpay-Nonce") + "\n" + string(body) + "\n"
+	d := sha256.Sum256([]byte(msg))
+	if err := rsa.VerifyPKCS1v15(wx.PlatformKey, crypto.SHA256, d[:], sig); err != nil {
+		return errors.New("invalid wechatpay signature")
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package pay
+
+import (
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func wechatSign(t *testing.T, k *rsa.PrivateKey, h http.Header, body []byte) {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	h.Set("Wechatpay-Timestamp", ts)
+	h.Set("Wechatpay-Nonce", "n1")
+	d := sha256.Sum256([]byte(ts + "\nn1\n" + string(body) + "\n"))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, d[:])
+	assert.Nil(t, err)
+	h.Set("Wechatpay-Signature", base64.StdEncoding.EncodeToString(sig))
+}
+
+func TestWechatPay(t *testing.T) {
+	mch, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	platform, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+
+	auth := regexp.MustCompile(`nonce_str="(\w+)",signature="([^"]+)",timestamp="(\d+)"`)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		m := auth.FindStringSubmatch(r.Header.Get("Authorization"))
+		assert.Equal(t, 4, len(m))
+		msg := r.Method + "\n" + r.URL.RequestURI() + "\n" + m[3] + "\n" + m[1] + "\n" + string(body) + "\n"
+		d := sha256.Sum256([]byte(msg))
+		sig, _ := base64.StdEncoding.DecodeString(m[2])
+		assert.Nil(t, rsa.VerifyPKCS1v15(&mch.PublicKey, crypto.SHA256, d[:], sig))
+
+		var resp []byte
+		switch r.URL.Path {
+		case "/v3/pay/transactions/native":
+			var args map[string]any
+			assert.Nil(t, json.Unmarshal(body, &args))
+			assert.Equal(t, "t1", args["out_trade_no"])
+			assert.Equal(t, map[string]any{"total": float64(100), "currency": "CNY"}, args["amount"])
+			resp = []byte(`{"code_url":"weixin://wxpay/bizpayurl?pr=x"}`)
+		case "/v3/pay/transactions/out-trade-no/t2":
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"code":"ORDER_NOT_EXIST","message":"not found"}`))
+			return
+		}
+		wechatSign(t, platform, w.Header(), resp)
+		w.Write(resp)
+	}))
+	defer ts.Close()
+
+	wx := &WechatPay{
+		AppID:       "app",
+		MchID:       "mch",
+		Key:         mch,
+		APIKey:      strings.Repeat("k", 32),
+		PlatformKey: &platform.PublicKey,
+		BaseURL:     ts.URL,
+	}
+
+	qr, err := wx.Create(context.Background(), Order{TradeNo: "t1", Cents: 100, Subject: "test"})
+	assert.Nil(t, err)
+	assert.Equal(t, "weixin://wxpay/bizpayurl?pr=x", qr)
+
+	_, err = wx.Create(context.Background(), Order{TradeNo: "t1", Extra: strings.Repeat("x", 129)})
+	assert.ErrorIs(t, err, ErrExtraTooLong)
+
+	_, err = wx.Query(context.Background(), "t2")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// 支付通知
+	block, _ := aes.NewCipher([]byte(wx.APIKey))
+	gcm, _ := cipher.NewGCM(block)
+	plain := `{"out_trade_no":"t1","transaction_id":"42","trade_state":"SUCCESS","attach":"x","amount":{"total":100},"payer":{"openid":"o1"}}`
+	ct := gcm.Seal(nil, []byte("0123456789ab"), []byte(plain), []byte("transaction"))
+	body, _ := json.Marshal(map[string]any{
+		"event_type": "TRANSACTION.SUCCESS",
+		"resource": map[string]string{
+			"ciphertext":      base64.StdEncoding.EncodeToString(ct),
+			"associated_data": "transaction",
+			"nonce":           "0123456789ab",
+		},
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/notify", strings.NewReader(string(body)))
+	wechatSign(t, platform, req.Header, body)
+	n, err := wx.Notify(req)
+	assert.Nil(t, err)
+	assert.Equal(t, &Notification{
+		Provider: "wechat",
+		TradeNo:  "t1",
+		PayNo:    "42",
+		Cents:    100,
+		Status:   StatusPaid,
+		BuyerID:  "o1",
+		Extra:    "x",
+	}, n)
+
+	// 签名错误
+	req = httptest.NewRequest(http.MethodPost, "/notify", strings.NewReader(string(body)))
+	wechatSign(t, mch, req.Header, body)
+	_, err = wx.Notify(req)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,37 @@
+package led
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/taoso/led/pay"
+)
+
+// defaultPayment 请求没有指定支付渠道时使用支付宝，兼容老客户端和老订单的通知地址
+const defaultPayment = "alipay"
+
+// AddPayment 启用支付渠道
+func (p *Proxy) AddPayment(pp pay.Provider) {
+	if p.Payments == nil {
+		p.Payments = map[string]pay.Provider{}
+	}
+	p.Payments[pp.Name()] = pp
+}
+
+// payment 按请求参数 provider 选择支付渠道
+func (p *Proxy) payment(req *http.Request) (pay.Provider, error) {
+	name := req.URL.Query().Get("provider")
+	if name == "" {
+		name = defaultPayment
+	}
+	if pp, ok := p.Payments[name]; ok {
+		return pp, nil
+	}
+	return nil, fmt.Errorf("payment %s is not enabled", name)
+}
+
+// notifyURL 生成 pp 的异步通知地址，通知时根据 provider 选择渠道验证
+func notifyURL(host, path string, pp pay.Provider) string {
+	return "https://" + host + path + "?provider=" + url.QueryEscape(pp.Name())
+}
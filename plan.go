@@ -0,0 +1,177 @@
+package led
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/taoso/led/store"
+)
+
+// ticketPlan 可购买的流量套餐
+type ticketPlan struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Cents int    `json:"cents"` // 价格，单位是分
+
+	store.TicketPlan
+
+	// 套餐的上架时间，用于限时促销，为空表示不限
+	Begin *time.Time `json:"begin,omitempty"`
+	End   *time.Time `json:"end,omitempty"`
+}
+
+// UnmarshalJSON 没有设置 up_ratio 和 down_ratio 时按 100% 计费，只有明确设为 0 才免费
+func (p *ticketPlan) UnmarshalJSON(b []byte) error {
+	type plan ticketPlan
+	v := plan{TicketPlan: store.TicketPlan{UpRatio: 100, DownRatio: 100}}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*p = ticketPlan(v)
+	return nil
+}
+
+// active reports whether the plan can be bought at t.
+func (p *ticketPlan) active(t time.Time) bool {
+	if p.Begin != nil && t.Before(*p.Begin) {
+		return false
+	}
+	if p.End != nil && !t.Before(*p.End) {
+		return false
+	}
+	return true
+}
+
+// ticketConfig 流量套餐及限速等级配置
+type ticketConfig struct {
+	Plans []ticketPlan          `json:"plans"`
+	Tiers map[string]ticketTier `json:"tiers"`
+}
+
+const GB = 1024 * 1024 * 1024
+
+var defaultTicketConfig = ticketConfig{
+	Plans: []ticketPlan{
+		{ID: "2g", Name: "2GB@30d", Cents: 200, TicketPlan: store.TicketPlan{Bytes: 2 * GB, Days: 30, Tier: "s", UpRatio: 100, DownRatio: 100}},
+		{ID: "8g", Name: "8GB@60d", Cents: 400, TicketPlan: store.TicketPlan{Bytes: 8 * GB, Days: 60, Tier: "m", UpRatio: 100, DownRatio: 100}},
+		{ID: "32g", Name: "32GB@90d", Cents: 800, TicketPlan: store.TicketPlan{Bytes: 32 * GB, Days: 90, Tier: "l", UpRatio: 100, DownRatio: 100}},
+	},
+	Tiers: map[string]ticketTier{
+		"s": {Rate: 2 * 1024 * 1024, Conns: 32, Lifetime: 2 * 3600},
+		"m": {Rate: 8 * 1024 * 1024, Conns: 64, Lifetime: 6 * 3600},
+		"l": {Rate: 32 * 1024 * 1024, Conns: 128, Lifetime: 24 * 3600},
+	},
+}
+
+// parseTicketConfig parses and validates the ticket config. Missing tiers
+// are taken from the default config.
+func parseTicketConfig(b []byte) (c ticketConfig, err error) {
+	if err = json.Unmarshal(b, &c); err != nil {
+		return
+	}
+	if c.Tiers == nil {
+		c.Tiers = map[string]ticketTier{}
+	}
+	for name, t := range defaultTicketConfig.Tiers {
+		if _, ok := c.Tiers[name]; !ok {
+			c.Tiers[name] = t
+		}
+	}
+	if len(c.Plans) == 0 {
+		err = errors.New("no ticket plans")
+		return
+	}
+	ids := map[string]bool{}
+	for _, p := range c.Plans {
+		if p.ID == "" || ids[p.ID] {
+			err = fmt.Errorf("invalid plan id %q", p.ID)
+			return
+		}
+		ids[p.ID] = true
+		if p.Cents <= 0 || p.Bytes <= 0 {
+			err = fmt.Errorf("invalid price or bytes of plan %s", p.ID)
+			return
+		}
+		if p.Days <= 0 && !p.Unlimited {
+			err = fmt.Errorf("invalid days of plan %s", p.ID)
+			return
+		}
+		if p.UpRatio < 0 || p.DownRatio < 0 {
+			err = fmt.Errorf("invalid ratio of plan %s", p.ID)
+			return
+		}
+		if _, ok := c.Tiers[p.Tier]; !ok {
+			err = fmt.Errorf("tier %q of plan %s not found", p.Tier, p.ID)
+			return
+		}
+	}
+	return
+}
+
+// LoadPlans loads ticket plans and tiers from the json file of path.
+func (p *Proxy) LoadPlans(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	c, err := parseTicketConfig(b)
+	if err != nil {
+		return err
+	}
+	p.update(func(cfg *config) { cfg.tickets = &c })
+	return nil
+}
+
+func (p *Proxy) ticketCfg() *ticketConfig {
+	if c := p.conf().tickets; c != nil {
+		return c
+	}
+	return &defaultTicketConfig
+}
+
+// activePlans returns plans which can be bought at t.
+func (p *Proxy) activePlans(t time.Time) []ticketPlan {
+	ps := []ticketPlan{}
+	for _, plan := range p.ticketCfg().Plans {
+		if plan.active(t) {
+			ps = append(ps, plan)
+		}
+	}
+	return ps
+}
+
+// findPlan returns the active plan of id. Old clients without plan id are
+// matched by price. The price must be the same as the plan if given.
+func (p *Proxy) findPlan(id string, cents int, t time.Time) (ticketPlan, error) {
+	for _, plan := range p.activePlans(t) {
+		if (id != "" && plan.ID != id) || (id == "" && plan.Cents != cents) {
+			continue
+		}
+		if cents != 0 && cents != plan.Cents {
+			return ticketPlan{}, errors.New("price does not match the plan")
+		}
+		return plan, nil
+	}
+	return ticketPlan{}, errors.New("plan not found")
+}
+
+// ticketTierOf returns the tier of t. Tickets bought before tiers were
+// introduced have no tier and stay unthrottled.
+func (p *Proxy) ticketTierOf(t store.Ticket) ticketTier {
+	if t.Tier == "" {
+		return ticketTier{}
+	}
+	return p.getTier(t.Tier)
+}
+
+// getTier returns the tier of name, unknown names fall back to defaultTier.
+func (p *Proxy) getTier(name string) ticketTier {
+	ts := p.ticketCfg().Tiers
+	if t, ok := ts[name]; ok {
+		return t
+	}
+	return ts[defaultTier]
+}
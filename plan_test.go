@@ -0,0 +1,69 @@
+package led
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTicketConfig(t *testing.T) {
+	c, err := parseTicketConfig([]byte(`{
+		"plans": [
+			{"id": "1g", "name": "1GB", "cents": 100, "bytes": 1073741824, "days": 7, "tier": "s", "up_ratio": 0, "down_ratio": 100},
+			{"id": "vip", "name": "VIP", "cents": 9900, "bytes": 1073741824, "unlimited": true, "tier": "vip"}
+		],
+		"tiers": {"vip": {"rate": 0, "conns": 256, "lifetime": 0}}
+	}`))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(c.Plans))
+	assert.Equal(t, 0, c.Plans[0].UpRatio)
+	assert.Equal(t, 100, c.Plans[0].DownRatio)
+	assert.True(t, c.Plans[1].Unlimited)
+	assert.Equal(t, 100, c.Plans[1].UpRatio)
+	assert.Equal(t, 100, c.Plans[1].DownRatio)
+	assert.Equal(t, 256, c.Tiers["vip"].Conns)
+	assert.Equal(t, 32, c.Tiers["s"].Conns)
+
+	for _, s := range []string{
+		`{"plans": []}`,
+		`{"plans": [{"id": "a", "cents": 100, "bytes": 1, "days": 1, "tier": "x"}]}`,
+		`{"plans": [{"id": "a", "cents": 100, "bytes": 1, "days": 1}]}`,
+		`{"plans": [{"id": "a", "cents": 100, "bytes": 1, "days": 1, "tier": "s", "up_ratio": -1}]}`,
+		`{"plans": [{"id": "a", "cents": 100, "bytes": 1, "tier": "s"}]}`,
+		`{"plans": [{"id": "a", "cents": 0, "bytes": 1, "days": 1, "tier": "s"}]}`,
+		`{"plans": [{"id": "a", "cents": 1, "bytes": 1, "days": 1, "tier": "s"}, {"id": "a", "cents": 1, "bytes": 1, "days": 1, "tier": "s"}]}`,
+	} {
+		_, err := parseTicketConfig([]byte(s))
+		assert.NotNil(t, err, s)
+	}
+}
+
+func TestFindPlan(t *testing.T) {
+	now := time.Now()
+	end := now.Add(time.Hour)
+	p := &Proxy{}
+	p.config.Store(&config{tickets: &ticketConfig{
+		Plans: []ticketPlan{
+			{ID: "a", Cents: 100},
+			{ID: "b", Cents: 200, End: &end},
+		},
+		Tiers: defaultTicketConfig.Tiers,
+	}})
+
+	plan, err := p.findPlan("a", 0, now)
+	assert.Nil(t, err)
+	assert.Equal(t, "a", plan.ID)
+
+	plan, err = p.findPlan("", 200, now)
+	assert.Nil(t, err)
+	assert.Equal(t, "b", plan.ID)
+
+	_, err = p.findPlan("a", 200, now)
+	assert.EqualError(t, err, "price does not match the plan")
+
+	_, err = p.findPlan("b", 200, end)
+	assert.EqualError(t, err, "plan not found")
+
+	assert.Equal(t, 1, len(p.activePlans(end)))
+}
@@ -1,6 +1,7 @@
 package led
 
 import (
+	"context"
 	"encoding/json"
 	"io"
 	"net/http"
@@ -31,27 +32,30 @@ func (f *FileHandler) webPush(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	envs, err := godotenv.Read(filepath.Join(f.Root, "env"))
+	r, err := f.push(req.Context(), &s, m)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
 		return
 	}
+	defer r.Body.Close()
+
+	w.WriteHeader(r.StatusCode)
+	io.Copy(w, r.Body)
+}
+
+// push sends message m to subscription s with the VAPID keys of site f.
+func (f *FileHandler) push(ctx context.Context, s *webpush.Subscription, m []byte) (*http.Response, error) {
+	envs, err := godotenv.Read(filepath.Join(f.Root, "env"))
+	if err != nil {
+		return nil, err
+	}
 	o := webpush.Options{
 		TTL:             86400,
 		Subscriber:      envs["PUSH_SUBSCRIBER"],
 		VAPIDPublicKey:  envs["PUSH_VAPID_PUB"],
 		VAPIDPrivateKey: envs["PUSH_VAPID_PRI"],
+		HTTPClient:      httpClient,
 	}
-
-	r, err := webpush.SendNotification(m, &s, &o)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
-		return
-	}
-	defer r.Body.Close()
-
-	w.WriteHeader(r.StatusCode)
-	io.Copy(w, r.Body)
+	return webpush.SendNotificationWithContext(ctx, m, s, &o)
 }
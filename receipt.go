@@ -0,0 +1,443 @@
+package led
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/taoso/led/ecdsa"
+	"github.com/taoso/led/pay"
+	"github.com/taoso/led/store"
+)
+
+const (
+	// receiptLinkTTL 用户获取的收据链接有效期
+	receiptLinkTTL = 7 * 24 * time.Hour
+	// statementLinkTTL 月度账单中的收据链接有效期
+	statementLinkTTL = 90 * 24 * time.Hour
+)
+
+var errReceiptNotFound = errors.New("purchase not found")
+
+var errReceiptDisabled = errors.New("receipt is not enabled")
+
+// receipt 一次购买的收据
+type receipt struct {
+	Kind     string // orderTokens 或 orderTicket
+	TradeNo  string // 商户订单号
+	PayNo    string // 渠道交易号，如支付宝交易号
+	Provider string
+	Cents    int
+	Tokens   int
+	Bytes    int
+	Expires  time.Time
+	Refunded int // 已退款金额
+	Created  time.Time
+	Sign     string
+
+	userID int    // 购买 Token 的钱包
+	token  string // 购买流量的 Ticket
+}
+
+func (r *receipt) signData() string {
+	return strings.Join([]string{
+		r.Kind, r.TradeNo, r.PayNo, r.Provider,
+		strconv.Itoa(r.Cents), strconv.Itoa(r.Tokens), strconv.Itoa(r.Bytes),
+		strconv.Itoa(r.Refunded), strconv.FormatInt(r.Created.Unix(), 10),
+	}, "|")
+}
+
+// receiptSign 收据和收据链接都使用单独的 receiptKey 签名，调用前需要确认已设置
+func (p *Proxy) receiptSign(data string) string {
+	h := hmac.New(sha256.New, p.receiptKey)
+	h.Write([]byte("receipt@" + data))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// receiptLink 生成购买 tradeNo 的收据链接，链接在 expires 后失效
+func (p *Proxy) receiptLink(host, tradeNo string, expires time.Time) (string, error) {
+	if len(p.receiptKey) == 0 {
+		return "", errReceiptDisabled
+	}
+	t := strconv.FormatInt(expires.Unix(), 10)
+	q := url.Values{}
+	q.Set("n", tradeNo)
+	q.Set("t", t)
+	q.Set("s", p.receiptSign("link@"+tradeNo+"@"+t))
+	return "https://" + host + "/+/receipt?" + q.Encode(), nil
+}
+
+// findReceipt 查找 Token 或者流量购买记录
+func (p *Proxy) findReceipt(ctx context.Context, tradeNo string) (*receipt, error) {
+	if p.TokenRepo != nil {
+		l, err := p.TokenRepo.FindLog(tradeNo)
+		if err != nil {
+			return nil, err
+		}
+		if l.ID != 0 && l.Type == store.LogTypeBuy {
+			r := &receipt{
+				Kind:     orderTokens,
+				TradeNo:  l.PayNo,
+				PayNo:    l.Extra["trade_no"],
+				Provider: l.Extra["provider"],
+				Cents:    l.ExtraNum,
+				Tokens:   l.TokenNum,
+				Created:  l.Created,
+				userID:   l.UserID,
+			}
+			// 老流水没有记录渠道，都是支付宝
+			if r.Provider == "" {
+				r.Provider = defaultPayment
+			}
+			f, err := p.TokenRepo.FindRefund(tradeNo)
+			if err != nil {
+				return nil, err
+			}
+			if f.Status == store.RefundDone {
+				r.Refunded = f.CentNum
+			}
+			r.Sign = p.receiptSign(r.signData())
+			return r, nil
+		}
+	}
+
+	if p.TicketRepo != nil {
+		t, err := p.TicketRepo.Find(tradeNo)
+		if err != nil {
+			return nil, err
+		}
+		if t.ID != 0 {
+			r := &receipt{
+				Kind:    orderTicket,
+				TradeNo: t.BuyOrder,
+				PayNo:   t.PayOrder,
+				Bytes:   t.TotalBytes,
+				Expires: t.Expires,
+				Created: t.Created,
+				token:   t.Token,
+			}
+			if err := p.ticketCents(ctx, r); err != nil {
+				return nil, err
+			}
+			r.Sign = p.receiptSign(r.signData())
+			return r, nil
+		}
+	}
+
+	return nil, errReceiptNotFound
+}
+
+// ticketCents 流量不记录金额，从订单库或者支付渠道查询
+func (p *Proxy) ticketCents(ctx context.Context, r *receipt) error {
+	if p.OrderRepo != nil {
+		o, err := p.OrderRepo.FindOrder(r.TradeNo)
+		if err != nil {
+			return err
+		}
+		if o.ID != 0 {
+			r.Cents = o.Cents
+			r.Provider = o.Provider
+			return nil
+		}
+	}
+
+	// 没有订单记录的都是支付宝订单
+	pp, ok := p.Payments[defaultPayment]
+	if !ok {
+		return fmt.Errorf("payment %s is not enabled", defaultPayment)
+	}
+	n, err := pp.Query(payContext(ctx), r.TradeNo)
+	if err != nil {
+		return err
+	}
+	r.Cents = n.Cents
+	r.Provider = pp.Name()
+	return nil
+}
+
+var receiptTmpl = template.Must(template.New("receipt").Funcs(template.FuncMap{
+	"yuan":  pay.Yuan,
+	"bytes": formatBytes,
+	"date":  func(t time.Time) string { return t.Format("2006-01-02 15:04:05 MST") },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Receipt {{.TradeNo}}</title>
+<style>
+body { font-family: sans-serif; max-width: 36em; margin: 2em auto; padding: 0 1em; }
+th { text-align: left; padding-right: 2em; font-weight: normal; color: #666; }
+td { font-family: monospace; word-break: break-all; }
+</style>
+</head>
+<body>
+<h1>Receipt</h1>
+<table>
+<tr><th>Order</th><td>{{.TradeNo}}</td></tr>
+<tr><th>Trade</th><td>{{.PayNo}}</td></tr>
+<tr><th>Payment</th><td>{{.Provider}}</td></tr>
+<tr><th>Time</th><td>{{date .Created}}</td></tr>
+{{- if .Tokens}}
+<tr><th>Tokens</th><td>{{.Tokens}}</td></tr>
+{{- end}}
+{{- if .Bytes}}
+<tr><th>Traffic</th><td>{{bytes .Bytes}}</td></tr>
+<tr><th>Expires</th><td>{{date .Expires}}</td></tr>
+{{- end}}
+<tr><th>Amount</th><td>¥{{yuan .Cents}}</td></tr>
+{{- if .Refunded}}
+<tr><th>Refunded</th><td>¥{{yuan .Refunded}}</td></tr>
+{{- end}}
+<tr><th>Signature</th><td>{{.Sign}}</td></tr>
+</table>
+</body>
+</html>
+`))
+
+// serveReceipt 收据
+//
+//	GET /+/receipt?n=x&t=1&s=y renders the receipt of purchase x, the link expires at t.
+//	POST /+/receipt {"trade_no":"x","token":"y"} returns the link of traffic purchase x.
+//	POST /+/receipt {"trade_no":"x","pubkey":"y","sign":"z","created":"t"} returns the link of token purchase x.
+//	POST /+/receipt?statement {"wallet_id":1,"email":"x","pubkey":"y","sign":"z","created":"t"}
+//	subscribes the monthly statement, and empty email unsubscribes.
+func (p *Proxy) serveReceipt(w http.ResponseWriter, req *http.Request) {
+	// 没有签名密钥时任何人都可以伪造链接
+	if len(p.receiptKey) == 0 {
+		http.Error(w, errReceiptDisabled.Error(), http.StatusNotImplemented)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		q := req.URL.Query()
+		n, t := q.Get("n"), q.Get("t")
+		if !hmac.Equal([]byte(q.Get("s")), []byte(p.receiptSign("link@"+n+"@"+t))) {
+			http.Error(w, "invalid signature", http.StatusBadRequest)
+			return
+		}
+		i, err := strconv.ParseInt(t, 10, 64)
+		if err != nil || time.Unix(i, 0).Before(time.Now()) {
+			http.Error(w, "link expired", http.StatusBadRequest)
+			return
+		}
+
+		r, err := p.findReceipt(req.Context(), n)
+		if errors.Is(err, errReceiptNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var buf bytes.Buffer
+		if err := receiptTmpl.Execute(&buf, r); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "private, no-store")
+		w.Write(buf.Bytes())
+	case http.MethodPost:
+		defer req.Body.Close()
+		args := struct {
+			TradeNo  string    `json:"trade_no"`
+			Token    string    `json:"token"`
+			WalletID int       `json:"wallet_id"`
+			Email    string    `json:"email"`
+			Pubkey   string    `json:"pubkey"`
+			Sign     string    `json:"sign"`
+			Created  time.Time `json:"created"`
+		}{}
+		if err := json.NewDecoder(req.Body).Decode(&args); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if req.URL.Query().Has("statement") {
+			if p.TokenRepo == nil {
+				http.Error(w, "statement is not enabled", http.StatusNotImplemented)
+				return
+			}
+			if args.Email != "" && !strings.Contains(args.Email, "@") {
+				http.Error(w, "invalid email", http.StatusBadRequest)
+				return
+			}
+			if code, err := p.verifyWallet(args.WalletID, "statement", args.Email, args.Pubkey, args.Sign, args.Created); err != nil {
+				http.Error(w, err.Error(), code)
+				return
+			}
+			if err := p.TokenRepo.SetWalletExtra(args.WalletID, "email", args.Email); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		r, err := p.findReceipt(req.Context(), args.TradeNo)
+		if errors.Is(err, errReceiptNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// 流量购买凭 Ticket 获取，Token 购买需要钱包签名
+		if r.Kind == orderTicket {
+			if args.Token == "" || args.Token != r.token {
+				http.Error(w, errReceiptNotFound.Error(), http.StatusNotFound)
+				return
+			}
+		} else if code, err := p.verifyWallet(r.userID, "receipt", args.TradeNo, args.Pubkey, args.Sign, args.Created); err != nil {
+			http.Error(w, err.Error(), code)
+			return
+		}
+
+		link, err := p.receiptLink(req.Host, r.TradeNo, time.Now().Add(receiptLinkTTL))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotImplemented)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"url": link})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// verifyWallet 验证钱包 uid 的用户对 action@msg 和请求时间的签名，返回出错时的状态码。
+// 签名内容带上操作名称，避免一个接口的签名被用于另一个接口。
+func (p *Proxy) verifyWallet(uid int, action, msg, pubkey, sign string, created time.Time) (int, error) {
+	if created.Sub(time.Now()).Abs() > 30*time.Second {
+		return http.StatusBadRequest, errors.New("client time is inaccurate")
+	}
+
+	pk, err := ecdsa.ParsePubkey(pubkey)
+	if err != nil {
+		return http.StatusBadRequest, errors.New("invalid pubkey")
+	}
+
+	ok, _, err := ecdsa.VerifyES256(action+"@"+msg+created.UTC().Format("2006-01-02T15:04:05.000Z"), sign, pk)
+	if err != nil || !ok {
+		return http.StatusBadRequest, errors.New("invalid signature")
+	}
+
+	u, err := p.TokenRepo.GetWallet(uid)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	owner, err := ownsWallet(p.TokenRepo, u, pk)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if !owner {
+		return http.StatusForbidden, errors.New("not your wallet")
+	}
+	return http.StatusOK, nil
+}
+
+// SendStatements 每隔 d 检查一次，给订阅的用户发送上个月的账单
+func (p *Proxy) SendStatements(host string, d time.Duration) {
+	t := time.NewTicker(d)
+	defer t.Stop()
+	for {
+		p.sendStatements(host, time.Now())
+		<-t.C
+	}
+}
+
+func (p *Proxy) sendStatements(host string, now time.Time) {
+	if len(p.receiptKey) == 0 {
+		slog.Error("send statements error", "err", errReceiptDisabled)
+		return
+	}
+
+	end := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	begin := end.AddDate(0, -1, 0)
+	month := begin.Format("2006-01")
+
+	logs, err := p.TokenRepo.ListPaidLogs(begin, end.Add(-time.Nanosecond))
+	if err != nil {
+		slog.Error("list paid logs error", "err", err)
+		return
+	}
+
+	var ids []int
+	users := map[int][]store.TokenLog{}
+	for _, l := range logs {
+		if l.Type != store.LogTypeBuy && l.Type != store.LogTypeRefund {
+			continue
+		}
+		if _, ok := users[l.UserID]; !ok {
+			ids = append(ids, l.UserID)
+		}
+		users[l.UserID] = append(users[l.UserID], l)
+	}
+
+	for _, id := range ids {
+		u, err := p.TokenRepo.GetWallet(id)
+		if err != nil {
+			slog.Error("get wallet error", "user_id", id, "err", err)
+			continue
+		}
+		email := u.Extra["email"]
+		if email == "" || u.Extra["statement"] >= month {
+			continue
+		}
+
+		msg, err := p.statement(host, month, users[id], now.Add(statementLinkTTL))
+		if err != nil {
+			slog.Error("build statement error", "user_id", id, "err", err)
+			continue
+		}
+		if err := sendMail(context.Background(), "", email, "Statement of "+month, msg); err != nil {
+			slog.Error("send statement error", "user_id", id, "err", err)
+			continue
+		}
+		if err := p.TokenRepo.SetWalletExtra(id, "statement", month); err != nil {
+			slog.Error("save statement error", "user_id", id, "err", err)
+		}
+	}
+}
+
+// statement 生成账单正文，每笔购买附带收据链接
+func (p *Proxy) statement(host, month string, logs []store.TokenLog, expires time.Time) (string, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Statement of %s\n\n", month)
+
+	paid, refunded := 0, 0
+	for _, l := range logs {
+		date := l.Created.Format("2006-01-02 15:04")
+		if l.Type == store.LogTypeRefund {
+			refunded += l.ExtraNum
+			fmt.Fprintf(&b, "%s  refund    -%d tokens  -¥%s  %s\n", date, l.TokenNum, pay.Yuan(l.ExtraNum), l.Extra["pay_no"])
+			continue
+		}
+		paid += l.ExtraNum
+		link, err := p.receiptLink(host, l.PayNo, expires)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "%s  purchase  %d tokens  ¥%s\n  %s\n", date, l.TokenNum, pay.Yuan(l.ExtraNum), link)
+	}
+
+	fmt.Fprintf(&b, "\nPaid: ¥%s\nRefunded: ¥%s\n", pay.Yuan(paid), pay.Yuan(refunded))
+	return b.String(), nil
+}
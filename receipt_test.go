@@ -0,0 +1,133 @@
+package led
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	ecdsa2 "github.com/taoso/led/ecdsa"
+	"github.com/taoso/led/store"
+)
+
+func TestReceipt(t *testing.T) {
+	f, err := os.CreateTemp("", "led-*.db")
+	assert.Nil(t, err)
+	f.Close()
+	defer os.Remove(f.Name())
+
+	repo := store.NewTokenRepo(f.Name())
+	p := &Proxy{
+		TokenRepo:  repo,
+		TicketRepo: store.NewTicketRepo(":memory:"),
+		OrderRepo:  store.NewOrderRepo(":memory:"),
+		receiptKey: bytes.Repeat([]byte("k"), 32),
+	}
+
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	l := store.TokenLog{Type: store.LogTypeBuy, TokenNum: 1000, ExtraNum: 100, PayNo: "pay-1",
+		Extra: store.KV{"_pubkey": ecdsa2.Compress(k.PublicKey), "trade_no": "2026101922001"}, Created: time.Now()}
+	_, err = repo.UpdateWallet(&l)
+	assert.Nil(t, err)
+
+	post := func(path string, args map[string]any) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(args)
+		w := httptest.NewRecorder()
+		p.serveReceipt(w, httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body)))
+		return w
+	}
+	signed := func(k *ecdsa.PrivateKey, msg string, args map[string]any) map[string]any {
+		now := time.Now().UTC()
+		h := sha256.Sum256([]byte(msg + now.Format("2006-01-02T15:04:05.000Z")))
+		args["sign"] = signHash(t, k, h[:])
+		args["pubkey"] = base64.StdEncoding.EncodeToString(elliptic.Marshal(k.Curve, k.X, k.Y))
+		args["created"] = now
+		return args
+	}
+	get := func(link string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		p.serveReceipt(w, httptest.NewRequest(http.MethodGet, link, nil))
+		return w
+	}
+
+	w := post("/+/receipt", signed(other, "receipt@pay-1", map[string]any{"trade_no": "pay-1"}))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = post("/+/receipt", signed(k, "receipt@pay-1", map[string]any{"trade_no": "pay-1"}))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var link struct{ URL string }
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &link))
+	u, err := url.Parse(link.URL)
+	assert.Nil(t, err)
+
+	w = get(u.RequestURI())
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "¥1.00")
+	assert.Contains(t, w.Body.String(), "2026101922001")
+
+	q := u.Query()
+	q.Set("t", "9999999999")
+	w = get("/+/receipt?" + q.Encode())
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// 流量购买凭 Ticket 获取收据
+	assert.Nil(t, p.TicketRepo.New("tk", store.TicketPlan{Bytes: 1 << 30, Days: 30}, "buy-1", "2026101922002"))
+	assert.Nil(t, p.OrderRepo.NewOrder(&store.PayOrder{Provider: "fake", Kind: orderTicket, TradeNo: "buy-1", Cents: 990}))
+
+	w = post("/+/receipt", map[string]any{"trade_no": "buy-1", "token": "other"})
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = post("/+/receipt", map[string]any{"trade_no": "buy-1", "token": "tk"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &link))
+	u, _ = url.Parse(link.URL)
+	w = get(u.RequestURI())
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "¥9.90")
+	assert.Contains(t, w.Body.String(), "fake")
+
+	// 订阅月度账单
+	w = post("/+/receipt?statement", signed(k, "statement@a@b.c", map[string]any{"wallet_id": l.UserID, "email": "a@b.c"}))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	u2, err := repo.GetWallet(l.UserID)
+	assert.Nil(t, err)
+	assert.Equal(t, "a@b.c", u2.Extra["email"])
+
+	s, err := p.statement("lehu.in", "2026-10", []store.TokenLog{l}, time.Now().Add(time.Hour))
+	assert.Nil(t, err)
+	assert.Contains(t, s, "1000 tokens")
+	assert.Contains(t, s, "https://lehu.in/+/receipt?n=pay-1&")
+	assert.True(t, strings.HasSuffix(s, "Paid: ¥1.00\nRefunded: ¥0.00\n"))
+}
+
+func TestReceiptDisabled(t *testing.T) {
+	p := &Proxy{}
+
+	// 没有签名密钥时空签名也不能通过
+	w := httptest.NewRecorder()
+	p.serveReceipt(w, httptest.NewRequest(http.MethodGet, "/+/receipt?n=x&t=9999999999&s=", nil))
+	assert.Equal(t, http.StatusNotImplemented, w.Code)
+
+	_, err := p.receiptLink("lehu.in", "x", time.Now().Add(time.Hour))
+	assert.Equal(t, errReceiptDisabled, err)
+
+	assert.NotNil(t, p.SetReceiptKey(base64.StdEncoding.EncodeToString([]byte("short"))))
+	assert.Nil(t, p.SetReceiptKey(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("k"), 32))))
+	_, err = p.receiptLink("lehu.in", "x", time.Now().Add(time.Hour))
+	assert.Nil(t, err)
+}
@@ -0,0 +1,56 @@
+package led
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// referrals 邀请人查看被邀请人及其带来的奖励
+//
+//	POST /+/referrals {"wallet_id":1,"before":0,"pubkey":"x","sign":"y","created":"t"}
+//	lists invitees of wallet 1 with id less than before, the sign covers wallet_id and created.
+func (p *Proxy) referrals(w http.ResponseWriter, req *http.Request) {
+	if p.TokenRepo == nil {
+		http.Error(w, "referral is not enabled", http.StatusNotImplemented)
+		return
+	}
+
+	defer req.Body.Close()
+	args := struct {
+		WalletID int       `json:"wallet_id"`
+		Before   int       `json:"before"`
+		Pubkey   string    `json:"pubkey"`
+		Sign     string    `json:"sign"`
+		Created  time.Time `json:"created"`
+	}{}
+	if err := json.NewDecoder(req.Body).Decode(&args); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if code, err := p.verifyWallet(args.WalletID, "referral", strconv.Itoa(args.WalletID), args.Pubkey, args.Sign, args.Created); err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	u, err := p.TokenRepo.GetWallet(args.WalletID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	is, err := p.TokenRepo.ListInvitees(args.WalletID, args.Before, 20)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"invite_users":  u.InviteUsers,
+		"invite_tokens": u.InviteTokens,
+		"invitees":      is,
+	})
+}
@@ -0,0 +1,74 @@
+package led
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	ecdsa2 "github.com/taoso/led/ecdsa"
+	"github.com/taoso/led/store"
+)
+
+func TestReferrals(t *testing.T) {
+	f, err := os.CreateTemp("", "led-*.db")
+	assert.Nil(t, err)
+	f.Close()
+	defer os.Remove(f.Name())
+
+	repo := store.NewTokenRepo(f.Name())
+	p := &Proxy{TokenRepo: repo}
+
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	a := store.TokenLog{Type: store.LogTypeBuy, TokenNum: 100, ExtraNum: 10, PayNo: "pay-a", Created: time.Now(),
+		Extra: store.KV{"_pubkey": ecdsa2.Compress(k.PublicKey)}}
+	wa, err := repo.UpdateWallet(&a)
+	assert.Nil(t, err)
+
+	b := store.TokenLog{Type: store.LogTypeBuy, TokenNum: 1000, ExtraNum: 100, PayNo: "pay-b", Created: time.Now(),
+		Extra: store.KV{"_pubkey": "b", "_from_id": strconv.Itoa(wa.ID)}}
+	wb, err := repo.UpdateWallet(&b)
+	assert.Nil(t, err)
+
+	request := func(uid int) *httptest.ResponseRecorder {
+		now := time.Now().UTC()
+		h := sha256.Sum256([]byte("referral@" + strconv.Itoa(uid) + now.Format("2006-01-02T15:04:05.000Z")))
+		body, _ := json.Marshal(map[string]any{
+			"wallet_id": uid,
+			"sign":      signHash(t, k, h[:]),
+			"pubkey":    base64.StdEncoding.EncodeToString(elliptic.Marshal(k.Curve, k.X, k.Y)),
+			"created":   now,
+		})
+		w := httptest.NewRecorder()
+		p.referrals(w, httptest.NewRequest(http.MethodPost, "/+/referrals", bytes.NewReader(body)))
+		return w
+	}
+
+	w := request(wb.ID)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = request(wa.ID)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var r struct {
+		InviteTokens int             `json:"invite_tokens"`
+		Invitees     []store.Invitee `json:"invitees"`
+	}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &r))
+	assert.Equal(t, 100, r.InviteTokens)
+	if assert.Equal(t, 1, len(r.Invitees)) {
+		assert.Equal(t, wb.ID, r.Invitees[0].ID)
+		assert.Equal(t, 100, r.Invitees[0].Tokens)
+	}
+}
@@ -0,0 +1,308 @@
+package led
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/taoso/led/ecdsa"
+	"github.com/taoso/led/pay"
+	"github.com/taoso/led/store"
+)
+
+// prepareRefund 生成充值订单 payNo 的退款单，只退还尚未消费的 Token。
+// 已发起但未完成的退款单原样返回，用于重试。
+func (p *Proxy) prepareRefund(payNo, reason string) (f store.TokenRefund, err error) {
+	f, err = p.TokenRepo.FindRefund(payNo)
+	if err != nil {
+		return
+	}
+	switch f.Status {
+	case store.RefundDone:
+		return f, errors.New("already refunded")
+	case store.RefundPending:
+		return f, nil
+	}
+
+	l, err := p.TokenRepo.FindLog(payNo)
+	if err != nil {
+		return
+	}
+	if l.ID == 0 || l.Type != store.LogTypeBuy {
+		return f, errors.New("purchase not found")
+	}
+
+	w, err := p.TokenRepo.GetWallet(l.UserID)
+	if err != nil {
+		return
+	}
+
+	n := min(w.Tokens, l.TokenNum)
+	if n <= 0 {
+		return f, errors.New("no unspent tokens")
+	}
+
+	f.UserID = l.UserID
+	f.PayNo = payNo
+	f.RefundNo = "R" + payNo
+	f.TokenNum = n
+	f.CentNum = l.ExtraNum * n / l.TokenNum
+	f.Status = store.RefundPending
+	if reason != "" {
+		f.Reason = reason
+	}
+	err = p.TokenRepo.SaveRefund(&f)
+	return
+}
+
+// refund 通过充值时的支付渠道发起退款，成功后扣除 Token
+func (p *Proxy) refund(ctx context.Context, payNo, reason string) (f store.TokenRefund, err error) {
+	f, err = p.prepareRefund(payNo, reason)
+	if err != nil {
+		return
+	}
+
+	l, err := p.TokenRepo.FindLog(f.PayNo)
+	if err != nil {
+		return
+	}
+
+	// 老流水没有记录渠道，都是支付宝
+	name := l.Extra["provider"]
+	if name == "" {
+		name = defaultPayment
+	}
+	pp, ok := p.Payments[name]
+	if !ok {
+		return f, fmt.Errorf("payment %s is not enabled", name)
+	}
+
+	err = pp.Refund(ctx, pay.Refund{
+		TradeNo:  f.PayNo,
+		RefundNo: f.RefundNo,
+		Cents:    f.CentNum,
+		Total:    l.ExtraNum,
+		Reason:   f.Reason,
+
+		RequestID: RequestID(ctx),
+	})
+	if err != nil {
+		return
+	}
+
+	err = p.finishRefund(&f)
+	return
+}
+
+// finishRefund 写入退款流水并完成退款单，可以重复调用
+func (p *Proxy) finishRefund(f *store.TokenRefund) error {
+	l := store.TokenLog{
+		UserID:   f.UserID,
+		Type:     store.LogTypeRefund,
+		TokenNum: f.TokenNum,
+		ExtraNum: f.CentNum,
+		PayNo:    f.RefundNo,
+		Extra:    store.KV{"pay_no": f.PayNo},
+		Created:  time.Now(),
+	}
+	if _, err := p.TokenRepo.UpdateWallet(&l); err != nil {
+		return err
+	}
+
+	f.Status = store.RefundDone
+	return p.TokenRepo.SaveRefund(f)
+}
+
+// refundNotify 处理退款异步通知，返回处理失败的原因
+func (p *Proxy) refundNotify(w http.ResponseWriter, pp pay.Provider, trade *pay.Notification) error {
+	f, err := p.TokenRepo.FindRefund(trade.TradeNo)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return err
+	}
+
+	// 在支付渠道后台直接退款的订单没有退款单
+	if f.ID == 0 || (trade.RefundNo != "" && f.RefundNo != trade.RefundNo) {
+		slog.Warn("unknown refund", "provider", trade.Provider, "trade_no", trade.TradeNo,
+			"refund_no", trade.RefundNo, "refund_cents", trade.RefundCents)
+	} else if f.Status == store.RefundPending {
+		if err := p.finishRefund(&f); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return err
+		}
+	}
+
+	pp.Ack(w)
+	return nil
+}
+
+// buyTokensRefund 用户申请退款，由管理员审核
+func (p *Proxy) buyTokensRefund(w http.ResponseWriter, req *http.Request, f *FileHandler) {
+	defer req.Body.Close()
+	args := struct {
+		TradeNo string    `json:"trade_no"`
+		Reason  string    `json:"reason"`
+		Sign    string    `json:"sign"`
+		Pubkey  string    `json:"pubkey"`
+		Created time.Time `json:"created"`
+	}{}
+	if err := json.NewDecoder(req.Body).Decode(&args); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if args.Created.Sub(time.Now()).Abs() > 30*time.Second {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("client time is inaccurate"))
+		return
+	}
+
+	pk, err := ecdsa.ParsePubkey(args.Pubkey)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("invalid pubkey"))
+		return
+	}
+
+	// 签名内容带上操作名称，不能用收据等其他接口的签名申请退款
+	var buf bytes.Buffer
+	buf.WriteString("refund@")
+	buf.WriteString(args.TradeNo)
+	buf.WriteString(args.Created.UTC().Format("2006-01-02T15:04:05.000Z"))
+
+	ok, _, err := ecdsa.VerifyES256(buf.String(), args.Sign, pk)
+	if err != nil || !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("invalid signature"))
+		return
+	}
+
+	l, err := p.TokenRepo.FindLog(args.TradeNo)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if l.ID == 0 || l.Type != store.LogTypeBuy {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("purchase not found"))
+		return
+	}
+
+	// 只能申请退款自己的订单
+	u, err := p.TokenRepo.GetWallet(l.UserID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	owner, err := ownsWallet(p.TokenRepo, u, pk)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if !owner {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("not your purchase"))
+		return
+	}
+
+	r, err := p.TokenRepo.FindRefund(args.TradeNo)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if r.ID == 0 {
+		r = store.TokenRefund{
+			UserID:   l.UserID,
+			PayNo:    l.PayNo,
+			RefundNo: "R" + l.PayNo,
+			Reason:   args.Reason,
+			Status:   store.RefundRequested,
+		}
+		if err := p.TokenRepo.SaveRefund(&r); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r)
+}
+
+// refunds 管理员查看和处理退款
+//
+// GET /+/refunds?status=0&before=100 lists refunds of status.
+// POST /+/refunds {"trade_no":"x","reason":"y"} refunds purchase x, and
+// {"trade_no":"x","reject":true} rejects the request of user.
+func (p *Proxy) refunds(w http.ResponseWriter, req *http.Request) {
+	if !p.isAdmin(w, req) {
+		return
+	}
+
+	if p.TokenRepo == nil || len(p.Payments) == 0 {
+		http.Error(w, "refund is not enabled", http.StatusNotImplemented)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		q := req.URL.Query()
+		status, _ := strconv.Atoi(q.Get("status"))
+		before, _ := strconv.Atoi(q.Get("before"))
+		fs, err := p.TokenRepo.ListRefunds(store.RefundStatus(status), before, 20)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(fs)
+	case http.MethodPost:
+		defer req.Body.Close()
+		args := struct {
+			TradeNo string `json:"trade_no"`
+			Reason  string `json:"reason"`
+			Reject  bool   `json:"reject"`
+		}{}
+		if err := json.NewDecoder(req.Body).Decode(&args); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var f store.TokenRefund
+		var err error
+		if args.Reject {
+			f, err = p.TokenRepo.FindRefund(args.TradeNo)
+			if err == nil && (f.ID == 0 || f.Status != store.RefundRequested) {
+				err = errors.New("refund is not requested")
+			}
+			if err == nil {
+				f.Status = store.RefundRejected
+				f.Reason = args.Reason
+				err = p.TokenRepo.SaveRefund(&f)
+			}
+		} else {
+			f, err = p.refund(req.Context(), args.TradeNo, args.Reason)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(f)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,170 @@
+package led
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	ecdsa2 "github.com/taoso/led/ecdsa"
+	"github.com/taoso/led/pay"
+	"github.com/taoso/led/store"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestRefund(t *testing.T) {
+	f, err := os.CreateTemp("", "led-*.db")
+	assert.Nil(t, err)
+	f.Close()
+	defer os.Remove(f.Name())
+
+	repo := store.NewTokenRepo(f.Name())
+	fake := &pay.Fake{}
+	p := &Proxy{TokenRepo: repo}
+	p.AddPayment(fake)
+
+	a := store.TokenLog{Type: store.LogTypeBuy, TokenNum: 1000, ExtraNum: 100, PayNo: "pay-a", Created: time.Now(),
+		Extra: store.KV{"_pubkey": "a", "provider": "fake"}}
+	wa, err := repo.UpdateWallet(&a)
+	assert.Nil(t, err)
+
+	b := store.TokenLog{Type: store.LogTypeBuy, TokenNum: 1000, ExtraNum: 100, PayNo: "pay-b", Created: time.Now(),
+		Extra: store.KV{"_pubkey": "b", "_from_id": strconv.Itoa(wa.ID)}}
+	wb, err := repo.UpdateWallet(&b)
+	assert.Nil(t, err)
+
+	_, err = repo.UpdateWallet(&store.TokenLog{Type: store.LogTypeCost, UserID: wb.ID, TokenNum: 300, Created: time.Now()})
+	assert.Nil(t, err)
+
+	r, err := p.prepareRefund("pay-b", "test")
+	assert.Nil(t, err)
+	assert.Equal(t, "Rpay-b", r.RefundNo)
+	assert.Equal(t, 700, r.TokenNum)
+	assert.Equal(t, 70, r.CentNum)
+	assert.Equal(t, store.RefundPending, r.Status)
+
+	// 支付渠道会重复通知
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		p.refundNotify(w, fake, &pay.Notification{TradeNo: "pay-b", RefundNo: "Rpay-b", RefundCents: 70})
+		assert.Equal(t, "success", w.Body.String())
+	}
+
+	wb, err = repo.GetWallet(wb.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, wb.Tokens)
+
+	wa, err = repo.GetWallet(wa.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, 1030, wa.Tokens)
+	assert.Equal(t, 30, wa.InviteTokens)
+	assert.Equal(t, 1, wa.InviteUsers) // 奖励没有全部收回
+
+	r, err = repo.FindRefund("pay-b")
+	assert.Nil(t, err)
+	assert.Equal(t, store.RefundDone, r.Status)
+
+	_, err = p.prepareRefund("pay-b", "")
+	assert.EqualError(t, err, "already refunded")
+
+	_, err = p.prepareRefund("pay-x", "")
+	assert.EqualError(t, err, "purchase not found")
+
+	// 通过充值时的渠道退款
+	r, err = p.refund(context.Background(), "pay-a", "")
+	assert.Nil(t, err)
+	assert.Equal(t, store.RefundDone, r.Status)
+	assert.Equal(t, []pay.Refund{{TradeNo: "pay-a", RefundNo: "Rpay-a", Cents: 100, Total: 100}}, fake.Refunds())
+
+	lr, err := VerifyLedger(repo, nil)
+	assert.Nil(t, err)
+	assert.Empty(t, lr.Issues)
+}
+
+func TestBuyTokensRefund(t *testing.T) {
+	f, err := os.CreateTemp("", "led-*.db")
+	assert.Nil(t, err)
+	f.Close()
+	defer os.Remove(f.Name())
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("pass"), bcrypt.MinCost)
+	assert.Nil(t, err)
+
+	repo := store.NewTokenRepo(f.Name())
+	p := &Proxy{
+		TokenRepo: repo,
+		Payments:  map[string]pay.Provider{"fake": &pay.Fake{}},
+	}
+	p.SetUsers(map[string]string{"admin": string(hash)})
+
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	l := store.TokenLog{Type: store.LogTypeBuy, TokenNum: 1000, ExtraNum: 100, PayNo: "pay-1",
+		Extra: store.KV{"_pubkey": ecdsa2.Compress(k.PublicKey)}, Created: time.Now()}
+	_, err = repo.UpdateWallet(&l)
+	assert.Nil(t, err)
+
+	request := func(k *ecdsa.PrivateKey, msg string) *httptest.ResponseRecorder {
+		now := time.Now().UTC()
+		h := sha256.Sum256([]byte(msg + now.Format("2006-01-02T15:04:05.000Z")))
+		body, _ := json.Marshal(map[string]any{
+			"trade_no": "pay-1",
+			"reason":   "no longer needed",
+			"sign":     signHash(t, k, h[:]),
+			"pubkey":   base64.StdEncoding.EncodeToString(elliptic.Marshal(k.Curve, k.X, k.Y)),
+			"created":  now,
+		})
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/+/buy-tokens-refund", bytes.NewReader(body))
+		p.buyTokensRefund(w, req, nil)
+		return w
+	}
+
+	w := request(other, "refund@pay-1")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// 收据接口的签名不能用来申请退款
+	w = request(k, "receipt@pay-1")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = request(k, "refund@pay-1")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var r store.TokenRefund
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &r))
+	assert.Equal(t, store.RefundRequested, r.Status)
+	assert.Equal(t, "no longer needed", r.Reason)
+
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/+/refunds?status=0", nil)
+	req.SetBasicAuth("admin", "pass")
+	p.refunds(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var rs []store.TokenRefund
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &rs))
+	assert.Equal(t, 1, len(rs))
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/+/refunds", bytes.NewBufferString(`{"trade_no":"pay-1","reason":"spent","reject":true}`))
+	req.SetBasicAuth("admin", "pass")
+	p.refunds(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	r, err = repo.FindRefund("pay-1")
+	assert.Nil(t, err)
+	assert.Equal(t, store.RefundRejected, r.Status)
+	assert.Equal(t, "spent", r.Reason)
+}
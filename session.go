@@ -0,0 +1,213 @@
+package led
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// proxySession is one active proxy flow.
+type proxySession struct {
+	ID     int64     `json:"id"`
+	User   string    `json:"user"`
+	Target string    `json:"target"`
+	Proto  string    `json:"proto"` // http, connect 或 connect-udp
+	Start  time.Time `json:"start"`
+	Up     int64     `json:"up"`   // 客户端发往目标的字节数
+	Down   int64     `json:"down"` // 目标发往客户端的字节数
+
+	up   atomic.Int64
+	down atomic.Int64
+
+	closers []io.Closer
+}
+
+// snapshot returns a copy of s with current byte counts.
+func (s *proxySession) snapshot() proxySession {
+	return proxySession{
+		ID:     s.ID,
+		User:   s.User,
+		Target: s.Target,
+		Proto:  s.Proto,
+		Start:  s.Start,
+		Up:     s.up.Load(),
+		Down:   s.down.Load(),
+	}
+}
+
+// kill closes all connections of s.
+func (s *proxySession) kill() {
+	for _, c := range s.closers {
+		c.Close()
+	}
+}
+
+// wrap counts bytes of rw into s. If rw is the upstream connection, Write
+// sends bytes to the target, otherwise Read receives bytes from the client.
+func (s *proxySession) wrap(rw io.ReadWriter, upstream bool) io.ReadWriter {
+	if upstream {
+		return sessionRW{rw: rw, r: &s.down, w: &s.up}
+	}
+	return sessionRW{rw: rw, r: &s.up, w: &s.down}
+}
+
+type sessionRW struct {
+	rw io.ReadWriter
+	r  *atomic.Int64
+	w  *atomic.Int64
+}
+
+func (s sessionRW) Read(p []byte) (n int, err error) {
+	n, err = s.rw.Read(p)
+	s.r.Add(int64(n))
+	return
+}
+
+func (s sessionRW) Write(p []byte) (n int, err error) {
+	n, err = s.rw.Write(p)
+	s.w.Add(int64(n))
+	return
+}
+
+type closeFunc func()
+
+func (f closeFunc) Close() error {
+	f()
+	return nil
+}
+
+// openSession registers one proxy flow. Killing the session closes all the
+// closers. closeSession must be called when the flow is done.
+func (p *Proxy) openSession(user, target, proto string, closers ...io.Closer) *proxySession {
+	s := &proxySession{
+		ID:      p.sessionID.Add(1),
+		User:    user,
+		Target:  target,
+		Proto:   proto,
+		Start:   time.Now(),
+		closers: closers,
+	}
+	p.sessions.Store(s.ID, s)
+	proxySessions.Inc(proto)
+	return s
+}
+
+func (p *Proxy) closeSession(s *proxySession) {
+	p.sessions.Delete(s.ID)
+	proxySessions.Dec(s.Proto)
+
+	ss := s.snapshot()
+	d := time.Since(ss.Start)
+	slog.Info("proxy session", "id", ss.ID, "proto", ss.Proto, "target", ss.Target,
+		"duration", d.Round(time.Second), "up", ss.Up, "down", ss.Down)
+
+	if p.UsageRepo == nil {
+		return
+	}
+	if _, ok := p.conf().users[ss.User]; ok {
+		return
+	}
+	err := p.UsageRepo.AddUsage(ss.User, ss.Start, int(ss.Up), int(ss.Down), int(d.Seconds()))
+	if err != nil {
+		slog.Error("add usage error", "id", ss.ID, "err", err)
+	}
+}
+
+// listSessions returns active sessions ordered by ID. Empty user matches all.
+func (p *Proxy) listSessions(user string) []proxySession {
+	ss := []proxySession{}
+	p.sessions.Range(func(k, v any) bool {
+		s := v.(*proxySession)
+		if user == "" || s.User == user {
+			ss = append(ss, s.snapshot())
+		}
+		return true
+	})
+	sort.Slice(ss, func(i, j int) bool { return ss[i].ID < ss[j].ID })
+	return ss
+}
+
+// proxySessions lists or kills active proxy sessions.
+//
+// GET /+/proxy-sessions?user=foo lists sessions of user foo, or all sessions
+// if user is empty. DELETE /+/proxy-sessions?id=1 kills session 1 and
+// DELETE /+/proxy-sessions?user=foo kills all sessions of user foo.
+//
+// The admin user must be in users.txt.
+func (p *Proxy) proxySessions(w http.ResponseWriter, req *http.Request) {
+	if !p.isAdmin(w, req) {
+		return
+	}
+
+	q := req.URL.Query()
+	user := q.Get("user")
+
+	switch req.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(p.listSessions(user))
+	case http.MethodDelete:
+		var n int
+		if id := q.Get("id"); id != "" {
+			i, err := strconv.ParseInt(id, 10, 64)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if v, ok := p.sessions.Load(i); ok {
+				v.(*proxySession).kill()
+				n++
+			}
+		} else if user != "" {
+			p.sessions.Range(func(k, v any) bool {
+				if s := v.(*proxySession); s.User == user {
+					s.kill()
+					n++
+				}
+				return true
+			})
+		} else {
+			http.Error(w, "id or user is required", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"killed": n})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// KillSessions kills all active sessions and returns the number of them.
+// It is used to stop hijacked tunnels which http.Server.Shutdown does not
+// wait for.
+func (p *Proxy) KillSessions() int {
+	var n int
+	p.sessions.Range(func(k, v any) bool {
+		v.(*proxySession).kill()
+		n++
+		return true
+	})
+	return n
+}
+
+// Wait waits for running requests until ctx is done. Usage and token billing
+// are saved before requests return, so call it after the servers are closed.
+func (p *Proxy) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		p.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
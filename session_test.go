@@ -0,0 +1,86 @@
+package led
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestProxySessions(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("pass"), bcrypt.MinCost)
+	p := &Proxy{}
+	p.SetUsers(map[string]string{"admin": string(hash)})
+
+	killed := false
+	s1 := p.openSession("foo", "a.com:443", "connect", closeFunc(func() { killed = true }))
+	s2 := p.openSession("bar", "b.com:443", "connect")
+
+	rw := s1.wrap(bytes.NewBuffer(nil), true)
+	rw.Write([]byte("hello"))
+	rw.Read(make([]byte, 3))
+
+	req := httptest.NewRequest("GET", "/+/proxy-sessions?user=foo", nil)
+	w := httptest.NewRecorder()
+	p.proxySessions(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	req.SetBasicAuth("admin", "pass")
+	w = httptest.NewRecorder()
+	p.proxySessions(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var ss []proxySession
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &ss))
+	assert.Equal(t, 1, len(ss))
+	assert.Equal(t, "a.com:443", ss[0].Target)
+	assert.Equal(t, int64(5), ss[0].Up)
+	assert.Equal(t, int64(3), ss[0].Down)
+
+	req = httptest.NewRequest("DELETE", "/+/proxy-sessions?id=1", nil)
+	req.SetBasicAuth("admin", "pass")
+	w = httptest.NewRecorder()
+	p.proxySessions(w, req)
+	assert.Equal(t, `{"killed":1}`+"\n", w.Body.String())
+	assert.True(t, killed)
+
+	p.closeSession(s1)
+	p.closeSession(s2)
+	assert.Empty(t, p.listSessions(""))
+}
+
+func TestKillSessions(t *testing.T) {
+	p := &Proxy{}
+
+	var killed int
+	s1 := p.openSession("foo", "a.com:443", "connect", closeFunc(func() { killed++ }))
+	s2 := p.openSession("bar", "b.com:443", "connect-udp", closeFunc(func() { killed++ }))
+
+	p.running.Add(1)
+	go func() {
+		defer p.running.Done()
+		time.Sleep(10 * time.Millisecond)
+		p.closeSession(s1)
+		p.closeSession(s2)
+	}()
+
+	assert.Equal(t, 2, p.KillSessions())
+	assert.Equal(t, 2, killed)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Nil(t, p.Wait(ctx))
+	assert.Empty(t, p.listSessions(""))
+
+	p.running.Add(1)
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, p.Wait(ctx))
+	p.running.Done()
+}
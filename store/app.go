@@ -0,0 +1,127 @@
+package store
+
+import (
+	"context"
+	"crypto/ed25519"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+)
+
+// App 接入支付接口的第三方应用
+type App struct {
+	ID   int    `db:"id" json:"id"`
+	Name string `db:"name" json:"name"` // 应用名，即请求头 zz-app
+
+	VerifyKey string `db:"verify_key" json:"verify_key"` // 应用的 Ed25519 公钥，验证应用的请求
+	SignKey   string `db:"sign_key" json:"-"`            // Ed25519 私钥种子，签名发给应用的通知
+
+	NotifyPrefixes string `db:"notify_prefixes" json:"notify_prefixes"` // 允许的通知地址前缀，每行一个
+	MinCents       int    `db:"min_cents" json:"min_cents"`             // 单笔最小金额，0 表示不限制
+	MaxCents       int    `db:"max_cents" json:"max_cents"`             // 单笔最大金额，0 表示不限制
+	Active         bool   `db:"active" json:"active"`
+
+	Created time.Time `db:"created" json:"created"`
+	Updated time.Time `db:"updated" json:"updated"`
+}
+
+func (_ *App) KeyName() string   { return "id" }
+func (_ *App) TableName() string { return "apps" }
+func (a *App) Schema() string {
+	return "CREATE TABLE IF NOT EXISTS " + a.TableName() + `(
+	` + a.KeyName() + ` INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL,
+	verify_key TEXT DEFAULT '',
+	sign_key TEXT DEFAULT '',
+	notify_prefixes TEXT DEFAULT '',
+	min_cents INTEGER DEFAULT 0,
+	max_cents INTEGER DEFAULT 0,
+	active BOOLEAN DEFAULT FALSE,
+	created DATETIME,
+	updated DATETIME
+);
+	CREATE UNIQUE INDEX IF NOT EXISTS a_name ON ` + a.TableName() + `(name);`
+}
+
+// AllowNotify 通知地址是否以允许的前缀开头，没有配置前缀时都不允许
+func (a *App) AllowNotify(u string) bool {
+	for _, p := range strings.Fields(a.NotifyPrefixes) {
+		if strings.HasPrefix(u, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowCents 金额是否在应用的限额内
+func (a *App) AllowCents(cents int) bool {
+	return cents >= a.MinCents && (a.MaxCents == 0 || cents <= a.MaxCents)
+}
+
+// SignPubkey 返回签名密钥的公钥，应用用它验证通知
+func (a *App) SignPubkey() string {
+	seed, err := base64.RawURLEncoding.DecodeString(a.SignKey)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return ""
+	}
+	pub := ed25519.NewKeyFromSeed(seed).Public().(ed25519.PublicKey)
+	return base64.RawURLEncoding.EncodeToString(pub)
+}
+
+type AppRepo interface {
+	// GetApp fetches the app of name, ID is 0 if not found.
+	GetApp(name string) (App, error)
+	// ListApps fetches all apps ordered by name.
+	ListApps() ([]App, error)
+	// SaveApp creates the app if ID is 0, or updates it.
+	SaveApp(a *App) error
+}
+
+func NewAppRepo(path string) AppRepo {
+	db := mustOpen(path)
+	if db.Dialect == SQLite {
+		db.SetMaxOpenConns(1)
+	}
+	if err := db.migrate("app"); err != nil {
+		panic(err)
+	}
+	return sqlAppRepo{db: db}
+}
+
+type sqlAppRepo struct {
+	db *DB
+}
+
+func (r sqlAppRepo) Ping(ctx context.Context) error {
+	return r.db.PingContext(ctx)
+}
+
+func (r sqlAppRepo) GetApp(name string) (a App, err error) {
+	err = r.db.Get(&a, "select * from "+a.TableName()+" where name = ?", name)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+	}
+	return
+}
+
+func (r sqlAppRepo) ListApps() (as []App, err error) {
+	err = r.db.Select(&as, "select * from "+(*App).TableName(nil)+" order by name")
+	return
+}
+
+func (r sqlAppRepo) SaveApp(a *App) (err error) {
+	now := time.Now()
+	a.Updated = now
+	if a.ID == 0 {
+		a.Created = now
+		a.ID, err = r.db.InsertID(a)
+		return
+	}
+	_, err = r.db.Exec("update "+a.TableName()+
+		" set verify_key = ?, sign_key = ?, notify_prefixes = ?, min_cents = ?, max_cents = ?, active = ?, updated = ?"+
+		" where id = ?",
+		a.VerifyKey, a.SignKey, a.NotifyPrefixes, a.MinCents, a.MaxCents, a.Active, a.Updated, a.ID)
+	return
+}
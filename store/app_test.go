@@ -0,0 +1,41 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAppRepo(t *testing.T) {
+	r := NewAppRepo(":memory:")
+
+	a := App{Name: "foo", NotifyPrefixes: "https://foo.com/pay/\nhttps://bar.com/", MaxCents: 1000}
+	assert.Nil(t, r.SaveApp(&a))
+	assert.NotZero(t, a.ID)
+	assert.True(t, IsUnique(r.SaveApp(&App{Name: "foo"})))
+
+	a.Active = true
+	a.MinCents = 10
+	assert.Nil(t, r.SaveApp(&a))
+
+	b, err := r.GetApp("foo")
+	assert.Nil(t, err)
+	assert.True(t, b.Active)
+	assert.Equal(t, 10, b.MinCents)
+
+	assert.True(t, b.AllowNotify("https://bar.com/x"))
+	assert.False(t, b.AllowNotify("https://foo.com/other"))
+	assert.False(t, (&App{}).AllowNotify("https://foo.com/"))
+
+	assert.True(t, b.AllowCents(1000))
+	assert.False(t, b.AllowCents(1001))
+	assert.False(t, b.AllowCents(9))
+
+	b, err = r.GetApp("bar")
+	assert.Nil(t, err)
+	assert.Zero(t, b.ID)
+
+	as, err := r.ListApps()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(as))
+}
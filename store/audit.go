@@ -0,0 +1,224 @@
+package store
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Audit 特权及安全相关操作记录，只能追加。
+// 每条记录的 Hash 包含上一条记录的 Hash，修改或删除历史记录会导致后续校验失败。
+type Audit struct {
+	ID       int       `db:"id" json:"id"`
+	Actor    string    `db:"actor" json:"actor"`   // 操作人，如 admin、wallet:1、pay:alipay
+	Action   string    `db:"action" json:"action"` // 操作类型，如 wallet.adjust
+	Target   string    `db:"target" json:"target"` // 操作对象，如 wallet:1
+	IP       string    `db:"ip" json:"ip"`
+	Agent    string    `db:"agent" json:"agent"`   // User-Agent
+	Result   string    `db:"result" json:"result"` // ok 或者错误信息
+	Detail   string    `db:"detail" json:"detail"` // 操作参数，一般为 JSON
+	PrevHash string    `db:"prev_hash" json:"prev_hash"`
+	Hash     string    `db:"hash" json:"hash"`
+	Created  time.Time `db:"created" json:"created"`
+}
+
+// AuditOK 操作成功时的 Result
+const AuditOK = "ok"
+
+// sum 计算记录的 Hash，时间精确到微秒以兼容 PostgreSQL
+func (a *Audit) sum() string {
+	h := sha256.New()
+	for _, s := range []string{
+		a.PrevHash, a.Actor, a.Action, a.Target, a.IP, a.Agent, a.Result, a.Detail,
+		a.Created.UTC().Truncate(time.Microsecond).Format(time.RFC3339Nano),
+	} {
+		h.Write([]byte(strconv.Itoa(len(s)) + ":" + s))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (_ *Audit) KeyName() string   { return "id" }
+func (_ *Audit) TableName() string { return "audits" }
+func (a *Audit) Schema() string {
+	return "CREATE TABLE IF NOT EXISTS " + a.TableName() + `(
+	` + a.KeyName() + ` INTEGER PRIMARY KEY AUTOINCREMENT,
+	actor TEXT NOT NULL,
+	action TEXT NOT NULL,
+	target TEXT DEFAULT '',
+	ip TEXT DEFAULT '',
+	agent TEXT DEFAULT '',
+	result TEXT DEFAULT '',
+	detail TEXT DEFAULT '',
+	prev_hash TEXT DEFAULT '',
+	hash TEXT DEFAULT '',
+	created DATETIME
+);
+	CREATE INDEX IF NOT EXISTS a_target ON ` + a.TableName() + `(target, id);`
+}
+
+type AuditRepo interface {
+	// AddAudit appends one record and chains it to the last one.
+	AddAudit(a *Audit) error
+	// ListAudits fetches records of target with id less than before, newest first.
+	// All records are listed if target is empty.
+	ListAudits(target string, before, num int) ([]Audit, error)
+	// VerifyAudits checks the hash chain from the first record.
+	// It returns the number of records checked and the id of the first broken one, or 0 if intact.
+	VerifyAudits() (n int, broken int, err error)
+}
+
+func NewAuditRepo(path string) AuditRepo {
+	db := mustOpen(path)
+	if db.Dialect == SQLite {
+		db.SetMaxOpenConns(1)
+	}
+	if err := db.migrate("audit"); err != nil {
+		panic(err)
+	}
+	return sqlAuditRepo{db: db}
+}
+
+type sqlAuditRepo struct {
+	db *DB
+}
+
+func (r sqlAuditRepo) Ping(ctx context.Context) error {
+	return r.db.PingContext(ctx)
+}
+
+// auditMu 保证同一进程内按顺序追加记录
+var auditMu sync.Mutex
+
+func (r sqlAuditRepo) AddAudit(a *Audit) (err error) {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	// 多实例共用 PostgreSQL 时需要锁表，否则会分叉
+	if tx.Dialect == Postgres {
+		if _, err = tx.Exec("LOCK TABLE " + a.TableName() + " IN EXCLUSIVE MODE"); err != nil {
+			return
+		}
+	}
+
+	var last []string
+	err = tx.Select(&last, "select hash from "+a.TableName()+" order by id desc limit 1")
+	if err != nil {
+		return
+	}
+	a.PrevHash = ""
+	if len(last) > 0 {
+		a.PrevHash = last[0]
+	}
+	if a.Result == "" {
+		a.Result = AuditOK
+	}
+	a.Created = time.Now().UTC().Truncate(time.Microsecond)
+	a.Hash = a.sum()
+
+	id, err := tx.InsertID(a)
+	if err != nil {
+		return
+	}
+	if err = tx.Commit(); err == nil {
+		a.ID = id
+	}
+	return
+}
+
+func (r sqlAuditRepo) VerifyAudits() (n int, broken int, err error) {
+	prev, last := "", 0
+	for {
+		var as []Audit
+		err = r.db.Select(&as, "select * from "+(*Audit).TableName(nil)+
+			" where id > ? order by id asc limit 500", last)
+		if err != nil || len(as) == 0 {
+			return
+		}
+		for _, a := range as {
+			if a.PrevHash != prev || a.Hash != a.sum() {
+				return n, a.ID, nil
+			}
+			prev, last = a.Hash, a.ID
+			n++
+		}
+	}
+}
+
+// chainAudits 为没有 Hash 的老记录补齐哈希链
+func chainAudits(tx *Tx) error {
+	var as []Audit
+	if err := tx.Select(&as, "select * from "+(*Audit).TableName(nil)+" order by id asc"); err != nil {
+		return err
+	}
+	prev := ""
+	for _, a := range as {
+		if a.Result == "" {
+			a.Result = AuditOK
+		}
+		a.PrevHash = prev
+		a.Hash = a.sum()
+		_, err := tx.Exec("update "+a.TableName()+" set result = ?, prev_hash = ?, hash = ? where id = ?",
+			a.Result, a.PrevHash, a.Hash, a.ID)
+		if err != nil {
+			return err
+		}
+		prev = a.Hash
+	}
+	return nil
+}
+
+// appendOnly 禁止修改和删除记录
+func appendOnly(tx *Tx) error {
+	t := (*Audit).TableName(nil)
+	ss := []string{
+		"CREATE TRIGGER IF NOT EXISTS " + t + "_no_update BEFORE UPDATE ON " + t +
+			" BEGIN SELECT RAISE(ABORT, '" + t + " is append-only'); END;",
+		"CREATE TRIGGER IF NOT EXISTS " + t + "_no_delete BEFORE DELETE ON " + t +
+			" BEGIN SELECT RAISE(ABORT, '" + t + " is append-only'); END;",
+	}
+	if tx.Dialect == Postgres {
+		ss = []string{
+			"CREATE OR REPLACE FUNCTION " + t + "_append_only() RETURNS trigger AS $$" +
+				" BEGIN RAISE EXCEPTION '" + t + " is append-only'; END; $$ LANGUAGE plpgsql;",
+			"DROP TRIGGER IF EXISTS " + t + "_append_only ON " + t + ";",
+			"CREATE TRIGGER " + t + "_append_only BEFORE UPDATE OR DELETE OR TRUNCATE ON " + t +
+				" FOR EACH STATEMENT EXECUTE FUNCTION " + t + "_append_only();",
+		}
+	}
+	for _, s := range ss {
+		if _, err := tx.Exec(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r sqlAuditRepo) ListAudits(target string, before, num int) (as []Audit, err error) {
+	if before <= 0 {
+		before = math.MaxInt
+	}
+	q := "select * from " + (*Audit).TableName(nil) + " where id < ?"
+	args := []any{before}
+	if target != "" {
+		q += " and target = ?"
+		args = append(args, target)
+	}
+	q += " order by id desc limit ?"
+	args = append(args, num)
+	err = r.db.Select(&as, q, args...)
+	return
+}
@@ -0,0 +1,85 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditRepo(t *testing.T) {
+	r := NewAuditRepo(":memory:")
+
+	for _, target := range []string{"wallet:1", "zone:foo", "wallet:1"} {
+		assert.Nil(t, r.AddAudit(&Audit{Actor: "admin", Action: "x", Target: target}))
+	}
+
+	as, err := r.ListAudits("", 0, 10)
+	assert.Nil(t, err)
+	assert.Len(t, as, 3)
+	assert.Equal(t, 3, as[0].ID)
+	assert.Equal(t, AuditOK, as[0].Result)
+	assert.Equal(t, as[1].Hash, as[0].PrevHash)
+	assert.Equal(t, "", as[2].PrevHash)
+
+	as, err = r.ListAudits("wallet:1", 0, 10)
+	assert.Nil(t, err)
+	assert.Len(t, as, 2)
+
+	as, err = r.ListAudits("wallet:1", 3, 10)
+	assert.Nil(t, err)
+	assert.Len(t, as, 1)
+	assert.Equal(t, 1, as[0].ID)
+
+	n, broken, err := r.VerifyAudits()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, n)
+	assert.Zero(t, broken)
+
+	// 只能追加
+	db := r.(sqlAuditRepo).db
+	_, err = db.Exec("update audits set target = 'zone:bar' where id = 2")
+	assert.NotNil(t, err)
+	_, err = db.Exec("delete from audits where id = 3")
+	assert.NotNil(t, err)
+
+	// 绕过触发器修改记录
+	_, err = db.Exec("drop trigger audits_no_update")
+	assert.Nil(t, err)
+	_, err = db.Exec("update audits set target = 'zone:bar' where id = 2")
+	assert.Nil(t, err)
+
+	n, broken, err = r.VerifyAudits()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, 2, broken)
+}
+
+func TestChainAudits(t *testing.T) {
+	db, err := Open(":memory:")
+	assert.Nil(t, err)
+	db.SetMaxOpenConns(1)
+
+	// 老版本没有请求字段和哈希链
+	_, err = db.Exec(`CREATE TABLE audits(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	actor TEXT NOT NULL,
+	action TEXT NOT NULL,
+	target TEXT DEFAULT '',
+	detail TEXT DEFAULT '',
+	created DATETIME
+)`)
+	assert.Nil(t, err)
+	_, err = db.Exec("insert into audits(actor, action, target, detail, created) values" +
+		" ('admin', 'x', 'wallet:1', '', '2026-10-01 00:00:00.123456789+00:00')," +
+		" ('admin', 'y', 'wallet:2', '', '2026-10-02 00:00:00+00:00')")
+	assert.Nil(t, err)
+
+	assert.Nil(t, db.migrate("audit"))
+	r := sqlAuditRepo{db: db}
+	assert.Nil(t, r.AddAudit(&Audit{Actor: "admin", Action: "z"}))
+
+	n, broken, err := r.VerifyAudits()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, n)
+	assert.Zero(t, broken)
+}
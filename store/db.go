@@ -0,0 +1,205 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/go-kiss/sqlx"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/jmoiron/sqlx/reflectx"
+	"modernc.org/sqlite"
+)
+
+// Dialect 数据库方言
+type Dialect int
+
+const (
+	SQLite Dialect = iota
+	Postgres
+)
+
+// 建表语句统一按 SQLite 语法编写，其他数据库按以下规则转换
+var pgSchema = strings.NewReplacer(
+	"INTEGER PRIMARY KEY AUTOINCREMENT", "BIGSERIAL PRIMARY KEY",
+	"INTEGER", "BIGINT",
+	"DATETIME", "TIMESTAMPTZ",
+	"TIMESTAMP", "TIMESTAMPTZ",
+	"BLOB", "BYTEA",
+)
+
+// Schema 将 SQLite 建表语句转换为当前方言
+func (d Dialect) Schema(s string) string {
+	if d == Postgres {
+		return pgSchema.Replace(s)
+	}
+	return s
+}
+
+// ForUpdate 返回锁定查询行的后缀。PostgreSQL 默认的 READ COMMITTED 级别下，
+// 先查询再更新会丢失并发修改，需要 FOR UPDATE 加锁；SQLite 写事务本身互斥，不需要。
+func (d Dialect) ForUpdate() string {
+	if d == Postgres {
+		return " FOR UPDATE"
+	}
+	return ""
+}
+
+// IsUnique 判断 err 是否为唯一约束冲突
+func IsUnique(err error) bool {
+	se := &sqlite.Error{}
+	// constraint failed: UNIQUE constraint failed
+	if errors.As(err, &se) {
+		return se.Code() == 2067
+	}
+	// unique_violation
+	var pe interface{ SQLState() string }
+	if errors.As(err, &pe) {
+		return pe.SQLState() == "23505"
+	}
+	return false
+}
+
+// DB 包装 sqlx.DB，查询语句统一使用 ? 占位符
+type DB struct {
+	*sqlx.DB
+	Dialect Dialect
+}
+
+// Open 打开数据库。dsn 以 postgres:// 或 postgresql:// 开头时使用 PostgreSQL，
+// 其余均视为 SQLite 数据源。
+func Open(dsn string) (*DB, error) {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		db, err := sqlx.Connect("pgx", dsn)
+		if err != nil {
+			return nil, err
+		}
+		return &DB{DB: db, Dialect: Postgres}, nil
+	}
+	db, err := sqlx.Connect("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &DB{DB: db, Dialect: SQLite}, nil
+}
+
+// hasTable 判断当前库中是否存在表 name
+func (db *DB) hasTable(name string) (bool, error) {
+	q := "select count(*) from sqlite_master where type = 'table' and name = ?"
+	if db.Dialect == Postgres {
+		q = "select count(*) from information_schema.tables where table_schema = current_schema() and table_name = ?"
+	}
+	var n int
+	err := db.Get(&n, q, name)
+	return n > 0, err
+}
+
+// Pinger 可以检查数据库连接的仓库，各 sql 仓库均已实现
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// Ping 检查 repo 的数据库连接，repo 没有实现 Pinger 时返回 nil
+func Ping(ctx context.Context, repo any) error {
+	if p, ok := repo.(Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func mustOpen(dsn string) *DB {
+	db, err := Open(dsn)
+	if err != nil {
+		panic(err)
+	}
+	return db
+}
+
+func (db *DB) Get(dest any, query string, args ...any) error {
+	return db.DB.Get(dest, db.Rebind(query), args...)
+}
+
+func (db *DB) Select(dest any, query string, args ...any) error {
+	return db.DB.Select(dest, db.Rebind(query), args...)
+}
+
+func (db *DB) Exec(query string, args ...any) (sql.Result, error) {
+	return db.DB.Exec(db.Rebind(query), args...)
+}
+
+func (db *DB) Beginx() (*Tx, error) {
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{Tx: tx, Dialect: db.Dialect}, nil
+}
+
+// InsertID 插入 m 并返回自增主键
+func (db *DB) InsertID(m sqlx.Modeler) (int, error) {
+	return insertID(db.DB, db.Dialect, m)
+}
+
+// Tx 包装 sqlx.Tx，查询语句统一使用 ? 占位符
+type Tx struct {
+	*sqlx.Tx
+	Dialect Dialect
+}
+
+func (tx *Tx) Get(dest any, query string, args ...any) error {
+	return tx.Tx.Get(dest, tx.Rebind(query), args...)
+}
+
+func (tx *Tx) Select(dest any, query string, args ...any) error {
+	return tx.Tx.Select(dest, tx.Rebind(query), args...)
+}
+
+func (tx *Tx) Exec(query string, args ...any) (sql.Result, error) {
+	return tx.Tx.Exec(tx.Rebind(query), args...)
+}
+
+// InsertID 插入 m 并返回自增主键
+func (tx *Tx) InsertID(m sqlx.Modeler) (int, error) {
+	return insertID(tx.Tx, tx.Dialect, m)
+}
+
+type inserter interface {
+	Insert(m sqlx.Modeler) (sql.Result, error)
+	GetMapper() *reflectx.Mapper
+	BindNamed(query string, arg any) (string, []any, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+func insertID(e inserter, d Dialect, m sqlx.Modeler) (int, error) {
+	if d != Postgres {
+		r, err := e.Insert(m)
+		if err != nil {
+			return 0, err
+		}
+		id, err := r.LastInsertId()
+		return int(id), err
+	}
+
+	// PostgreSQL 不支持 LastInsertId，主键交给序列生成并通过 RETURNING 取回
+	var names []string
+	for n := range e.GetMapper().TypeMap(reflect.TypeOf(m)).Names {
+		if n != m.KeyName() {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+
+	q := "INSERT INTO " + m.TableName() + "(" + strings.Join(names, ",") + ")" +
+		" VALUES (:" + strings.Join(names, ",:") + ") RETURNING " + m.KeyName()
+	q, args, err := e.BindNamed(q, m)
+	if err != nil {
+		return 0, err
+	}
+
+	var id int
+	err = e.QueryRow(q, args...).Scan(&id)
+	return id, err
+}
@@ -0,0 +1,80 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDialectSchema(t *testing.T) {
+	s := (*Session).Schema(nil)
+	assert.Equal(t, s, SQLite.Schema(s))
+
+	pg := Postgres.Schema(s)
+	assert.Contains(t, pg, "id BIGSERIAL PRIMARY KEY,")
+	assert.Contains(t, pg, "user_id BIGINT,")
+	assert.Contains(t, pg, "created TIMESTAMPTZ")
+	assert.NotContains(t, pg, "AUTOINCREMENT")
+
+	pg = Postgres.Schema((*TokenLog).Schema(nil))
+	assert.Contains(t, pg, "created TIMESTAMPTZ NOT NULL")
+
+	pg = Postgres.Schema((*TokenWallet).Schema(nil))
+	assert.Contains(t, pg, "password BYTEA")
+}
+
+type pgError string
+
+func (e pgError) Error() string    { return string(e) }
+func (e pgError) SQLState() string { return string(e) }
+
+func TestIsUnique(t *testing.T) {
+	r := NewZoneRepo(":memory:").(sqlZoneRepo)
+	_, err := r.db.Exec("CREATE UNIQUE INDEX z_webkey ON zones(webkey)")
+	assert.Nil(t, err)
+
+	assert.Nil(t, r.New(&Zone{Name: "a", WebKey: "k"}))
+	err = r.New(&Zone{Name: "b", WebKey: "k"})
+	assert.True(t, IsUnique(err))
+	assert.False(t, IsUnique(nil))
+
+	assert.True(t, IsUnique(fmt.Errorf("insert: %w", pgError("23505"))))
+	assert.False(t, IsUnique(pgError("23503")))
+}
+
+func TestInsertID(t *testing.T) {
+	db, err := Open(":memory:")
+	assert.Nil(t, err)
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec(SQLite.Schema((*Zone).Schema(nil)))
+	assert.Nil(t, err)
+
+	for i := 1; i <= 3; i++ {
+		id, err := db.InsertID(&Zone{Name: "a"})
+		assert.Nil(t, err)
+		assert.Equal(t, i, id)
+	}
+
+	tx, err := db.Beginx()
+	assert.Nil(t, err)
+	id, err := tx.InsertID(&Zone{Name: "b"})
+	assert.Nil(t, err)
+	assert.Equal(t, 4, id)
+
+	var z Zone
+	assert.Nil(t, tx.Get(&z, "select * from zones where id = ?", id))
+	assert.Equal(t, "b", z.Name)
+	assert.Nil(t, tx.Commit())
+}
+
+func TestPing(t *testing.T) {
+	ctx := context.Background()
+	repo := NewUsageRepo(":memory:")
+	assert.Nil(t, Ping(ctx, repo))
+	assert.Nil(t, Ping(ctx, struct{}{}))
+
+	repo.(sqlUsageRepo).db.Close()
+	assert.NotNil(t, Ping(ctx, repo))
+}
@@ -0,0 +1,238 @@
+package store
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// AutoMigrate 为 true 时创建仓库会自动执行未完成的迁移，
+// 否则存在未执行的迁移时创建失败，需要先手工执行 led migrate
+var AutoMigrate = true
+
+// Migration 数据库结构变更，同一仓库内按 Version 顺序执行且只执行一次
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *Tx) error
+}
+
+// Migrations 各仓库的迁移列表，键为仓库名。
+// 新表直接按最新 Schema 创建，老库中缺少的字段由后续迁移补齐。
+var Migrations = map[string][]Migration{
+	"token": {
+		{1, "create token tables", execSchema(
+			(*TokenWallet).Schema(nil),
+			(*TokenLog).Schema(nil),
+			(*Session).Schema(nil),
+		)},
+		{2, "add wallet login and invite columns", addColumns((*TokenWallet).TableName(nil),
+			"username TEXT default ''",
+			"password BLOB default ''",
+			"from_id INTEGER default 0",
+			"invite_tokens INTEGER default 0",
+			"invite_users INTEGER default 0",
+		)},
+		{3, "index wallet from_id", execSchema(
+			"CREATE INDEX IF NOT EXISTS w_from_id ON " + (*TokenWallet).TableName(nil) + "(from_id);",
+		)},
+		{4, "create token_refunds", execSchema((*TokenRefund).Schema(nil))},
+		{5, "add wallet referral_tokens", func(tx *Tx) error {
+			err := addColumns((*TokenWallet).TableName(nil), "referral_tokens INTEGER default 0")(tx)
+			if err != nil {
+				return err
+			}
+			return backfillReferralTokens(tx)
+		}},
+	},
+	"ticket": {
+		{1, "create tickets", execSchema((*Ticket).Schema(nil))},
+		{2, "add ticket tier and traffic columns", addColumns((*Ticket).TableName(nil),
+			"tier TEXT DEFAULT ''",
+			"up_bytes INTEGER DEFAULT 0",
+			"down_bytes INTEGER DEFAULT 0",
+			"up_ratio INTEGER DEFAULT 100",
+			"down_ratio INTEGER DEFAULT 100",
+		)},
+		{3, "create ticket_watches", execSchema((*TicketWatch).Schema(nil))},
+		{4, "index ticket buy_order", execSchema(
+			"CREATE INDEX IF NOT EXISTS t_buy_order ON " + (*Ticket).TableName(nil) + "(buy_order);",
+		)},
+	},
+	"usage": {
+		{1, "create usages", execSchema((*Usage).Schema(nil))},
+	},
+	"zone": {
+		{1, "create zones", execSchema((*Zone).Schema(nil))},
+	},
+	"order": {
+		{1, "create pay_orders", execSchema((*PayOrder).Schema(nil))},
+		{2, "create webhooks", execSchema((*Webhook).Schema(nil))},
+	},
+	"app": {
+		{1, "create apps", execSchema((*App).Schema(nil))},
+	},
+	"audit": {
+		{1, "create audits", execSchema((*Audit).Schema(nil))},
+		{2, "add audit request columns and hash chain", func(tx *Tx) error {
+			err := addColumns((*Audit).TableName(nil),
+				"ip TEXT DEFAULT ''",
+				"agent TEXT DEFAULT ''",
+				"result TEXT DEFAULT ''",
+				"prev_hash TEXT DEFAULT ''",
+				"hash TEXT DEFAULT ''",
+			)(tx)
+			if err != nil {
+				return err
+			}
+			if err = chainAudits(tx); err != nil {
+				return err
+			}
+			return appendOnly(tx)
+		}},
+	},
+}
+
+// SchemaVersion 已执行的迁移记录
+type SchemaVersion struct {
+	Repo    string    `db:"repo"`
+	Version int       `db:"version"`
+	Name    string    `db:"name"`
+	Applied time.Time `db:"applied"`
+}
+
+func (_ *SchemaVersion) TableName() string { return "schema_version" }
+func (v *SchemaVersion) Schema() string {
+	return "CREATE TABLE IF NOT EXISTS " + v.TableName() + `(
+	repo TEXT NOT NULL,
+	version INTEGER NOT NULL,
+	name TEXT NOT NULL,
+	applied DATETIME NOT NULL,
+	PRIMARY KEY (repo, version)
+);`
+}
+
+// Version 返回 repo 已执行的最大迁移版本，只读取不修改数据库
+func (db *DB) Version(repo string) (v int, err error) {
+	ok, err := db.hasTable((*SchemaVersion).TableName(nil))
+	if err != nil || !ok {
+		return
+	}
+	err = db.Get(&v, "select coalesce(max(version), 0) from "+
+		(*SchemaVersion).TableName(nil)+" where repo = ?", repo)
+	return
+}
+
+// Migrate 执行 repo 中未执行的迁移，返回本次执行的迁移。
+// dryRun 为 true 时只返回待执行的迁移，不修改数据库。
+func (db *DB) Migrate(repo string, dryRun bool) (done []Migration, err error) {
+	ms, ok := Migrations[repo]
+	if !ok {
+		return nil, fmt.Errorf("unknown repo %q", repo)
+	}
+
+	v, err := db.Version(repo)
+	if err != nil {
+		return nil, err
+	}
+	if !dryRun {
+		if _, err = db.Exec(db.Dialect.Schema((*SchemaVersion).Schema(nil))); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, m := range ms {
+		if m.Version <= v {
+			continue
+		}
+		if !dryRun {
+			if err = db.apply(repo, m); err != nil {
+				return done, fmt.Errorf("migrate %s %d %s: %w", repo, m.Version, m.Name, err)
+			}
+			slog.Info("migrated", "repo", repo, "version", m.Version, "name", m.Name)
+		}
+		done = append(done, m)
+	}
+	return
+}
+
+func (db *DB) apply(repo string, m Migration) (err error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	if err = m.Up(tx); err != nil {
+		return
+	}
+
+	// 多实例同时迁移时主键冲突，只有一个能提交
+	_, err = tx.Exec("insert into "+(*SchemaVersion).TableName(nil)+
+		"(repo, version, name, applied) values (?, ?, ?, ?)",
+		repo, m.Version, m.Name, time.Now())
+	if err != nil {
+		return
+	}
+	return tx.Commit()
+}
+
+// migrate 按 AutoMigrate 执行或检查 repo 的迁移
+func (db *DB) migrate(repo string) error {
+	ms, err := db.Migrate(repo, !AutoMigrate)
+	if err != nil {
+		return err
+	}
+	if !AutoMigrate && len(ms) > 0 {
+		return fmt.Errorf("%s has %d pending migrations", repo, len(ms))
+	}
+	return nil
+}
+
+func execSchema(schemas ...string) func(tx *Tx) error {
+	return func(tx *Tx) error {
+		for _, s := range schemas {
+			if _, err := tx.Exec(tx.Dialect.Schema(s)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// addColumns 添加 table 中不存在的字段，cols 为 SQLite 语法的字段定义
+func addColumns(table string, cols ...string) func(tx *Tx) error {
+	return func(tx *Tx) error {
+		for _, c := range cols {
+			name, _, _ := strings.Cut(c, " ")
+			ok, err := tx.hasColumn(table, name)
+			if err != nil {
+				return err
+			}
+			if ok {
+				continue
+			}
+			_, err = tx.Exec("ALTER TABLE " + table + " ADD COLUMN " + tx.Dialect.Schema(c))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func (tx *Tx) hasColumn(table, name string) (bool, error) {
+	q := "select count(*) from pragma_table_info(?) where name = ?"
+	if tx.Dialect == Postgres {
+		q = "select count(*) from information_schema.columns" +
+			" where table_schema = current_schema() and table_name = ? and column_name = ?"
+	}
+	var n int
+	err := tx.Get(&n, q, table, name)
+	return n > 0, err
+}
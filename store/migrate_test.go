@@ -0,0 +1,75 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrate(t *testing.T) {
+	db, err := Open(":memory:")
+	assert.Nil(t, err)
+	db.SetMaxOpenConns(1)
+
+	// 老数据库没有登录和邀请字段
+	_, err = db.Exec(`CREATE TABLE token_wallets(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	tokens INTEGER,
+	pubkey TEXT,
+	extra TEXT,
+	created DATETIME,
+	updated DATETIME
+)`)
+	assert.Nil(t, err)
+	_, err = db.Exec("INSERT INTO token_wallets(tokens, pubkey, extra, created, updated) VALUES (1, 'k', '{}', ?, ?)", time.Now(), time.Now())
+	assert.Nil(t, err)
+
+	ms, err := db.Migrate("token", true)
+	assert.Nil(t, err)
+	assert.Equal(t, len(Migrations["token"]), len(ms))
+
+	v, err := db.Version("token")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, v)
+
+	// 只检查时不创建迁移记录表
+	ok, err := db.hasTable((*SchemaVersion).TableName(nil))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	ms, err = db.Migrate("token", false)
+	assert.Nil(t, err)
+	assert.Equal(t, len(Migrations["token"]), len(ms))
+
+	v, err = db.Version("token")
+	assert.Nil(t, err)
+	assert.Equal(t, len(Migrations["token"]), v)
+
+	var w TokenWallet
+	err = db.Get(&w, "select * from token_wallets where pubkey = 'k'")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, w.Tokens)
+	assert.Equal(t, 0, w.InviteTokens)
+
+	ms, err = db.Migrate("token", false)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(ms))
+
+	_, err = db.Migrate("foo", false)
+	assert.NotNil(t, err)
+}
+
+func TestMigrateManual(t *testing.T) {
+	AutoMigrate = false
+	defer func() { AutoMigrate = true }()
+
+	assert.Panics(t, func() { NewZoneRepo(":memory:") })
+
+	db, err := Open(":memory:")
+	assert.Nil(t, err)
+	db.SetMaxOpenConns(1)
+	_, err = db.Migrate("zone", false)
+	assert.Nil(t, err)
+	assert.Nil(t, db.migrate("zone"))
+}
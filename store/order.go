@@ -0,0 +1,127 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// OrderStatus 支付订单状态
+type OrderStatus int
+
+const (
+	OrderPending OrderStatus = iota // 等待支付
+	OrderPaid                       // 已支付并到账
+	OrderClosed                     // 超时未支付，已关闭
+)
+
+// PayOrder 已创建的支付订单，用于补偿丢失的支付通知
+type PayOrder struct {
+	ID       int         `db:"id" json:"id"`
+	Provider string      `db:"provider" json:"provider"` // 支付渠道
+	Kind     string      `db:"kind" json:"kind"`         // 业务类型，如 tokens、ticket
+	TradeNo  string      `db:"trade_no" json:"trade_no"` // 商户订单号
+	PayNo    string      `db:"pay_no" json:"pay_no"`     // 渠道交易号
+	Cents    int         `db:"cents" json:"cents"`
+	Subject  string      `db:"subject" json:"subject"`
+	Extra    string      `db:"extra" json:"-"` // 回传参数
+	Status   OrderStatus `db:"status" json:"status"`
+	Created  time.Time   `db:"created" json:"created"`
+	Updated  time.Time   `db:"updated" json:"updated"`
+}
+
+func (_ *PayOrder) KeyName() string   { return "id" }
+func (_ *PayOrder) TableName() string { return "pay_orders" }
+func (o *PayOrder) Schema() string {
+	return "CREATE TABLE IF NOT EXISTS " + o.TableName() + `(
+	` + o.KeyName() + ` INTEGER PRIMARY KEY AUTOINCREMENT,
+	provider TEXT NOT NULL,
+	kind TEXT NOT NULL,
+	trade_no TEXT NOT NULL,
+	pay_no TEXT DEFAULT '',
+	cents INTEGER NOT NULL,
+	subject TEXT DEFAULT '',
+	extra TEXT DEFAULT '',
+	status INTEGER DEFAULT 0,
+	created DATETIME,
+	updated DATETIME
+);
+	CREATE UNIQUE INDEX IF NOT EXISTS o_trade_no ON ` + o.TableName() + `(trade_no);
+	CREATE INDEX IF NOT EXISTS o_status ON ` + o.TableName() + `(status, created);`
+}
+
+type OrderRepo interface {
+	// NewOrder saves a pending order.
+	NewOrder(o *PayOrder) error
+	// FindOrder fetches the order of tradeNo, ID is 0 if not found.
+	FindOrder(tradeNo string) (PayOrder, error)
+	// UpdateOrder changes the status and pay_no of order.
+	UpdateOrder(o *PayOrder) error
+	// ListPending fetches pending orders created before the time whose id > after, oldest first.
+	ListPending(before time.Time, after, num int) ([]PayOrder, error)
+
+	// AddWebhook saves a pending webhook, which is due now if NextAt is zero.
+	AddWebhook(h *Webhook) error
+	// FindWebhook fetches the webhook of id, ID is 0 if not found.
+	FindWebhook(id int) (Webhook, error)
+	// SaveWebhook updates the delivery state of webhook.
+	SaveWebhook(h *Webhook) error
+	// DueWebhooks fetches pending webhooks whose next_at <= now.
+	DueWebhooks(now time.Time, num int) ([]Webhook, error)
+	// ListWebhooks fetches webhooks of app whose id < before, newest first.
+	// All orders of app are listed if tradeNo is empty.
+	ListWebhooks(app, tradeNo string, before, num int) ([]Webhook, error)
+}
+
+func NewOrderRepo(path string) OrderRepo {
+	db := mustOpen(path)
+	if db.Dialect == SQLite {
+		db.SetMaxOpenConns(1)
+	}
+	if err := db.migrate("order"); err != nil {
+		panic(err)
+	}
+	return sqlOrderRepo{db: db}
+}
+
+type sqlOrderRepo struct {
+	db *DB
+}
+
+func (r sqlOrderRepo) Ping(ctx context.Context) error {
+	return r.db.PingContext(ctx)
+}
+
+func (r sqlOrderRepo) NewOrder(o *PayOrder) (err error) {
+	// SQLite 按字符串比较时间，统一使用 UTC
+	now := time.Now().UTC()
+	o.Status = OrderPending
+	o.Created = now
+	o.Updated = now
+	o.ID, err = r.db.InsertID(o)
+	return
+}
+
+func (r sqlOrderRepo) FindOrder(tradeNo string) (o PayOrder, err error) {
+	err = r.db.Get(&o, "select * from "+o.TableName()+" where trade_no = ?", tradeNo)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+	}
+	return
+}
+
+func (r sqlOrderRepo) UpdateOrder(o *PayOrder) error {
+	o.Updated = time.Now().UTC()
+	_, err := r.db.Exec("update "+o.TableName()+
+		" set status = ?, pay_no = ?, updated = ? where id = ?",
+		o.Status, o.PayNo, o.Updated, o.ID)
+	return err
+}
+
+func (r sqlOrderRepo) ListPending(before time.Time, after, num int) (orders []PayOrder, err error) {
+	err = r.db.Select(&orders, "select * from "+(*PayOrder).TableName(nil)+
+		" where status = ? and created < ? and id > ? order by id limit ?",
+		OrderPending, before.UTC(), after, num)
+	return
+}
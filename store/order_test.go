@@ -0,0 +1,52 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrderRepo(t *testing.T) {
+	r := NewOrderRepo(":memory:")
+
+	for _, no := range []string{"t1", "t2", "t3"} {
+		o := PayOrder{Provider: "fake", Kind: "tokens", TradeNo: no, Cents: 100}
+		assert.Nil(t, r.NewOrder(&o))
+		assert.NotZero(t, o.ID)
+	}
+
+	o := PayOrder{Provider: "fake", Kind: "tokens", TradeNo: "t1"}
+	assert.True(t, IsUnique(r.NewOrder(&o)))
+
+	o, err := r.FindOrder("t2")
+	assert.Nil(t, err)
+	assert.Equal(t, OrderPending, o.Status)
+
+	o.Status = OrderPaid
+	o.PayNo = "p2"
+	assert.Nil(t, r.UpdateOrder(&o))
+
+	o, err = r.FindOrder("t2")
+	assert.Nil(t, err)
+	assert.Equal(t, OrderPaid, o.Status)
+	assert.Equal(t, "p2", o.PayNo)
+
+	o, err = r.FindOrder("t4")
+	assert.Nil(t, err)
+	assert.Zero(t, o.ID)
+
+	os, err := r.ListPending(time.Now(), 0, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(os))
+	assert.Equal(t, "t1", os[0].TradeNo)
+
+	os, err = r.ListPending(time.Now(), os[0].ID, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(os))
+	assert.Equal(t, "t3", os[0].TradeNo)
+
+	os, err = r.ListPending(time.Now().Add(-time.Minute), 0, 10)
+	assert.Nil(t, err)
+	assert.Empty(t, os)
+}
@@ -0,0 +1,190 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// ReferralPolicy 邀请奖励规则
+type ReferralPolicy struct {
+	Percent int           // 按被邀请人购买 Token 数量的百分比奖励邀请人
+	Cap     int           // 每个被邀请人最多带来的奖励，0 表示不限制
+	Window  time.Duration // 被邀请人创建钱包后多长时间内的购买有奖励，0 表示不限制
+}
+
+// DefaultReferralPolicy 与原来固定奖励 10% 的规则一致
+var DefaultReferralPolicy = ReferralPolicy{Percent: 10}
+
+// reward 计算被邀请人 w 本次购买 n 个 Token 给邀请人的奖励
+func (p ReferralPolicy) reward(w *TokenWallet, n int, now time.Time) int {
+	if p.Window > 0 && now.Sub(w.Created) > p.Window {
+		return 0
+	}
+	t := n * p.Percent / 100
+	if p.Cap > 0 {
+		t = min(t, p.Cap-w.ReferralTokens)
+	}
+	return max(t, 0)
+}
+
+// Invitee 被邀请人及其带来的奖励
+type Invitee struct {
+	ID      int       `db:"id" json:"id"`
+	Tokens  int       `db:"referral_tokens" json:"tokens"`
+	Created time.Time `db:"created" json:"created"`
+}
+
+func (r *sqlTokenRepo) SetReferralPolicy(p ReferralPolicy) {
+	r.policy = p
+}
+
+func (r *sqlTokenRepo) ListInvitees(fromID, before, num int) (is []Invitee, err error) {
+	if before <= 0 {
+		before = math.MaxInt
+	}
+	q := "select id, referral_tokens, created from " + (*TokenWallet).TableName(nil) +
+		" where from_id = ? and id < ? order by id desc limit ?"
+	err = r.db.Select(&is, q, fromID, before, num)
+	return
+}
+
+// selfReferral 邀请人与被邀请人使用相同的支付宝账号或者公钥时视为自己邀请自己
+func selfReferral(tx *Tx, fw, w *TokenWallet, buyerID, pubkey string) (bool, error) {
+	if alipay := fw.Extra["alipay"]; alipay != "" && (alipay == buyerID || alipay == w.Extra["alipay"]) {
+		return true, nil
+	}
+
+	keys := []string{w.Pubkey, pubkey}
+	for _, k := range keys {
+		if k != "" && k == fw.Pubkey {
+			return true, nil
+		}
+	}
+
+	// 被邀请人的公钥是邀请人的登录会话
+	var n int
+	err := tx.Get(&n, "select count(*) from "+(*Session).TableName(nil)+
+		" where user_id = ? and pubkey in (?, ?)", fw.ID, w.Pubkey, pubkey)
+	return n > 0, err
+}
+
+// referral 按规则发放或者收回邀请奖励。
+// 购买时奖励记录在流水的 invite_tokens 中，退款时按比例收回。
+func (r *sqlTokenRepo) referral(tx *Tx, w *TokenWallet, log *TokenLog, buyerID, pubkey string) (fo *TokenLog, err error) {
+	var fw TokenWallet
+	err = tx.Get(&fw, "select * from "+fw.TableName()+" where id = ?"+tx.Dialect.ForUpdate(), w.FromID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return
+	}
+
+	t := 0
+	if log.Type == LogTypeBuy {
+		var self bool
+		if self, err = selfReferral(tx, &fw, w, buyerID, pubkey); err != nil {
+			return
+		}
+		if self {
+			// 不再奖励自己邀请自己的钱包
+			w.FromID = 0
+			_, err = tx.Exec("update "+w.TableName()+" set from_id = 0 where id = ?", w.ID)
+			return
+		}
+		if t = r.policy.reward(w, log.TokenNum, time.Now()); t == 0 {
+			return
+		}
+		log.Extra["invite_tokens"] = strconv.Itoa(t)
+		// 被邀请人第一次带来奖励时才计入邀请人数
+		if w.ReferralTokens == 0 {
+			fw.InviteUsers += 1
+		}
+		fw.Tokens += t
+		fw.InviteTokens += t
+		w.ReferralTokens += t
+	} else {
+		var bl TokenLog
+		err = tx.Get(&bl, "select * from "+bl.TableName()+" where pay_no = ?", log.Extra["pay_no"])
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return
+		}
+		err = nil
+		if s, ok := bl.Extra["invite_tokens"]; ok && bl.TokenNum > 0 {
+			n, _ := strconv.Atoi(s)
+			t = n * log.TokenNum / bl.TokenNum
+		} else {
+			// 老流水固定奖励 10%
+			t = log.TokenNum / 10
+		}
+		if t = min(t, w.ReferralTokens); t <= 0 {
+			return
+		}
+		fw.Tokens -= t
+		fw.InviteTokens -= t
+		w.ReferralTokens -= t
+		// 奖励全部收回后不再计入邀请人数
+		if w.ReferralTokens == 0 {
+			fw.InviteUsers -= 1
+		}
+	}
+
+	if _, err = tx.Exec("update "+w.TableName()+" set referral_tokens = ? where id = ?", w.ReferralTokens, w.ID); err != nil {
+		return
+	}
+	fw.Updated = time.Now()
+	if _, err = tx.Update(&fw); err != nil {
+		return
+	}
+
+	fo = &TokenLog{
+		UserID:   fw.ID,
+		Type:     LogTypeInvite,
+		TokenNum: t,
+		AfterNum: fw.Tokens,
+		Extra: map[string]string{
+			"from_id": strconv.Itoa(w.ID),
+		},
+		Created: log.Created,
+	}
+	if log.Type == LogTypeRefund { // 退款时按退回的 Token 收回邀请奖励
+		fo.Type = LogTypeRefund
+	}
+	return
+}
+
+// backfillReferralTokens 按已有的邀请流水统计每个被邀请人带来的奖励
+func backfillReferralTokens(tx *Tx) error {
+	var logs []TokenLog
+	err := tx.Select(&logs, "select * from "+(*TokenLog).TableName(nil)+
+		" where type in (?, ?) and pay_no = ''", LogTypeInvite, LogTypeRefund)
+	if err != nil {
+		return err
+	}
+
+	sums := map[int]int{}
+	for _, l := range logs {
+		id, err := strconv.Atoi(l.Extra["from_id"])
+		if err != nil {
+			continue
+		}
+		if l.Type == LogTypeInvite {
+			sums[id] += l.TokenNum
+		} else {
+			sums[id] -= l.TokenNum
+		}
+	}
+
+	for id, n := range sums {
+		_, err := tx.Exec("update "+(*TokenWallet).TableName(nil)+
+			" set referral_tokens = ? where id = ?", max(n, 0), id)
+		if err != nil {
+			return fmt.Errorf("backfill wallet %d: %w", id, err)
+		}
+	}
+	return nil
+}
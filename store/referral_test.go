@@ -0,0 +1,92 @@
+package store
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReferral(t *testing.T) {
+	f, err := os.CreateTemp("", "led-*.db")
+	assert.Nil(t, err)
+	f.Close()
+	defer os.Remove(f.Name())
+
+	repo := NewTokenRepo(f.Name())
+	repo.SetReferralPolicy(ReferralPolicy{Percent: 20, Cap: 300})
+
+	buy := func(uid int, n int, payNo string, extra KV) TokenWallet {
+		l := TokenLog{UserID: uid, Type: LogTypeBuy, TokenNum: n, ExtraNum: n / 10, PayNo: payNo, Extra: extra, Created: time.Now()}
+		w, err := repo.UpdateWallet(&l)
+		assert.Nil(t, err)
+		return w
+	}
+
+	a := buy(0, 100, "pay-a", KV{"_pubkey": "a", "_buyer_id": "alipay-a"})
+	from := strconv.Itoa(a.ID)
+
+	b := buy(0, 1000, "pay-b1", KV{"_pubkey": "b", "_buyer_id": "alipay-b", "_from_id": from})
+	assert.Equal(t, 200, b.ReferralTokens)
+	b = buy(b.ID, 1000, "pay-b2", KV{"_buyer_id": "alipay-b"})
+	assert.Equal(t, 300, b.ReferralTokens)
+
+	l, err := repo.FindLog("pay-b2")
+	assert.Nil(t, err)
+	assert.Equal(t, "100", l.Extra["invite_tokens"])
+
+	a, err = repo.GetWallet(a.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, 400, a.Tokens)
+	assert.Equal(t, 300, a.InviteTokens)
+	assert.Equal(t, 1, a.InviteUsers)
+
+	// 退款按比例收回奖励
+	_, err = repo.UpdateWallet(&TokenLog{UserID: b.ID, Type: LogTypeRefund, TokenNum: 500, PayNo: "Rpay-b2",
+		Extra: KV{"pay_no": "pay-b2"}, Created: time.Now()})
+	assert.Nil(t, err)
+	a, err = repo.GetWallet(a.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, 350, a.Tokens)
+	assert.Equal(t, 250, a.InviteTokens)
+	assert.Equal(t, 1, a.InviteUsers)
+
+	// 奖励全部收回后才减少邀请人数
+	_, err = repo.UpdateWallet(&TokenLog{UserID: b.ID, Type: LogTypeRefund, TokenNum: 1000, PayNo: "Rpay-b1",
+		Extra: KV{"pay_no": "pay-b1"}, Created: time.Now()})
+	assert.Nil(t, err)
+	a, err = repo.GetWallet(a.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, 150, a.Tokens)
+	assert.Equal(t, 50, a.InviteTokens)
+	assert.Equal(t, 1, a.InviteUsers)
+	_, err = repo.UpdateWallet(&TokenLog{UserID: b.ID, Type: LogTypeRefund, TokenNum: 500, PayNo: "Rpay-b2-2",
+		Extra: KV{"pay_no": "pay-b2"}, Created: time.Now()})
+	assert.Nil(t, err)
+	a, err = repo.GetWallet(a.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, 100, a.Tokens)
+	assert.Equal(t, 0, a.InviteTokens)
+	assert.Equal(t, 0, a.InviteUsers)
+
+	// 用邀请人的支付宝账号购买
+	c := buy(0, 1000, "pay-c", KV{"_pubkey": "c", "_buyer_id": "alipay-a", "_from_id": from})
+	assert.Equal(t, 0, c.FromID)
+	assert.Equal(t, 0, c.ReferralTokens)
+
+	// 超出奖励时间
+	repo.SetReferralPolicy(ReferralPolicy{Percent: 20, Window: time.Nanosecond})
+	d := buy(0, 1000, "pay-d", KV{"_pubkey": "d", "_from_id": from})
+	assert.Equal(t, a.ID, d.FromID)
+	assert.Equal(t, 0, d.ReferralTokens)
+
+	is, err := repo.ListInvitees(a.ID, 0, 10)
+	assert.Nil(t, err)
+	if assert.Equal(t, 2, len(is)) {
+		assert.Equal(t, d.ID, is[0].ID)
+		assert.Equal(t, b.ID, is[1].ID)
+		assert.Equal(t, 0, is[1].Tokens)
+	}
+}
@@ -0,0 +1,84 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"math"
+	"time"
+)
+
+type RefundStatus int
+
+const (
+	RefundRequested RefundStatus = iota // 用户申请退款
+	RefundPending                       // 已向支付宝发起退款
+	RefundDone                          // 退款完成
+	RefundRejected                      // 拒绝退款
+)
+
+// TokenRefund Token 充值退款单，每笔充值最多退款一次
+type TokenRefund struct {
+	ID       int          `db:"id" json:"id"`
+	UserID   int          `db:"user_id" json:"user_id"`
+	PayNo    string       `db:"pay_no" json:"pay_no"`       // 充值订单号
+	RefundNo string       `db:"refund_no" json:"refund_no"` // 退款请求号，也是退款流水的 pay_no
+	TokenNum int          `db:"token_num" json:"token_num"` // 扣除的 Token 数量
+	CentNum  int          `db:"cent_num" json:"cent_num"`   // 退款金额，单位为分
+	Reason   string       `db:"reason" json:"reason"`
+	Status   RefundStatus `db:"status" json:"status"`
+
+	Created time.Time `db:"created" json:"created"`
+	Updated time.Time `db:"updated" json:"updated"`
+}
+
+func (_ *TokenRefund) KeyName() string   { return "id" }
+func (_ *TokenRefund) TableName() string { return "token_refunds" }
+func (r *TokenRefund) Schema() string {
+	return "CREATE TABLE IF NOT EXISTS " + r.TableName() + `(
+	` + r.KeyName() + ` INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	pay_no TEXT NOT NULL,
+	refund_no TEXT NOT NULL,
+	token_num INTEGER NOT NULL,
+	cent_num INTEGER NOT NULL,
+	reason TEXT NOT NULL,
+	status INTEGER NOT NULL,
+	created DATETIME NOT NULL,
+	updated DATETIME NOT NULL
+);
+	CREATE UNIQUE INDEX IF NOT EXISTS r_pay_no ON ` + r.TableName() + `(pay_no);
+	CREATE INDEX IF NOT EXISTS r_status ON ` + r.TableName() + `(status, id);`
+}
+
+func (r *sqlTokenRepo) SaveRefund(f *TokenRefund) error {
+	f.Updated = time.Now()
+	if f.ID != 0 {
+		_, err := r.db.Update(f)
+		return err
+	}
+	f.Created = f.Updated
+	id, err := r.db.InsertID(f)
+	if err != nil {
+		return err
+	}
+	f.ID = id
+	return nil
+}
+
+func (r *sqlTokenRepo) FindRefund(payNo string) (f TokenRefund, err error) {
+	err = r.db.Get(&f, "select * from "+f.TableName()+" where pay_no = ?", payNo)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+	}
+	return
+}
+
+func (r *sqlTokenRepo) ListRefunds(status RefundStatus, before, num int) (fs []TokenRefund, err error) {
+	if before <= 0 {
+		before = math.MaxInt
+	}
+	q := "select * from " + (*TokenRefund).TableName(nil) +
+		" where status = ? and id < ? order by id desc limit ?"
+	err = r.db.Select(&fs, q, status, before, num)
+	return
+}
@@ -1,11 +1,11 @@
 package store
 
 import (
+	"context"
+	"database/sql"
 	"errors"
+	"math"
 	"time"
-
-	"github.com/go-kiss/sqlx"
-	"modernc.org/sqlite"
 )
 
 type Ticket struct {
@@ -13,6 +13,11 @@ type Ticket struct {
 	Token      string `db:"token" json:"-"`
 	Bytes      int    `db:"bytes" json:"bytes"`
 	TotalBytes int    `db:"total_bytes" json:"total_bytes"`
+	UpBytes    int    `db:"up_bytes" json:"up_bytes"`     // 已用上传流量
+	DownBytes  int    `db:"down_bytes" json:"down_bytes"` // 已用下载流量
+	UpRatio    int    `db:"up_ratio" json:"up_ratio"`     // 上传流量计费百分比
+	DownRatio  int    `db:"down_ratio" json:"down_ratio"` // 下载流量计费百分比
+	Tier       string `db:"tier" json:"tier"`
 	PayOrder   string `db:"pay_order" json:"pay_order"`
 	BuyOrder   string `db:"buy_order" json:"buy_order"`
 
@@ -21,6 +26,26 @@ type Ticket struct {
 	Expires time.Time `db:"expires" json:"expires"`
 }
 
+// charged 累计上下行流量按比例折算后的计费流量
+func (t *Ticket) charged() int {
+	return (t.UpBytes*t.UpRatio + t.DownBytes*t.DownRatio) / 100
+}
+
+// cost 再使用 up 和 down 流量需要扣减的计费流量
+func (t *Ticket) cost(up, down int) int {
+	n := *t
+	n.UpBytes += up
+	n.DownBytes += down
+	return n.charged() - t.charged()
+}
+
+// charge 记录 up 和 down 流量并扣减计费流量，与 Cost 的 SQL 计算方式相同
+func (t *Ticket) charge(up, down int) {
+	t.Bytes -= t.cost(up, down)
+	t.UpBytes += up
+	t.DownBytes += down
+}
+
 func (_ *Ticket) KeyName() string   { return "id" }
 func (_ *Ticket) TableName() string { return "tickets" }
 func (t *Ticket) Schema() string {
@@ -29,6 +54,11 @@ func (t *Ticket) Schema() string {
 	token TEXT,
 	bytes INTEGER,
 	total_bytes INTEGER,
+	up_bytes INTEGER DEFAULT 0,
+	down_bytes INTEGER DEFAULT 0,
+	up_ratio INTEGER DEFAULT 100,
+	down_ratio INTEGER DEFAULT 100,
+	tier TEXT DEFAULT '',
 	pay_order TEXT,
 	buy_order TEXT,
 	created DATETIME,
@@ -39,33 +69,99 @@ func (t *Ticket) Schema() string {
 	CREATE UNIQUE INDEX IF NOT EXISTS t_pay_order ON ` + t.TableName() + `(pay_order);`
 }
 
+// TicketPlan 流量套餐
+type TicketPlan struct {
+	Bytes     int    `json:"bytes"`      // 流量字节数
+	Days      int    `json:"days"`       // 有效天数
+	Tier      string `json:"tier"`       // 限速等级
+	UpRatio   int    `json:"up_ratio"`   // 上传流量计费百分比，0 表示免费
+	DownRatio int    `json:"down_ratio"` // 下载流量计费百分比，0 表示免费
+	Unlimited bool   `json:"unlimited"`  // 永不过期，忽略 Days
+}
+
+// Forever 不限时 Ticket 的过期时间
+var Forever = time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+
+// TicketBalance 用户所有有效 Ticket 的汇总信息
+type TicketBalance struct {
+	Bytes       int       `json:"bytes"`        // 剩余流量
+	TotalBytes  int       `json:"total_bytes"`  // 购买流量
+	NextBytes   int       `json:"next_bytes"`   // 最早过期 Ticket 的剩余流量
+	NextExpires time.Time `json:"next_expires"` // 最早过期 Ticket 的过期时间
+	Expires     time.Time `json:"expires"`      // 最晚过期时间
+}
+
+// TicketWatch 用户订阅的余额及过期提醒
+type TicketWatch struct {
+	ID         int       `db:"id" json:"-"`
+	Token      string    `db:"token" json:"-"`
+	Site       string    `db:"site" json:"-"`                  // 订阅所在站点，用于读取推送配置
+	Email      string    `db:"email" json:"email"`             // 邮件提醒地址
+	Push       string    `db:"push" json:"push"`               // Web Push 订阅信息
+	LowSent    time.Time `db:"low_sent" json:"low_sent"`       // 余额不足提醒时间
+	ExpirySent time.Time `db:"expiry_sent" json:"expiry_sent"` // 已提醒的过期时间
+	Created    time.Time `db:"created" json:"created"`
+	Updated    time.Time `db:"updated" json:"updated"`
+}
+
+func (_ *TicketWatch) KeyName() string   { return "id" }
+func (_ *TicketWatch) TableName() string { return "ticket_watches" }
+func (t *TicketWatch) Schema() string {
+	return "CREATE TABLE IF NOT EXISTS " + t.TableName() + `(
+	` + t.KeyName() + ` INTEGER PRIMARY KEY AUTOINCREMENT,
+	token TEXT,
+	site TEXT,
+	email TEXT,
+	push TEXT,
+	low_sent DATETIME,
+	expiry_sent DATETIME,
+	created DATETIME,
+	updated DATETIME
+);
+	CREATE UNIQUE INDEX IF NOT EXISTS tw_token ON ` + t.TableName() + `(token);`
+}
+
 type TicketRepo interface {
 	// New create and save one Ticket
-	New(token string, bytes, days int, trade string, order string) error
-	// Cost decreases  bytes of one Ticket
-	Cost(token string, bytes int) error
+	New(token string, plan TicketPlan, trade, order string) error
+	// Cost decreases bytes of one Ticket by the up and down traffic
+	Cost(token string, up, down int) error
 	// List fetches all current Tickets with bytes available.
 	List(token string, limit int) ([]Ticket, error)
+	// Balance sums all unexpired Tickets.
+	Balance(token string) (TicketBalance, error)
+	// History fetches Tickets with id less than before, including expired ones.
+	History(token string, before, limit int) ([]Ticket, error)
+	// Find fetches the Ticket bought by trade, ID is 0 if not found.
+	Find(trade string) (Ticket, error)
+	// Get fetches the Ticket by id, ID is 0 if not found.
+	Get(id int) (Ticket, error)
+	// Update saves the bytes, tier and expires of Ticket.
+	Update(t *Ticket) error
+	// Watch creates or updates the TicketWatch of w.Token.
+	Watch(w *TicketWatch) error
+	// ListWatches fetches all TicketWatches.
+	ListWatches() ([]TicketWatch, error)
 }
 
 func NewTicketRepo(path string) TicketRepo {
-	db, err := sqlx.Connect("sqlite", path)
-	if err != nil {
+	db := mustOpen(path)
+	if db.Dialect == SQLite {
+		db.SetMaxOpenConns(1)
+	}
+	if err := db.migrate("ticket"); err != nil {
 		panic(err)
 	}
-	db.SetMaxOpenConns(1)
-	r := sqliteTicketReop{db: db}
-	r.Init()
-	return r
+	return sqlTicketRepo{db: db}
 }
 
 type FreeTicketRepo struct{}
 
-func (r FreeTicketRepo) New(token string, bytes, days int, trade, order string) error {
+func (r FreeTicketRepo) New(token string, plan TicketPlan, trade, order string) error {
 	return nil
 }
 
-func (r FreeTicketRepo) Cost(token string, bytes int) error {
+func (r FreeTicketRepo) Cost(token string, up, down int) error {
 	return nil
 }
 
@@ -73,17 +169,43 @@ func (r FreeTicketRepo) List(token string, limit int) ([]Ticket, error) {
 	return []Ticket{{Bytes: 100}}, nil
 }
 
-type sqliteTicketReop struct {
-	db *sqlx.DB
+func (r FreeTicketRepo) Balance(token string) (TicketBalance, error) {
+	return TicketBalance{Bytes: 100, TotalBytes: 100}, nil
 }
 
-func (r sqliteTicketReop) Init() {
-	if _, err := r.db.Exec((*Ticket).Schema(nil)); err != nil {
-		panic(err)
-	}
+func (r FreeTicketRepo) History(token string, before, limit int) ([]Ticket, error) {
+	return nil, nil
+}
+
+func (r FreeTicketRepo) Find(trade string) (Ticket, error) {
+	return Ticket{}, nil
+}
+
+func (r FreeTicketRepo) Get(id int) (Ticket, error) {
+	return Ticket{}, nil
+}
+
+func (r FreeTicketRepo) Update(t *Ticket) error {
+	return nil
+}
+
+func (r FreeTicketRepo) Watch(w *TicketWatch) error {
+	return nil
+}
+
+func (r FreeTicketRepo) ListWatches() ([]TicketWatch, error) {
+	return nil, nil
+}
+
+type sqlTicketRepo struct {
+	db *DB
 }
 
-func (r sqliteTicketReop) New(token string, bytes, days int, trade, order string) error {
+func (r sqlTicketRepo) Ping(ctx context.Context) error {
+	return r.db.PingContext(ctx)
+}
+
+func (r sqlTicketRepo) New(token string, plan TicketPlan, trade, order string) error {
 	now := time.Now()
 	begin := time.Now()
 
@@ -92,40 +214,54 @@ func (r sqliteTicketReop) New(token string, bytes, days int, trade, order string
 		return err
 	}
 
-	if len(ts) == 1 && ts[0].Expires.After(begin) {
+	// 不限时 Ticket 不顺延后续 Ticket 的有效期
+	if len(ts) == 1 && ts[0].Expires.After(begin) && ts[0].Expires.Before(Forever) {
 		begin = ts[0].Expires
 	}
 
+	expires := begin.AddDate(0, 0, plan.Days)
+	if plan.Unlimited {
+		expires = Forever
+	}
+
 	t := Ticket{
 		Token:      token,
-		Bytes:      bytes,
-		TotalBytes: bytes,
+		Bytes:      plan.Bytes,
+		TotalBytes: plan.Bytes,
+		UpRatio:    plan.UpRatio,
+		DownRatio:  plan.DownRatio,
+		Tier:       plan.Tier,
 		PayOrder:   order,
 		BuyOrder:   trade,
 		Created:    now,
 		Updated:    now,
-		Expires:    begin.AddDate(0, 0, days),
+		Expires:    expires,
 	}
 
 	_, err = r.db.Insert(&t)
 
-	se := &sqlite.Error{}
-	// constraint failed: UNIQUE constraint failed
-	if errors.As(err, &se) && se.Code() == 2067 {
+	// 支付回调可能重复，同一订单只创建一次
+	if IsUnique(err) {
 		return nil
 	}
 
 	return err
 }
 
-func (r sqliteTicketReop) Cost(token string, bytes int) error {
+// Cost 扣减最早的可用 Ticket 流量，计费流量按该 Ticket 的上下行比例计算。
+// 每次扣费按累计上下行流量计算，取整的余数留到下次，小流量也不会漏计。
+func (r sqlTicketRepo) Cost(token string, up, down int) error {
 	now := time.Now()
 
+	charge := "(((up_bytes + ?) * up_ratio + (down_bytes + ?) * down_ratio) / 100" +
+		" - (up_bytes * up_ratio + down_bytes * down_ratio) / 100)"
+
 	sql := "update " + (*Ticket).TableName(nil) +
-		" set bytes = bytes - ?, updated = ? where id in (select id from " + (*Ticket).TableName(nil) +
-		" where token = ? and expires > ? order by id asc limit 1) and bytes >= ?"
+		" set bytes = bytes - " + charge + ", up_bytes = up_bytes + ?, down_bytes = down_bytes + ?, updated = ?" +
+		" where id in (select id from " + (*Ticket).TableName(nil) +
+		" where token = ? and expires > ? order by id asc limit 1) and bytes >= " + charge
 
-	_r, err := r.db.Exec(sql, bytes, now, token, now, bytes)
+	_r, err := r.db.Exec(sql, up, down, up, down, now, token, now, up, down)
 	if err != nil {
 		return err
 	}
@@ -137,10 +273,10 @@ func (r sqliteTicketReop) Cost(token string, bytes int) error {
 		return nil
 	}
 
-	return r.costSlow(token, bytes)
+	return r.costSlow(token, up, down)
 }
 
-func (r sqliteTicketReop) costSlow(token string, bytes int) error {
+func (r sqlTicketRepo) costSlow(token string, up, down int) error {
 	sql := "select * from " + (*Ticket).TableName(nil) +
 		" where token = ? and bytes > 0 and expires > ?" +
 		" order by id asc"
@@ -153,23 +289,24 @@ func (r sqliteTicketReop) costSlow(token string, bytes int) error {
 		return errors.New("no tickets found")
 	}
 
+	// 跨多个 Ticket 扣费时按剩余流量拆分上下行流量，各自按自己的比例计费，最后一个 Ticket 可以透支
 	var i int
-	var t Ticket
-	for i, t = range ts {
-		if t.Bytes >= bytes {
-			ts[i].Bytes -= bytes
-			bytes = 0
+	for i = range ts {
+		t := &ts[i]
+		u, d := up, down
+		if c := t.cost(u, d); c > t.Bytes && i < len(ts)-1 {
+			f := float64(t.Bytes) / float64(c)
+			u, d = int(float64(u)*f), int(float64(d)*f)
+		}
+		t.charge(u, d)
+		if i < len(ts)-1 {
+			t.Bytes = max(t.Bytes, 0)
+		}
+		if up, down = up-u, down-d; up == 0 && down == 0 {
 			break
-		} else {
-			bytes -= t.Bytes
-			ts[i].Bytes = 0
 		}
 	}
 
-	if bytes > 0 {
-		ts[i].Bytes -= bytes
-	}
-
 	if i == 0 {
 		t := ts[i]
 		t.Updated = time.Now()
@@ -194,9 +331,93 @@ func (r sqliteTicketReop) costSlow(token string, bytes int) error {
 	return tx.Commit()
 }
 
-func (r sqliteTicketReop) List(token string, limit int) (tickets []Ticket, err error) {
+func (r sqlTicketRepo) List(token string, limit int) (tickets []Ticket, err error) {
 	sql := "select * from " + (*Ticket).TableName(nil) +
 		" where token = ? order by id desc limit ?"
 	err = r.db.Select(&tickets, sql, token, limit)
 	return
 }
+
+func (r sqlTicketRepo) Balance(token string) (b TicketBalance, err error) {
+	sql := "select * from " + (*Ticket).TableName(nil) +
+		" where token = ? and expires > ? order by expires asc"
+	var ts []Ticket
+	if err = r.db.Select(&ts, sql, token, time.Now()); err != nil {
+		return
+	}
+	for _, t := range ts {
+		b.Bytes += t.Bytes
+		b.TotalBytes += t.TotalBytes
+		if t.Bytes > 0 && b.NextExpires.IsZero() {
+			b.NextBytes = t.Bytes
+			b.NextExpires = t.Expires
+		}
+		if t.Expires.After(b.Expires) {
+			b.Expires = t.Expires
+		}
+	}
+	return
+}
+
+func (r sqlTicketRepo) History(token string, before, limit int) (tickets []Ticket, err error) {
+	if before <= 0 {
+		before = math.MaxInt
+	}
+	sql := "select * from " + (*Ticket).TableName(nil) +
+		" where token = ? and id < ? order by id desc limit ?"
+	err = r.db.Select(&tickets, sql, token, before, limit)
+	return
+}
+
+func (r sqlTicketRepo) Find(trade string) (t Ticket, err error) {
+	err = r.db.Get(&t, "select * from "+t.TableName()+" where buy_order = ?", trade)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+	}
+	return
+}
+
+func (r sqlTicketRepo) Get(id int) (t Ticket, err error) {
+	err = r.db.Get(&t, "select * from "+t.TableName()+" where id = ?", id)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+	}
+	return
+}
+
+func (r sqlTicketRepo) Update(t *Ticket) error {
+	t.Updated = time.Now()
+	_, err := r.db.Exec("update "+t.TableName()+
+		" set bytes = ?, total_bytes = ?, tier = ?, expires = ?, updated = ? where id = ?",
+		t.Bytes, t.TotalBytes, t.Tier, t.Expires, t.Updated, t.ID)
+	return err
+}
+
+func (r sqlTicketRepo) Watch(w *TicketWatch) error {
+	var old TicketWatch
+	err := r.db.Get(&old, "select * from "+w.TableName()+" where token = ?", w.Token)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	w.Updated = time.Now()
+	if old.ID == 0 {
+		w.Created = w.Updated
+		id, err := r.db.InsertID(w)
+		if err != nil {
+			return err
+		}
+		w.ID = id
+		return nil
+	}
+
+	w.ID = old.ID
+	w.Created = old.Created
+	_, err = r.db.Update(w)
+	return err
+}
+
+func (r sqlTicketRepo) ListWatches() (ws []TicketWatch, err error) {
+	err = r.db.Select(&ws, "select * from "+(*TicketWatch).TableName(nil)+" order by id asc")
+	return
+}
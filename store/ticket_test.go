@@ -10,7 +10,7 @@ import (
 func TestTicketRepo(t *testing.T) {
 	r := NewTicketRepo(":memory:")
 
-	err := r.New("foo", 100, 1, "buy-1", "pay-1")
+	err := r.New("foo", TicketPlan{Bytes: 100, Days: 1, UpRatio: 100, DownRatio: 100}, "buy-1", "pay-1")
 	assert.Nil(t, err)
 
 	ts, err := r.List("foo", 2)
@@ -27,7 +27,7 @@ func TestTicketRepo(t *testing.T) {
 	assert.Equal(t, ts[0].Created, ts[0].Updated)
 	assert.Equal(t, n.Truncate(time.Second), ts[0].Created.Truncate(time.Second))
 
-	err = r.Cost("foo", 50)
+	err = r.Cost("foo", 0, 50)
 	assert.Nil(t, err)
 	n = time.Now()
 	assert.Equal(t, n.Truncate(time.Second), ts[0].Updated.Truncate(time.Second))
@@ -37,13 +37,13 @@ func TestTicketRepo(t *testing.T) {
 	assert.Equal(t, 1, len(ts))
 	assert.Equal(t, 50, ts[0].Bytes)
 
-	err = r.New("foo", 30, 1, "buy-2", "pay-2")
+	err = r.New("foo", TicketPlan{Bytes: 30, Days: 1, UpRatio: 100, DownRatio: 100}, "buy-2", "pay-2")
 	assert.Nil(t, err)
 
-	err = r.New("foo", 40, 1, "buy-3", "pay-3")
+	err = r.New("foo", TicketPlan{Bytes: 40, Days: 1, UpRatio: 100, DownRatio: 100}, "buy-3", "pay-3")
 	assert.Nil(t, err)
 
-	err = r.Cost("foo", 110)
+	err = r.Cost("foo", 0, 110)
 	assert.Nil(t, err)
 
 	ts, err = r.List("foo", 4)
@@ -53,20 +53,20 @@ func TestTicketRepo(t *testing.T) {
 	assert.Equal(t, 0, ts[1].Bytes)
 	assert.Equal(t, 0, ts[2].Bytes)
 
-	err = r.Cost("foo", 20)
+	err = r.Cost("foo", 0, 20)
 	assert.Nil(t, err)
 
 	ts, err = r.List("foo", 1)
 	assert.Nil(t, err)
 	assert.Equal(t, -10, ts[0].Bytes)
 
-	err = r.New("foo", 40, 1, "buy-4", "pay-4")
+	err = r.New("foo", TicketPlan{Bytes: 40, Days: 1, UpRatio: 100, DownRatio: 100}, "buy-4", "pay-4")
 	assert.Nil(t, err)
 
-	err = r.New("foo", 10, 1, "buy-5", "pay-5")
+	err = r.New("foo", TicketPlan{Bytes: 10, Days: 1, UpRatio: 100, DownRatio: 100}, "buy-5", "pay-5")
 	assert.Nil(t, err)
 
-	err = r.Cost("foo", 65)
+	err = r.Cost("foo", 0, 65)
 	assert.Nil(t, err)
 
 	ts, err = r.List("foo", 1)
@@ -77,13 +77,13 @@ func TestTicketRepo(t *testing.T) {
 func TestTicketRepoSlow(t *testing.T) {
 	r := NewTicketRepo(":memory:")
 
-	err := r.New("foo", 10, 1, "buy-1", "pay-1")
+	err := r.New("foo", TicketPlan{Bytes: 10, Days: 1, Tier: "m", UpRatio: 100, DownRatio: 100}, "buy-1", "pay-1")
 	assert.Nil(t, err)
 
-	err = r.New("foo", 30, 1, "buy-2", "pay-2")
+	err = r.New("foo", TicketPlan{Bytes: 30, Days: 1, UpRatio: 100, DownRatio: 100}, "buy-2", "pay-2")
 	assert.Nil(t, err)
 
-	err = r.Cost("foo", 20)
+	err = r.Cost("foo", 0, 20)
 	assert.Nil(t, err)
 
 	ts, err := r.List("foo", 3)
@@ -91,4 +91,132 @@ func TestTicketRepoSlow(t *testing.T) {
 	assert.Equal(t, 2, len(ts))
 	assert.Equal(t, 20, ts[0].Bytes)
 	assert.Equal(t, 0, ts[1].Bytes)
+	assert.Equal(t, "", ts[0].Tier)
+	assert.Equal(t, "m", ts[1].Tier)
+}
+
+func TestTicketRepoRatio(t *testing.T) {
+	r := NewTicketRepo(":memory:")
+
+	err := r.New("foo", TicketPlan{Bytes: 100, Days: 1, UpRatio: 0, DownRatio: 100}, "buy-1", "pay-1")
+	assert.Nil(t, err)
+
+	err = r.Cost("foo", 30, 20)
+	assert.Nil(t, err)
+
+	ts, err := r.List("foo", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 80, ts[0].Bytes)
+	assert.Equal(t, 30, ts[0].UpBytes)
+	assert.Equal(t, 20, ts[0].DownBytes)
+
+	err = r.New("foo", TicketPlan{Bytes: 100, Days: 1, UpRatio: 50, DownRatio: 200}, "buy-2", "pay-2")
+	assert.Nil(t, err)
+
+	// 第一个 Ticket 余额不足，按 80/90 拆出 35/80 字节按其比例计费，
+	// 剩余的 5/10 字节按第二个 Ticket 的比例计费 22 字节
+	err = r.Cost("foo", 40, 90)
+	assert.Nil(t, err)
+
+	ts, err = r.List("foo", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, ts[1].Bytes)
+	assert.Equal(t, 65, ts[1].UpBytes)
+	assert.Equal(t, 100, ts[1].DownBytes)
+	assert.Equal(t, 78, ts[0].Bytes)
+	assert.Equal(t, 5, ts[0].UpBytes)
+	assert.Equal(t, 10, ts[0].DownBytes)
+}
+
+func TestTicketRepoRemainder(t *testing.T) {
+	r := NewTicketRepo(":memory:")
+
+	err := r.New("foo", TicketPlan{Bytes: 100, Days: 1, UpRatio: 50, DownRatio: 50}, "buy-1", "pay-1")
+	assert.Nil(t, err)
+
+	// 每次只有 1 字节，单独计算都是 0，累计 10 次计费 5 字节
+	for range 10 {
+		assert.Nil(t, r.Cost("foo", 1, 0))
+	}
+
+	ts, err := r.List("foo", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 95, ts[0].Bytes)
+	assert.Equal(t, 10, ts[0].UpBytes)
+}
+
+func TestTicketBalance(t *testing.T) {
+	r := NewTicketRepo(":memory:")
+
+	b, err := r.Balance("foo")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, b.Bytes)
+	assert.True(t, b.NextExpires.IsZero())
+
+	err = r.New("foo", TicketPlan{Bytes: 100, Days: 1, UpRatio: 100, DownRatio: 100}, "buy-1", "pay-1")
+	assert.Nil(t, err)
+	err = r.New("foo", TicketPlan{Bytes: 50, Days: 1, UpRatio: 100, DownRatio: 100}, "buy-2", "pay-2")
+	assert.Nil(t, err)
+
+	err = r.Cost("foo", 0, 30)
+	assert.Nil(t, err)
+
+	b, err = r.Balance("foo")
+	assert.Nil(t, err)
+	assert.Equal(t, 120, b.Bytes)
+	assert.Equal(t, 150, b.TotalBytes)
+	assert.Equal(t, 70, b.NextBytes)
+	assert.True(t, b.Expires.After(b.NextExpires))
+
+	ts, err := r.History("foo", 0, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(ts))
+	assert.Equal(t, 50, ts[0].Bytes)
+
+	ts, err = r.History("foo", ts[0].ID, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(ts))
+	assert.Equal(t, 70, ts[0].Bytes)
+
+	tk, err := r.Find("buy-2")
+	assert.Nil(t, err)
+	assert.Equal(t, "pay-2", tk.PayOrder)
+	assert.Equal(t, 50, tk.TotalBytes)
+
+	tk, err = r.Find("buy-3")
+	assert.Nil(t, err)
+	assert.Zero(t, tk.ID)
+}
+
+func TestTicketWatch(t *testing.T) {
+	r := NewTicketRepo(":memory:")
+
+	w := TicketWatch{Token: "foo", Email: "a@b.c"}
+	assert.Nil(t, r.Watch(&w))
+	assert.Equal(t, 1, w.ID)
+
+	w2 := TicketWatch{Token: "foo", Push: "{}"}
+	assert.Nil(t, r.Watch(&w2))
+	assert.Equal(t, 1, w2.ID)
+
+	ws, err := r.ListWatches()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(ws))
+	assert.Equal(t, "", ws[0].Email)
+	assert.Equal(t, "{}", ws[0].Push)
+}
+
+func TestTicketRepoUnlimited(t *testing.T) {
+	r := NewTicketRepo(":memory:")
+
+	err := r.New("foo", TicketPlan{Bytes: 100, Unlimited: true}, "buy-1", "pay-1")
+	assert.Nil(t, err)
+
+	err = r.New("foo", TicketPlan{Bytes: 100, Days: 1}, "buy-2", "pay-2")
+	assert.Nil(t, err)
+
+	ts, err := r.List("foo", 2)
+	assert.Nil(t, err)
+	assert.True(t, ts[0].Expires.Before(time.Now().AddDate(0, 0, 2)))
+	assert.Equal(t, Forever, ts[1].Expires.UTC())
 }
@@ -1,6 +1,7 @@
 package store
 
 import (
+	"context"
 	"database/sql"
 	"database/sql/driver"
 	"encoding/json"
@@ -10,10 +11,8 @@ import (
 	"strings"
 	"time"
 
-	"github.com/go-kiss/sqlx"
 	"github.com/taoso/led/ecdsa"
 	"golang.org/x/crypto/bcrypt"
-	_ "modernc.org/sqlite"
 )
 
 var (
@@ -28,10 +27,57 @@ const (
 	LogTypeCost   = LogType(1)
 	LogTypeRefund = LogType(2)
 	LogTypeInvite = LogType(3)
+	LogTypeAdjust = LogType(4) // 管理员调整，TokenNum 为负数时扣减
 )
 
-type TokenRepo struct {
-	db *sqlx.DB
+type TokenRepo interface {
+	// Init runs all pending migrations.
+	Init() error
+	// FindWallet fetches the wallet by pubkey.
+	FindWallet(pubkey string) (TokenWallet, error)
+	// FindWalletByName fetches the wallet by username.
+	FindWalletByName(username string) (TokenWallet, error)
+	// FindWalletBySession fetches the wallet of Session id.
+	FindWalletBySession(id int) (TokenWallet, error)
+	// GetWallet fetches the wallet by id.
+	GetWallet(id int) (TokenWallet, error)
+	// SaveWallet updates the wallet.
+	SaveWallet(w TokenWallet) error
+	// SetWalletExtra sets key of the wallet extra, and deletes it if value is empty.
+	SetWalletExtra(id int, key, value string) error
+	// UpdateWallet changes tokens of the wallet and saves the log.
+	UpdateWallet(log *TokenLog) (TokenWallet, error)
+	// GetSession fetches the Session by id.
+	GetSession(id int) (Session, error)
+	// AddSession creates one Session.
+	AddSession(s *Session) error
+	// ListSession fetches all Sessions of user uid.
+	ListSession(uid int) ([]Session, error)
+	// DelSession deletes Session id of user uid.
+	DelSession(id, uid int) error
+	// ScanLogs fetches logs with id less than last.
+	ScanLogs(userID, last, num int) ([]TokenLog, error)
+	// FindLog fetches the log by payNo.
+	FindLog(payNo string) (TokenLog, error)
+	// ListWallets fetches wallets with id greater than after.
+	ListWallets(after, num int) ([]TokenWallet, error)
+	// ReplayLogs fetches logs of userID with id greater than after, oldest first.
+	ReplayLogs(userID, after, num int) ([]TokenLog, error)
+	// DupPayNos fetches pay_no values shared by more than one log.
+	DupPayNos() ([]string, error)
+	// ListPaidLogs fetches logs with pay_no created in [begin, end].
+	// The location of begin and end does not matter.
+	ListPaidLogs(begin, end time.Time) ([]TokenLog, error)
+	// SaveRefund creates or updates the refund.
+	SaveRefund(f *TokenRefund) error
+	// FindRefund fetches the refund of purchase payNo.
+	FindRefund(payNo string) (TokenRefund, error)
+	// ListRefunds fetches refunds of status with id less than before.
+	ListRefunds(status RefundStatus, before, num int) ([]TokenRefund, error)
+	// SetReferralPolicy changes the rules of invite rewards.
+	SetReferralPolicy(p ReferralPolicy)
+	// ListInvitees fetches wallets invited by fromID with id less than before, newest first.
+	ListInvitees(fromID, before, num int) ([]Invitee, error)
 }
 
 type Session struct {
@@ -50,7 +96,7 @@ func (s *Session) GetPubkey() (ecdsa.PublicKey, error) {
 func (_ *Session) KeyName() string   { return "id" }
 func (_ *Session) TableName() string { return "sessions" }
 func (s *Session) Schema() string {
-	return `CREATE TABLE ` + s.TableName() + `(
+	return `CREATE TABLE IF NOT EXISTS ` + s.TableName() + `(
 	` + s.KeyName() + ` INTEGER PRIMARY KEY AUTOINCREMENT,
 	user_id INTEGER,
 	pubkey TEXT,
@@ -58,8 +104,8 @@ func (s *Session) Schema() string {
 	address TEXT,
 	created DATETIME
 ); 
-	CREATE INDEX s_user_id ON ` + s.TableName() + `(user_id);
-	CREATE UNIQUE INDEX s_pubkey ON ` + s.TableName() + `(pubkey);`
+	CREATE INDEX IF NOT EXISTS s_user_id ON ` + s.TableName() + `(user_id);
+	CREATE UNIQUE INDEX IF NOT EXISTS s_pubkey ON ` + s.TableName() + `(pubkey);`
 }
 
 type TokenWallet struct {
@@ -75,6 +121,8 @@ type TokenWallet struct {
 	InviteTokens int `db:"invite_tokens"` // 我邀请的奖励
 	InviteUsers  int `db:"invite_users"`  // 我邀请的人数
 
+	ReferralTokens int `db:"referral_tokens"` // 我给邀请人带来的奖励
+
 	Created time.Time `db:"created"` // 创建时间
 	Updated time.Time `db:"updated"` // 更新时间
 }
@@ -82,7 +130,7 @@ type TokenWallet struct {
 func (w *TokenWallet) KeyName() string   { return "id" }
 func (w *TokenWallet) TableName() string { return "token_wallets" }
 func (w *TokenWallet) Schema() string {
-	return `CREATE TABLE ` + w.TableName() + `(
+	return `CREATE TABLE IF NOT EXISTS ` + w.TableName() + `(
 	` + w.KeyName() + ` INTEGER PRIMARY KEY AUTOINCREMENT,
     	tokens INTEGER,
     	pubkey TEXT,
@@ -92,11 +140,11 @@ func (w *TokenWallet) Schema() string {
 	from_id INTEGER default 0,
 	invite_tokens INTEGER default 0,
 	invite_users INTEGER default 0,
+	referral_tokens INTEGER default 0,
     	created DATETIME,
     	updated DATETIME
 ); 
-	CREATE INDEX w_from_id ON ` + w.TableName() + `(from_id);
-	CREATE UNIQUE INDEX pubkey ON ` + w.TableName() + `(pubkey);`
+	CREATE UNIQUE INDEX IF NOT EXISTS pubkey ON ` + w.TableName() + `(pubkey);`
 }
 
 func (w *TokenWallet) GetPubkey() (ecdsa.PublicKey, error) {
@@ -147,7 +195,7 @@ type TokenLog struct {
 func (l *TokenLog) KeyName() string   { return "id" }
 func (l *TokenLog) TableName() string { return "token_logs" }
 func (l *TokenLog) Schema() string {
-	return `CREATE TABLE ` + l.TableName() + `(
+	return `CREATE TABLE IF NOT EXISTS ` + l.TableName() + `(
 	` + l.KeyName() + ` INTEGER PRIMARY KEY AUTOINCREMENT,
         user_id INTEGER NOT NULL,
         type INTEGER NOT NULL,
@@ -159,8 +207,8 @@ func (l *TokenLog) Schema() string {
         pay_no TEXT NOT NULL,
         created TIMESTAMP NOT NULL
 ); 
-	CREATE INDEX user_order ON ` + l.TableName() + `(user_id, id);
-	CREATE INDEX pay_no ON ` + l.TableName() + `(pay_no) where pay_no != "";`
+	CREATE INDEX IF NOT EXISTS user_order ON ` + l.TableName() + `(user_id, id);
+	CREATE INDEX IF NOT EXISTS pay_no ON ` + l.TableName() + `(pay_no) where pay_no != '';`
 }
 
 // SignData 返回需要签名的数据
@@ -180,33 +228,33 @@ func (l *TokenLog) SignData() string {
 	return strings.Join(ss, ":")
 }
 
-func NewTokenRepo(path string) *TokenRepo {
-	db, err := sqlx.Connect("sqlite", "file://"+path)
-	if err != nil {
+// NewTokenRepo 打开 path 对应的数据库，path 也可以是 postgres:// 地址
+func NewTokenRepo(path string) TokenRepo {
+	if !strings.Contains(path, "://") {
+		path = "file://" + path
+	}
+	r := &sqlTokenRepo{db: mustOpen(path), policy: DefaultReferralPolicy}
+	if err := r.db.migrate("token"); err != nil {
 		panic(err)
 	}
-	return &TokenRepo{db: db}
+	return r
 }
 
-func (r *TokenRepo) Init() error {
-	_, err := r.db.Exec((*TokenWallet).Schema(nil))
-	if err != nil {
-		panic(err)
-		return err
-	}
-	_, err = r.db.Exec((*TokenLog).Schema(nil))
-	if err != nil {
-		panic(err)
-		return err
-	}
-	_, err = r.db.Exec((*Session).Schema(nil))
-	if err != nil {
-		panic(err)
-	}
+type sqlTokenRepo struct {
+	db     *DB
+	policy ReferralPolicy
+}
+
+func (r *sqlTokenRepo) Ping(ctx context.Context) error {
+	return r.db.PingContext(ctx)
+}
+
+func (r *sqlTokenRepo) Init() error {
+	_, err := r.db.Migrate("token", false)
 	return err
 }
 
-func (r *TokenRepo) FindWallet(pubkey string) (w TokenWallet, err error) {
+func (r *sqlTokenRepo) FindWallet(pubkey string) (w TokenWallet, err error) {
 	err = r.db.Get(&w, "select * from "+w.TableName()+" where pubkey = ?", pubkey)
 	if errors.Is(err, sql.ErrNoRows) {
 		err = nil
@@ -214,7 +262,7 @@ func (r *TokenRepo) FindWallet(pubkey string) (w TokenWallet, err error) {
 	return
 }
 
-func (r *TokenRepo) FindWalletByName(username string) (w TokenWallet, err error) {
+func (r *sqlTokenRepo) FindWalletByName(username string) (w TokenWallet, err error) {
 	err = r.db.Get(&w, "select * from "+w.TableName()+" where username = ?", username)
 	if errors.Is(err, sql.ErrNoRows) {
 		err = nil
@@ -222,7 +270,7 @@ func (r *TokenRepo) FindWalletByName(username string) (w TokenWallet, err error)
 	return
 }
 
-func (r *TokenRepo) GetSession(id int) (s Session, err error) {
+func (r *sqlTokenRepo) GetSession(id int) (s Session, err error) {
 	err = r.db.Get(&s, "select * from "+s.TableName()+" where id = ?", id)
 	if errors.Is(err, sql.ErrNoRows) {
 		err = nil
@@ -230,7 +278,7 @@ func (r *TokenRepo) GetSession(id int) (s Session, err error) {
 	return
 }
 
-func (r *TokenRepo) FindWalletBySession(id int) (w TokenWallet, err error) {
+func (r *sqlTokenRepo) FindWalletBySession(id int) (w TokenWallet, err error) {
 	var s Session
 	err = r.db.Get(&s, "select * from "+s.TableName()+" where id = ?", id)
 	if errors.Is(err, sql.ErrNoRows) {
@@ -247,7 +295,7 @@ func (r *TokenRepo) FindWalletBySession(id int) (w TokenWallet, err error) {
 	return
 }
 
-func (r *TokenRepo) GetWallet(id int) (w TokenWallet, err error) {
+func (r *sqlTokenRepo) GetWallet(id int) (w TokenWallet, err error) {
 	err = r.db.Get(&w, "select * from "+w.TableName()+" where id = ?", id)
 	if errors.Is(err, sql.ErrNoRows) {
 		err = nil
@@ -255,52 +303,77 @@ func (r *TokenRepo) GetWallet(id int) (w TokenWallet, err error) {
 	return
 }
 
-func (r *TokenRepo) SaveWallet(w TokenWallet) error {
+func (r *sqlTokenRepo) SaveWallet(w TokenWallet) error {
 	w.Updated = time.Now()
 	_, err := r.db.Update(&w)
 	return err
 }
 
-func (r *TokenRepo) AddSession(s *Session) error {
-	s.Created = time.Now()
-	x, err := r.db.Insert(s)
+func (r *sqlTokenRepo) SetWalletExtra(id int, key, value string) (err error) {
+	tx, err := r.db.Beginx()
 	if err != nil {
-		return err
+		return
 	}
-	id, err := x.LastInsertId()
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	// 只更新 extra 字段，避免覆盖并发修改的余额
+	var extra string
+	if err = tx.Get(&extra, "select extra from "+(*TokenWallet).TableName(nil)+" where id = ?"+tx.Dialect.ForUpdate(), id); err != nil {
+		return
+	}
+	kv := KV{}
+	if extra != "" {
+		if err = json.Unmarshal([]byte(extra), &kv); err != nil {
+			return
+		}
+	}
+	if value == "" {
+		delete(kv, key)
+	} else {
+		kv[key] = value
+	}
+	if _, err = tx.Exec("update "+(*TokenWallet).TableName(nil)+" set extra = ?, updated = ? where id = ?",
+		kv, time.Now(), id); err != nil {
+		return
+	}
+	return tx.Commit()
+}
+
+func (r *sqlTokenRepo) AddSession(s *Session) error {
+	s.Created = time.Now()
+	id, err := r.db.InsertID(s)
 	if err != nil {
 		return err
 	}
-	s.ID = int(id)
+	s.ID = id
 	return nil
 }
 
-func (r *TokenRepo) ListSession(uid int) (s []Session, err error) {
+func (r *sqlTokenRepo) ListSession(uid int) (s []Session, err error) {
 	err = r.db.Select(&s, "select * from "+(&Session{}).TableName()+" where user_id = ?", uid)
 	return
 }
 
-func (r *TokenRepo) DelSession(id, uid int) (err error) {
+func (r *sqlTokenRepo) DelSession(id, uid int) (err error) {
 	_, err = r.db.Exec("delete from "+(&Session{}).TableName()+" where id = ? and user_id = ?", id, uid)
 	return
 }
 
-func (r *TokenRepo) newWallet(tx *sqlx.Tx, w *TokenWallet) error {
-	res, err := tx.Insert(w)
-	if err != nil {
-		err = fmt.Errorf("%v %w", err, ServerErr)
-		return err
-	}
-	id, err := res.LastInsertId()
+func (r *sqlTokenRepo) newWallet(tx *Tx, w *TokenWallet) error {
+	id, err := tx.InsertID(w)
 	if err != nil {
 		err = fmt.Errorf("%v %w", err, ServerErr)
 		return err
 	}
-	w.ID = int(id)
+	w.ID = id
 	return nil
 }
 
-func (r *TokenRepo) UpdateWallet(log *TokenLog) (w TokenWallet, err error) {
+func (r *sqlTokenRepo) UpdateWallet(log *TokenLog) (w TokenWallet, err error) {
 	tx, err := r.db.Beginx()
 	if err != nil {
 		err = fmt.Errorf("%v %w", err, ServerErr)
@@ -312,8 +385,26 @@ func (r *TokenRepo) UpdateWallet(log *TokenLog) (w TokenWallet, err error) {
 		}
 	}()
 	now := time.Now()
+	if log.Type == LogTypeRefund && log.PayNo != "" { // 退款通知可能重复，同一退款单只扣一次
+		var l TokenLog
+		err = tx.Get(&l, "select * from "+l.TableName()+" where pay_no = ?", log.PayNo)
+		if !errors.Is(err, sql.ErrNoRows) && err != nil {
+			err = fmt.Errorf("%v %w", err, ServerErr)
+			return
+		}
+		if l.ID != 0 {
+			*log = l
+			err = tx.Get(&w, "select * from "+w.TableName()+" where id = ?", l.UserID)
+			if err != nil {
+				err = fmt.Errorf("%v %w", err, ServerErr)
+				return
+			}
+			err = tx.Commit()
+			return
+		}
+	}
 	if log.UserID == 0 && log.Extra["_pubkey"] != "" { // 老用户在新设备登录场景
-		err = tx.Get(&w, "select * from "+w.TableName()+" where pubkey = ?", log.Extra["_pubkey"])
+		err = tx.Get(&w, "select * from "+w.TableName()+" where pubkey = ?"+tx.Dialect.ForUpdate(), log.Extra["_pubkey"])
 		if !errors.Is(err, sql.ErrNoRows) && err != nil {
 			err = fmt.Errorf("%v %w", err, ServerErr)
 			return
@@ -343,7 +434,7 @@ func (r *TokenRepo) UpdateWallet(log *TokenLog) (w TokenWallet, err error) {
 		log.UserID = w.ID
 	} else {
 		if w.ID == 0 { // 前面使用公钥查没查到，继续使用用户ID查找
-			err = tx.Get(&w, "select * from "+w.TableName()+" where id = ?", log.UserID)
+			err = tx.Get(&w, "select * from "+w.TableName()+" where id = ?"+tx.Dialect.ForUpdate(), log.UserID)
 			if err != nil {
 				err = fmt.Errorf("%v %w", err, ServerErr)
 				return
@@ -355,6 +446,10 @@ func (r *TokenRepo) UpdateWallet(log *TokenLog) (w TokenWallet, err error) {
 		}
 		if log.Type == LogTypeBuy {
 			w.Tokens += log.TokenNum
+		} else if log.Type == LogTypeRefund { // 支付宝已经退款，余额不足也要扣
+			w.Tokens -= log.TokenNum
+		} else if log.Type == LogTypeAdjust {
+			w.Tokens += log.TokenNum
 		} else {
 			if w.Tokens <= 0 {
 				err = fmt.Errorf("there is not enough tokens %w", ClientErr)
@@ -370,73 +465,54 @@ func (r *TokenRepo) UpdateWallet(log *TokenLog) (w TokenWallet, err error) {
 	}
 	log.AfterNum = w.Tokens
 
+	buyerID, pubkey := log.Extra["_buyer_id"], log.Extra["_pubkey"]
 	for k := range log.Extra {
 		if strings.HasPrefix(k, "_") {
 			delete(log.Extra, k)
 		}
 	}
 
-	res, err := tx.Insert(log)
-	if err != nil {
-		err = fmt.Errorf("%v %w", err, ServerErr)
-		return
+	var fo *TokenLog
+	if (log.Type == LogTypeBuy || log.Type == LogTypeRefund) && w.FromID > 0 {
+		if log.Extra == nil {
+			log.Extra = KV{}
+		}
+		if fo, err = r.referral(tx, &w, log, buyerID, pubkey); err != nil {
+			err = fmt.Errorf("%v %w", err, ServerErr)
+			return
+		}
 	}
-	id, err := res.LastInsertId()
+
+	id, err := tx.InsertID(log)
 	if err != nil {
 		err = fmt.Errorf("%v %w", err, ServerErr)
 		return
 	}
 
-	if log.Type == LogTypeBuy && w.FromID > 0 {
-		var fw TokenWallet
-		fw, err = r.GetWallet(w.FromID)
-		if err != nil {
+	if fo != nil {
+		fo.Extra["from_oid"] = strconv.Itoa(id)
+		if _, err = tx.Insert(fo); err != nil {
 			err = fmt.Errorf("%v %w", err, ServerErr)
 			return
 		}
-		if fw.ID != 0 {
-			t := log.TokenNum / 10
-			fw.Tokens += t
-			fw.InviteUsers += 1
-			fw.InviteTokens += t
-			if _, err = tx.Update(&fw); err != nil {
-				err = fmt.Errorf("%v %w", err, ServerErr)
-				return
-			}
-			fo := TokenLog{
-				UserID:   fw.ID,
-				Type:     LogTypeInvite,
-				TokenNum: t,
-				AfterNum: fw.Tokens,
-				Extra: map[string]string{
-					"from_id":  strconv.Itoa(w.ID),
-					"from_oid": strconv.FormatInt(id, 10),
-				},
-				Created: log.Created,
-			}
-			if _, err = tx.Insert(&fo); err != nil {
-				err = fmt.Errorf("%v %w", err, ServerErr)
-				return
-			}
-		}
 	}
 
 	if err = tx.Commit(); err == nil {
-		log.ID = int(id)
+		log.ID = id
 		return
 	}
 	err = fmt.Errorf("%v %w", err, ServerErr)
 	return
 }
 
-func (r *TokenRepo) ScanLogs(userID, last, num int) (logs []TokenLog, err error) {
+func (r *sqlTokenRepo) ScanLogs(userID, last, num int) (logs []TokenLog, err error) {
 	q := "select * from " + (&TokenLog{}).TableName() + " where " +
 		"user_id = ? and id < ? order by id desc limit ?"
 	err = r.db.Select(&logs, q, userID, last, num)
 	return
 }
 
-func (r *TokenRepo) FindLog(payNo string) (log TokenLog, err error) {
+func (r *sqlTokenRepo) FindLog(payNo string) (log TokenLog, err error) {
 	q := "select * from " + (&TokenLog{}).TableName() + " where pay_no = ?"
 	err = r.db.Get(&log, q, payNo)
 	if errors.Is(err, sql.ErrNoRows) {
@@ -444,3 +520,31 @@ func (r *TokenRepo) FindLog(payNo string) (log TokenLog, err error) {
 	}
 	return
 }
+
+func (r *sqlTokenRepo) ListWallets(after, num int) (ws []TokenWallet, err error) {
+	q := "select * from " + (&TokenWallet{}).TableName() + " where id > ? order by id asc limit ?"
+	err = r.db.Select(&ws, q, after, num)
+	return
+}
+
+func (r *sqlTokenRepo) ReplayLogs(userID, after, num int) (logs []TokenLog, err error) {
+	q := "select * from " + (&TokenLog{}).TableName() + " where " +
+		"user_id = ? and id > ? order by id asc limit ?"
+	err = r.db.Select(&logs, q, userID, after, num)
+	return
+}
+
+func (r *sqlTokenRepo) DupPayNos() (nos []string, err error) {
+	q := "select pay_no from " + (&TokenLog{}).TableName() +
+		" where pay_no != '' group by pay_no having count(*) > 1"
+	err = r.db.Select(&nos, q)
+	return
+}
+
+func (r *sqlTokenRepo) ListPaidLogs(begin, end time.Time) (logs []TokenLog, err error) {
+	q := "select * from " + (&TokenLog{}).TableName() +
+		" where pay_no != '' and created >= ? and created <= ? order by id asc"
+	// created 按写入时的本地时间保存，SQLite 按文本比较，所以查询条件也要转成本地时间
+	err = r.db.Select(&logs, q, begin.Local(), end.Local())
+	return
+}
@@ -3,6 +3,8 @@ package store
 import (
 	"math"
 	"os"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 
@@ -108,6 +110,18 @@ func TestTokenRepo(t *testing.T) {
 	w, err = repo.GetWallet(1)
 	assert.Nil(t, err)
 	assert.Equal(t, 1400, w.Tokens)
+
+	assert.Nil(t, repo.SetWalletExtra(1, "email", "a@b.c"))
+	w, err = repo.GetWallet(1)
+	assert.Nil(t, err)
+	assert.Equal(t, 1400, w.Tokens)
+	assert.Equal(t, "a@b.c", w.Extra["email"])
+	assert.Equal(t, "123", w.Extra["alipay"])
+
+	assert.Nil(t, repo.SetWalletExtra(1, "email", ""))
+	w, err = repo.GetWallet(1)
+	assert.Nil(t, err)
+	assert.Equal(t, "", w.Extra["email"])
 }
 
 func TestSignData(t *testing.T) {
@@ -197,3 +211,69 @@ func TestSession(t *testing.T) {
 	assert.Equal(t, w.ID, w2.ID)
 	assert.Equal(t, s1.Pubkey, w2.Pubkey)
 }
+
+// TestUpdateWalletConcurrent 并发修改同一个钱包不能丢失更新。
+// SQLite 写事务互斥，需要设置 TEST_POSTGRES_DSN 在 PostgreSQL 上测试。
+func TestUpdateWalletConcurrent(t *testing.T) {
+	dsn := os.Getenv("TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("TEST_POSTGRES_DSN is not set")
+	}
+	repo := NewTokenRepo(dsn)
+
+	// 数据库可能被多次测试使用，公钥加上随机后缀
+	run := strconv.FormatInt(time.Now().UnixNano(), 36)
+	inviter := TokenLog{Type: LogTypeBuy, TokenNum: 1000, Extra: KV{"_pubkey": "inviter-" + run}, Created: time.Now()}
+	fw, err := repo.UpdateWallet(&inviter)
+	assert.Nil(t, err)
+
+	const n = 20
+	var wg sync.WaitGroup
+	for i := range n {
+		// 调整邀请人余额
+		wg.Go(func() {
+			l := TokenLog{UserID: fw.ID, Type: LogTypeAdjust, TokenNum: 1, Created: time.Now()}
+			_, err := repo.UpdateWallet(&l)
+			assert.Nil(t, err)
+		})
+		// 新的被邀请人购买，奖励邀请人 10%
+		wg.Go(func() {
+			l := TokenLog{Type: LogTypeBuy, TokenNum: 100, Created: time.Now(), Extra: KV{
+				"_pubkey":  "invitee-" + run + "-" + strconv.Itoa(i),
+				"_from_id": strconv.Itoa(fw.ID),
+			}}
+			_, err := repo.UpdateWallet(&l)
+			assert.Nil(t, err)
+		})
+	}
+	wg.Wait()
+
+	w, err := repo.GetWallet(fw.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, 1000+n*1+n*10, w.Tokens)
+	assert.Equal(t, n, w.InviteUsers)
+	assert.Equal(t, n*10, w.InviteTokens)
+}
+
+func TestListPaidLogs(t *testing.T) {
+	f, err := os.CreateTemp("", "led-*.db")
+	assert.Nil(t, err)
+	f.Close()
+	defer os.Remove(f.Name())
+
+	repo := NewTokenRepo(f.Name())
+
+	created := time.Date(2023, 4, 12, 23, 30, 0, 0, time.Local)
+	l := TokenLog{Type: LogTypeBuy, TokenNum: 1000, ExtraNum: 100, PayNo: "pay-1",
+		Extra: KV{"_pubkey": "pk"}, Created: created}
+	_, err = repo.UpdateWallet(&l)
+	assert.Nil(t, err)
+
+	// 查询条件的时区和写入时不同也要能查到
+	for _, loc := range []*time.Location{time.UTC, time.FixedZone("CST", 8*3600), time.FixedZone("EST", -5*3600)} {
+		begin := created.Add(-time.Hour).In(loc)
+		logs, err := repo.ListPaidLogs(begin, begin.Add(2*time.Hour))
+		assert.Nil(t, err)
+		assert.Len(t, logs, 1, loc.String())
+	}
+}
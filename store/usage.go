@@ -0,0 +1,77 @@
+package store
+
+import (
+	"context"
+	"time"
+)
+
+// Usage 代理用户每天的流量汇总
+type Usage struct {
+	ID      int    `db:"id" json:"-"`
+	Token   string `db:"token" json:"-"`
+	Day     string `db:"day" json:"day"`         // 日期，格式为 2006-01-02
+	Up      int    `db:"up" json:"up"`           // 上传字节数
+	Down    int    `db:"down" json:"down"`       // 下载字节数
+	Flows   int    `db:"flows" json:"flows"`     // 连接数
+	Seconds int    `db:"seconds" json:"seconds"` // 连接总时长
+}
+
+func (_ *Usage) KeyName() string   { return "id" }
+func (_ *Usage) TableName() string { return "usages" }
+func (u *Usage) Schema() string {
+	return "CREATE TABLE IF NOT EXISTS " + u.TableName() + `(
+	` + u.KeyName() + ` INTEGER PRIMARY KEY AUTOINCREMENT,
+	token TEXT,
+	day TEXT,
+	up INTEGER DEFAULT 0,
+	down INTEGER DEFAULT 0,
+	flows INTEGER DEFAULT 0,
+	seconds INTEGER DEFAULT 0
+);
+	CREATE UNIQUE INDEX IF NOT EXISTS u_token_day ON ` + u.TableName() + `(token, day);`
+}
+
+type UsageRepo interface {
+	// AddUsage adds one finished flow to the usage of day.
+	AddUsage(token string, day time.Time, up, down, seconds int) error
+	// ListUsage fetches the usage of recent days, newest first.
+	ListUsage(token string, days int) ([]Usage, error)
+}
+
+func NewUsageRepo(path string) UsageRepo {
+	db := mustOpen(path)
+	if db.Dialect == SQLite {
+		db.SetMaxOpenConns(1)
+	}
+	if err := db.migrate("usage"); err != nil {
+		panic(err)
+	}
+	return sqlUsageRepo{db: db}
+}
+
+type sqlUsageRepo struct {
+	db *DB
+}
+
+func (r sqlUsageRepo) Ping(ctx context.Context) error {
+	return r.db.PingContext(ctx)
+}
+
+func (r sqlUsageRepo) AddUsage(token string, day time.Time, up, down, seconds int) error {
+	t := (*Usage).TableName(nil)
+	// PostgreSQL 要求用表名限定已有行的字段
+	sql := "insert into " + t +
+		"(token, day, up, down, flows, seconds) values (?, ?, ?, ?, 1, ?)" +
+		" on conflict(token, day) do update set" +
+		" up = " + t + ".up + excluded.up, down = " + t + ".down + excluded.down," +
+		" flows = " + t + ".flows + 1, seconds = " + t + ".seconds + excluded.seconds"
+	_, err := r.db.Exec(sql, token, day.Format(time.DateOnly), up, down, seconds)
+	return err
+}
+
+func (r sqlUsageRepo) ListUsage(token string, days int) (us []Usage, err error) {
+	sql := "select * from " + (*Usage).TableName(nil) +
+		" where token = ? order by day desc limit ?"
+	err = r.db.Select(&us, sql, token, days)
+	return
+}
@@ -0,0 +1,33 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUsageRepo(t *testing.T) {
+	r := NewUsageRepo(":memory:")
+
+	d1 := time.Date(2024, 1, 1, 10, 0, 0, 0, time.Local)
+	d2 := d1.AddDate(0, 0, 1)
+
+	assert.Nil(t, r.AddUsage("foo", d1, 10, 100, 5))
+	assert.Nil(t, r.AddUsage("foo", d1.Add(time.Hour), 20, 200, 6))
+	assert.Nil(t, r.AddUsage("foo", d2, 1, 2, 3))
+	assert.Nil(t, r.AddUsage("bar", d2, 1, 2, 3))
+
+	us, err := r.ListUsage("foo", 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(us))
+
+	assert.Equal(t, "2024-01-02", us[0].Day)
+	assert.Equal(t, 1, us[0].Flows)
+
+	assert.Equal(t, "2024-01-01", us[1].Day)
+	assert.Equal(t, 30, us[1].Up)
+	assert.Equal(t, 300, us[1].Down)
+	assert.Equal(t, 2, us[1].Flows)
+	assert.Equal(t, 11, us[1].Seconds)
+}
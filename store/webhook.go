@@ -0,0 +1,109 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"math"
+	"time"
+)
+
+// WebhookStatus 通知投递状态
+type WebhookStatus int
+
+const (
+	WebhookPending   WebhookStatus = iota // 等待投递或重试
+	WebhookDelivered                      // 应用已确认
+	WebhookDead                           // 重试次数用完，需要应用手工重放
+)
+
+// Webhook 待投递给第三方应用的通知
+type Webhook struct {
+	ID        int           `db:"id" json:"id"`
+	App       string        `db:"app" json:"app"`
+	Event     string        `db:"event" json:"event"`       // 事件类型，如 order.paid
+	TradeNo   string        `db:"trade_no" json:"trade_no"` // 商户订单号，即应用的 order_id
+	URL       string        `db:"url" json:"url"`
+	Body      string        `db:"body" json:"body"`
+	Status    WebhookStatus `db:"status" json:"status"`
+	Attempts  int           `db:"attempts" json:"attempts"`
+	NextAt    time.Time     `db:"next_at" json:"next_at"`
+	LastCode  int           `db:"last_code" json:"last_code"`
+	LastError string        `db:"last_error" json:"last_error"`
+	Created   time.Time     `db:"created" json:"created"`
+	Updated   time.Time     `db:"updated" json:"updated"`
+}
+
+func (_ *Webhook) KeyName() string   { return "id" }
+func (_ *Webhook) TableName() string { return "webhooks" }
+func (h *Webhook) Schema() string {
+	return "CREATE TABLE IF NOT EXISTS " + h.TableName() + `(
+	` + h.KeyName() + ` INTEGER PRIMARY KEY AUTOINCREMENT,
+	app TEXT NOT NULL,
+	event TEXT NOT NULL,
+	trade_no TEXT NOT NULL,
+	url TEXT NOT NULL,
+	body TEXT NOT NULL,
+	status INTEGER DEFAULT 0,
+	attempts INTEGER DEFAULT 0,
+	next_at DATETIME,
+	last_code INTEGER DEFAULT 0,
+	last_error TEXT DEFAULT '',
+	created DATETIME,
+	updated DATETIME
+);
+	CREATE INDEX IF NOT EXISTS h_status ON ` + h.TableName() + `(status, next_at);
+	CREATE INDEX IF NOT EXISTS h_app ON ` + h.TableName() + `(app, trade_no);`
+}
+
+func (r sqlOrderRepo) AddWebhook(h *Webhook) (err error) {
+	now := time.Now().UTC()
+	h.Status = WebhookPending
+	if h.NextAt.IsZero() {
+		h.NextAt = now
+	}
+	h.NextAt = h.NextAt.UTC()
+	h.Created = now
+	h.Updated = now
+	h.ID, err = r.db.InsertID(h)
+	return
+}
+
+func (r sqlOrderRepo) FindWebhook(id int) (h Webhook, err error) {
+	err = r.db.Get(&h, "select * from "+h.TableName()+" where id = ?", id)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+	}
+	return
+}
+
+func (r sqlOrderRepo) SaveWebhook(h *Webhook) error {
+	h.NextAt = h.NextAt.UTC()
+	h.Updated = time.Now().UTC()
+	_, err := r.db.Exec("update "+h.TableName()+
+		" set status = ?, attempts = ?, next_at = ?, last_code = ?, last_error = ?, updated = ? where id = ?",
+		h.Status, h.Attempts, h.NextAt, h.LastCode, h.LastError, h.Updated, h.ID)
+	return err
+}
+
+func (r sqlOrderRepo) DueWebhooks(now time.Time, num int) (hs []Webhook, err error) {
+	err = r.db.Select(&hs, "select * from "+(*Webhook).TableName(nil)+
+		" where status = ? and next_at <= ? order by next_at limit ?",
+		WebhookPending, now.UTC(), num)
+	return
+}
+
+func (r sqlOrderRepo) ListWebhooks(app, tradeNo string, before, num int) (hs []Webhook, err error) {
+	if before <= 0 {
+		before = math.MaxInt
+	}
+	q := "select * from " + (*Webhook).TableName(nil) + " where app = ? and id < ?"
+	args := []any{app, before}
+	if tradeNo != "" {
+		q += " and trade_no = ?"
+		args = append(args, tradeNo)
+	}
+	q += " order by id desc limit ?"
+	args = append(args, num)
+	err = r.db.Select(&hs, q, args...)
+	return
+}
@@ -1,13 +1,11 @@
 package store
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"strings"
 	"time"
-
-	"github.com/go-kiss/sqlx"
-	_ "modernc.org/sqlite"
 )
 
 type Status int
@@ -15,6 +13,7 @@ type Status int
 const (
 	StatusOK Status = iota
 	StatusDeleted
+	StatusSuspended // 管理员暂停，保留域名但不能使用
 )
 
 type Zone struct {
@@ -45,38 +44,43 @@ func (t *Zone) Schema() string {
         CREATE INDEX IF NOT EXISTS email ON ` + t.TableName() + `(email);`
 }
 
-type ZoneRepo struct {
-	db *sqlx.DB
+type ZoneRepo interface {
+	// New creates one Zone.
+	New(z *Zone) error
+	// Update saves the Zone.
+	Update(z *Zone) error
+	// Get fetches the active Zone by name.
+	Get(name string) (Zone, error)
+	// GetAll fetches all Zones of name, including deleted ones.
+	GetAll(name string) ([]Zone, error)
+	// ListByEmail fetches all Zones of email.
+	ListByEmail(email string) ([]Zone, error)
 }
 
-func (r ZoneRepo) init() {
-	s := (*Zone).Schema(nil)
-	if _, err := r.db.Exec(s); err != nil {
-		panic(err)
-	}
+type sqlZoneRepo struct {
+	db *DB
 }
 
-func (r ZoneRepo) New(z *Zone) error {
-	x, err := r.db.Insert(z)
-	if err != nil {
-		return err
-	}
+func (r sqlZoneRepo) Ping(ctx context.Context) error {
+	return r.db.PingContext(ctx)
+}
 
-	id, err := x.LastInsertId()
+func (r sqlZoneRepo) New(z *Zone) error {
+	id, err := r.db.InsertID(z)
 	if err != nil {
 		return err
 	}
 
-	z.ID = int(id)
+	z.ID = id
 	return nil
 }
 
-func (r ZoneRepo) Update(z *Zone) error {
+func (r sqlZoneRepo) Update(z *Zone) error {
 	_, err := r.db.Update(z)
 	return err
 }
 
-func (r ZoneRepo) Get(name string) (z Zone, err error) {
+func (r sqlZoneRepo) Get(name string) (z Zone, err error) {
 	name = strings.ToLower(name)
 	err = r.db.Get(
 		&z,
@@ -90,7 +94,7 @@ func (r ZoneRepo) Get(name string) (z Zone, err error) {
 	return
 }
 
-func (r ZoneRepo) GetAll(name string) (zs []Zone, err error) {
+func (r sqlZoneRepo) GetAll(name string) (zs []Zone, err error) {
 	name = strings.ToLower(name)
 	err = r.db.Select(
 		&zs,
@@ -100,7 +104,7 @@ func (r ZoneRepo) GetAll(name string) (zs []Zone, err error) {
 	return
 }
 
-func (r ZoneRepo) ListByEmail(email string) (zs []Zone, err error) {
+func (r sqlZoneRepo) ListByEmail(email string) (zs []Zone, err error) {
 	email = strings.ToLower(email)
 	err = r.db.Select(
 		&zs,
@@ -111,14 +115,14 @@ func (r ZoneRepo) ListByEmail(email string) (zs []Zone, err error) {
 }
 
 func NewZoneRepo(path string) ZoneRepo {
-	db, err := sqlx.Connect("sqlite", path)
-	if err != nil {
-		panic(err)
+	db := mustOpen(path)
+	if db.Dialect == SQLite {
+		db.SetMaxOpenConns(1)
 	}
-	db.SetMaxOpenConns(1)
 
-	r := ZoneRepo{db: db}
-	r.init()
+	if err := db.migrate("zone"); err != nil {
+		panic(err)
+	}
 
-	return r
+	return sqlZoneRepo{db: db}
 }
@@ -6,14 +6,25 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"strconv"
 	"strings"
 	"time"
 
 	"github.com/taoso/led/pay"
+	"github.com/taoso/led/store"
 )
 
 func (h *Proxy) ServeTicket(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("plans") != "" {
+		w.Header().Add("content-type", "application/json")
+		json.NewEncoder(w).Encode(h.activePlans(time.Now()))
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
 	if r.URL.Query().Get("query") != "" {
 		req := struct {
 			Token string `json:"token"`
@@ -29,14 +40,137 @@ func (h *Proxy) ServeTicket(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		type ticket struct {
+			store.Ticket
+			Limits ticketTier `json:"limits"`
+		}
+		rs := make([]ticket, len(ts))
+		for i, t := range ts {
+			rs[i] = ticket{Ticket: t, Limits: h.ticketTierOf(t)}
+		}
+		w.Header().Add("content-type", "application/json")
+		json.NewEncoder(w).Encode(rs)
+		return
+	}
+
+	if r.URL.Query().Get("balance") != "" {
+		req := struct {
+			Token string `json:"token"`
+		}{}
+		defer r.Body.Close()
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		b, err := h.TicketRepo.Balance(req.Token)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Add("content-type", "application/json")
+		json.NewEncoder(w).Encode(b)
+		return
+	}
+
+	if r.URL.Query().Get("history") != "" {
+		req := struct {
+			Token  string `json:"token"`
+			Before int    `json:"before"`
+		}{}
+		defer r.Body.Close()
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ts, err := h.TicketRepo.History(req.Token, req.Before, 20)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 		w.Header().Add("content-type", "application/json")
 		json.NewEncoder(w).Encode(ts)
 		return
 	}
 
+	if r.URL.Query().Get("watch") != "" {
+		req := struct {
+			Token string          `json:"token"`
+			Email string          `json:"email"`
+			Push  json.RawMessage `json:"push"`
+		}{}
+		defer r.Body.Close()
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Email != "" && !strings.Contains(req.Email, "@") {
+			http.Error(w, "invalid email", http.StatusBadRequest)
+			return
+		}
+		ts, err := h.TicketRepo.List(req.Token, 1)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(ts) == 0 {
+			http.Error(w, "ticket not found", http.StatusNotFound)
+			return
+		}
+		tw := store.TicketWatch{
+			Token: req.Token,
+			Site:  h.host(r.Host),
+			Email: req.Email,
+		}
+		if len(req.Push) > 0 && string(req.Push) != "null" {
+			tw.Push = string(req.Push)
+		}
+		if err := h.TicketRepo.Watch(&tw); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Add("content-type", "application/json")
+		json.NewEncoder(w).Encode(tw)
+		return
+	}
+
+	if r.URL.Query().Get("usage") != "" {
+		req := struct {
+			Token string `json:"token"`
+			Days  int    `json:"days"`
+		}{}
+		defer r.Body.Close()
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if h.UsageRepo == nil {
+			http.Error(w, "usage is not enabled", http.StatusNotImplemented)
+			return
+		}
+		if req.Days <= 0 || req.Days > 90 {
+			req.Days = 30
+		}
+		us, err := h.UsageRepo.ListUsage(req.Token, req.Days)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Add("content-type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Usages   []store.Usage  `json:"usages"`
+			Sessions []proxySession `json:"sessions"`
+		}{Usages: us, Sessions: h.listSessions(req.Token)})
+		return
+	}
+
 	if r.URL.Query().Get("buy") != "" {
 		req := struct {
 			Token string `json:"token"`
+			Plan  string `json:"plan"`
 			Cents int    `json:"cents"`
 		}{}
 		defer r.Body.Close()
@@ -46,21 +180,9 @@ func (h *Proxy) ServeTicket(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		var bytes int
-		var days int
-		const GB = 1024 * 1024 * 1024
-		switch req.Cents {
-		case 200:
-			bytes = 2 * GB
-			days = 30
-		case 400:
-			bytes = 8 * GB
-			days = 60
-		case 800:
-			bytes = 32 * GB
-			days = 90
-		default:
-			http.Error(w, "cents must in [200,400,800]", http.StatusBadRequest)
+		plan, err := h.findPlan(req.Plan, req.Cents, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
@@ -74,18 +196,27 @@ func (h *Proxy) ServeTicket(w http.ResponseWriter, r *http.Request) {
 			req.Token = base64.RawURLEncoding.EncodeToString(b)
 		}
 
-		now := time.Now().Format(time.RFC3339)
-		yuan := strconv.FormatFloat(float64(req.Cents)/100, 'f', 2, 64)
+		pp, err := h.payment(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		extra, err := json.Marshal(ticketExtra{Token: req.Token, TicketPlan: plan.TicketPlan})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 
 		o := pay.Order{
-			Subject:   fmt.Sprintf("Traffic: %dGB@%dd", bytes/GB, days),
-			TradeNo:   req.Token + "@" + now,
-			Amount:    yuan,
-			NotifyURL: "https://" + r.Host + r.URL.Path,
-			Extra:     fmt.Sprintf(`{"bytes":%d,"days":%d}`, bytes, days),
+			Subject:   "Traffic: " + plan.Name,
+			TradeNo:   pay.NewTradeNo(),
+			Cents:     plan.Cents,
+			NotifyURL: notifyURL(r.Host, r.URL.Path, pp),
+			Extra:     string(extra),
 		}
 
-		qr, err := h.Alipay.CreateQR(o)
+		qr, err := h.createOrder(r.Context(), pp, orderTicket, o)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -98,37 +229,57 @@ func (h *Proxy) ServeTicket(w http.ResponseWriter, r *http.Request) {
 			Order string `json:"order"`
 		}{QR: qr, Token: req.Token, Order: o.TradeNo})
 	} else {
-		o, err := h.Alipay.GetNotification(r)
+		pp, err := h.payment(r)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		i := strings.Index(o.OutTradeNo, "@")
-		token := o.OutTradeNo[:i]
-
-		var extra struct {
-			Bytes  int `json:"bytes"`
-			Months int `json:"months"`
-			Days   int `json:"days"`
-		}
-
-		err = json.Unmarshal([]byte(o.PassbackParams), &extra)
+		o, err := pp.Notify(r)
 		if err != nil {
+			h.recordNotify(r, pp, nil, err)
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		if extra.Months > 0 {
-			extra.Days = extra.Months * 30
+		// 退款等通知无需处理
+		if !o.IsRefund() && o.Status == pay.StatusPaid {
+			err = h.applyPayment(r.Context(), orderTicket, o)
 		}
-
-		err = h.TicketRepo.New(token, extra.Bytes, extra.Days, o.OutTradeNo, o.TradeNo)
+		h.recordNotify(r, pp, o, err)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			notifyError(w, err)
 			return
 		}
 
-		w.Write([]byte("success"))
+		pp.Ack(w)
+	}
+}
+
+// applyTicket 按回传参数创建 Ticket，同一订单只创建一次
+func (h *Proxy) applyTicket(o *pay.Notification) error {
+	// 老订单没有计费比例，上下行都按全价计费
+	e := ticketExtra{TicketPlan: store.TicketPlan{UpRatio: 100, DownRatio: 100}}
+
+	err := json.Unmarshal([]byte(o.Extra), &e)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errInvalidNotify, err)
+	}
+
+	// 老订单号为 token@time 格式
+	if e.Token == "" {
+		i := strings.Index(o.TradeNo, "@")
+		if i <= 0 {
+			return fmt.Errorf("%w: token not found", errInvalidNotify)
+		}
+		e.Token = o.TradeNo[:i]
 	}
+
+	return h.TicketRepo.New(e.Token, e.TicketPlan, o.TradeNo, o.PayNo)
+}
+
+// ticketExtra 流量订单的回传参数
+type ticketExtra struct {
+	Token string `json:"token"`
+	store.TicketPlan
 }
@@ -0,0 +1,123 @@
+package trace
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/felixge/httpsnoop"
+)
+
+// Inject 将 ctx 中的 Span 写入 traceparent 请求头
+func Inject(ctx context.Context, h http.Header) {
+	sc := SpanContextFrom(ctx)
+	if !sc.IsValid() {
+		return
+	}
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	h.Set("traceparent", "00-"+sc.TraceID.String()+"-"+sc.SpanID.String()+"-"+flags)
+}
+
+// Extract 解析 traceparent 请求头，格式不对时返回原 ctx
+func Extract(ctx context.Context, h http.Header) context.Context {
+	sc, ok := parseTraceparent(h.Get("traceparent"))
+	if !ok {
+		return ctx
+	}
+	return WithRemote(ctx, sc)
+}
+
+// parseTraceparent 解析 version-traceid-spanid-flags，只支持 00 版本的格式
+func parseTraceparent(v string) (sc SpanContext, ok bool) {
+	p := strings.Split(strings.TrimSpace(v), "-")
+	if len(p) < 4 || len(p[0]) != 2 || p[0] == "ff" || len(p[1]) != 32 || len(p[2]) != 16 || len(p[3]) != 2 {
+		return
+	}
+	if p[0] == "00" && len(p) != 4 {
+		return
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(p[1])); err != nil {
+		return
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(p[2])); err != nil {
+		return
+	}
+	var flags [1]byte
+	if _, err := hex.Decode(flags[:], []byte(p[3])); err != nil {
+		return
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, sc.IsValid()
+}
+
+// Handler 为请求创建服务端 Span，并沿用 traceparent 中的上游链路。
+// name 返回 Span 名称，返回空字符串时不追踪该请求。
+func Handler(h http.Handler, name func(req *http.Request) string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		n := name(req)
+		if n == "" || global.Load() == nil {
+			h.ServeHTTP(w, req)
+			return
+		}
+
+		ctx, s := start(Extract(req.Context(), req.Header), n, KindServer)
+		s.Set("http.request.method", req.Method)
+		s.Set("server.address", req.Host)
+		s.Set("url.path", req.URL.Path)
+
+		m := httpsnoop.CaptureMetrics(h, w, req.WithContext(ctx))
+
+		s.Set("http.response.status_code", m.Code)
+		if m.Code >= http.StatusInternalServerError {
+			s.End(statusError(m.Code))
+			return
+		}
+		s.End(nil)
+	})
+}
+
+// Transport 为发出的请求创建客户端 Span，并写入 traceparent 请求头。
+// 请求需要通过 http.NewRequestWithContext 带上父 Span。
+type Transport struct {
+	Base http.RoundTripper // 为空时使用 http.DefaultTransport
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	ctx, s := start(req.Context(), "HTTP "+req.Method+" "+req.URL.Host, KindClient)
+	if s == nil {
+		return base.RoundTrip(req)
+	}
+	s.Set("http.request.method", req.Method)
+	s.Set("server.address", req.URL.Host)
+	s.Set("url.path", req.URL.Path)
+
+	// RoundTripper 不能修改原请求
+	req = req.Clone(ctx)
+	Inject(ctx, req.Header)
+
+	resp, err := base.RoundTrip(req)
+	if err != nil {
+		s.End(err)
+		return nil, err
+	}
+	s.Set("http.response.status_code", resp.StatusCode)
+	if resp.StatusCode >= http.StatusInternalServerError {
+		s.End(statusError(resp.StatusCode))
+	} else {
+		s.End(nil)
+	}
+	return resp, nil
+}
+
+type statusError int
+
+func (e statusError) Error() string { return http.StatusText(int(e)) }
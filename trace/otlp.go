@@ -0,0 +1,169 @@
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// OTLP 通过 OTLP/HTTP 的 JSON 编码导出 Span，兼容 OpenTelemetry Collector、
+// Jaeger、Tempo 等。
+type OTLP struct {
+	Endpoint string            // 如 http://127.0.0.1:4318，会自动加上 /v1/traces
+	Service  string            // service.name
+	Headers  map[string]string // 如鉴权头
+	Client   *http.Client      // 为空时使用 http.DefaultClient，不能使用 Transport，否则会追踪自己
+}
+
+// ParseHeaders 解析 OTEL_EXPORTER_OTLP_HEADERS 格式的 k1=v1,k2=v2
+func ParseHeaders(s string) map[string]string {
+	h := map[string]string{}
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(kv, "=")
+		if k = strings.TrimSpace(k); ok && k != "" {
+			h[k] = strings.TrimSpace(v)
+		}
+	}
+	return h
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"` // int64 按 protobuf JSON 规范编码为字符串
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"` // 1 OK，2 ERROR
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID      string     `json:"traceId"`
+	SpanID       string     `json:"spanId"`
+	ParentSpanID string     `json:"parentSpanId,omitempty"`
+	Name         string     `json:"name"`
+	Kind         Kind       `json:"kind"`
+	Start        string     `json:"startTimeUnixNano"`
+	End          string     `json:"endTimeUnixNano"`
+	Attributes   []otlpAttr `json:"attributes,omitempty"`
+	Status       otlpStatus `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttr `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func attr(k string, v any) otlpAttr {
+	a := otlpAttr{Key: k}
+	switch v := v.(type) {
+	case string:
+		a.Value.StringValue = &v
+	case int:
+		s := strconv.Itoa(v)
+		a.Value.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		a.Value.IntValue = &s
+	case float64:
+		a.Value.DoubleValue = &v
+	case bool:
+		a.Value.BoolValue = &v
+	default:
+		s := fmt.Sprint(v)
+		a.Value.StringValue = &s
+	}
+	return a
+}
+
+func (o *OTLP) encode(spans []*Span) ([]byte, error) {
+	var ss otlpScopeSpans
+	ss.Scope.Name = "github.com/taoso/led"
+
+	for _, s := range spans {
+		s.mu.Lock()
+		x := otlpSpan{
+			TraceID: s.sc.TraceID.String(),
+			SpanID:  s.sc.SpanID.String(),
+			Name:    s.name,
+			Kind:    s.kind,
+			Start:   strconv.FormatInt(s.start.UnixNano(), 10),
+			End:     strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parent.IsValid() {
+			x.ParentSpanID = s.parent.String()
+		}
+		for _, a := range s.attrs {
+			x.Attributes = append(x.Attributes, attr(a.Key, a.Value))
+		}
+		if s.err != "" {
+			x.Status = otlpStatus{Code: 2, Message: s.err}
+		}
+		s.mu.Unlock()
+		ss.Spans = append(ss.Spans, x)
+	}
+
+	var rs otlpResourceSpans
+	rs.Resource.Attributes = []otlpAttr{attr("service.name", o.Service)}
+	rs.ScopeSpans = []otlpScopeSpans{ss}
+
+	return json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{rs}})
+}
+
+func (o *OTLP) Export(ctx context.Context, spans []*Span) error {
+	b, err := o.encode(spans)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		strings.TrimRight(o.Endpoint, "/")+"/v1/traces", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range o.Headers {
+		req.Header.Set(k, v)
+	}
+
+	c := o.Client
+	if c == nil {
+		c = http.DefaultClient
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("otlp export: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,297 @@
+// Package trace 实现 W3C Trace Context 传播和 OTLP/HTTP JSON 导出，
+// 只覆盖 led 用到的功能，避免引入完整的 OpenTelemetry SDK。
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	mrand "math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TraceID 16 字节的链路 ID
+type TraceID [16]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+
+func (t TraceID) IsValid() bool { return t != TraceID{} }
+
+// SpanID 8 字节的 Span ID
+type SpanID [8]byte
+
+func (s SpanID) String() string { return hex.EncodeToString(s[:]) }
+
+func (s SpanID) IsValid() bool { return s != SpanID{} }
+
+// SpanContext 需要跨进程传播的 Span 信息
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+	Remote  bool // 从请求头中解析的上游 Span
+}
+
+func (sc SpanContext) IsValid() bool { return sc.TraceID.IsValid() && sc.SpanID.IsValid() }
+
+// Kind Span 类型，取值与 OTLP 一致
+type Kind int
+
+const (
+	KindInternal Kind = 1
+	KindServer   Kind = 2
+	KindClient   Kind = 3
+)
+
+// Attr Span 属性，Value 支持 string、int、int64、float64 和 bool
+type Attr struct {
+	Key   string
+	Value any
+}
+
+// Span 一次操作。nil 的 Span 表示未开启追踪，所有方法都可以安全调用。
+type Span struct {
+	t      *Tracer
+	name   string
+	kind   Kind
+	sc     SpanContext
+	parent SpanID
+	start  time.Time
+
+	mu    sync.Mutex
+	end   time.Time
+	attrs []Attr
+	err   string
+}
+
+// Name 返回 Span 名称
+func (s *Span) Name() string {
+	if s == nil {
+		return ""
+	}
+	return s.name
+}
+
+// SpanContext 返回 Span 的传播信息
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+// Set 设置属性，同名属性以最后一次为准
+func (s *Span) Set(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, a := range s.attrs {
+		if a.Key == key {
+			s.attrs[i].Value = value
+			return
+		}
+	}
+	s.attrs = append(s.attrs, Attr{key, value})
+}
+
+// Attrs 返回属性副本
+func (s *Span) Attrs() []Attr {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Attr(nil), s.attrs...)
+}
+
+// Err 返回 End 时记录的错误信息
+func (s *Span) Err() string {
+	if s == nil {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// End 结束 Span，err 不为空时标记为错误状态。重复调用无效。
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if !s.end.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.end = time.Now()
+	if err != nil {
+		s.err = err.Error()
+	}
+	s.mu.Unlock()
+
+	if s.sc.Sampled {
+		s.t.enqueue(s)
+	}
+}
+
+type spanKey struct{}
+type remoteKey struct{}
+
+// FromContext 返回 ctx 中的 Span，没有时为 nil
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// SpanContextFrom 返回 ctx 中当前 Span 或者上游 Span 的传播信息
+func SpanContextFrom(ctx context.Context) SpanContext {
+	if s := FromContext(ctx); s != nil {
+		return s.sc
+	}
+	sc, _ := ctx.Value(remoteKey{}).(SpanContext)
+	return sc
+}
+
+// WithRemote 将上游的 Span 保存到 ctx 中，作为后续 Span 的父节点
+func WithRemote(ctx context.Context, sc SpanContext) context.Context {
+	sc.Remote = true
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// Exporter 导出已结束的 Span
+type Exporter interface {
+	Export(ctx context.Context, spans []*Span) error
+}
+
+const (
+	queueSize  = 2048
+	batchSize  = 512
+	batchDelay = 5 * time.Second
+)
+
+// Tracer 创建 Span，并在后台分批导出
+type Tracer struct {
+	exp   Exporter
+	ratio float64
+
+	ch      chan *Span
+	stop    chan struct{}
+	once    sync.Once
+	done    chan struct{}
+	dropped atomic.Int64
+}
+
+var global atomic.Pointer[Tracer]
+
+// Setup 创建 Tracer 并设为全局默认。ratio 为根 Span 的采样比例，
+// 有上游 Span 时沿用上游的采样结果。
+func Setup(exp Exporter, ratio float64) *Tracer {
+	t := &Tracer{
+		exp:   exp,
+		ratio: ratio,
+		ch:    make(chan *Span, queueSize),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go t.loop()
+	global.Store(t)
+	return t
+}
+
+// Start 在 ctx 下创建内部 Span，未开启追踪时返回 nil
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	return start(ctx, name, KindInternal)
+}
+
+func start(ctx context.Context, name string, kind Kind) (context.Context, *Span) {
+	t := global.Load()
+	if t == nil {
+		return ctx, nil
+	}
+
+	s := &Span{t: t, name: name, kind: kind, start: time.Now()}
+
+	parent := SpanContextFrom(ctx)
+	if parent.IsValid() {
+		s.sc.TraceID = parent.TraceID
+		s.sc.Sampled = parent.Sampled
+		s.parent = parent.SpanID
+	} else {
+		rand.Read(s.sc.TraceID[:])
+		s.sc.Sampled = mrand.Float64() < t.ratio
+	}
+	rand.Read(s.sc.SpanID[:])
+
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func (t *Tracer) enqueue(s *Span) {
+	select {
+	case <-t.done:
+	case t.ch <- s:
+	default:
+		// 导出太慢时丢弃，不能阻塞请求
+		if t.dropped.Add(1)%1000 == 1 {
+			slog.Warn("trace queue is full, spans dropped", "dropped", t.dropped.Load())
+		}
+	}
+}
+
+func (t *Tracer) loop() {
+	defer close(t.done)
+
+	tk := time.NewTicker(batchDelay)
+	defer tk.Stop()
+
+	var batch []*Span
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := t.exp.Export(ctx, batch); err != nil {
+			slog.Warn("export spans error", "spans", len(batch), "err", err)
+		}
+		batch = nil
+	}
+
+	for {
+		select {
+		case s := <-t.ch:
+			if batch = append(batch, s); len(batch) >= batchSize {
+				flush()
+			}
+		case <-tk.C:
+			flush()
+		case <-t.stop:
+			for {
+				select {
+				case s := <-t.ch:
+					batch = append(batch, s)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// Shutdown 导出剩余的 Span 后停止，并取消全局默认。可以重复调用。
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	global.CompareAndSwap(t, nil)
+	t.once.Do(func() { close(t.stop) })
+	select {
+	case <-t.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
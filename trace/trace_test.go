@@ -0,0 +1,177 @@
+package trace
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// collector 进程内的 OTLP/HTTP 收集器
+type collector struct {
+	*httptest.Server
+
+	mu    sync.Mutex
+	spans map[string]otlpSpan
+	attrs []otlpAttr
+}
+
+func newCollector(t *testing.T) *collector {
+	c := &collector{spans: map[string]otlpSpan{}}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "/v1/traces", req.URL.Path)
+		assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+		assert.Equal(t, "k1", req.Header.Get("X-Api-Key"))
+
+		var r otlpRequest
+		assert.Nil(t, json.NewDecoder(req.Body).Decode(&r))
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for _, rs := range r.ResourceSpans {
+			c.attrs = rs.Resource.Attributes
+			for _, ss := range rs.ScopeSpans {
+				for _, s := range ss.Spans {
+					c.spans[s.Name] = s
+				}
+			}
+		}
+	}))
+	return c
+}
+
+func TestTrace(t *testing.T) {
+	c := newCollector(t)
+	defer c.Close()
+
+	tr := Setup(&OTLP{Endpoint: c.URL, Service: "led", Headers: ParseHeaders("X-Api-Key=k1, bad")}, 1)
+
+	var upstream string
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		upstream = req.Header.Get("traceparent")
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer up.Close()
+
+	client := &http.Client{Transport: &Transport{}}
+
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if FromContext(req.Context()) == nil {
+			return
+		}
+		ctx, s := Start(req.Context(), "repo")
+		s.Set("rows", 3)
+		s.End(errors.New("boom"))
+		s.End(nil)
+
+		r, _ := http.NewRequestWithContext(ctx, http.MethodGet, up.URL+"/x?token=t", nil)
+		resp, err := client.Do(r)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		assert.Empty(t, r.Header.Get("traceparent"))
+	}), func(req *http.Request) string {
+		if req.URL.Path == "/skip" {
+			return ""
+		}
+		return req.Method + " " + req.URL.Path
+	})
+
+	parent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	req := httptest.NewRequest(http.MethodGet, "/chat", nil)
+	req.Header.Set("traceparent", parent)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	// 不追踪的请求没有 Span
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/skip", nil))
+
+	assert.Nil(t, tr.Shutdown(context.Background()))
+	assert.Nil(t, tr.Shutdown(context.Background()))
+
+	_, s := Start(context.Background(), "after shutdown")
+	assert.Nil(t, s)
+
+	assert.Len(t, c.spans, 3)
+	assert.Equal(t, "service.name", c.attrs[0].Key)
+	assert.Equal(t, "led", *c.attrs[0].Value.StringValue)
+
+	server := c.spans["GET /chat"]
+	repo := c.spans["repo"]
+	client2 := c.spans["HTTP GET "+up.Listener.Addr().String()]
+
+	trace := "4bf92f3577b34da6a3ce929d0e0e4736"
+	for _, s := range []otlpSpan{server, repo, client2} {
+		assert.Equal(t, trace, s.TraceID)
+	}
+	assert.Equal(t, "00f067aa0ba902b7", server.ParentSpanID)
+	assert.Equal(t, server.SpanID, repo.ParentSpanID)
+	assert.Equal(t, repo.SpanID, client2.ParentSpanID)
+	assert.Equal(t, "00-"+trace+"-"+client2.SpanID+"-01", upstream)
+
+	assert.Equal(t, KindServer, server.Kind)
+	assert.Equal(t, KindInternal, repo.Kind)
+	assert.Equal(t, KindClient, client2.Kind)
+
+	assert.Equal(t, otlpStatus{}, server.Status)
+	assert.Equal(t, otlpStatus{Code: 2, Message: "boom"}, repo.Status)
+	assert.Equal(t, otlpStatus{Code: 2, Message: "Bad Gateway"}, client2.Status)
+
+	assert.Equal(t, "rows", repo.Attributes[0].Key)
+	assert.Equal(t, "3", *repo.Attributes[0].Value.IntValue)
+	for _, a := range client2.Attributes {
+		if a.Key == "url.path" {
+			assert.Equal(t, "/x", *a.Value.StringValue)
+		}
+	}
+}
+
+func TestSampling(t *testing.T) {
+	var spans []*Span
+	tr := Setup(exporterFunc(func(ctx context.Context, ss []*Span) error {
+		spans = append(spans, ss...)
+		return nil
+	}), 0)
+
+	// 未采样的根 Span 仍然传播，但不导出
+	ctx, s := Start(context.Background(), "root")
+	assert.False(t, s.SpanContext().Sampled)
+	h := http.Header{}
+	Inject(ctx, h)
+	assert.Regexp(t, `^00-[0-9a-f]{32}-[0-9a-f]{16}-00$`, h.Get("traceparent"))
+	s.End(nil)
+
+	// 上游已采样时沿用上游的结果
+	ctx = Extract(context.Background(), http.Header{"Traceparent": {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}})
+	_, s = Start(ctx, "child")
+	assert.True(t, s.SpanContext().Sampled)
+	s.End(nil)
+
+	assert.Nil(t, tr.Shutdown(context.Background()))
+	assert.Len(t, spans, 1)
+	assert.Equal(t, "child", spans[0].Name())
+}
+
+type exporterFunc func(ctx context.Context, spans []*Span) error
+
+func (f exporterFunc) Export(ctx context.Context, spans []*Span) error { return f(ctx, spans) }
+
+func TestParseTraceparent(t *testing.T) {
+	for v, ok := range map[string]bool{
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01":     true,
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-xyz": true,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-xyz": false,
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01":     false,
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01":     false,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01":     false,
+		"00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01":     false,
+		"":    false,
+		"abc": false,
+	} {
+		_, got := parseTraceparent(v)
+		assert.Equal(t, ok, got, v)
+	}
+}
@@ -0,0 +1,30 @@
+package led
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/taoso/led/trace"
+)
+
+// httpClient 调用上游接口，请求需要带上 ctx 才能关联到当前链路
+var httpClient = &http.Client{Transport: &trace.Transport{}}
+
+// traceRepo 为仓库调用创建 Span，返回的函数用于结束 Span。
+// 仓库接口不带 ctx，只能在调用处记录。
+func traceRepo(ctx context.Context, name string) func(err error) {
+	_, sp := trace.Start(ctx, name)
+	return sp.End
+}
+
+// Trace 为站点请求创建 Span，名称为方法加路由，如 POST /+/chat。
+// 代理请求不追踪，避免记录用户的访问目标。
+func (p *Proxy) Trace(h http.Handler) http.Handler {
+	return trace.Handler(h, func(req *http.Request) string {
+		vhost, route := p.metricLabels(req)
+		if vhost == "proxy" {
+			return ""
+		}
+		return req.Method + " " + route
+	})
+}
@@ -0,0 +1,77 @@
+package led
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/taoso/led/trace"
+)
+
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []*trace.Span
+}
+
+func (r *spanRecorder) Export(ctx context.Context, spans []*trace.Span) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, spans...)
+	return nil
+}
+
+func TestTrace(t *testing.T) {
+	r := &spanRecorder{}
+	tr := trace.Setup(r, 1)
+
+	img := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.NotEmpty(t, req.Header.Get("traceparent"))
+		png.Encode(w, image.NewGray(image.Rect(0, 0, 3, 2)))
+	}))
+	defer img.Close()
+
+	p := &Proxy{}
+	p.SetSites(map[string]string{"lehu.in": ""})
+	h := p.Trace(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if trace.FromContext(req.Context()) == nil {
+			return
+		}
+		end := traceRepo(req.Context(), "TokenRepo.GetWallet")
+		end(nil)
+
+		c, err := openImageConfig(req.Context(), img.URL+"/a.png")
+		assert.Nil(t, err)
+		assert.Equal(t, color.GrayModel, c.ColorModel)
+	}))
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "https://lehu.in/+/chat/v1/chat/completions", nil))
+
+	// 代理请求不追踪
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("Proxy-Authorization", "Basic eDp5")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.Nil(t, tr.Shutdown(context.Background()))
+
+	var names []string
+	for _, s := range r.spans {
+		names = append(names, s.Name())
+	}
+	assert.ElementsMatch(t, []string{
+		"POST /+/chat",
+		"TokenRepo.GetWallet",
+		"HTTP GET " + img.Listener.Addr().String(),
+	}, names)
+
+	root := r.spans[len(r.spans)-1]
+	assert.Equal(t, "POST /+/chat", root.Name())
+	for _, s := range r.spans {
+		assert.Equal(t, root.SpanContext().TraceID, s.SpanContext().TraceID)
+	}
+}
@@ -2,52 +2,79 @@ package led
 
 import (
 	"io"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
+// bytesCounter 分别统计上下行流量，每隔 d 调用一次 f
 type bytesCounter struct {
 	w io.ReadWriter
-	f func(n int)
+	f func(up, down int)
 	d time.Duration
 
-	c atomic.Int64
-	t *time.Ticker
-	s chan int
+	// client 表示 w 是客户端连接，Read 为上行，Write 为下行。
+	// 默认 w 为目标连接，Write 为上行，Read 为下行。
+	client bool
+
+	up   atomic.Int64
+	down atomic.Int64
+	t    *time.Ticker
+	s    chan int
+	o    sync.Once
+}
+
+// init makes Done safe to be called before Start runs.
+func (bc *bytesCounter) init() {
+	bc.o.Do(func() {
+		bc.s = make(chan int, 1)
+		bc.t = time.NewTicker(bc.d)
+	})
 }
 
 func (bc *bytesCounter) Done() {
+	bc.init()
 	bc.t.Stop()
 	close(bc.s)
 }
 
 func (bc *bytesCounter) Start() {
-	bc.s = make(chan int, 1)
-	bc.t = time.NewTicker(bc.d)
+	bc.init()
 
 	for {
 		select {
 		case <-bc.t.C:
-			if n := bc.c.Swap(0); n > 0 {
-				bc.f(int(n))
-			}
+			bc.flush()
 		case <-bc.s:
-			if n := bc.c.Swap(0); n > 0 {
-				bc.f(int(n))
-			}
+			bc.flush()
 			return
 		}
 	}
 }
 
+func (bc *bytesCounter) flush() {
+	up, down := bc.up.Swap(0), bc.down.Swap(0)
+	if up > 0 || down > 0 {
+		bc.f(int(up), int(down))
+	}
+}
+
 func (bc *bytesCounter) Write(p []byte) (n int, err error) {
 	n, err = bc.w.Write(p)
-	bc.c.Add(int64(n))
+	if bc.client {
+		bc.down.Add(int64(n))
+	} else {
+		bc.up.Add(int64(n))
+	}
 	return
 }
 
 func (bc *bytesCounter) Read(p []byte) (n int, err error) {
 	n, err = bc.w.Read(p)
-	bc.c.Add(int64(n))
+	if bc.client {
+		bc.up.Add(int64(n))
+	} else {
+		bc.down.Add(int64(n))
+	}
 	return
 }
@@ -10,12 +10,13 @@ import (
 
 func TestBytesCounter(t *testing.T) {
 	b := bytes.NewBuffer(nil)
-	i := 0
+	up, down := 0, 0
 	bc := bytesCounter{
 		w: b,
 		d: 100 * time.Millisecond,
-		f: func(n int) {
-			i += n
+		f: func(u, d int) {
+			up += u
+			down += d
 		},
 	}
 
@@ -33,6 +34,7 @@ func TestBytesCounter(t *testing.T) {
 
 	bc.Done()
 
-	assert.Equal(t, 12, i)
+	assert.Equal(t, 6, up)
+	assert.Equal(t, 6, down)
 	assert.Equal(t, "abcdef", s)
 }
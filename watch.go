@@ -0,0 +1,127 @@
+package led
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/SherClockHolmes/webpush-go"
+	"github.com/taoso/led/store"
+)
+
+const (
+	// 剩余流量低于购买流量的该百分比时提醒
+	ticketLowPercent = 10
+	// 距离过期小于该时间时提醒
+	ticketExpiryWarn = 3 * 24 * time.Hour
+)
+
+// WatchTickets checks all TicketWatches every d and warns the holders whose
+// balance is low or whose tickets will expire soon.
+func (p *Proxy) WatchTickets(d time.Duration) {
+	t := time.NewTicker(d)
+	defer t.Stop()
+	for {
+		p.checkTicketWatches(time.Now())
+		<-t.C
+	}
+}
+
+func (p *Proxy) checkTicketWatches(now time.Time) {
+	ws, err := p.TicketRepo.ListWatches()
+	if err != nil {
+		slog.Error("list ticket watches error", "err", err)
+		return
+	}
+	for _, w := range ws {
+		b, err := p.TicketRepo.Balance(w.Token)
+		if err != nil {
+			slog.Error("ticket balance error", "token", w.Token, "err", err)
+			continue
+		}
+
+		changed := false
+
+		low := b.TotalBytes > 0 && b.Bytes*100 < b.TotalBytes*ticketLowPercent
+		if low && w.LowSent.IsZero() {
+			msg := fmt.Sprintf("Your traffic balance is low: %s of %s left.",
+				formatBytes(b.Bytes), formatBytes(b.TotalBytes))
+			if err := p.warnTicket(w, "Traffic balance is low", msg); err != nil {
+				slog.Error("ticket warn error", "token", w.Token, "err", err)
+			} else {
+				w.LowSent = now
+				changed = true
+			}
+		} else if !low && !w.LowSent.IsZero() {
+			// 充值后重新提醒
+			w.LowSent = time.Time{}
+			changed = true
+		}
+
+		expiring := !b.NextExpires.IsZero() && b.NextExpires.Sub(now) < ticketExpiryWarn
+		if expiring && !w.ExpirySent.Equal(b.NextExpires) {
+			msg := fmt.Sprintf("%s of your traffic will expire at %s.",
+				formatBytes(b.NextBytes), b.NextExpires.Format(time.RFC3339))
+			if err := p.warnTicket(w, "Traffic will expire soon", msg); err != nil {
+				slog.Error("ticket warn error", "token", w.Token, "err", err)
+			} else {
+				w.ExpirySent = b.NextExpires
+				changed = true
+			}
+		}
+
+		if changed {
+			if err := p.TicketRepo.Watch(&w); err != nil {
+				slog.Error("save ticket watch error", "token", w.Token, "err", err)
+			}
+		}
+	}
+}
+
+// warnTicket sends the warning by email and web push if configured.
+func (p *Proxy) warnTicket(w store.TicketWatch, subject, msg string) error {
+	if w.Email != "" {
+		if err := sendMail(context.Background(), "", w.Email, subject, msg); err != nil {
+			return err
+		}
+	}
+
+	if w.Push != "" {
+		f := p.conf().sites[w.Site]
+		if f == nil {
+			return fmt.Errorf("site %s not found", w.Site)
+		}
+		var s webpush.Subscription
+		if err := json.Unmarshal([]byte(w.Push), &s); err != nil {
+			return err
+		}
+		m, err := json.Marshal(map[string]string{"title": subject, "body": msg})
+		if err != nil {
+			return err
+		}
+		r, err := f.push(context.Background(), &s, m)
+		if err != nil {
+			return err
+		}
+		r.Body.Close()
+		if r.StatusCode >= 400 {
+			return fmt.Errorf("web push status %d", r.StatusCode)
+		}
+	}
+	return nil
+}
+
+func formatBytes(n int) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	d, e := unit, 0
+	for m := n / unit; m >= unit; m /= unit {
+		d *= unit
+		e++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(n)/float64(d), "KMGTPE"[e])
+}
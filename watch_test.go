@@ -0,0 +1,43 @@
+package led
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/taoso/led/store"
+)
+
+func TestCheckTicketWatches(t *testing.T) {
+	r := store.NewTicketRepo(":memory:")
+	p := &Proxy{TicketRepo: r}
+
+	plan := store.TicketPlan{Bytes: 100, Days: 1, UpRatio: 100, DownRatio: 100}
+	assert.Nil(t, r.New("foo", plan, "buy-1", "pay-1"))
+	assert.Nil(t, r.Watch(&store.TicketWatch{Token: "foo"}))
+
+	now := time.Now()
+	p.checkTicketWatches(now)
+
+	ws, _ := r.ListWatches()
+	assert.True(t, ws[0].LowSent.IsZero())
+	assert.False(t, ws[0].ExpirySent.IsZero())
+
+	assert.Nil(t, r.Cost("foo", 0, 95))
+	p.checkTicketWatches(now)
+
+	ws, _ = r.ListWatches()
+	assert.Equal(t, now.Unix(), ws[0].LowSent.Unix())
+
+	assert.Nil(t, r.New("foo", plan, "buy-2", "pay-2"))
+	p.checkTicketWatches(now)
+
+	ws, _ = r.ListWatches()
+	assert.True(t, ws[0].LowSent.IsZero())
+}
+
+func TestFormatBytes(t *testing.T) {
+	assert.Equal(t, "10B", formatBytes(10))
+	assert.Equal(t, "1.5KB", formatBytes(1536))
+	assert.Equal(t, "2.0GB", formatBytes(2*1024*1024*1024))
+}
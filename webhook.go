@@ -0,0 +1,211 @@
+package led
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/taoso/led/pay"
+	"github.com/taoso/led/store"
+	"github.com/taoso/led/trace"
+)
+
+// 应用通知事件类型
+const (
+	eventOrderPending  = "order.pending"
+	eventOrderPaid     = "order.paid"
+	eventOrderClosed   = "order.closed"
+	eventOrderRefunded = "order.refunded"
+)
+
+// webhookMaxAttempts 投递失败超过此次数后不再重试
+const webhookMaxAttempts = 10
+
+var webhookClient = &http.Client{Transport: &trace.Transport{}, Timeout: 10 * time.Second}
+
+func appEvent(n *pay.Notification) string {
+	switch {
+	case n.IsRefund():
+		return eventOrderRefunded
+	case n.Status == pay.StatusPaid:
+		return eventOrderPaid
+	case n.Status == pay.StatusClosed:
+		return eventOrderClosed
+	default:
+		return eventOrderPending
+	}
+}
+
+// webhookBackoff 第 n 次投递失败后的重试间隔，从 30 秒开始翻倍，最长 6 小时
+func webhookBackoff(n int) time.Duration {
+	d := 30 * time.Second << min(n, 10)
+	return min(d, 6*time.Hour)
+}
+
+// sendWebhook 使用创建订单的应用的私钥签名并投递通知，应用返回 200 才算成功
+func (p *Proxy) sendWebhook(ctx context.Context, h *store.Webhook) (int, error) {
+	key, err := p.appSignKey(h.App)
+	if err != nil {
+		return 0, err
+	}
+
+	sign := base64.RawURLEncoding.EncodeToString(ed25519.Sign(key, []byte(h.Body)))
+
+	r, err := http.NewRequestWithContext(ctx, "POST", h.URL, bytes.NewReader([]byte(h.Body)))
+	if err != nil {
+		return 0, err
+	}
+
+	r.Header.Set("zz-app", h.App)
+	r.Header.Set("zz-sign", sign)
+	r.Header.Set("zz-event", h.Event)
+	if h.ID != 0 {
+		r.Header.Set("zz-delivery", strconv.Itoa(h.ID))
+	}
+	r.Header.Set("Content-Type", "application/json")
+
+	resp, err := webhookClient.Do(r)
+	if err != nil {
+		upstreamDone("webhook", err, 0)
+		return 0, err
+	}
+
+	defer resp.Body.Close()
+	upstreamDone("webhook", nil, resp.StatusCode)
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		return resp.StatusCode, &appError{Code: resp.StatusCode, Body: b}
+	}
+	return resp.StatusCode, nil
+}
+
+// deliverWebhook 投递一次并记录结果
+func (p *Proxy) deliverWebhook(ctx context.Context, h store.Webhook) {
+	code, err := p.sendWebhook(ctx, &h)
+	h.Attempts++
+	h.LastCode = code
+	if err == nil {
+		h.Status = store.WebhookDelivered
+		h.LastError = ""
+	} else {
+		h.LastError = err.Error()
+		if len(h.LastError) > 500 {
+			h.LastError = h.LastError[:500]
+		}
+		if h.Attempts >= webhookMaxAttempts {
+			h.Status = store.WebhookDead
+			slog.Warn("webhook dead", "id", h.ID, "app", h.App, "trade_no", h.TradeNo, "err", err)
+		} else {
+			h.NextAt = time.Now().Add(webhookBackoff(h.Attempts))
+		}
+	}
+	if err := p.OrderRepo.SaveWebhook(&h); err != nil {
+		slog.Error("save webhook error", "id", h.ID, "err", err)
+	}
+}
+
+// DeliverWebhooks 定期投递到期的应用通知
+func (p *Proxy) DeliverWebhooks(d time.Duration) {
+	t := time.NewTicker(d)
+	defer t.Stop()
+	for {
+		p.deliverWebhooks(time.Now())
+		<-t.C
+	}
+}
+
+func (p *Proxy) deliverWebhooks(now time.Time) {
+	hs, err := p.OrderRepo.DueWebhooks(now, 100)
+	if err != nil {
+		slog.Error("list due webhooks error", "err", err)
+		return
+	}
+	for _, h := range hs {
+		// 每次投递单独分配请求 ID，便于在日志和链路中查找
+		ctx, sp := trace.Start(WithRequestID(context.Background(), newRequestID()), "webhook.deliver")
+		p.deliverWebhook(ctx, h)
+		sp.End(nil)
+	}
+}
+
+// appWebhooks 应用查询和重放通知，请求需要应用签名
+//
+//	{"order_id":"x","before":0} lists webhooks of order x, or all orders if empty.
+//	{"id":1,"replay":true} delivers webhook 1 again, including dead ones.
+func (p *Proxy) appWebhooks(w http.ResponseWriter, req *http.Request) {
+	if p.OrderRepo == nil {
+		http.Error(w, "webhook is not enabled", http.StatusNotImplemented)
+		return
+	}
+
+	app, body, err := p.verifyApp(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	args := struct {
+		OrderID string    `json:"order_id"`
+		Before  int       `json:"before"`
+		ID      int       `json:"id"`
+		Replay  bool      `json:"replay"`
+		Created time.Time `json:"created"`
+	}{}
+	if err := json.Unmarshal(body, &args); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if args.Created.Sub(time.Now()).Abs() > 5*time.Minute {
+		http.Error(w, "client time is inaccurate", http.StatusBadRequest)
+		return
+	}
+
+	if args.ID == 0 {
+		hs, err := p.OrderRepo.ListWebhooks(app.Name, args.OrderID, args.Before, 20)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(hs)
+		return
+	}
+
+	h, err := p.OrderRepo.FindWebhook(args.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// 只能查看自己的通知
+	if h.ID == 0 || h.App != app.Name {
+		http.Error(w, "webhook not found", http.StatusNotFound)
+		return
+	}
+
+	if args.Replay {
+		// 与首次投递一样，立即投递失败后再由 DeliverWebhooks 重试
+		h.Status = store.WebhookPending
+		h.Attempts = 0
+		h.NextAt = time.Now().Add(webhookBackoff(0))
+		h.LastError = ""
+		err = p.OrderRepo.SaveWebhook(&h)
+		if err == nil {
+			go p.deliverWebhook(context.WithoutCancel(req.Context()), h)
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h)
+}
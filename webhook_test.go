@@ -0,0 +1,134 @@
+package led
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/taoso/led/pay"
+	"github.com/taoso/led/store"
+)
+
+func TestWebhookBackoff(t *testing.T) {
+	assert.Equal(t, 30*time.Second, webhookBackoff(0))
+	assert.Equal(t, 2*time.Minute, webhookBackoff(2))
+	assert.Equal(t, 6*time.Hour, webhookBackoff(20))
+}
+
+func TestAppWebhooks(t *testing.T) {
+	zzPub, zzKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	t.Setenv("APP_PRVKEY_zz", base64.RawURLEncoding.EncodeToString(zzKey.Seed()))
+
+	appPub, appKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	t.Setenv("APP_PUBKEY_app1", base64.RawURLEncoding.EncodeToString(appPub))
+
+	var fail atomic.Bool
+	var got atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		sign, _ := base64.RawURLEncoding.DecodeString(r.Header.Get("zz-sign"))
+		assert.True(t, ed25519.Verify(zzPub, b, sign))
+		assert.Equal(t, eventOrderPaid, r.Header.Get("zz-event"))
+		assert.NotEmpty(t, r.Header.Get("zz-delivery"))
+
+		var args alipayOrderArgs
+		assert.Nil(t, json.Unmarshal(b, &args))
+		assert.Equal(t, eventOrderPaid, args.Event)
+		assert.Equal(t, "o1", args.OrderID)
+		extras, _ := url.ParseQuery(args.Extra)
+		assert.Equal(t, "x", extras.Get("extra"))
+		assert.Equal(t, "TRADE_SUCCESS", extras.Get("trade_status"))
+		assert.Equal(t, "", extras.Get("app"))
+
+		got.Add(1)
+		if fail.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("success"))
+	}))
+	defer ts.Close()
+
+	p := &Proxy{OrderRepo: store.NewOrderRepo(":memory:")}
+
+	extras := url.Values{}
+	extras.Set("app", "app1")
+	extras.Set("url", ts.URL)
+	extras.Set("extra", "x")
+
+	// 应用不可用时先写入发件箱
+	fail.Store(true)
+	err = p.notifyApp(context.Background(), &pay.Notification{
+		Provider: "fake",
+		TradeNo:  "o1",
+		PayNo:    "p1",
+		Cents:    100,
+		Status:   pay.StatusPaid,
+		Extra:    extras.Encode(),
+	})
+	assert.Nil(t, err)
+
+	find := func() store.Webhook {
+		hs, err := p.OrderRepo.ListWebhooks("app1", "o1", 0, 10)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(hs))
+		return hs[0]
+	}
+	assert.Eventually(t, func() bool { return find().Attempts == 1 }, time.Second, 10*time.Millisecond)
+	h := find()
+	assert.Equal(t, store.WebhookPending, h.Status)
+	assert.Equal(t, http.StatusServiceUnavailable, h.LastCode)
+
+	// 未到重试时间
+	p.deliverWebhooks(time.Now())
+	assert.Equal(t, int32(1), got.Load())
+
+	// 重试次数用完
+	h.Attempts = webhookMaxAttempts - 1
+	assert.Nil(t, p.OrderRepo.SaveWebhook(&h))
+	p.deliverWebhooks(time.Now().Add(time.Hour))
+	h = find()
+	assert.Equal(t, store.WebhookDead, h.Status)
+	assert.Equal(t, int32(2), got.Load())
+
+	request := func(key ed25519.PrivateKey, app string, args map[string]any) *httptest.ResponseRecorder {
+		args["created"] = time.Now()
+		b, _ := json.Marshal(args)
+		req := httptest.NewRequest(http.MethodPost, "/+/app-webhooks", bytes.NewReader(b))
+		req.Header.Set("zz-app", app)
+		req.Header.Set("zz-sign", base64.RawURLEncoding.EncodeToString(ed25519.Sign(key, b)))
+		w := httptest.NewRecorder()
+		p.appWebhooks(w, req)
+		return w
+	}
+
+	w := request(appKey, "app1", map[string]any{"order_id": "o1"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	var hs []store.Webhook
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &hs))
+	assert.Equal(t, 1, len(hs))
+	assert.Equal(t, store.WebhookDead, hs[0].Status)
+
+	w = request(zzKey, "app1", map[string]any{"order_id": "o1"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// 应用恢复后手工重放
+	fail.Store(false)
+	w = request(appKey, "app1", map[string]any{"id": h.ID, "replay": true})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Eventually(t, func() bool { return find().Status == store.WebhookDelivered }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(3), got.Load())
+}
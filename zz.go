@@ -2,17 +2,21 @@ package led
 
 import (
 	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -20,6 +24,7 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/jhillyerd/enmime"
 	"github.com/miekg/dns"
+	"github.com/taoso/led/store"
 )
 
 type Zone struct {
@@ -111,7 +116,7 @@ func (p *Proxy) zoneLink(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	ok, err := p.zidExist(domain)
+	ok, err := p.zidExist(req.Context(), domain)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -122,13 +127,13 @@ func (p *Proxy) zoneLink(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	id, err := p.zidNew(z.Name, z.Owner, z.Email)
+	id, err := p.zidNew(req.Context(), z.Name, z.Owner, z.Email)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	token, err := p.zidToken(id)
+	token, err := p.zidToken(req.Context(), id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -169,11 +174,7 @@ func (p *Proxy) zoneLink(w http.ResponseWriter, req *http.Request) {
 		Subject("ZZ.AC Zone Editor Link").
 		Text([]byte(content))
 
-	ss := TLSSender{
-		Username: os.Getenv("SMTP_USER"),
-		Password: os.Getenv("SMTP_PASS"),
-		Hostaddr: os.Getenv("SMTP_HOST"),
-	}
+	ss := smtpSender(req.Context())
 
 	if err := m.Send(ss); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -227,11 +228,7 @@ func (p *Proxy) zoneWebDAV(w http.ResponseWriter, req *http.Request) {
 		Subject("ZZ.AC WebDAV Details").
 		Text([]byte(content))
 
-	ss := TLSSender{
-		Username: os.Getenv("SMTP_USER"),
-		Password: os.Getenv("SMTP_PASS"),
-		Hostaddr: os.Getenv("SMTP_HOST"),
-	}
+	ss := smtpSender(req.Context())
 
 	if err := m.Send(ss); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -286,7 +283,7 @@ func (p *Proxy) zonePut(w http.ResponseWriter, req *http.Request) {
 	}
 
 	if token != "" {
-		zone, d.Error = deSecZone(name+".zz.ac", token)
+		zone, d.Error = deSecZone(req.Context(), name+".zz.ac", token)
 	} else {
 		d.Error = parseZone(name+".zz.ac.", zone)
 	}
@@ -303,6 +300,13 @@ func (p *Proxy) zonePut(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
+	mode := "zone"
+	if token != "" {
+		mode = "desec"
+	}
+	p.audit(req, "zone:"+name, "zone.put", "zone:"+name, d.Error, map[string]string{"mode": mode})
+	zoneUpdates.Inc(mode, result(d.Error))
+
 	var err string
 	if d.Error != nil {
 		err = d.Error.Error()
@@ -332,7 +336,9 @@ func (p *Proxy) zoneApply(w http.ResponseWriter, req *http.Request) {
 	d.Meaning = strings.TrimSpace(strings.ToValidUTF8(d.Meaning, ""))
 	d.Plan = strings.TrimSpace(strings.ToValidUTF8(d.Plan, ""))
 
+	end := traceRepo(req.Context(), "ZoneRepo.Get")
 	z, err := p.ZoneRepo.Get(d.Domain)
+	end(err)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -410,11 +416,7 @@ func (p *Proxy) zoneApply(w http.ResponseWriter, req *http.Request) {
 		Subject("Verify your ZZ.AC Email").
 		Text([]byte(content))
 
-	ss := TLSSender{
-		Username: os.Getenv("SMTP_USER"),
-		Password: os.Getenv("SMTP_PASS"),
-		Hostaddr: os.Getenv("SMTP_HOST"),
-	}
+	ss := smtpSender(req.Context())
 
 	if err := m.Send(ss); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -448,7 +450,9 @@ func (p *Proxy) zoneApplyVerifyEmail(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	end := traceRepo(req.Context(), "ZoneRepo.Get")
 	z, err := p.ZoneRepo.Get(d.Domain)
+	end(err)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -472,12 +476,16 @@ func (p *Proxy) zoneApplyVerifyEmail(w http.ResponseWriter, req *http.Request) {
 
 	link := "https://" + req.Host + req.URL.Path + auth
 
+	end = traceRepo(req.Context(), "ZoneRepo.ListByEmail")
 	zs, err := p.ZoneRepo.ListByEmail(d.Email)
+	end(err)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	end = traceRepo(req.Context(), "ZoneRepo.GetAll")
 	zs2, err := p.ZoneRepo.GetAll(d.Domain)
+	end(err)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -506,11 +514,7 @@ func (p *Proxy) zoneApplyVerifyEmail(w http.ResponseWriter, req *http.Request) {
 		Subject("New ZZ.AC application.").
 		Text([]byte(content))
 
-	ss := TLSSender{
-		Username: os.Getenv("SMTP_USER"),
-		Password: os.Getenv("SMTP_PASS"),
-		Hostaddr: os.Getenv("SMTP_HOST"),
-	}
+	ss := smtpSender(req.Context())
 
 	if err := m.Send(ss); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -527,37 +531,94 @@ func (p *Proxy) zoneApplyVerifyEmail(w http.ResponseWriter, req *http.Request) {
 }
 
 func (p *Proxy) zoneApplyAuth(w http.ResponseWriter, req *http.Request) {
-	k := req.URL.Query().Get("n")
-	path := p.zPath + "/tmp/" + k + ".json_"
-
-	b, err := os.ReadFile(path)
+	z, link, err := p.approveZone(req.Context(), req.URL.Query().Get("n"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		code := http.StatusInternalServerError
+		if errors.Is(err, errZoneApply) {
+			code = http.StatusBadRequest
+		}
+		http.Error(w, err.Error(), code)
 		return
 	}
 
-	var d struct {
-		Domain  string `json:"domain"`
-		Email   string `json:"email"`
-		Name    string `json:"name"`
-		Meaning string `json:"meaning"`
-		Plan    string `json:"plan"`
+	if err := zoneCreatedMail(req.Context(), z, link); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
 	}
 
-	if err := json.Unmarshal(b, &d); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	e.Encode(z)
+}
+
+// errZoneApply 域名申请无效或者域名已被占用
+var errZoneApply = errors.New("invalid zone application")
+
+// zoneApplication 已验证邮箱、等待审核的域名申请
+type zoneApplication struct {
+	Domain  string `json:"domain"`
+	Email   string `json:"email"`
+	Name    string `json:"name"`
+	Meaning string `json:"meaning"`
+	Plan    string `json:"plan"`
+}
+
+// zoneApplications 列出等待审核的域名申请，即 tmp/*.json_ 文件
+func (p *Proxy) zoneApplications() ([]zoneApplication, error) {
+	paths, err := filepath.Glob(p.zPath + "/tmp/*.json_")
+	if err != nil {
+		return nil, err
+	}
+	ds := make([]zoneApplication, 0, len(paths))
+	for _, path := range paths {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var d zoneApplication
+		if err := json.Unmarshal(b, &d); err != nil {
+			slog.Warn("invalid zone application", "path", path, "err", err)
+			continue
+		}
+		ds = append(ds, d)
 	}
+	return ds, nil
+}
 
-	z, err := p.ZoneRepo.Get(d.Domain)
+// removeApplication 驳回域名申请 k
+func removeApplication(zPath, k string) error {
+	return os.Remove(zPath + "/tmp/" + k + ".json_")
+}
+
+// approveZone 通过域名申请 k，创建 Zone 和 zz.ID，返回 zz.ID 的激活链接
+func (p *Proxy) approveZone(ctx context.Context, k string) (z store.Zone, loginLink string, err error) {
+	if k == "" || filepath.Base(k) != k {
+		return z, "", fmt.Errorf("%w: %q", errZoneApply, k)
+	}
+	path := p.zPath + "/tmp/" + k + ".json_"
+
+	b, err := os.ReadFile(path)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if z.Name != "" {
-		http.Error(w, "domain is unaviable", http.StatusBadRequest)
+
+	var d zoneApplication
+	if err = json.Unmarshal(b, &d); err != nil {
+		return z, "", fmt.Errorf("%w: %w", errZoneApply, err)
+	}
+
+	// 暂停的域名也不能再申请
+	end := traceRepo(ctx, "ZoneRepo.GetAll")
+	zs, err := p.ZoneRepo.GetAll(d.Domain)
+	end(err)
+	if err != nil {
 		return
 	}
+	for _, z := range zs {
+		if z.Status != store.StatusDeleted {
+			return store.Zone{}, "", fmt.Errorf("%w: domain is unaviable", errZoneApply)
+		}
+	}
 
 	z.Name = d.Domain
 	z.Email = d.Email
@@ -565,8 +626,10 @@ func (p *Proxy) zoneApplyAuth(w http.ResponseWriter, req *http.Request) {
 	z.Descr = d.Meaning
 	z.Time = time.Now().Truncate(time.Second)
 
-	if err := p.ZoneRepo.New(&z); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	end = traceRepo(ctx, "ZoneRepo.New")
+	err = p.ZoneRepo.New(&z)
+	end(err)
+	if err != nil {
 		return
 	}
 
@@ -574,37 +637,35 @@ func (p *Proxy) zoneApplyAuth(w http.ResponseWriter, req *http.Request) {
 
 	err = os.WriteFile(p.zPath+"/zz.ac/"+d.Domain+".zone", []byte(""), 0644)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	db, err := os.OpenFile(p.zPath+"/db.zz.ac", os.O_APPEND|os.O_WRONLY, 0644)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	defer db.Close()
 
 	_, err = db.WriteString("$INCLUDE zz.ac/" + d.Domain + ".zone\t\t" + d.Domain + "\n")
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	id, err := p.zidNew(z.Name, z.Owner, z.Email)
+	id, err := p.zidNew(ctx, z.Name, z.Owner, z.Email)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	token, err := p.zidToken(id)
+	token, err := p.zidToken(ctx, id)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	loginLink := "https://id.zz.ac/lc/" + token
+	return z, "https://id.zz.ac/lc/" + token, nil
+}
 
+// zoneCreatedMail 通知申请人域名已注册
+func zoneCreatedMail(ctx context.Context, z store.Zone, loginLink string) error {
 	content := "Hi " + z.Owner + ",\n\n" +
 		"🎉 恭喜！你的域名 " + z.Name + ".zz.ac 已成功注册。\n" +
 		"🎉 Congratulations! Your domain " + z.Name + ".zz.ac has been successfully registered.\n\n" +
@@ -625,20 +686,9 @@ func (p *Proxy) zoneApplyAuth(w http.ResponseWriter, req *http.Request) {
 		Subject(z.Name + ".zz.ac domain created").
 		Text([]byte(content))
 
-	ss := TLSSender{
-		Username: os.Getenv("SMTP_USER"),
-		Password: os.Getenv("SMTP_PASS"),
-		Hostaddr: os.Getenv("SMTP_HOST"),
-	}
-
-	if err := m.Send(ss); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
-	}
+	ss := smtpSender(ctx)
 
-	e := json.NewEncoder(w)
-	e.SetIndent("", "  ")
-	e.Encode(z)
+	return m.Send(ss)
 }
 
 func (p *Proxy) zoneOpenVPS(w http.ResponseWriter, req *http.Request) {
@@ -700,7 +750,8 @@ func parseZone(origin, zone string) error {
 	return zp.Err()
 }
 
-func (p *Proxy) zidDo(method, api string, body, out any) error {
+// zidDo 调用 zz.ID 的接口，并带上 ctx 中的请求 ID
+func (p *Proxy) zidDo(ctx context.Context, method, api string, body, out any) error {
 	var r io.Reader
 	if body != nil {
 		b, err := json.Marshal(body)
@@ -709,15 +760,16 @@ func (p *Proxy) zidDo(method, api string, body, out any) error {
 		}
 		r = bytes.NewReader(b)
 	}
-	req, err := http.NewRequest(method, api, r)
+	req, err := http.NewRequestWithContext(ctx, method, api, r)
 	if err != nil {
 		return err
 	}
+	setRequestID(ctx, req)
 	req.Header.Set("x-api-key", p.ZzIDAppKey)
 	if body != nil {
 		req.Header.Set("content-type", "application/json")
 	}
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return err
 	}
@@ -728,13 +780,13 @@ func (p *Proxy) zidDo(method, api string, body, out any) error {
 	return json.NewDecoder(resp.Body).Decode(out)
 }
 
-func (p *Proxy) zidExist(name string) (ok bool, err error) {
+func (p *Proxy) zidExist(ctx context.Context, name string) (ok bool, err error) {
 	var b struct {
 		Data []struct {
 			Username string `json:"username"`
 		} `json:"data"`
 	}
-	if err = p.zidDo(http.MethodGet, "https://id.zz.ac/api/users?search="+name, nil, &b); err != nil {
+	if err = p.zidDo(ctx, http.MethodGet, "https://id.zz.ac/api/users?search="+name, nil, &b); err != nil {
 		return
 	}
 	for _, u := range b.Data {
@@ -745,7 +797,7 @@ func (p *Proxy) zidExist(name string) (ok bool, err error) {
 	return
 }
 
-func (p *Proxy) zidNew(userName, displayName, email string) (id string, err error) {
+func (p *Proxy) zidNew(ctx context.Context, userName, displayName, email string) (id string, err error) {
 	body := struct {
 		Email         string `json:"email"`
 		UserName      string `json:"username"`
@@ -760,13 +812,13 @@ func (p *Proxy) zidNew(userName, displayName, email string) (id string, err erro
 	var u struct {
 		ID string `json:"id"`
 	}
-	if err = p.zidDo(http.MethodPost, "https://id.zz.ac/api/users", body, &u); err != nil {
+	if err = p.zidDo(ctx, http.MethodPost, "https://id.zz.ac/api/users", body, &u); err != nil {
 		return
 	}
 	return u.ID, nil
 }
 
-func (p *Proxy) zidToken(id string) (token string, err error) {
+func (p *Proxy) zidToken(ctx context.Context, id string) (token string, err error) {
 	api := "https://id.zz.ac/api/users/" + id + "/one-time-access-token"
 	body := struct {
 		TTL int `json:"ttl"`
@@ -774,7 +826,7 @@ func (p *Proxy) zidToken(id string) (token string, err error) {
 	var u struct {
 		Token string `json:"token"`
 	}
-	if err = p.zidDo(http.MethodPost, api, body, &u); err != nil {
+	if err = p.zidDo(ctx, http.MethodPost, api, body, &u); err != nil {
 		return
 	}
 	return u.Token, nil
@@ -782,6 +834,7 @@ func (p *Proxy) zidToken(id string) (token string, err error) {
 
 // zzOIDCConfig holds discovered OIDC endpoints and client credentials.
 type zzOIDCConfig struct {
+	Issuer           string
 	AuthEndpoint     string
 	TokenEndpoint    string
 	UserinfoEndpoint string
@@ -808,11 +861,30 @@ func (p *Proxy) InitZzAuth() error {
 		return nil
 	}
 
-	resp, err := http.Get(issuer + "/.well-known/openid-configuration")
+	c, err := discoverOIDC(context.Background(), issuer)
 	if err != nil {
 		return err
 	}
+	c.ClientID = os.Getenv("ZZ_OIDC_CLIENT_ID")
+	c.ClientSecret = os.Getenv("ZZ_OIDC_CLIENT_SECRET")
+	p.ZzOIDC = c
+	return nil
+}
+
+// discoverOIDC reads endpoints from the well-known configuration of issuer.
+func discoverOIDC(ctx context.Context, issuer string) (*zzOIDCConfig, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oidc discovery: %s", resp.Status)
+	}
 
 	var meta struct {
 		AuthEndpoint     string `json:"authorization_endpoint"`
@@ -820,17 +892,15 @@ func (p *Proxy) InitZzAuth() error {
 		UserinfoEndpoint string `json:"userinfo_endpoint"`
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&meta); err != nil {
-		return err
+		return nil, err
 	}
 
-	p.ZzOIDC = &zzOIDCConfig{
+	return &zzOIDCConfig{
+		Issuer:           issuer,
 		AuthEndpoint:     meta.AuthEndpoint,
 		TokenEndpoint:    meta.TokenEndpoint,
 		UserinfoEndpoint: meta.UserinfoEndpoint,
-		ClientID:         os.Getenv("ZZ_OIDC_CLIENT_ID"),
-		ClientSecret:     os.Getenv("ZZ_OIDC_CLIENT_SECRET"),
-	}
-	return nil
+	}, nil
 }
 
 // zzAPI routes /api/* requests for the zz.NIC backend.
@@ -954,7 +1024,13 @@ func (p *Proxy) zzCallback(w http.ResponseWriter, req *http.Request) {
 	form.Set("code", code)
 	form.Set("client_id", p.ZzOIDC.ClientID)
 	form.Set("client_secret", p.ZzOIDC.ClientSecret)
-	resp, err := http.PostForm(p.ZzOIDC.TokenEndpoint, form)
+	tReq, err := http.NewRequestWithContext(req.Context(), http.MethodPost, p.ZzOIDC.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		zzError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	tReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := httpClient.Do(tReq)
 	if err != nil {
 		zzError(w, http.StatusInternalServerError, "token exchange failed: "+err.Error())
 		return
@@ -970,13 +1046,13 @@ func (p *Proxy) zzCallback(w http.ResponseWriter, req *http.Request) {
 	}
 
 	// Fetch userinfo.
-	uReq, err := http.NewRequest(http.MethodGet, p.ZzOIDC.UserinfoEndpoint, nil)
+	uReq, err := http.NewRequestWithContext(req.Context(), http.MethodGet, p.ZzOIDC.UserinfoEndpoint, nil)
 	if err != nil {
 		zzError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 	uReq.Header.Set("Authorization", "Bearer "+tokenResp.AccessToken)
-	uResp, err := http.DefaultClient.Do(uReq)
+	uResp, err := httpClient.Do(uReq)
 	if err != nil {
 		zzError(w, http.StatusInternalServerError, "userinfo request failed: "+err.Error())
 		return
@@ -1062,11 +1138,14 @@ func (p *Proxy) zzZonePut(w http.ResponseWriter, req *http.Request, name string)
 		if err.Error() == "no cookie" {
 			zzError(w, http.StatusUnauthorized, "Unauthorized")
 		} else {
+			p.audit(req, "", "zone.put", "zone:"+name, err, nil)
 			zzError(w, http.StatusUnauthorized, "Token invalid or expired")
 		}
 		return
 	}
+	actor := "zzid:" + claims.Username
 	if claims.Username+".zz.ac" != name {
+		p.audit(req, actor, "zone.put", "zone:"+name, errors.New("forbidden"), nil)
 		zzError(w, http.StatusForbidden, "Forbidden")
 		return
 	}
@@ -1086,13 +1165,16 @@ func (p *Proxy) zzZonePut(w http.ResponseWriter, req *http.Request, name string)
 			return
 		}
 
-		zone, err := deSecZone(name, token)
+		zone, err := deSecZone(req.Context(), name, token)
 		if err != nil {
 			zzError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
 
-		if err := os.WriteFile(p.zzZonePath(name), []byte(zone), 0644); err != nil {
+		err = os.WriteFile(p.zzZonePath(name), []byte(zone), 0644)
+		p.audit(req, actor, "zone.put", "zone:"+name, err, map[string]string{"mode": "desec"})
+		zoneUpdates.Inc("desec", result(err))
+		if err != nil {
 			zzError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
@@ -1104,11 +1186,16 @@ func (p *Proxy) zzZonePut(w http.ResponseWriter, req *http.Request, name string)
 	zone = zone + "\n"
 
 	if err = parseZone(name+".", zone); err != nil {
+		p.audit(req, actor, "zone.put", "zone:"+name, err, map[string]string{"mode": "zone"})
+		zoneUpdates.Inc("zone", result(err))
 		zzError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	if err := os.WriteFile(p.zzZonePath(name), []byte(zone), 0644); err != nil {
+	err = os.WriteFile(p.zzZonePath(name), []byte(zone), 0644)
+	p.audit(req, actor, "zone.put", "zone:"+name, err, map[string]string{"mode": "zone"})
+	zoneUpdates.Inc("zone", result(err))
+	if err != nil {
 		zzError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
@@ -1208,7 +1295,7 @@ func (p *Proxy) zzEmailResetPassword(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	req, err = http.NewRequest(http.MethodPost, os.Getenv("ZZ_EMAIL_PASSAPI"), nil)
+	req, err = http.NewRequestWithContext(req.Context(), http.MethodPost, os.Getenv("ZZ_EMAIL_PASSAPI"), nil)
 	if err != nil {
 		zzError(w, http.StatusInternalServerError, err.Error())
 		return
@@ -1217,7 +1304,7 @@ func (p *Proxy) zzEmailResetPassword(w http.ResponseWriter, req *http.Request) {
 	req.Header.Set("x-email", claims.Username+"@zz.ac")
 	req.Header.Set("x-api-key", os.Getenv("ZZ_EMAIL_PASSKEY"))
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		zzError(w, http.StatusBadGateway, err.Error())
 		return